@@ -24,4 +24,20 @@ pub fn build(b: *std.Build) void {
         .linkage = .dynamic,
     });
     b.installArtifact(shared);
+
+    // `zig build wasm`: the core as a WASM module for the cgo-free engine
+    // build (go generate -tags gapwasm in engine/ runs this and copies gap.wasm into engine/wasm/)
+    const wasm_mod = b.createModule(.{
+        .root_source_file = b.path("src/root.zig"),
+        .target = b.resolveTargetQuery(.{ .cpu_arch = .wasm32, .os_tag = .freestanding }),
+        .optimize = .ReleaseFast,
+    });
+    const wasm = b.addExecutable(.{
+        .name = "gap",
+        .root_module = wasm_mod,
+    });
+    wasm.entry = .disabled;
+    wasm.rdynamic = true;
+    const wasm_step = b.step("wasm", "Build gap.wasm for the cgo-free engine");
+    wasm_step.dependOn(&b.addInstallArtifact(wasm, .{}).step);
 }
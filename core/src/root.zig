@@ -138,3 +138,15 @@ export fn gap_decompress_data(
         output[i] = decoder.decode(&model);
     }
 }
+
+/// Allocates len bytes for a host that cannot pass its own memory (the
+/// WASM build). Returns null when out of memory.
+export fn gap_alloc(len: usize) ?[*]u8 {
+    const buf = std.heap.page_allocator.alloc(u8, len) catch return null;
+    return buf.ptr;
+}
+
+/// Frees a buffer returned by gap_alloc.
+export fn gap_free(ptr: [*]u8, len: usize) void {
+    std.heap.page_allocator.free(ptr[0..len]);
+}
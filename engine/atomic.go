@@ -0,0 +1,74 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "sync"
+)
+
+// Outputs are written to <output>.tmp-<pid> in the same directory, synced
+// and renamed over the target only once complete, so a failed or
+// interrupted run never leaves a truncated file that looks valid.
+
+// pendingTemps holds the temp files currently being written, removed by
+// the interrupt handler
+var pendingTemps sync.Map
+
+// writeFileAtomic creates path with the bytes produced by write. On any
+// error the temp file is removed and path is left untouched.
+func writeFileAtomic(path string, write func(w io.Writer) error) (err error) {
+    tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+    f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to create output: %v", err)
+    }
+    pendingTemps.Store(tmp, struct{}{})
+    defer func() {
+        if err != nil {
+            f.Close()
+            os.Remove(tmp)
+        }
+        pendingTemps.Delete(tmp)
+    }()
+
+    if err := write(f); err != nil {
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        return fmt.Errorf("failed to sync output: %v", err)
+    }
+    if err := f.Close(); err != nil {
+        return fmt.Errorf("failed to close output: %v", err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return fmt.Errorf("failed to rename output into place: %v", err)
+    }
+    return nil
+}
+
+// writeBytesAtomic is writeFileAtomic for an in-memory result
+func writeBytesAtomic(path string, data []byte) error {
+    return writeFileAtomic(path, func(w io.Writer) error {
+        if _, err := w.Write(data); err != nil {
+            return fmt.Errorf("failed to write output: %v", err)
+        }
+        return nil
+    })
+}
+
+// removeTempsOnInterrupt deletes in-flight temp files on Ctrl-C before
+// exiting with the conventional status 130.
+func removeTempsOnInterrupt() {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt)
+    go func() {
+        <-sig
+        pendingTemps.Range(func(k, _ interface{}) bool {
+            os.Remove(k.(string))
+            return true
+        })
+        os.Exit(130)
+    }()
+}
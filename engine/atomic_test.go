@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failAfterWriter accepts n bytes, then fails every write
+type failAfterWriter struct {
+	w io.Writer
+	n int
+}
+
+func (f *failAfterWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		written, _ := f.w.Write(p[:f.n])
+		f.n = 0
+		return written, fmt.Errorf("simulated write failure")
+	}
+	f.n -= len(p)
+	return f.w.Write(p)
+}
+
+// TestAtomicWrite encodes a PNG into an existing destination through a
+// writer that fails mid-way, then checks the old file survived and no
+// temp file is left; a clean write must then replace it.
+func TestAtomicWrite(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gap-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "out.png")
+	if err := os.WriteFile(dest, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img := benchRGBA(64, 64)
+	err = writeFileAtomic(dest, func(w io.Writer) error {
+		return encodeDecodedPNG(&failAfterWriter{w: w, n: 100}, img, nil, DecodeOptions{})
+	})
+	if err == nil {
+		t.Fatalf("failing writer reported success")
+	}
+	if got, _ := os.ReadFile(dest); string(got) != "previous" {
+		t.Fatalf("destination changed after a failed write (%d bytes)", len(got))
+	}
+	if temps, _ := filepath.Glob(dest + ".tmp-*"); len(temps) != 0 {
+		t.Fatalf("temp file left behind: %v", temps)
+	}
+
+	if err := writeDecoded(dest, img, nil, DecodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("replaced file is not a valid PNG: %v", err)
+	}
+}
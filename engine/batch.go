@@ -0,0 +1,293 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// workerLimit caps the goroutines each parallel stage of the codec
+// starts; 0 means threadsEnv, else one per CPU. A batch divides it so
+// that its concurrent files share the CPUs instead of each taking all of
+// them. A Workers option overrides it for one call.
+var workerLimit atomic.Int32
+
+// deterministicEnv set to 1 runs the codec on a single thread: every
+// parallel stage gets one worker and main sets GOMAXPROCS to 1. Output is
+// byte-identical across CPU counts without it (see Encode); this pins the
+// execution itself, for golden-file tests and for bisecting a difference.
+const deterministicEnv = "GAP_DETERMINISTIC"
+
+// deterministic is set by main from deterministicEnv
+var deterministic atomic.Bool
+
+// threadsEnv caps the workers of every parallel stage, as -threads does
+// for one command
+const threadsEnv = "GAP_THREADS"
+
+// envThreads is threadsEnv as a worker count, read once; 0 when it is
+// unset or not a positive integer (main rejects those)
+var envThreads = sync.OnceValue(func() int {
+    n, err := strconv.Atoi(os.Getenv(threadsEnv))
+    if err != nil || n < 1 { return 0 }
+    return n
+})
+
+// workerCount is the number of goroutines a parallel stage should use:
+// n when positive (a call's Workers option), else the process limit,
+// threadsEnv or one per CPU
+func workerCount(n int) int {
+    if deterministic.Load() {
+        return 1
+    }
+    if n > 0 {
+        return n
+    }
+    if n := workerLimit.Load(); n > 0 {
+        return int(n)
+    }
+    if n := envThreads(); n > 0 {
+        return n
+    }
+    return runtime.NumCPU()
+}
+
+// parallelFor calls fn for 0..n-1 on at most workerCount(workers)
+// goroutines; with one worker they run in order on the calling goroutine
+func parallelFor(n, workers int, fn func(i int)) {
+    workers = min(workerCount(workers), n)
+    if workers <= 1 {
+        for i := 0; i < n; i++ { fn(i) }
+        return
+    }
+    var next atomic.Int32
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := int(next.Add(1)) - 1; i < n; i = int(next.Add(1)) - 1 {
+                fn(i)
+            }
+        }()
+    }
+    wg.Wait()
+}
+
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+    *l = append(*l, v)
+    return nil
+}
+
+// batchFlags are the encode/decode flags for converting many files at once
+type batchFlags struct {
+    recursive *bool
+    outDir    *string
+    jobs      *int
+    // toDir is encode-batch's form: always a batch, -o naming outDir
+    toDir bool
+}
+
+func addBatchFlags(fs *flag.FlagSet) *batchFlags {
+    return &batchFlags{
+        recursive: fs.Bool("r", false, "Descend into subdirectories of directory inputs"),
+        outDir:    fs.String("outdir", "", "Batch output directory (default: next to each input)"),
+        jobs:      fs.Int("jobs", runtime.NumCPU(), "Files converted concurrently in batch mode"),
+    }
+}
+
+// addEncodeBatchFlags is addBatchFlags for encode-batch, where -o is
+// the output directory and -j the job count
+func addEncodeBatchFlags(fs *flag.FlagSet) *batchFlags {
+    return &batchFlags{
+        recursive: fs.Bool("r", false, "Descend into subdirectories of directory inputs"),
+        outDir:    new(string),
+        jobs:      fs.Int("j", runtime.NumCPU(), "Files encoded concurrently"),
+        toDir:     true,
+    }
+}
+
+// isBatch reports whether the -i values call for batch mode: more than
+// one input, a directory, or a glob pattern
+func isBatch(inputs []string) bool {
+    if len(inputs) != 1 { return len(inputs) > 1 }
+    info, err := os.Stat(inputs[0])
+    if err != nil {
+        return isGlob(inputs[0])
+    }
+    return info.IsDir()
+}
+
+// isGlob reports whether path holds filepath.Match metacharacters
+func isGlob(path string) bool {
+    return strings.ContainsAny(path, "*?[")
+}
+
+// expandInput lists the paths an -i value stands for: itself, or the
+// matches of a glob pattern that names no existing file
+func expandInput(in string) ([]string, error) {
+    if _, err := os.Stat(in); err == nil || !isGlob(in) {
+        return []string{in}, nil
+    }
+    paths, err := filepath.Glob(in)
+    if err != nil {
+        return nil, fmt.Errorf("invalid pattern %s: %v", in, err)
+    }
+    if len(paths) == 0 {
+        return nil, fmt.Errorf("no files match %s", in)
+    }
+    return paths, nil
+}
+
+// batchJob is one file to convert
+type batchJob struct {
+    input, output string
+}
+
+// collectBatch expands the inputs into jobs. Glob patterns stand for
+// their matches (see expandInput). Directories contribute the
+// files whose extension is in exts, recursively with recursive. Outputs
+// swap the extension for outExt; with outDir they go there, keeping the
+// path below a directory input so recursive batches cannot collide.
+func collectBatch(inputs []string, exts []string, outExt, outDir string, recursive bool) ([]batchJob, error) {
+    var jobs []batchJob
+    add := func(path, rel string) {
+        out := strings.TrimSuffix(path, filepath.Ext(path)) + outExt
+        if outDir != "" {
+            out = filepath.Join(outDir, strings.TrimSuffix(rel, filepath.Ext(rel))+outExt)
+        }
+        jobs = append(jobs, batchJob{input: path, output: out})
+    }
+    matches := func(path string) bool {
+        ext := strings.ToLower(filepath.Ext(path))
+        for _, e := range exts {
+            if ext == e { return true }
+        }
+        return false
+    }
+
+    var paths []string
+    for _, in := range inputs {
+        if in == "-" {
+            return nil, fmt.Errorf("stdin cannot be part of a batch")
+        }
+        expanded, err := expandInput(in)
+        if err != nil {
+            return nil, err
+        }
+        paths = append(paths, expanded...)
+    }
+
+    for _, in := range paths {
+        info, err := os.Stat(in)
+        if err != nil {
+            return nil, fmt.Errorf("failed to open input: %v", err)
+        }
+        if !info.IsDir() {
+            add(in, filepath.Base(in))
+            continue
+        }
+        err = filepath.WalkDir(in, func(path string, d os.DirEntry, err error) error {
+            if err != nil { return err }
+            if d.IsDir() {
+                if path != in && !recursive { return filepath.SkipDir }
+                return nil
+            }
+            if matches(path) {
+                rel, err := filepath.Rel(in, path)
+                if err != nil { return err }
+                add(path, rel)
+            }
+            return nil
+        })
+        if err != nil {
+            return nil, fmt.Errorf("failed to list %s: %v", in, err)
+        }
+    }
+    sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].input < jobs[j].input })
+    return jobs, nil
+}
+
+// runBatch converts every job with at most workers running at once,
+// each file's own parallel stages sharing out the CPUs (workerCount).
+// Every file is reported as it finishes; failures are counted without
+// stopping the batch, and a summary of input and output sizes follows.
+// Returns the failure count.
+func runBatch(jobs []batchJob, workers int, convert func(input, output string) error) int {
+    workers = max(1, min(workers, len(jobs)))
+    prev := workerLimit.Load()
+    workerLimit.Store(int32(max(1, workerCount(0)/workers)))
+    defer workerLimit.Store(prev)
+    var mu sync.Mutex
+    failed := 0
+    var inBytes, outBytes int64
+
+    work := make(chan batchJob)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for job := range work {
+                err := os.MkdirAll(filepath.Dir(job.output), 0755)
+                if err == nil {
+                    err = convert(job.input, job.output)
+                }
+                mu.Lock()
+                if err != nil {
+                    failed++
+                    fmt.Fprintf(os.Stderr, "FAILED %s: %v\n", job.input, err)
+                } else if in, err := os.Stat(job.input); err == nil {
+                    if out, err := os.Stat(job.output); err == nil {
+                        inBytes += in.Size()
+                        outBytes += out.Size()
+                        fmt.Fprintf(os.Stderr, "OK %s -> %s (%d -> %d bytes)\n", job.input, job.output, in.Size(), out.Size())
+                    }
+                }
+                mu.Unlock()
+            }
+        }()
+    }
+    for _, job := range jobs {
+        work <- job
+    }
+    close(work)
+    wg.Wait()
+
+    ratio := 0.0
+    if outBytes > 0 { ratio = float64(inBytes) / float64(outBytes) }
+    fmt.Fprintf(os.Stderr, "Batch: %d files, %d failed, %d -> %d bytes (%.2f:1)\n", len(jobs), failed, inBytes, outBytes, ratio)
+    return failed
+}
+
+// runBatchCommand is the batch branch of encode and decode: it expands
+// the inputs, converts them and exits non-zero if any file failed.
+func runBatchCommand(inputs []string, output string, bf *batchFlags, exts []string, outExt string, convert func(input, output string) error) {
+    if bf.toDir {
+        *bf.outDir, output = output, ""
+    }
+    if output != "" {
+        fmt.Fprintln(os.Stderr, "Error: -o names a single output; use -outdir with several inputs or a directory")
+        os.Exit(1)
+    }
+    jobs, err := collectBatch(inputs, exts, outExt, *bf.outDir, *bf.recursive)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    if runBatch(jobs, *bf.jobs, convert) > 0 {
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// TestBatch encodes a directory tree holding two good PNGs (one in a
+// subdirectory) and a corrupt one, then decodes the results into -outdir
+func TestBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gap-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, benchRGBA(32, 24)); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"a.png": buf.Bytes(), "sub/b.png": buf.Bytes(), "bad.png": []byte("not a png"), "notes.txt": []byte("skip")}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(src, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flat, err := collectBatch([]string{src}, []string{".png"}, ".gap", "", false)
+	if err != nil || len(flat) != 2 {
+		t.Fatalf("non-recursive listing found %d files (%v)", len(flat), err)
+	}
+	jobs, err := collectBatch([]string{src}, []string{".png"}, ".gap", "", true)
+	if err != nil || len(jobs) != 3 {
+		t.Fatalf("recursive listing found %d files (%v)", len(jobs), err)
+	}
+	opts := EncodeOptions{S: 0.1, Threshold: 0.5}
+	if failed := runBatch(jobs, 2, func(in, out string) error { return EncodeImage(in, out, opts) }); failed != 1 {
+		t.Fatalf("%d encodes failed, want 1 (bad.png)", failed)
+	}
+
+	out := filepath.Join(dir, "out")
+	jobs, err = collectBatch([]string{src}, []string{".gap"}, ".png", out, true)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("found %d .gap files (%v)", len(jobs), err)
+	}
+	if failed := runBatch(jobs, 2, func(in, out string) error { return DecodeImage(in, out, DecodeOptions{}) }); failed != 0 {
+		t.Fatalf("%d decodes failed", failed)
+	}
+	for _, name := range []string{"a.png", "sub/b.png"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// encode-batch's glob form, and the CPUs shared between its jobs
+	jobs, err = collectBatch([]string{filepath.Join(src, "*.png")}, sourceExtensions, ".gap", out, false)
+	if err != nil || len(jobs) != 2 || jobs[0].output != filepath.Join(out, "a.gap") {
+		t.Fatalf("glob found %v (%v)", jobs, err)
+	}
+	if _, err := collectBatch([]string{filepath.Join(src, "*.jpg")}, sourceExtensions, ".gap", out, false); err == nil {
+		t.Fatalf("a glob matching nothing was accepted")
+	}
+	var mu sync.Mutex
+	budget := 0
+	runBatch(jobs, 2, func(in, out string) error {
+		mu.Lock()
+		budget = max(budget, workerCount(0))
+		mu.Unlock()
+		return nil
+	})
+	if want := max(1, runtime.NumCPU()/2); budget != want || workerCount(0) != runtime.NumCPU() {
+		t.Fatalf("per-file workers %d, want %d; %d after the batch", budget, want, workerCount(0))
+	}
+}
@@ -1,3 +1,8 @@
+//go:build !gapwasm
+
+// The native codec: the Zig core linked as a static library through cgo.
+// Build with -tags gapwasm for the cgo-free version in bridge_wazero.go.
+
 package main
 
 /*
@@ -20,17 +25,22 @@ import (
     "unsafe"
 )
 
-// GapCompressPatch ... (same as before)
-
-// GapCompressData compresses a byte slice using Range Coding.
-// Returns compressed bytes.
-func GapCompressData(input []byte) []byte {
-    if len(input) == 0 { return nil }
+// GapCompressDataInto is GapCompressData using dst's storage as the
+// output buffer, growing it when its capacity is too small. The result
+// aliases dst, so it is only valid until dst is reused. The coder keeps
+// no state between calls: concurrent calls are safe as long as each
+// goroutine uses its own dst. Empty input yields (nil, nil); a non-nil
+// error means the coder rejected the input.
+func GapCompressDataInto(input, dst []byte) ([]byte, error) {
+    if len(input) == 0 { return nil, nil }
     
     // Output capacity: Input + slightly more for overhead (though usually smaller)
     // Range coding rarely expands unless random noise, but be safe.
     maxCap := len(input) + 1024 
-    output := make([]byte, maxCap)
+    if cap(dst) < maxCap {
+        dst = make([]byte, maxCap)
+    }
+    output := dst[:maxCap]
     
     cIn := (*C.uchar)(unsafe.Pointer(&input[0]))
     cOut := (*C.uchar)(unsafe.Pointer(&output[0]))
@@ -38,11 +48,10 @@ func GapCompressData(input []byte) []byte {
     written := C.gap_compress_data(cIn, C.size_t(len(input)), cOut, C.size_t(maxCap))
     
     if written == 0 {
-        // Failed or empty
-        return nil
+        return nil, fmt.Errorf("range coder produced no output for %d bytes", len(input))
     }
     
-    return output[:written]
+    return output[:written], nil
 }
 
 // GapDecompressData decompresses range-coded data.
@@ -60,6 +69,16 @@ func GapDecompressData(input []byte, outputSize int) []byte {
     return output
 }
 
+// GapAnalyzePatch returns the angle, in radians, of an 8x8 patch's mean
+// gradient: the direction GapCompressPatch aligns the patch to. A ramp
+// rising to the right gives 0, one rising downward pi/2.
+func GapAnalyzePatch(patch []float32) (float32, error) {
+    if len(patch) != 64 {
+        return 0, fmt.Errorf("patch must be 64 floats, got %d", len(patch))
+    }
+    return float32(C.gap_analyze_patch((*C.float)(unsafe.Pointer(&patch[0])))), nil
+}
+
 // GapCompressPatch analyzes and compresses an 8x8 patch.
 // Returns: (angle, compressed_coeffs, keep_count, error)
 func GapCompressPatch(patch []float32, s float32, threshold float32) (float32, []float32, int, error) {
@@ -81,14 +100,6 @@ func GapCompressPatch(patch []float32, s float32, threshold float32) (float32, [
     return angle, output, kept, nil
 }
 
-func GapDecompressPatch(coeffs []float32, angle float32, s float32) ([]float32, error) {
-    output := make([]float32, 64)
-    if err := GapDecompressPatchTo(coeffs, angle, s, output); err != nil {
-        return nil, err
-    }
-    return output, nil
-}
-
 func GapDecompressPatchTo(coeffs []float32, angle float32, s float32, output []float32) error {
     if (len(coeffs) != 128 || len(output) != 64) {
         return fmt.Errorf("invalid buffer sizes for GapDecompressPatch: coeffs=%d, output=%d", len(coeffs), len(output))
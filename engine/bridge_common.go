@@ -0,0 +1,64 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+)
+
+// Codec entry points shared by the cgo (bridge.go) and WASM
+// (bridge_wazero.go) builds, written in terms of the functions both provide.
+
+// GapCompressData compresses a byte slice using Range Coding.
+// Returns compressed bytes; see GapCompressDataInto for the error.
+func GapCompressData(input []byte) ([]byte, error) {
+    return GapCompressDataInto(input, nil)
+}
+
+func GapDecompressPatch(coeffs []float32, angle float32, s float32) ([]float32, error) {
+    output := make([]float32, 64)
+    if err := GapDecompressPatchTo(coeffs, angle, s, output); err != nil {
+        return nil, err
+    }
+    return output, nil
+}
+
+// maxRangeDecompressed bounds the length RangeDecompress will allocate
+// for, since the prefix comes from untrusted input.
+const maxRangeDecompressed = 1 << 30
+
+// RangeCompress range-codes data for general use. The result starts with
+// the uncompressed length as a uvarint, so RangeDecompress needs nothing
+// else. The image pipeline keeps its explicit u32 lengths instead.
+func RangeCompress(data []byte) ([]byte, error) {
+    out := binary.AppendUvarint(nil, uint64(len(data)))
+    if len(data) == 0 {
+        return out, nil
+    }
+    compressed, err := GapCompressData(data)
+    if err != nil {
+        return nil, err
+    }
+    return append(out, compressed...), nil
+}
+
+// RangeDecompress reverses RangeCompress
+func RangeDecompress(blob []byte) ([]byte, error) {
+    n, k := binary.Uvarint(blob)
+    if k <= 0 {
+        return nil, fmt.Errorf("invalid length prefix")
+    }
+    if n > maxRangeDecompressed {
+        return nil, fmt.Errorf("decompressed length %d exceeds %d", n, maxRangeDecompressed)
+    }
+    payload := blob[k:]
+    if n == 0 {
+        if len(payload) != 0 {
+            return nil, fmt.Errorf("%d trailing bytes after empty payload", len(payload))
+        }
+        return []byte{}, nil
+    }
+    if len(payload) == 0 {
+        return nil, fmt.Errorf("missing payload for %d bytes", n)
+    }
+    return GapDecompressData(payload, int(n)), nil
+}
@@ -0,0 +1,295 @@
+//go:build gapwasm
+
+// The cgo-free codec: the Zig core compiled to WASM (`go generate -tags
+// gapwasm` runs `zig build wasm` in core/ and copies the module into
+// wasm/) and run through wazero. Signatures and results match bridge.go.
+
+package main
+
+import (
+    "context"
+    "embed"
+    "errors"
+    "fmt"
+    "io/fs"
+    "math"
+    "sync"
+
+    "github.com/tetratelabs/wazero"
+    "github.com/tetratelabs/wazero/api"
+)
+
+//go:generate sh -c "cd ../core && zig build wasm && cp zig-out/bin/gap.wasm ../engine/wasm/"
+
+// wasmDir holds gap.wasm once it is generated; the directory itself is
+// committed, so a checkout without the module still builds
+//go:embed wasm
+var wasmDir embed.FS
+
+var (
+    wasmOnce     sync.Once
+    wasmRuntime  wazero.Runtime
+    wasmCompiled wazero.CompiledModule
+    wasmErr      error
+
+    // A module instance is single-threaded, so each goroutine borrows one
+    wasmPool = sync.Pool{New: func() any { return newWasmCodec() }}
+)
+
+// wasmCodec is one instance of the module with a reusable scratch buffer
+// in its linear memory
+type wasmCodec struct {
+    mod    api.Module
+    mem    api.Memory
+    err    error
+    buf    uint32 // Scratch buffer address (0 = none yet)
+    bufLen uint32
+
+    analyze, compress, decompress, decompressPatches api.Function
+    compressData, decompressData, alloc, free        api.Function
+}
+
+func newWasmCodec() any {
+    ctx := context.Background()
+    wasmOnce.Do(func() {
+        gapWasm, err := wasmDir.ReadFile("wasm/gap.wasm")
+        if errors.Is(err, fs.ErrNotExist) {
+            wasmErr = fmt.Errorf("this binary was built without gap.wasm; run `go generate -tags gapwasm` in engine/ (needs zig) and rebuild")
+            return
+        }
+        wasmRuntime = wazero.NewRuntime(ctx)
+        wasmCompiled, wasmErr = wasmRuntime.CompileModule(ctx, gapWasm)
+        if wasmErr != nil { wasmErr = fmt.Errorf("failed to compile gap.wasm: %v", wasmErr) }
+    })
+    if wasmErr != nil {
+        return &wasmCodec{err: wasmErr}
+    }
+    // Anonymous instances, so several can coexist
+    mod, err := wasmRuntime.InstantiateModule(ctx, wasmCompiled, wazero.NewModuleConfig().WithName(""))
+    if err != nil {
+        return &wasmCodec{err: fmt.Errorf("failed to instantiate gap.wasm: %v", err)}
+    }
+    c := &wasmCodec{
+        mod: mod, mem: mod.Memory(),
+        analyze:           mod.ExportedFunction("gap_analyze_patch"),
+        compress:          mod.ExportedFunction("gap_compress_patch"),
+        decompress:        mod.ExportedFunction("gap_decompress_patch"),
+        decompressPatches: mod.ExportedFunction("gap_decompress_patches"),
+        compressData:      mod.ExportedFunction("gap_compress_data"),
+        decompressData:    mod.ExportedFunction("gap_decompress_data"),
+        alloc:             mod.ExportedFunction("gap_alloc"),
+        free:              mod.ExportedFunction("gap_free"),
+    }
+    for _, fn := range []api.Function{c.analyze, c.compress, c.decompress, c.decompressPatches, c.compressData, c.decompressData, c.alloc, c.free} {
+        if fn == nil {
+            return &wasmCodec{err: fmt.Errorf("gap.wasm is missing codec exports; rebuild it with `zig build wasm`")}
+        }
+    }
+    return c
+}
+
+// getWasmCodec borrows a module instance; return it with wasmPool.Put
+func getWasmCodec() (*wasmCodec, error) {
+    c := wasmPool.Get().(*wasmCodec)
+    if c.err != nil {
+        return nil, c.err
+    }
+    return c, nil
+}
+
+// call runs an exported function, which only fails if the module traps
+func (c *wasmCodec) call(fn api.Function, params ...uint64) (uint64, error) {
+    res, err := fn.Call(context.Background(), params...)
+    if err != nil {
+        return 0, fmt.Errorf("gap.wasm: %v", err)
+    }
+    if len(res) == 0 { return 0, nil }
+    return res[0], nil
+}
+
+// scratch returns the address of at least n bytes of module memory,
+// valid until the next call
+func (c *wasmCodec) scratch(n uint32) (uint32, error) {
+    if n <= c.bufLen {
+        return c.buf, nil
+    }
+    if c.buf != 0 {
+        if _, err := c.call(c.free, uint64(c.buf), uint64(c.bufLen)); err != nil {
+            return 0, err
+        }
+        c.buf, c.bufLen = 0, 0
+    }
+    ptr, err := c.call(c.alloc, uint64(n))
+    if err != nil {
+        return 0, err
+    }
+    if ptr == 0 {
+        return 0, fmt.Errorf("gap.wasm: out of memory allocating %d bytes", n)
+    }
+    c.buf, c.bufLen = uint32(ptr), n
+    return c.buf, nil
+}
+
+func (c *wasmCodec) writeFloats(addr uint32, v []float32) {
+    b, _ := c.mem.Read(addr, uint32(len(v)*4))
+    for i, f := range v {
+        bits := math.Float32bits(f)
+        b[i*4], b[i*4+1], b[i*4+2], b[i*4+3] = byte(bits), byte(bits>>8), byte(bits>>16), byte(bits>>24)
+    }
+}
+
+func (c *wasmCodec) readFloats(addr uint32, v []float32) {
+    b, _ := c.mem.Read(addr, uint32(len(v)*4))
+    for i := range v {
+        v[i] = math.Float32frombits(uint32(b[i*4]) | uint32(b[i*4+1])<<8 | uint32(b[i*4+2])<<16 | uint32(b[i*4+3])<<24)
+    }
+}
+
+// GapCompressDataInto is GapCompressData using dst's storage as the
+// output buffer, growing it when its capacity is too small. The result
+// aliases dst, so it is only valid until dst is reused. Concurrent calls
+// are safe as long as each goroutine uses its own dst. Empty input
+// yields (nil, nil); a non-nil error means the coder rejected the input.
+func GapCompressDataInto(input, dst []byte) ([]byte, error) {
+    if len(input) == 0 { return nil, nil }
+
+    maxCap := len(input) + 1024
+    if cap(dst) < maxCap {
+        dst = make([]byte, maxCap)
+    }
+    output := dst[:maxCap]
+
+    c, err := getWasmCodec()
+    if err != nil { return nil, err }
+    defer wasmPool.Put(c)
+    in, err := c.scratch(uint32(len(input) + maxCap))
+    if err != nil { return nil, err }
+    out := in + uint32(len(input))
+    c.mem.Write(in, input)
+
+    written, err := c.call(c.compressData, uint64(in), uint64(len(input)), uint64(out), uint64(maxCap))
+    if err != nil {
+        return nil, fmt.Errorf("range coder failed: %v", err)
+    }
+    if uint32(written) == 0 {
+        return nil, fmt.Errorf("range coder produced no output for %d bytes", len(input))
+    }
+    b, _ := c.mem.Read(out, uint32(written))
+    return output[:copy(output, b)], nil
+}
+
+// GapDecompressData decompresses range-coded data.
+// Output size MUST be correct.
+func GapDecompressData(input []byte, outputSize int) []byte {
+    if len(input) == 0 { return nil }
+
+    output := make([]byte, outputSize)
+
+    c, err := getWasmCodec()
+    if err != nil { return output }
+    defer wasmPool.Put(c)
+    in, err := c.scratch(uint32(len(input) + outputSize))
+    if err != nil { return output }
+    out := in + uint32(len(input))
+    c.mem.Write(in, input)
+
+    if _, err := c.call(c.decompressData, uint64(in), uint64(len(input)), uint64(out), uint64(outputSize)); err != nil {
+        return output
+    }
+    b, _ := c.mem.Read(out, uint32(outputSize))
+    copy(output, b)
+    return output
+}
+
+// GapAnalyzePatch returns the angle, in radians, of an 8x8 patch's mean
+// gradient: the direction GapCompressPatch aligns the patch to. A ramp
+// rising to the right gives 0, one rising downward pi/2.
+func GapAnalyzePatch(patch []float32) (float32, error) {
+    if len(patch) != 64 {
+        return 0, fmt.Errorf("patch must be 64 floats, got %d", len(patch))
+    }
+    c, err := getWasmCodec()
+    if err != nil { return 0, err }
+    defer wasmPool.Put(c)
+    in, err := c.scratch(64 * 4)
+    if err != nil { return 0, err }
+    c.writeFloats(in, patch)
+    a, err := c.call(c.analyze, uint64(in))
+    if err != nil { return 0, err }
+    return api.DecodeF32(a), nil
+}
+
+// GapCompressPatch analyzes and compresses an 8x8 patch.
+// Returns: (angle, compressed_coeffs, keep_count, error)
+func GapCompressPatch(patch []float32, s float32, threshold float32) (float32, []float32, int, error) {
+    if len(patch) != 64 {
+        return 0, nil, 0, fmt.Errorf("patch must be 64 floats, got %d", len(patch))
+    }
+
+    c, err := getWasmCodec()
+    if err != nil { return 0, nil, 0, err }
+    defer wasmPool.Put(c)
+    in, err := c.scratch((64 + 128) * 4)
+    if err != nil { return 0, nil, 0, err }
+    out := in + 64*4
+    c.writeFloats(in, patch)
+
+    // 1. Analyze
+    a, err := c.call(c.analyze, uint64(in))
+    if err != nil { return 0, nil, 0, err }
+    angle := api.DecodeF32(a)
+
+    // 2. Compress
+    kept, err := c.call(c.compress, uint64(in), uint64(out), api.EncodeF32(angle), api.EncodeF32(s), api.EncodeF32(threshold))
+    if err != nil { return 0, nil, 0, err }
+    output := make([]float32, 128)
+    c.readFloats(out, output)
+
+    return angle, output, int(int32(kept)), nil
+}
+
+// GapDecompressPatchTo restores one patch into output. Like the native
+// call, it leaves the filtered coefficients in coeffs.
+func GapDecompressPatchTo(coeffs []float32, angle float32, s float32, output []float32) error {
+    if (len(coeffs) != 128 || len(output) != 64) {
+        return fmt.Errorf("invalid buffer sizes for GapDecompressPatch: coeffs=%d, output=%d", len(coeffs), len(output))
+    }
+    c, err := getWasmCodec()
+    if err != nil { return err }
+    defer wasmPool.Put(c)
+    in, err := c.scratch((128 + 64) * 4)
+    if err != nil { return err }
+    out := in + 128*4
+    c.writeFloats(in, coeffs)
+
+    if _, err := c.call(c.decompress, uint64(in), uint64(out), api.EncodeF32(angle), api.EncodeF32(s)); err != nil {
+        return err
+    }
+    c.readFloats(in, coeffs)
+    c.readFloats(out, output)
+    return nil
+}
+
+func GapDecompressPatches(coeffs []float32, angles []float32, output []float32, s float32) error {
+    numPatches := len(angles)
+    if numPatches == 0 { return nil }
+    if (len(coeffs) < numPatches*128 || len(output) < numPatches*64) {
+        return fmt.Errorf("batch buffer size mismatch: numPatches=%d, coeffs=%d, output=%d", numPatches, len(coeffs), len(output))
+    }
+    c, err := getWasmCodec()
+    if err != nil { return err }
+    defer wasmPool.Put(c)
+    in, err := c.scratch(uint32(numPatches * (128 + 64 + 1) * 4))
+    if err != nil { return err }
+    out := in + uint32(numPatches*128*4)
+    ang := out + uint32(numPatches*64*4)
+    c.writeFloats(in, coeffs[:numPatches*128])
+    c.writeFloats(ang, angles)
+
+    if _, err := c.call(c.decompressPatches, uint64(in), uint64(out), uint64(ang), uint64(numPatches), api.EncodeF32(s)); err != nil {
+        return err
+    }
+    c.readFloats(in, coeffs[:numPatches*128])
+    c.readFloats(out, output[:numPatches*64])
+    return nil
+}
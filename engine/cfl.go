@@ -0,0 +1,117 @@
+package main
+
+import (
+    "fmt"
+    "image"
+)
+
+// Chroma-from-luma (FlagCfL): each 8x8 chroma patch is predicted from the
+// co-located patch of the reconstructed, downsampled luma plane as
+//
+//     C = residual + alpha * (L - mean(L))
+//
+// Only alpha is coded (one signed byte per patch, cflAlphaScale steps);
+// the offset term is carried by the residual's DC, so the residual plane
+// goes through the normal patch transform unchanged. The decoder needs
+// the finished luma plane before it can apply the prediction, so the
+// alphas are stored after all plane streams, one block per chroma plane.
+
+// cflAlphaScale is the number of alpha steps per unit slope (range +-3.97)
+const cflAlphaScale = 32
+
+// cflPatch copies the 8x8 patch of p at (x, y) with the same edge
+// clamping the encoder uses for padding and returns its mean.
+func cflPatch(p *image.Gray, x, y int, dst *[64]float32) float32 {
+    b := p.Bounds()
+    w, h := b.Dx(), b.Dy()
+    var sum float32
+    for py := 0; py < 8; py++ {
+        sy := y + py
+        if sy >= h { sy = h - 1 }
+        for px := 0; px < 8; px++ {
+            sx := x + px
+            if sx >= w { sx = w - 1 }
+            v := float32(p.Pix[sy*p.Stride+sx])
+            dst[py*8+px] = v
+            sum += v
+        }
+    }
+    return sum / 64
+}
+
+// cflResidual fits alpha per patch of chroma against luma (same size) and
+// returns the residual plane to encode along with the alpha stream.
+func cflResidual(chroma, luma *image.Gray) (*image.Gray, []byte) {
+    b := chroma.Bounds()
+    w, h := b.Dx(), b.Dy()
+    residual := image.NewGray(image.Rect(0, 0, w, h))
+    alphas := make([]byte, 0, ((w+7)/8)*((h+7)/8))
+
+    var lp, cp [64]float32
+    for y := 0; y < h; y += 8 {
+        for x := 0; x < w; x += 8 {
+            meanL := cflPatch(luma, x, y, &lp)
+            meanC := cflPatch(chroma, x, y, &cp)
+
+            // Least-squares slope of chroma against luma
+            var cov, varL float32
+            for i := 0; i < 64; i++ {
+                dl := lp[i] - meanL
+                cov += dl * (cp[i] - meanC)
+                varL += dl * dl
+            }
+            q := 0
+            if varL > 1 {
+                q = int(roundHalfAway(cov / varL * cflAlphaScale))
+                if q > 127 { q = 127 }
+                if q < -127 { q = -127 }
+            }
+            alphas = append(alphas, byte(int8(q)))
+            alpha := float32(q) / cflAlphaScale
+
+            for py := 0; py < 8 && y+py < h; py++ {
+                for px := 0; px < 8 && x+px < w; px++ {
+                    i := py*8 + px
+                    off := (y+py)*residual.Stride + x + px
+                    residual.Pix[off] = clampToByte(cp[i] - alpha*(lp[i]-meanL))
+                }
+            }
+        }
+    }
+    return residual, alphas
+}
+
+// applyCfL adds the luma prediction back onto a decoded residual plane
+func applyCfL(plane, luma *image.Gray, alphas []byte) error {
+    b := plane.Bounds()
+    w, h := b.Dx(), b.Dy()
+    if luma.Bounds().Dx() != w || luma.Bounds().Dy() != h {
+        return fmt.Errorf("luma is %v, chroma is %v", luma.Bounds().Size(), b.Size())
+    }
+    if want := ((w + 7) / 8) * ((h + 7) / 8); len(alphas) != want {
+        return fmt.Errorf("got %d alphas, want %d", len(alphas), want)
+    }
+
+    var lp [64]float32
+    patch := 0
+    for y := 0; y < h; y += 8 {
+        for x := 0; x < w; x += 8 {
+            alpha := float32(int8(alphas[patch])) / cflAlphaScale
+            patch++
+            if alpha == 0 { continue }
+            meanL := cflPatch(luma, x, y, &lp)
+            for py := 0; py < 8 && y+py < h; py++ {
+                for px := 0; px < 8 && x+px < w; px++ {
+                    off := (y+py)*plane.Stride + x + px
+                    plane.Pix[off] = clampToByte(float32(plane.Pix[off]) + alpha*(lp[py*8+px]-meanL))
+                }
+            }
+        }
+    }
+    return nil
+}
+
+func roundHalfAway(v float32) float32 {
+    if v < 0 { return float32(int(v - 0.5)) }
+    return float32(int(v + 0.5))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "strings"
+)
+
+// ErrChecksumMismatch is returned when a FlagChecksum file's payload does
+// not match its CRC32 footer: the file is truncated or corrupt
+var ErrChecksumMismatch = errors.New("checksum mismatch: the file is truncated or corrupt")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize is the length of the FlagChecksum footer
+const checksumSize = 4
+
+// appendChecksum appends the FlagChecksum footer to a complete file: the
+// CRC32-C (little endian) of everything from payloadStart, the first
+// byte after the header, plane table and chunks
+func appendChecksum(file []byte, payloadStart int) []byte {
+    return binary.LittleEndian.AppendUint32(file, crc32.Checksum(file[payloadStart:], castagnoli))
+}
+
+// readPayload reads the rest of a FlagChecksum file from r, checks the
+// footer unless verify is false, and returns the payload without it.
+// On ErrChecksumMismatch the payload is still returned unless the file
+// is too short to have a footer at all. Files longer than
+// maxPayloadSize(header) are rejected without reading past the bound.
+func readPayload(r io.Reader, header *gapFileHeader, verify bool) (io.Reader, error) {
+    limit := maxPayloadSize(header)
+    data, err := io.ReadAll(io.LimitReader(r, limit+1))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read payload: %v", err)
+    }
+    if int64(len(data)) > limit {
+        return nil, fmt.Errorf("payload is larger than the %d bytes a %dx%d file can hold", limit, header.Width, header.Height)
+    }
+    if len(data) < checksumSize {
+        if !verify { return bytes.NewReader(data), nil } // Cut before the footer: nothing to strip
+        return nil, ErrChecksumMismatch
+    }
+    payload, footer := data[:len(data)-checksumSize], data[len(data)-checksumSize:]
+    if verify && crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(footer) {
+        // The payload comes back too, for FlagStreamCRC to narrow down
+        return bytes.NewReader(payload), ErrChecksumMismatch
+    }
+    return bytes.NewReader(payload), nil
+}
+
+// maxPayloadSize bounds what follows the chunks of a valid file with this
+// header: every block at the most it unpacks to (see splitStreamMax) plus
+// its framing and the range coder's growth, the CfL alphas, the lossless
+// residual and the footer. Gzip and the cipher add less than the slack.
+func maxPayloadSize(h *gapFileHeader) int64 {
+    const blockMax = 12 + 1024 // Framing with FlagStreamCRC, and range coder growth
+    var n int64
+    for i := range h.Planes {
+        patches := int64(planePatches(h, i))
+        for _, m := range splitStreamMax {
+            n += patches*int64(m) + blockMax
+        }
+        n += patches + blockMax
+    }
+    n += int64(h.Width)*int64(h.Height)*3 + blockMax
+    return n + n/64 + blockMax + checksumSize
+}
+
+// splitStreamNames names a plane's five split streams in file order
+var splitStreamNames = [5]string{"Angles", "Counts", "MaxVals", "Indices", "Values"}
+
+// StreamChecksumError reports the split stream whose FlagStreamCRC
+// checksum failed. It wraps ErrChecksumMismatch.
+type StreamChecksumError struct {
+    Plane  int    // -1 for the lossless residual
+    Stream string // One of splitStreamNames, "Alphas" or "Residual"
+}
+
+func (e *StreamChecksumError) Error() string {
+    if e.Plane < 0 {
+        return fmt.Sprintf("%s stream corrupt", strings.ToLower(e.Stream))
+    }
+    return fmt.Sprintf("plane %d, %s stream corrupt", e.Plane, strings.ToLower(e.Stream))
+}
+
+func (e *StreamChecksumError) Unwrap() error { return ErrChecksumMismatch }
+
+// blockHeaderSize is the length of a split stream block's framing: two
+// length words, plus the checksum with FlagStreamCRC
+func blockHeaderSize(flags uint32) int {
+    if flags&FlagStreamCRC != 0 {
+        return 12
+    }
+    return 8
+}
+
+// writeBlockHeader writes a block's length words and, with withCRC,
+// the CRC32-C of data, its uncompressed stream
+func writeBlockHeader(w io.Writer, uLen, cLen uint32, data []byte, withCRC bool) error {
+    if err := binary.Write(w, binary.LittleEndian, uLen); err != nil { return err }
+    if err := binary.Write(w, binary.LittleEndian, cLen); err != nil { return err }
+    if !withCRC {
+        return nil
+    }
+    return binary.Write(w, binary.LittleEndian, crc32.Checksum(data, castagnoli))
+}
+
+// verify reports whether data, the block's unpacked stream, matches its
+// checksum. Blocks without one always pass.
+func (b streamBlock) verify(data []byte) bool {
+    return !b.hasCRC || crc32.Checksum(data, castagnoli) == b.crc
+}
+
+// streamCheck is one split stream's result from checkStreams
+type streamCheck struct {
+    Plane      int    // -1 for the lossless residual
+    Stream     string
+    Raw        int
+    Compressed int
+    Stored     bool
+    Status     string // "ok", "corrupt", or "unchecked" without FlagStreamCRC
+}
+
+// name is the stream as the check command lists it
+func (s streamCheck) name() string {
+    if s.Plane < 0 {
+        return s.Stream
+    }
+    return fmt.Sprintf("Plane %d %s", s.Plane, s.Stream)
+}
+
+// checkReport is what the check command prints
+type checkReport struct {
+    Checksum string // Whole-file footer: "ok", "mismatch" or "none"
+    Streams  []streamCheck
+    Err      error // Why the remaining streams could not be read, if they could not
+}
+
+// corrupt reports whether anything in the report failed
+func (c *checkReport) corrupt() bool {
+    if c.Checksum == "mismatch" || c.Err != nil {
+        return true
+    }
+    for _, s := range c.Streams {
+        if s.Status == "corrupt" {
+            return true
+        }
+    }
+    return false
+}
+
+// checkStreams reads a split-stream file block by block, unpacking each
+// stream and checking it against its FlagStreamCRC checksum. Unlike
+// decoding it carries on past a bad stream, so every stream gets a status.
+// passphrase opens FlagEncrypted files.
+func checkStreams(r io.Reader, passphrase string) (*checkReport, error) {
+    header, err := readHeader(r)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read header: %v", err)
+    }
+    if header.Flags&FlagRangeCoded == 0 {
+        return nil, fmt.Errorf("per-stream checks need split streams, not %s", compressionFromFlags(header.Flags))
+    }
+    report := &checkReport{Checksum: "none"}
+    if header.Flags&FlagChecksum != 0 {
+        payload, err := readPayload(r, header, true)
+        switch {
+        case err == nil:
+            report.Checksum = "ok"
+        case errors.Is(err, ErrChecksumMismatch) && payload != nil:
+            report.Checksum = "mismatch"
+        default:
+            report.Checksum = "mismatch"
+            report.Err = err
+            return report, nil
+        }
+        r = payload
+    }
+    if header.Flags&FlagEncrypted != 0 {
+        if report.Checksum == "mismatch" {
+            report.Err = fmt.Errorf("the sealed payload is corrupt; streams cannot be checked")
+            return report, nil
+        }
+        if r, err = decryptPayload(r, header, DecodeOptions{Passphrase: passphrase}); err != nil {
+            report.Err = err
+            return report, nil
+        }
+    }
+
+    // Each stream with the most bytes it may unpack to
+    var layout []streamCheck
+    var limits []int
+    for i := range header.Planes {
+        for k, name := range splitStreamNames {
+            layout = append(layout, streamCheck{Plane: i, Stream: name})
+            limits = append(limits, planePatches(header, i)*splitStreamMax[k])
+        }
+    }
+    if header.Flags&FlagCfL != 0 {
+        for i := 1; i < len(header.Planes); i++ {
+            layout = append(layout, streamCheck{Plane: i, Stream: "Alphas"})
+            limits = append(limits, planePatches(header, i))
+        }
+    }
+    if header.Flags&FlagLossless != 0 {
+        layout = append(layout, streamCheck{Plane: -1, Stream: "Residual"})
+        limits = append(limits, int(header.Width)*int(header.Height)*3)
+    }
+    for j, s := range layout {
+        b, err := readStreamBlock(r, header.Flags, limits[j])
+        if err != nil {
+            report.Err = fmt.Errorf("failed to read %s: %w", s.name(), err)
+            break
+        }
+        s.Raw, s.Compressed, s.Stored = int(b.uLen), len(b.cData), b.stored
+        switch {
+        case !b.hasCRC:
+            s.Status = "unchecked"
+        case b.verify(b.unpack()):
+            s.Status = "ok"
+        default:
+            s.Status = "corrupt"
+        }
+        report.Streams = append(report.Streams, s)
+    }
+    return report, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// TestChecksumFooter flips one byte at several payload positions and
+// truncates the file, expecting ErrChecksumMismatch each time (and no
+// checksum error with NoVerify), then strips the footer and flag to make
+// an older file, which must decode to the same pixels.
+func TestChecksumFooter(t *testing.T) {
+	for _, opts := range []EncodeOptions{{S: 0.1, Threshold: 0.5}, {S: 0.1, Threshold: 0.5, Compress: CompressGzip}} {
+		data, want := roundTrip(t, benchRGBA(40, 24), opts)
+		payloadStart := binary.Size(GapHeader{}) + 3*binary.Size(PlaneParams{})
+		for _, pos := range []int{payloadStart, (payloadStart + len(data)) / 2, len(data) - 1} {
+			bad := append([]byte(nil), data...)
+			bad[pos] ^= 0x10
+			if _, _, err := decodeGap(bytes.NewReader(bad), DecodeOptions{}); !errors.Is(err, ErrChecksumMismatch) {
+				t.Fatalf("%s: byte %d flipped gave %v", opts.Compress, pos, err)
+			}
+			if _, _, err := decodeGap(bytes.NewReader(bad), DecodeOptions{NoVerify: true}); errors.Is(err, ErrChecksumMismatch) {
+				t.Fatalf("%s: NoVerify still checked", opts.Compress)
+			}
+		}
+		if _, _, err := decodeGap(bytes.NewReader(data[:len(data)-10]), DecodeOptions{}); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("%s: truncated file gave %v", opts.Compress, err)
+		}
+
+		old := append([]byte(nil), data[:len(data)-checksumSize]...)
+		binary.LittleEndian.PutUint32(old[20:], binary.LittleEndian.Uint32(old[20:])&^FlagChecksum)
+		got, _, err := decodeGap(bytes.NewReader(old), DecodeOptions{})
+		if err != nil {
+			t.Fatalf("%s: file without a footer: %v", opts.Compress, err)
+		}
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Fatalf("%s: file without a footer decoded differently", opts.Compress)
+		}
+	}
+}
+
+// zeroReader is an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// TestPayloadBound checks that files of each layout fit maxPayloadSize,
+// and that a file followed by endless bytes fails once it passes the
+// bound instead of being read to the end
+func TestPayloadBound(t *testing.T) {
+	src := benchRGBA(40, 24)
+	for _, opts := range []EncodeOptions{
+		{S: 0.1, Threshold: 0.5},
+		{S: 0.1, Threshold: 0.5, Compress: CompressGzip},
+		{S: 0.1, Threshold: 0.5, Compress: CompressNone},
+		{S: 0.01, Threshold: 0, Lossless: true, CfL: true, StreamChecksums: true},
+		{S: 0.1, Threshold: 0.5, Passphrase: "secret", kdfIterations: 1000},
+	} {
+		data, err := encodeGap(src, nil, opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := readHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hb, err := headerBytes(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, limit := int64(len(data)-len(hb)), maxPayloadSize(header); n > limit {
+			t.Fatalf("%s: payload of %d bytes is over the %d-byte bound", opts.Compress, n, limit)
+		}
+		endless := io.MultiReader(bytes.NewReader(data), zeroReader{})
+		if _, _, err := decodeGap(endless, DecodeOptions{}); err == nil || errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("%s: endless file gave %v, want the size error", opts.Compress, err)
+		}
+	}
+}
+
+// TestStreamChecksums corrupts each stream of a FlagStreamCRC file in
+// turn and expects decode to name exactly that stream, and the check
+// scan to mark it and only it corrupt
+func TestStreamChecksums(t *testing.T) {
+	src := benchRGBA(40, 24)
+	opts := EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: true, CfL: true, StreamChecksums: true}
+	data, got := roundTrip(t, src, opts)
+	plain := opts
+	plain.StreamChecksums = false
+	_, want := roundTrip(t, src, plain)
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Fatalf("checksummed file decoded differently")
+	}
+	if _, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, StreamChecksums: true, Compress: CompressGzip}, nil); err == nil {
+		t.Fatalf("gzip accepted")
+	}
+
+	report, err := checkStreams(bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if report.corrupt() || len(report.Streams) != 3*5+2+1 {
+		t.Fatalf("clean file checked as %+v", report)
+	}
+
+	// Walk the blocks: two length words and the checksum, then the data
+	pos := binary.Size(GapHeader{}) + 3*binary.Size(PlaneParams{})
+	for i, st := range report.Streams {
+		cLen := int(binary.LittleEndian.Uint32(data[pos+4:]) &^ storedBlockBit)
+		start := pos + blockHeaderSize(FlagStreamCRC)
+		pos = start + cLen
+		if cLen == 0 {
+			continue
+		}
+		bad := append([]byte(nil), data...)
+		bad[start] ^= 0x5A
+		_, _, err := decodeGap(bytes.NewReader(bad), DecodeOptions{})
+		var serr *StreamChecksumError
+		if !errors.As(err, &serr) || serr.Plane != st.Plane || serr.Stream != st.Stream {
+			t.Fatalf("corrupt %s gave %v", st.name(), err)
+		}
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("%v does not match ErrChecksumMismatch", err)
+		}
+		// Best effort loses what the stream held instead of failing
+		if img, _, err := decodeGap(bytes.NewReader(bad), DecodeOptions{BestEffort: true}); err != nil || img.Bounds() != want.Bounds() {
+			t.Fatalf("best-effort decode of corrupt %s: %v", st.name(), err)
+		}
+		r, err := checkStreams(bytes.NewReader(bad), "")
+		if err != nil || r.Checksum != "mismatch" || len(r.Streams) != len(report.Streams) {
+			t.Fatalf("check of corrupt %s: %v", st.name(), err)
+		}
+		for j, other := range r.Streams {
+			if (other.Status == "corrupt") != (j == i) {
+				t.Fatalf("corrupt %s reported %s as %s", st.name(), other.name(), other.Status)
+			}
+		}
+	}
+	if pos != len(data)-checksumSize {
+		t.Fatalf("blocks end at %d, footer at %d", pos, len(data)-checksumSize)
+	}
+	if msg := (&StreamChecksumError{Plane: 1, Stream: "Values"}).Error(); msg != "plane 1, values stream corrupt" {
+		t.Fatalf("diagnostic reads %q", msg)
+	}
+}
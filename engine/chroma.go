@@ -0,0 +1,146 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "sync"
+)
+
+// ChromaMode is how far the chroma planes of YCbCr files are reduced.
+// Chroma420 is the default; the others trade color detail for size in
+// images where luma detail matters and color hardly does.
+type ChromaMode uint8
+
+const (
+    Chroma420  ChromaMode = iota // Half width and height: one sample per 2x2 luma pixels
+    Chroma411                    // Quarter width, full height: one sample per 4x1 luma pixels
+    ChromaMono                   // One sample per 16x16 luma region, for old photos and screenshots
+)
+
+// ChunkChroma holds the ChromaMode byte when FlagChromaMode is set
+var ChunkChroma = [4]byte{'C', 'H', 'R', 'M'}
+
+func (m ChromaMode) String() string {
+    switch m {
+    case Chroma420:
+        return "4:2:0"
+    case Chroma411:
+        return "4:1:1"
+    case ChromaMono:
+        return "mono"
+    }
+    return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+// ParseChromaMode accepts the -chroma names
+func ParseChromaMode(name string) (ChromaMode, error) {
+    switch name {
+    case "420", "4:2:0":
+        return Chroma420, nil
+    case "411", "4:1:1":
+        return Chroma411, nil
+    case "mono":
+        return ChromaMono, nil
+    }
+    return 0, fmt.Errorf("unknown chroma mode %q (want 420, 411 or mono)", name)
+}
+
+// factors are the luma pixels per chroma sample across and down
+func (m ChromaMode) factors() (int, int) {
+    switch m {
+    case Chroma411:
+        return 4, 1
+    case ChromaMono:
+        return 16, 16
+    }
+    return 2, 2
+}
+
+// planeSize is the size of a width x height image's chroma planes in this
+// mode. Partial regions at the right and bottom get a sample of their
+// own; 4:2:0 chroma of files without FlagChromaCeil did not (see
+// chromaPlaneSize).
+func (m ChromaMode) planeSize(width, height int, flags uint32) (int, int) {
+    if m == Chroma420 {
+        return chromaPlaneSize(width, height, flags)
+    }
+    fx, fy := m.factors()
+    return (width + fx - 1) / fx, (height + fy - 1) / fy
+}
+
+// downsample averages each region of the mode into one chroma sample
+func (m ChromaMode) downsample(src *image.Gray, workers int) *image.Gray {
+    if m == Chroma420 {
+        return downsamplePlane(src, workers)
+    }
+    fx, fy := m.factors()
+    return downsamplePlaneBy(src, fx, fy, workers)
+}
+
+// upsample brings a chroma plane back to the luma size targetW x
+// targetH. Chroma sample x sits at the middle of the luma pixels it
+// averaged, fx*x + (fx-1)/2, whatever the plane sizes, as in upsamplePlane.
+func (m ChromaMode) upsample(src *image.Gray, targetW, targetH int, mode ChromaUpsample, workers int) *image.Gray {
+    if m == Chroma420 {
+        return upsamplePlane(src, targetW, targetH, mode, workers)
+    }
+    fx, fy := m.factors()
+    dst := image.NewGray(image.Rect(0, 0, targetW, targetH))
+    parallelUpsample(src, dst, 1/float32(fx), 1/float32(fy), mode, workers)
+    return dst
+}
+
+// decodeChromaMode parses ChunkChroma. 4:2:0 files do not store one.
+func decodeChromaMode(data []byte) (ChromaMode, error) {
+    if len(data) != 1 {
+        return 0, fmt.Errorf("chroma mode chunk is %d bytes, want 1", len(data))
+    }
+    if m := ChromaMode(data[0]); m == Chroma411 || m == ChromaMono {
+        return m, nil
+    }
+    return 0, fmt.Errorf("unknown chroma mode %d", data[0])
+}
+
+// planeSize is the coded size of plane i
+func (h *gapFileHeader) planeSize(i int) (int, int) {
+    if h.Flags&FlagSubsampled != 0 && (i == 1 || i == 2) {
+        return h.Chroma.planeSize(int(h.Width), int(h.Height), h.Flags)
+    }
+    return int(h.Width), int(h.Height)
+}
+
+// downsamplePlaneBy averages each fx x fy block of src into one pixel,
+// with output rows split across workers. Partial blocks at the right and
+// bottom repeat their last column or row, so odd sizes round up.
+func downsamplePlaneBy(src *image.Gray, fx, fy, workers int) *image.Gray {
+    b := src.Bounds()
+    w, h := b.Dx(), b.Dy()
+    newW, newH := (w+fx-1)/fx, (h+fy-1)/fy
+    dst := image.NewGray(image.Rect(0, 0, newW, newH))
+    n := fx * fy
+
+    var wg sync.WaitGroup
+    workers = workerCount(workers)
+    rowsPerWorker := max((newH+workers-1)/workers, 1)
+    for startY := 0; startY < newH; startY += rowsPerWorker {
+        wg.Add(1)
+        go func(y0, y1 int) {
+            defer wg.Done()
+            for y := y0; y < y1; y++ {
+                out := dst.Pix[y*dst.Stride:]
+                for x := 0; x < newW; x++ {
+                    sum := 0
+                    for j := 0; j < fy; j++ {
+                        row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+min(y*fy+j, h-1)):]
+                        for i := 0; i < fx; i++ {
+                            sum += int(row[min(x*fx+i, w-1)])
+                        }
+                    }
+                    out[x] = uint8(sum / n)
+                }
+            }
+        }(startY, min(startY+rowsPerWorker, newH))
+    }
+    wg.Wait()
+    return dst
+}
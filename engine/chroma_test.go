@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestChromaModes encodes a tinted gray texture, whose chroma is
+// nearly flat, in each chroma mode: the header records the mode and the
+// plane sizes, the smaller modes make smaller files at close to the 4:2:0
+// quality, low-memory coding gives the same bytes, Y4M names 4:1:1 and
+// refuses mono, and transcoding goes back to 4:2:0
+func TestChromaModes(t *testing.T) {
+	const w, h = 90, 60
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l := 128 + 80*math.Sin(float64(x)*0.3)*math.Cos(float64(y)*0.2)
+			src.SetRGBA(x, y, color.RGBA{uint8(l + 20), uint8(l), uint8(l - 25), 255})
+		}
+	}
+	sizes := map[ChromaMode]image.Point{Chroma420: {45, 30}, Chroma411: {23, 60}, ChromaMono: {6, 4}}
+	var size420 int
+	var psnr420 float64
+	for _, m := range []ChromaMode{Chroma420, Chroma411, ChromaMono} {
+		if parsed, err := ParseChromaMode(m.String()); err != nil || parsed != m {
+			t.Fatalf("%s does not parse back", m)
+		}
+		stats := &Stats{}
+		data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, Chroma: m}, stats)
+		if err != nil {
+			t.Fatalf("%s: %v", m, err)
+		}
+		header, err := readHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", m, err)
+		}
+		if header.Chroma != m || (header.Flags&FlagChromaMode != 0) != (m != Chroma420) {
+			t.Fatalf("%s: header says %s, flags 0x%x", m, header.Chroma, header.Flags)
+		}
+		if cw, ch := header.planeSize(1); (image.Point{cw, ch}) != sizes[m] {
+			t.Fatalf("%s: chroma planes are %dx%d, want %v", m, cw, ch, sizes[m])
+		}
+		if (stats.Chroma != nil) != (m != Chroma420) || (stats.Chroma != nil && stats.Chroma.Samples != sizes[m].X*sizes[m].Y) {
+			t.Fatalf("%s: stats %+v", m, stats.Chroma)
+		}
+		img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", m, err)
+		}
+		psnr := PSNR(src, img)
+		if m == Chroma420 {
+			size420, psnr420 = len(data), psnr
+			continue
+		}
+		if len(data) >= size420 {
+			t.Fatalf("%s: %d bytes, 4:2:0 takes %d", m, len(data), size420)
+		}
+		if psnr < psnr420-1 {
+			t.Fatalf("%s: %.2f dB, 4:2:0 reaches %.2f dB", m, psnr, psnr420)
+		}
+		banded, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, Chroma: m, LowMem: true}, nil)
+		if err != nil || !bytes.Equal(banded, data) {
+			t.Fatalf("%s: low-memory coding differs (%v)", m, err)
+		}
+
+		var y4m bytes.Buffer
+		err = Decode(bytes.NewReader(data), &y4m, DecodeOptions{Format: FormatY4M})
+		if m == Chroma411 && (err != nil || !strings.Contains(y4m.String(), " C411 ")) {
+			t.Fatalf("%s: y4m output (%v)", m, err)
+		}
+		if m == ChromaMono && err == nil {
+			t.Fatalf("%s: wrote y4m without a chroma tag for it", m)
+		}
+
+		out, _, err := Transcode(data, EncodeOptions{S: 0.1, Threshold: 0.5})
+		if err != nil {
+			t.Fatalf("%s: transcode: %v", m, err)
+		}
+		if th, err := readHeader(bytes.NewReader(out)); err != nil || th.Chroma != Chroma420 || th.Flags&FlagChromaMode != 0 || findChunk(th.Chunks, ChunkChroma) != nil {
+			t.Fatalf("%s: transcode to 4:2:0 kept the mode (%v)", m, err)
+		}
+	}
+
+	for _, opts := range []EncodeOptions{{Matrix: MatrixIdentity, Chroma: Chroma411}, {CfL: true, Chroma: ChromaMono}} {
+		opts.S, opts.Threshold = 0.1, 0.5
+		if _, err := encodeGap(src, nil, opts, nil); err == nil {
+			t.Fatalf("encoded %s chroma with matrix %s and CfL %v", opts.Chroma, opts.Matrix, opts.CfL)
+		}
+	}
+}
+
+// TestChromaUpsample upsamples small planes directly and decodes a
+// file in each mode: nearest repeats each sample, bicubic follows a ramp
+// like bilinear but makes a step steeper, a flat plane stays flat in
+// every mode, and lossless files decode exactly whatever the mode
+func TestChromaUpsample(t *testing.T) {
+	const w, h = 9, 7
+	flat, ramp, step := image.NewGray(image.Rect(0, 0, w, h)), image.NewGray(image.Rect(0, 0, w, h)), image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			flat.Pix[y*w+x] = 77
+			ramp.Pix[y*w+x] = uint8(40 + 20*x)
+			step.Pix[y*w+x] = 50
+			if x >= w/2 {
+				step.Pix[y*w+x] = 200
+			}
+		}
+	}
+	modes := []ChromaUpsample{UpsampleNearest, UpsampleBilinear, UpsampleBicubic}
+	for _, m := range modes {
+		if name, err := ParseChromaUpsample(m.String()); err != nil || name != m {
+			t.Fatalf("%s does not parse back", m)
+		}
+		up := upsamplePlane(flat, 2*w, 2*h, m, 0)
+		for _, v := range up.Pix {
+			if v != 77 {
+				t.Fatalf("%s turns a flat 77 plane into %d", m, v)
+			}
+		}
+	}
+	near := upsamplePlane(ramp, 2*w-1, 2*h, UpsampleNearest, 0)
+	for y := 0; y < 2*h; y++ {
+		for x := 0; x < 2*w-1; x++ {
+			if got, want := near.GrayAt(x, y).Y, ramp.GrayAt(x/2, y/2).Y; got != want {
+				t.Fatalf("nearest (%d, %d) is %d, want %d", x, y, got, want)
+			}
+		}
+	}
+	// Away from the clamped edges a ramp is reproduced by both filters
+	lin, cub := upsamplePlane(ramp, 2*w, 2*h, UpsampleBilinear, 0), upsamplePlane(ramp, 2*w, 2*h, UpsampleBicubic, 0)
+	for x := 2; x < 2*w-2; x++ {
+		if d := int(lin.GrayAt(x, 3).Y) - int(cub.GrayAt(x, 3).Y); d < -1 || d > 1 {
+			t.Fatalf("bicubic ramp differs from bilinear by %d at x=%d", d, x)
+		}
+	}
+	// The step's two middle pixels are pulled further apart by bicubic
+	mid := w / 2 * 2
+	lin, cub = upsamplePlane(step, 2*w, 2*h, UpsampleBilinear, 0), upsamplePlane(step, 2*w, 2*h, UpsampleBicubic, 0)
+	linEdge := int(lin.GrayAt(mid, 3).Y) - int(lin.GrayAt(mid-1, 3).Y)
+	cubEdge := int(cub.GrayAt(mid, 3).Y) - int(cub.GrayAt(mid-1, 3).Y)
+	if cubEdge <= linEdge {
+		t.Fatalf("bicubic step %d is not steeper than bilinear %d", cubEdge, linEdge)
+	}
+
+	src := colorWheel(48, 40)
+	for _, lossless := range []bool{false, true} {
+		data, def := roundTrip(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: lossless})
+		for _, m := range modes {
+			img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{ChromaUpsample: m})
+			if err != nil {
+				t.Fatalf("%s: %v", m, err)
+			}
+			if lossless && !bytes.Equal(img.Pix, src.Pix) {
+				t.Fatalf("%s: lossless decode is not exact", m)
+			}
+			if !lossless && m == UpsampleBilinear && !bytes.Equal(img.Pix, def.Pix) {
+				t.Fatalf("bilinear differs from the default")
+			}
+		}
+	}
+}
+
+// TestChromaParams codes a color wheel with the derived chroma
+// parameters, with -cs/-ct equal to luma's and with finer ones, and
+// compares each decoded chroma plane against the subsampled source
+// plane. The plane table must record the overrides, and chroma fidelity
+// must follow them: luma's coarser cutoff loses detail, finer ones keep more.
+// Decoding the chroma of a derived-parameter file with luma's entries in
+// the plane table, as version 1 did, must lose to its own parameters.
+func TestChromaParams(t *testing.T) {
+	src := colorWheel(128, 128)
+	_, cb, cr := splitImagePlanes(src, MatrixBT601, 0)
+	want := []*image.Gray{downsamplePlane(cb, 0), downsamplePlane(cr, 0)}
+	decodedPSNR := func(data []byte) (float64, *gapFileHeader, error) {
+		r := bytes.NewReader(data)
+		h, err := readHeader(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		planes, _, _, err := decodePlanes(r, h, DecodeOptions{}, &DecodeStats{})
+		if err != nil {
+			return 0, nil, err
+		}
+		return (PSNR(planes[1], want[0]) + PSNR(planes[2], want[1])) / 2, h, nil
+	}
+	chromaPSNR := func(opts EncodeOptions) (float64, *gapFileHeader, error) {
+		opts.S, opts.Threshold = 0.1, 0.5
+		data, err := encodeGap(src, nil, opts, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		return decodedPSNR(data)
+	}
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, h, err := decodedPSNR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Planes[1].S == h.Planes[0].S {
+		t.Fatalf("derived chroma s equals luma's %g", h.Planes[0].S)
+	}
+	// The plane table follows the header and lies outside the checksum
+	table := binary.Size(GapHeader{})
+	size := binary.Size(PlaneParams{})
+	for i := 1; i < 3; i++ {
+		copy(data[table+i*size:table+(i+1)*size], data[table:table+size])
+	}
+	lumaDecoded, _, err := decodedPSNR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derived <= lumaDecoded {
+		t.Fatalf("chroma is %.2f dB with its own s, %.2f dB decoded with luma's", derived, lumaDecoded)
+	}
+	luma, h, err := chromaPSNR(EncodeOptions{ChromaS: 0.1, ChromaT: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Planes[1] != h.Planes[0] || h.Planes[2] != h.Planes[0] {
+		t.Fatalf("plane table %v", h.Planes)
+	}
+	fine, h, err := chromaPSNR(EncodeOptions{ChromaS: 0.04, ChromaT: 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Planes[1] != (PlaneParams{S: 0.04, Threshold: 0.05}) {
+		t.Fatalf("plane table %v", h.Planes)
+	}
+	t.Logf("Chroma PSNR: derived %.2f dB, luma's %.2f dB, -cs 0.04 -ct 0.05 %.2f dB", derived, luma, fine)
+	if !(fine > derived && derived > luma) {
+		t.Fatalf("chroma PSNR does not follow the parameters")
+	}
+	if _, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, ChromaS: 0.1, Matrix: MatrixIdentity}, nil); err == nil {
+		t.Fatalf("accepted with the rgb matrix")
+	}
+}
+
+// TestOddChroma down- and upsamples 101x101 chroma ramps (2 levels
+// per pixel, so a quarter-pixel shift costs a level) and expects every
+// interior pixel back within one level, then round-trips a 101x101 color
+// wheel and checks the center pixel's chroma. A 51x37 gray image with a red
+// last column and row must keep them red (FlagChromaCeil), and a file
+// without the flag must still decode.
+func TestOddChroma(t *testing.T) {
+	const n = 101
+	ramp := image.NewGray(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			ramp.Pix[y*ramp.Stride+x] = uint8(20 + 2*x)
+		}
+	}
+	for _, src := range []*image.Gray{ramp, transposeGray(ramp)} {
+		back := upsamplePlane(downsamplePlane(src, 0), n, n, UpsampleBilinear, 0)
+		for y := 1; y < n-1; y++ {
+			for x := 1; x < n-1; x++ {
+				d := int(back.Pix[y*back.Stride+x]) - int(src.Pix[y*src.Stride+x])
+				if d < -1 || d > 1 {
+					t.Fatalf("(%d,%d) came back as %d, want %d", x, y, back.Pix[y*back.Stride+x], src.Pix[y*src.Stride+x])
+				}
+			}
+		}
+	}
+
+	wheel := colorWheel(n, n)
+	_, img := roundTrip(t, wheel, EncodeOptions{S: 0.05, Threshold: 0.1, ChromaS: 0.05, ChromaT: 0.1})
+	c := wheel.RGBAAt(n/2+10, n/2+10)
+	_, wantCb, wantCr := color.RGBToYCbCr(c.R, c.G, c.B)
+	c = img.RGBAAt(n/2+10, n/2+10)
+	_, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+	if absInt(int(cb)-int(wantCb)) > 3 || absInt(int(cr)-int(wantCr)) > 3 {
+		t.Fatalf("center Cb/Cr %d/%d, want %d/%d", cb, cr, wantCb, wantCr)
+	}
+
+	edge := image.NewRGBA(image.Rect(0, 0, 51, 37))
+	for y := 0; y < 37; y++ {
+		for x := 0; x < 51; x++ {
+			c := color.RGBA{R: 120, G: 120, B: 120, A: 255}
+			if x == 50 || y == 36 {
+				c = color.RGBA{R: 220, G: 40, B: 40, A: 255}
+			}
+			edge.SetRGBA(x, y, c)
+		}
+	}
+	_, img = roundTrip(t, edge, EncodeOptions{S: 0.05, Threshold: 0.1, ChromaS: 0.05, ChromaT: 0.1})
+	for _, p := range []image.Point{{50, 10}, {20, 36}, {50, 36}} {
+		c := img.RGBAAt(p.X, p.Y)
+		if _, _, cr := color.RGBToYCbCr(c.R, c.G, c.B); cr < 170 {
+			t.Fatalf("edge pixel %v decoded as %v, want red", p, c)
+		}
+	}
+
+	// Even sizes give the same planes either way, so clearing the flag
+	// must not change the decode
+	data, want := roundTrip(t, colorWheel(48, 32), EncodeOptions{S: 0.1, Threshold: 0.5})
+	flags := binary.LittleEndian.Uint32(data[20:])
+	binary.LittleEndian.PutUint32(data[20:], flags&^FlagChromaCeil)
+	got, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+	if err != nil {
+		t.Fatalf("without FlagChromaCeil: %v", err)
+	}
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Fatalf("clearing FlagChromaCeil changed an even-size decode")
+	}
+}
+
+// TestChromaParity round-trips color ramps of every parity of width
+// and height, down to 1 and 2 pixels, through lossy, lossless, CfL and
+// -lowmem coding. Every decode must have the source's size and stay
+// close to it, lossless ones exactly, and -lowmem must write the same
+// file, so the encoder and decoder agree on each chroma plane's size.
+func TestChromaParity(t *testing.T) {
+	sizes := []int{1, 2, 3, 8, 9, 16, 17, 31}
+	base := EncodeOptions{S: 0.05, Threshold: 0.1, ChromaS: 0.05, ChromaT: 0.1}
+	for _, w := range sizes {
+		for _, h := range sizes {
+			// Red rises to the right and blue downward, so a chroma plane
+			// shifted or cut short shows in every pixel
+			src := image.NewRGBA(image.Rect(0, 0, w, h))
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					src.SetRGBA(x, y, color.RGBA{uint8(40 + 4*x), 110, uint8(40 + 4*y), 255})
+				}
+			}
+			plain, err := encodeGap(src, nil, base, nil)
+			if err != nil {
+				t.Fatalf("%dx%d: %v", w, h, err)
+			}
+			modes := []struct {
+				name string
+				opts EncodeOptions
+			}{{"lossy", base}, {"lossless", base}, {"cfl", base}, {"lowmem", base}}
+			modes[1].opts.Lossless = true
+			modes[2].opts.CfL = true
+			modes[3].opts.LowMem = true
+			for _, m := range modes {
+				data, err := encodeGap(src, nil, m.opts, nil)
+				if err != nil {
+					t.Fatalf("%dx%d %s: %v", w, h, m.name, err)
+				}
+				if m.opts.LowMem && !bytes.Equal(data, plain) {
+					t.Fatalf("%dx%d: -lowmem wrote a different file", w, h)
+				}
+				img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+				if err != nil {
+					t.Fatalf("%dx%d %s: %v", w, h, m.name, err)
+				}
+				if img.Bounds() != src.Bounds() {
+					t.Fatalf("%dx%d %s decoded as %v", w, h, m.name, img.Bounds())
+				}
+				psnr := PSNR(src, img)
+				if m.opts.Lossless && !bytes.Equal(img.Pix, src.Pix) {
+					t.Fatalf("%dx%d lossless decode differs (%.1f dB)", w, h, psnr)
+				}
+				if psnr < 30 {
+					t.Fatalf("%dx%d %s: %.1f dB", w, h, m.name, psnr)
+				}
+			}
+		}
+	}
+}
+
+// transposeGray swaps the axes of a square plane
+func transposeGray(src *image.Gray) *image.Gray {
+	n := src.Bounds().Dx()
+	dst := image.NewGray(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			dst.Pix[x*dst.Stride+y] = src.Pix[y*src.Stride+x]
+		}
+	}
+	return dst
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "sync"
+)
+
+// ColorMatrix selects the RGB <-> plane transform, stored in the header
+// flags (FlagMatrixMask).
+type ColorMatrix uint32
+
+const (
+    MatrixBT601    ColorMatrix = 0 // JFIF full-range YCbCr (stdlib color.RGBToYCbCr)
+    MatrixBT709    ColorMatrix = 1 // Full-range YCbCr with Rec.709 coefficients
+    MatrixIdentity ColorMatrix = 2 // Planes hold R, G, B directly
+)
+
+func (m ColorMatrix) String() string {
+    switch m {
+    case MatrixBT601:
+        return "bt601"
+    case MatrixBT709:
+        return "bt709"
+    case MatrixIdentity:
+        return "rgb"
+    }
+    return fmt.Sprintf("unknown(%d)", uint32(m))
+}
+
+// ParseColorMatrix accepts the CLI spellings of each matrix
+func ParseColorMatrix(name string) (ColorMatrix, error) {
+    switch name {
+    case "601", "bt601":
+        return MatrixBT601, nil
+    case "709", "bt709":
+        return MatrixBT709, nil
+    case "rgb", "identity":
+        return MatrixIdentity, nil
+    }
+    return 0, fmt.Errorf("unknown color matrix %q (want 601, 709 or rgb)", name)
+}
+
+// matrixFromFlags extracts the color matrix code from header flags
+func matrixFromFlags(flags uint32) ColorMatrix {
+    return ColorMatrix((flags & FlagMatrixMask) >> flagMatrixShift)
+}
+
+func clampToByte(v float32) uint8 {
+    if v < 0 { return 0 }
+    if v > 255 { return 255 }
+    return uint8(v + 0.5)
+}
+
+// rgbToPlanes converts one pixel into the three plane values for the matrix
+func rgbToPlanes(m ColorMatrix, r, g, b uint8) (uint8, uint8, uint8) {
+    switch m {
+    case MatrixBT709:
+        fr, fg, fb := float32(r), float32(g), float32(b)
+        // Rounding each product stops the compiler fusing them into FMAs
+        // (as it may on arm64), so every platform gets the same planes
+        y := float32(0.2126*fr) + float32(0.7152*fg) + float32(0.0722*fb)
+        cb := (fb-y)/1.8556 + 128
+        cr := (fr-y)/1.5748 + 128
+        return clampToByte(y), clampToByte(cb), clampToByte(cr)
+    case MatrixIdentity:
+        return r, g, b
+    }
+    return color.RGBToYCbCr(r, g, b)
+}
+
+// planesToRGB is the inverse of rgbToPlanes
+func planesToRGB(m ColorMatrix, y, cb, cr uint8) (uint8, uint8, uint8) {
+    switch m {
+    case MatrixBT709:
+        fy := float32(y)
+        r := fy + bt709Tables.crR[cr]
+        g := fy - bt709Tables.cbG[cb] - bt709Tables.crG[cr]
+        b := fy + bt709Tables.cbB[cb]
+        return clampToByte(r), clampToByte(g), clampToByte(b)
+    case MatrixIdentity:
+        return y, cb, cr
+    }
+    return color.YCbCrToRGB(y, cb, cr)
+}
+
+// jfifTables holds the chroma terms of color.YCbCrToRGB in its 16.16
+// fixed point, indexed by the plane level. clamp maps a result shifted
+// down 16 bits, plus jfifClampOffset, to a byte the same way
+// YCbCrToRGB clamps: below 0 gives 0, 256 and up give 255.
+var jfifTables = func() (t struct {
+    crR, cbG, crG, cbB [256]int32
+    clamp              [768]uint8
+}) {
+    for i := range 256 {
+        c := int32(i) - 128
+        t.crR[i], t.cbG[i], t.crG[i], t.cbB[i] = 91881*c, 22554*c, 46802*c, 116130*c
+    }
+    for i := range t.clamp {
+        t.clamp[i] = uint8(min(max(i-jfifClampOffset, 0), 255))
+    }
+    return t
+}()
+
+// jfifClampOffset covers the most negative shifted result, -227 (blue
+// at cb = 0); the largest, 481, stays below len(clamp) - offset
+const jfifClampOffset = 256
+
+// bt709Tables holds the chroma products of the BT.709 inverse, each
+// rounded to float32 as planesToRGB computes them
+var bt709Tables = func() (t struct{ crR, cbG, crG, cbB [256]float32 }) {
+    for i := range 256 {
+        c := float32(i) - 128
+        t.crR[i], t.cbG[i], t.crG[i], t.cbB[i] = float32(1.5748*c), float32(0.1873*c), float32(0.4681*c), float32(1.8556*c)
+    }
+    return t
+}()
+
+// planeRow returns row y of p, Dx() levels long
+func planeRow(p *image.Gray, y int) []uint8 {
+    off := p.PixOffset(p.Rect.Min.X, p.Rect.Min.Y+y)
+    return p.Pix[off : off+p.Rect.Dx()]
+}
+
+// planesToRGBARow converts one row of plane levels into RGBA pixels (dst
+// holds 4 bytes per pixel, alpha set opaque). It gives planesToRGB's
+// result without its per-pixel dispatch and, for BT.601, without
+// color.YCbCrToRGB's clamping branches.
+func planesToRGBARow(m ColorMatrix, y, cb, cr, dst []uint8) {
+    dst = dst[:len(y)*4]
+    cb, cr = cb[:len(y)], cr[:len(y)]
+    switch m {
+    case MatrixBT601:
+        t := &jfifTables
+        for x, yv := range y {
+            yy := int32(yv) * 0x10101
+            c, d := cb[x], cr[x]
+            p := dst[x*4 : x*4+4 : x*4+4]
+            p[0] = t.clamp[(yy+t.crR[d])>>16+jfifClampOffset]
+            p[1] = t.clamp[(yy-t.cbG[c]-t.crG[d])>>16+jfifClampOffset]
+            p[2] = t.clamp[(yy+t.cbB[c])>>16+jfifClampOffset]
+            p[3] = 255
+        }
+    case MatrixBT709:
+        t := &bt709Tables
+        for x, yv := range y {
+            fy := float32(yv)
+            c, d := cb[x], cr[x]
+            p := dst[x*4 : x*4+4 : x*4+4]
+            p[0] = clampToByte(fy + t.crR[d])
+            p[1] = clampToByte(fy - t.cbG[c] - t.crG[d])
+            p[2] = clampToByte(fy + t.cbB[c])
+            p[3] = 255
+        }
+    default:
+        for x, yv := range y {
+            p := dst[x*4 : x*4+4 : x*4+4]
+            p[0], p[1], p[2], p[3] = yv, cb[x], cr[x], 255
+        }
+    }
+}
+
+// cmykToRGB converts ink amounts to RGB the way color.CMYK does: each of
+// C, M and Y removes its share of the light the black ink leaves, so
+// R = (255-C)(255-K)/255 and likewise for G and B. No ink profile is
+// applied; a color-managed viewer would show a press profile's smaller
+// gamut, so saturated print colors come out somewhat brighter here.
+func cmykToRGB(c, m, y, k uint8) (uint8, uint8, uint8) {
+    return color.CMYKToRGB(c, m, y, k)
+}
+
+// planeDeltaToRGB maps a change in plane values onto the RGB change it
+// causes, i.e. the linear part of planesToRGB.
+func planeDeltaToRGB(m ColorMatrix, dy, dcb, dcr float32) (float32, float32, float32) {
+    switch m {
+    case MatrixBT709:
+        return dy + 1.5748*dcr, dy - 0.1873*dcb - 0.4681*dcr, dy + 1.8556*dcb
+    case MatrixIdentity:
+        return dy, dcb, dcr
+    }
+    return dy + 1.402*dcr, dy - 0.344136*dcb - 0.714136*dcr, dy + 1.772*dcb
+}
+
+// splitImagePlanes converts src into three full-resolution planes using
+// the given matrix, split across row bands like the decoder's merge.
+// RGBA, NRGBA, YCbCr and CMYK sources are read from Pix directly; the
+// result matches the generic At() path, except that a JFIF YCbCr source
+// coded with MatrixBT601 is copied without a round trip through RGB.
+func splitImagePlanes(src image.Image, m ColorMatrix, workers int) (*image.Gray, *image.Gray, *image.Gray) {
+    bounds := src.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    rect := image.Rect(0, 0, width, height)
+    p0, p1, p2 := image.NewGray(rect), image.NewGray(rect), image.NewGray(rect)
+
+    numWorkers := workerCount(workers)
+    rowsPerWorker := (height + numWorkers - 1) / numWorkers
+
+    var wg sync.WaitGroup
+    for w := 0; w < numWorkers; w++ {
+        startY := w * rowsPerWorker
+        endY := startY + rowsPerWorker
+        if endY > height { endY = height }
+        if startY >= height { continue }
+
+        wg.Add(1)
+        go func(sy, ey int) {
+            defer wg.Done()
+            for y := sy; y < ey; y++ {
+                off := y * p0.Stride
+                splitRow(src, m, bounds.Min.Y+y, p0.Pix[off:off+width], p1.Pix[off:off+width], p2.Pix[off:off+width])
+            }
+        }(startY, endY)
+    }
+    wg.Wait()
+    return p0, p1, p2
+}
+
+// splitRow converts image row y of src into the three plane rows
+func splitRow(src image.Image, m ColorMatrix, y int, p0, p1, p2 []uint8) {
+    minX := src.Bounds().Min.X
+    switch img := src.(type) {
+    case *image.RGBA:
+        pix := img.Pix[img.PixOffset(minX, y):]
+        for x := range p0 {
+            i := x * 4
+            p0[x], p1[x], p2[x] = rgbToPlanes(m, pix[i], pix[i+1], pix[i+2])
+        }
+        return
+    case *image.NRGBA:
+        pix := img.Pix[img.PixOffset(minX, y):]
+        for x := range p0 {
+            i := x * 4
+            r, g, b, a := pix[i], pix[i+1], pix[i+2], pix[i+3]
+            if a != 0xFF {
+                // Premultiply exactly as color.NRGBA.RGBA does
+                r = uint8(uint32(r) * 0x101 * uint32(a) / 0xFF >> 8)
+                g = uint8(uint32(g) * 0x101 * uint32(a) / 0xFF >> 8)
+                b = uint8(uint32(b) * 0x101 * uint32(a) / 0xFF >> 8)
+            }
+            p0[x], p1[x], p2[x] = rgbToPlanes(m, r, g, b)
+        }
+        return
+    case *image.YCbCr:
+        for x := range p0 {
+            yi, ci := img.YOffset(minX+x, y), img.COffset(minX+x, y)
+            yy, cb, cr := img.Y[yi], img.Cb[ci], img.Cr[ci]
+            if m == MatrixBT601 {
+                p0[x], p1[x], p2[x] = yy, cb, cr
+                continue
+            }
+            r, g, b, _ := color.YCbCr{Y: yy, Cb: cb, Cr: cr}.RGBA()
+            p0[x], p1[x], p2[x] = rgbToPlanes(m, uint8(r>>8), uint8(g>>8), uint8(b>>8))
+        }
+        return
+    case *image.CMYK:
+        // Print sources: image/jpeg has already undone the Adobe inversion
+        // of CMYK JPEGs, so these are ink amounts (255 = full ink)
+        pix := img.Pix[img.PixOffset(minX, y):]
+        for x := range p0 {
+            i := x * 4
+            r, g, b := cmykToRGB(pix[i], pix[i+1], pix[i+2], pix[i+3])
+            p0[x], p1[x], p2[x] = rgbToPlanes(m, r, g, b)
+        }
+        return
+    }
+    for x := range p0 {
+        r, g, b, _ := src.At(minX+x, y).RGBA()
+        p0[x], p1[x], p2[x] = rgbToPlanes(m, uint8(r>>8), uint8(g>>8), uint8(b>>8))
+    }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestColorMatrixRoundTrip converts a coarse RGB lattice to planes and
+// back with each matrix. 8-bit plane rounding allows a few levels of
+// drift; identity must be exact.
+func TestColorMatrixRoundTrip(t *testing.T) {
+	for _, m := range []ColorMatrix{MatrixBT601, MatrixBT709, MatrixIdentity} {
+		worst := 0
+		for r := 0; r < 256; r += 15 {
+			for g := 0; g < 256; g += 15 {
+				for b := 0; b < 256; b += 15 {
+					y, cb, cr := rgbToPlanes(m, uint8(r), uint8(g), uint8(b))
+					r2, g2, b2 := planesToRGB(m, y, cb, cr)
+					for _, d := range []int{int(r2) - r, int(g2) - g, int(b2) - b} {
+						worst = max(worst, d, -d)
+					}
+				}
+			}
+		}
+		tolerance := 3
+		if m == MatrixIdentity {
+			tolerance = 0
+		}
+		if worst > tolerance {
+			t.Fatalf("%s color round trip error %d exceeds %d", m, worst, tolerance)
+		}
+	}
+}
+
+// TestSplitPlanes converts RGBA, translucent NRGBA and subsampled
+// YCbCr images through the fast paths and through At(), for every matrix
+// the fast path does not special-case, and expects identical planes.
+func TestSplitPlanes(t *testing.T) {
+	const w, h = 37, 21 // Odd sizes exercise the chroma subsampling edges
+	rgba := benchRGBA(w, h)
+	nrgba := image.NewNRGBA(image.Rect(3, 5, 3+w, 5+h))
+	ycc := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := rgba.PixOffset(x, y)
+			nrgba.SetNRGBA(3+x, 5+y, color.NRGBA{rgba.Pix[i], uint8(x * 7), uint8(y * 11), uint8(255 - x*3)})
+			ycc.Y[ycc.YOffset(x, y)] = rgba.Pix[i]
+			ci := ycc.COffset(x, y)
+			ycc.Cb[ci], ycc.Cr[ci] = uint8(x*5), uint8(255-y*9)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		img      image.Image
+		matrices []ColorMatrix
+	}{
+		{"rgba", rgba, []ColorMatrix{MatrixBT601, MatrixBT709, MatrixIdentity}},
+		{"nrgba", nrgba, []ColorMatrix{MatrixBT601, MatrixBT709, MatrixIdentity}},
+		{"ycbcr", ycc, []ColorMatrix{MatrixBT709, MatrixIdentity}},
+	}
+	for _, tc := range cases {
+		for _, m := range tc.matrices {
+			f0, f1, f2 := splitImagePlanes(tc.img, m, 0)
+			g0, g1, g2 := splitImagePlanes(genericImage{tc.img}, m, 0)
+			if !bytes.Equal(f0.Pix, g0.Pix) || !bytes.Equal(f1.Pix, g1.Pix) || !bytes.Equal(f2.Pix, g2.Pix) {
+				t.Fatalf("%s/%s fast path differs from At()", tc.name, m)
+			}
+		}
+	}
+
+	// BT.601 YCbCr sources are copied as-is
+	y0, cb, _ := splitImagePlanes(ycc, MatrixBT601, 0)
+	if y0.Pix[0] != ycc.Y[0] || cb.Pix[w-1] != ycc.Cb[ycc.COffset(w-1, 0)] {
+		t.Fatalf("YCbCr source was not copied directly")
+	}
+}
+
+// TestPlanesToRGBA compares the row conversion with the per-pixel
+// references for every (y, cb, cr): color.YCbCrToRGB for BT.601 and the
+// scalar BT.709 inverse
+func TestPlanesToRGBA(t *testing.T) {
+	cb := make([]uint8, 256)
+	for i := range cb {
+		cb[i] = uint8(i)
+	}
+	ys, crs := make([]uint8, 256), make([]uint8, 256)
+	dst := make([]uint8, 256*4)
+	for _, m := range []ColorMatrix{MatrixBT601, MatrixBT709, MatrixIdentity} {
+		for y := 0; y < 256; y++ {
+			for cr := 0; cr < 256; cr++ {
+				for i := range ys {
+					ys[i], crs[i] = uint8(y), uint8(cr)
+				}
+				planesToRGBARow(m, ys, cb, crs, dst)
+				for c := 0; c < 256; c++ {
+					var r, g, b uint8
+					switch m {
+					case MatrixBT601:
+						r, g, b = color.YCbCrToRGB(uint8(y), uint8(c), uint8(cr))
+					case MatrixBT709:
+						fy, fcb, fcr := float32(y), float32(c)-128, float32(cr)-128
+						r = clampToByte(fy + float32(1.5748*fcr))
+						g = clampToByte(fy - float32(0.1873*fcb) - float32(0.4681*fcr))
+						b = clampToByte(fy + float32(1.8556*fcb))
+					default:
+						r, g, b = uint8(y), uint8(c), uint8(cr)
+					}
+					p := dst[c*4 : c*4+4]
+					if p[0] != r || p[1] != g || p[2] != b || p[3] != 255 {
+						t.Fatalf("%s (%d, %d, %d) gave %v, want %d %d %d", m, y, c, cr, p, r, g, b)
+					}
+					if r2, g2, b2 := planesToRGB(m, uint8(y), uint8(c), uint8(cr)); r2 != r || g2 != g || b2 != b {
+						t.Fatalf("planesToRGB %s (%d, %d, %d) disagrees", m, y, c, cr)
+					}
+				}
+			}
+		}
+	}
+}
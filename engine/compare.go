@@ -0,0 +1,106 @@
+package main
+
+import (
+    "bytes"
+    "flag"
+    "fmt"
+    "image"
+    "image/png"
+    "io"
+    "os"
+
+    "gap-engine/metrics"
+)
+
+// loadCompareImage reads an image for compare: .gap files (by their
+// magic) are decoded as decode would write them, anything else as an
+// encoder source
+func loadCompareImage(path string) (image.Image, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    var img image.Image
+    if bytes.HasPrefix(data, []byte("GAP")) {
+        img, _, err = decodeImageTo(bytes.NewReader(data), DecodeOptions{Passphrase: os.Getenv(passphraseEnv)})
+    } else {
+        img, err = decodeSource(data)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    return img, nil
+}
+
+// writeCompareTable prints a comparison the way compare reports it.
+// SSIM and MS-SSIM of 0 mean the images were too small to measure.
+func writeCompareTable(w io.Writer, r *metrics.Result, ssim, msssim float64) {
+    c := metrics.Channels
+    fmt.Fprintf(w, "MSE:      %.4f (%s %.4f, %s %.4f, %s %.4f)\n", r.MSEOverall, c[0], r.MSE[0], c[1], r.MSE[1], c[2], r.MSE[2])
+    fmt.Fprintf(w, "PSNR:     %.2f dB (%s %.2f, %s %.2f, %s %.2f)\n", r.Overall, c[0], r.PSNR[0], c[1], r.PSNR[1], c[2], r.PSNR[2])
+    if ssim != 0 {
+        fmt.Fprintf(w, "SSIM:     %.4f (luma)\n", ssim)
+        fmt.Fprintf(w, "MS-SSIM:  %.4f (luma)\n", msssim)
+    } else {
+        fmt.Fprintln(w, "SSIM:     n/a (under 11x11 pixels)")
+    }
+    if r.MaxDiff == 0 {
+        fmt.Fprintln(w, "Max diff: 0 (identical)")
+        return
+    }
+    fmt.Fprintf(w, "Max diff: %d in %s at (%d, %d)\n", r.MaxDiff, c[r.MaxChannel], r.MaxDiffAt.X, r.MaxDiffAt.Y)
+}
+
+func runCompare(args []string) {
+    fs := flag.NewFlagSet("compare", flag.ExitOnError)
+    diffPtr := fs.String("diff", "", "Write a difference heatmap PNG here")
+    gainPtr := fs.Float64("gain", 8, "Amplify differences this much in the -diff heatmap")
+    // Flags may come before, between or after the two images
+    var paths []string
+    for rest := args; ; {
+        fs.Parse(rest)
+        if fs.NArg() == 0 { break }
+        paths = append(paths, fs.Arg(0))
+        rest = fs.Args()[1:]
+    }
+    if len(paths) != 2 {
+        fmt.Fprintln(os.Stderr, "Error: compare takes two images (png, jpeg, bmp, tiff, webp or gap)")
+        fs.PrintDefaults()
+        os.Exit(1)
+    }
+    if *gainPtr <= 0 {
+        fmt.Fprintln(os.Stderr, "Error: -gain must be positive")
+        os.Exit(1)
+    }
+
+    err := func() error {
+        a, err := loadCompareImage(paths[0])
+        if err != nil {
+            return err
+        }
+        b, err := loadCompareImage(paths[1])
+        if err != nil {
+            return err
+        }
+        r, err := metrics.Compare(a, b)
+        if err != nil {
+            return err
+        }
+        ssim, msssim := structural(a, b)
+        writeCompareTable(os.Stdout, r, ssim, msssim)
+        if *diffPtr == "" {
+            return nil
+        }
+        heatmap, err := metrics.DiffImage(a, b, *gainPtr)
+        if err != nil {
+            return err
+        }
+        return writeFileAtomic(*diffPtr, func(w io.Writer) error {
+            return png.Encode(w, heatmap)
+        })
+    }()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Compare failed: %v\n", err)
+        os.Exit(1)
+    }
+}
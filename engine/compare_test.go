@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gap-engine/metrics"
+)
+
+// TestCompare compares an image with a copy that has one sample
+// changed: the MSE, PSNR and the place of the largest difference must be
+// what that change gives, the heatmap black except there, and a .gap file
+// must load as its decode. Images of different size must not compare.
+func TestCompare(t *testing.T) {
+	src := benchRGBA(40, 30)
+	edited := image.NewRGBA(src.Bounds())
+	copy(edited.Pix, src.Pix)
+	i := edited.PixOffset(13, 7) + 1
+	edited.Pix[i] = uint8(int(edited.Pix[i]+100) % 256)
+	d := float64(int(edited.Pix[i]) - int(src.Pix[i]))
+
+	r, err := metrics.Compare(src, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.MaxDiff != int(math.Abs(d)) || r.MaxDiffAt != image.Pt(13, 7) || metrics.Channels[r.MaxChannel] != "G" {
+		t.Fatalf("max diff %d in %s at %v, want %v in G at (13, 7)", r.MaxDiff, metrics.Channels[r.MaxChannel], r.MaxDiffAt, math.Abs(d))
+	}
+	n := float64(40 * 30)
+	if r.MSE[1] != d*d/n || r.MSE[0] != 0 || r.MSEOverall != d*d/(3*n) {
+		t.Fatalf("MSE %v overall %v, want G %v", r.MSE, r.MSEOverall, d*d/n)
+	}
+	if !math.IsInf(r.PSNR[0], 1) || math.Abs(r.Overall-10*math.Log10(255*255*3*n/(d*d))) > 1e-9 {
+		t.Fatalf("PSNR %v overall %v", r.PSNR, r.Overall)
+	}
+	heatmap, err := metrics.DiffImage(src, edited, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			if black := heatmap.RGBAAt(x, y) == (color.RGBA{0, 0, 0, 255}); black == (x == 13 && y == 7) {
+				t.Fatalf("heatmap pixel (%d, %d) is %v", x, y, heatmap.RGBAAt(x, y))
+			}
+		}
+	}
+	if _, err := metrics.Compare(src, benchRGBA(40, 31)); err == nil || !strings.Contains(err.Error(), "differ in size") {
+		t.Fatalf("mismatched sizes gave %v", err)
+	}
+
+	dir, err := os.MkdirTemp("", "gap-compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gapPath := filepath.Join(dir, "a.gap")
+	if err := os.WriteFile(gapPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadCompareImage(gapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := DecodeImageTo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := metrics.Compare(loaded, want); err != nil || r.MaxDiff != 0 {
+		t.Fatalf(".gap input does not load as its decode (%v)", err)
+	}
+}
+
+// TestSSIM pins SSIM and MS-SSIM: identical images score 1, flat
+// planes of different levels score the luminance term alone, and a
+// textured image against its 9x9 box blur keeps the values measured when
+// the implementation was written, so any change to the window, constants
+// or scales shows up here. -verify reports both.
+func TestSSIM(t *testing.T) {
+	const w, h = 96, 80
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 128 + 60*math.Sin(float64(x)*0.21)*math.Cos(float64(y)*0.17)
+			if (x/12+y/10)%2 == 0 {
+				v += 40
+			}
+			src.SetRGBA(x, y, color.RGBA{uint8(v), uint8(v * 0.9), uint8(255 - v), 255})
+		}
+	}
+	blurred := image.NewRGBA(src.Rect)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [3]int
+			for j := -4; j <= 4; j++ {
+				for i := -4; i <= 4; i++ {
+					c := src.RGBAAt(min(max(x+i, 0), w-1), min(max(y+j, 0), h-1))
+					sum[0], sum[1], sum[2] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B)
+				}
+			}
+			blurred.SetRGBA(x, y, color.RGBA{uint8(sum[0] / 81), uint8(sum[1] / 81), uint8(sum[2] / 81), 255})
+		}
+	}
+
+	pairs := []struct {
+		name         string
+		a, b         image.Image
+		ssim, msssim float64
+	}{
+		{"identical", src, src, 1, 1},
+		{"blurred", src, blurred, 0.710210, 0.843124},
+	}
+	for _, p := range pairs {
+		ssim, err := metrics.SSIM(p.a, p.b)
+		if err != nil {
+			t.Fatalf("%s: %v", p.name, err)
+		}
+		msssim, err := metrics.MSSSIM(p.a, p.b)
+		if err != nil {
+			t.Fatalf("%s: %v", p.name, err)
+		}
+		t.Logf("%-9s SSIM %.6f, MS-SSIM %.6f", p.name, ssim, msssim)
+		if math.Abs(ssim-p.ssim) > 1e-6 || math.Abs(msssim-p.msssim) > 1e-6 {
+			t.Fatalf("%s: SSIM %.6f, MS-SSIM %.6f, want %.6f and %.6f", p.name, ssim, msssim, p.ssim, p.msssim)
+		}
+	}
+	// Flat planes have no contrast or structure to compare
+	dark, light := image.NewGray(image.Rect(0, 0, 20, 20)), image.NewGray(image.Rect(0, 0, 20, 20))
+	for i := range dark.Pix {
+		dark.Pix[i], light.Pix[i] = 100, 150
+	}
+	const c1 = (0.01 * 255) * (0.01 * 255)
+	if ssim, err := metrics.SSIM(dark, light); err != nil || math.Abs(ssim-(2*100*150+c1)/(100*100+150*150+c1)) > 1e-9 {
+		t.Fatalf("flat 100 against flat 150 gave %v (%v)", ssim, err)
+	}
+	if _, err := metrics.SSIM(benchRGBA(10, 40), benchRGBA(10, 40)); !errors.Is(err, metrics.ErrTooSmall) {
+		t.Fatalf("a 10-pixel-wide image gave %v", err)
+	}
+
+	var source bytes.Buffer
+	if err := png.Encode(&source, src); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := EncodeWithStats(&source, io.Discard, EncodeOptions{S: 0.1, Threshold: 0.5, Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := stats.Quality; q == nil || q.SSIM <= 0.5 || q.SSIM > 1 || q.MSSSIM <= 0.5 || q.MSSSIM > 1 {
+		t.Fatalf("-verify reported %+v", stats.Quality)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "fmt"
+)
+
+// Compression selects how the encoder stores the patch streams
+type Compression int
+
+const (
+    CompressRange       Compression = iota // Five range-coded streams per plane (FlagRangeCoded)
+    CompressGzip                           // Interleaved patches in one gzip stream (FlagGzip)
+    CompressNone                           // Five stored streams per plane (FlagRangeCoded | FlagRawStreams)
+    CompressInterleaved                    // Interleaved patches, uncompressed
+)
+
+func (c Compression) String() string {
+    switch c {
+    case CompressRange:
+        return "range"
+    case CompressGzip:
+        return "gzip"
+    case CompressNone:
+        return "none"
+    case CompressInterleaved:
+        return "interleaved"
+    }
+    return fmt.Sprintf("unknown(%d)", int(c))
+}
+
+// ParseCompression accepts the -compress names
+func ParseCompression(name string) (Compression, error) {
+    switch name {
+    case "range":
+        return CompressRange, nil
+    case "gzip":
+        return CompressGzip, nil
+    case "none":
+        return CompressNone, nil
+    case "interleaved":
+        return CompressInterleaved, nil
+    }
+    return 0, fmt.Errorf("unknown compression %q (want range, none, gzip or interleaved)", name)
+}
+
+// interleaved reports whether c writes the legacy single-stream layout
+func (c Compression) interleaved() bool {
+    return c == CompressGzip || c == CompressInterleaved
+}
+
+// compressionFromFlags names the stream layout of a file
+func compressionFromFlags(flags uint32) Compression {
+    switch {
+    case flags&FlagGzip != 0:
+        return CompressGzip
+    case flags&FlagRawStreams != 0:
+        return CompressNone
+    case flags&FlagRangeCoded != 0:
+        return CompressRange
+    }
+    return CompressInterleaved
+}
+
+// interleavePatches merges one plane's split streams into the legacy
+// single-stream layout: each patch's fields in the order patchParser
+// reads them (count first for skip-flat and sparse-angle files, then
+// angle, count, maxVal, and an index followed by its values for each
+// coefficient).
+func interleavePatches(angles, counts, maxVals, indices, values []byte, flags uint32) ([]byte, error) {
+    maxValSize := 0
+    if flags&FlagQuantized != 0 {
+        maxValSize = 4
+        if flags&FlagHalfMaxVal != 0 { maxValSize = 2 }
+    }
+    valueSize := 2
+    if coeffDepth(flags) > 8 { valueSize = 4 }
+    skipFlat := flags&FlagSkipFlat != 0
+    sparse := flags&FlagSparseAngles != 0
+
+    out := make([]byte, 0, len(angles)+len(counts)+len(maxVals)+len(indices)+len(values))
+    take := func(stream *[]byte, n int) error {
+        if len(*stream) < n {
+            return fmt.Errorf("split stream ends early")
+        }
+        out = append(out, (*stream)[:n]...)
+        *stream = (*stream)[n:]
+        return nil
+    }
+    for _, count := range counts {
+        if skipFlat || sparse {
+            out = append(out, count)
+            if skipFlat && count == flatPatchCount {
+                if err := take(&values, 1); err != nil { return nil, err }
+                continue
+            }
+        }
+        if count > 0 || !sparse {
+            if err := take(&angles, 1); err != nil { return nil, err }
+        }
+        if !skipFlat && !sparse { out = append(out, count) }
+        if err := take(&maxVals, maxValSize); err != nil { return nil, err }
+        for k := 0; k < int(count); k++ {
+            if err := take(&indices, 1); err != nil { return nil, err }
+            if err := take(&values, valueSize); err != nil { return nil, err }
+        }
+    }
+    return out, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"testing"
+)
+
+// TestRangeCoderBridge round-trips a short message through the Zig range
+// coder, and an empty input through GapCompressData
+func TestRangeCoderBridge(t *testing.T) {
+	input := []byte("Hello GAP! This is a test of the Range Coder bridge.")
+	compressed, err := GapCompressData(input)
+	if err != nil || compressed == nil {
+		t.Fatalf("GapCompressData returned nil: %v", err)
+	}
+	if empty, err := GapCompressData(nil); empty != nil || err != nil {
+		t.Fatalf("GapCompressData on empty input: %d bytes, %v", len(empty), err)
+	}
+	decompressed := GapDecompressData(compressed, len(input))
+	if string(decompressed) != string(input) {
+		t.Fatalf("decompression mismatch: got %q, want %q", decompressed, input)
+	}
+}
+
+// TestStoredFallback makes the range coder reject some streams and
+// checks the encode stores them instead, marks the file with
+// FlagStoredBlocks and decodes to the same pixels as a normal encode
+func TestStoredFallback(t *testing.T) {
+	src := benchRGBA(40, 24)
+	for _, opts := range []EncodeOptions{{S: 0.1, Threshold: 0.5}, {S: 0.1, Threshold: 0.5, Lossless: true}, {S: 0.1, Threshold: 0.5, CfL: true}} {
+		name := fmt.Sprintf("lossless=%v cfl=%v", opts.Lossless, opts.CfL)
+		data, err := encodeGap(src, nil, opts, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if binary.LittleEndian.Uint32(data[headerFlagsOffset:])&FlagStoredBlocks != 0 {
+			t.Fatalf("%s: flag set without a fallback", name)
+		}
+		want, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, reject := range []func(n int) bool{func(n int) bool { return n%2 == 1 }, func(int) bool { return true }} {
+			rangeCompress = func(input, dst []byte) ([]byte, error) {
+				if len(input) > 0 && reject(len(input)) {
+					return nil, fmt.Errorf("rejected")
+				}
+				return GapCompressDataInto(input, dst)
+			}
+			stored, err := encodeGap(src, nil, opts, nil)
+			rangeCompress = GapCompressDataInto
+			if err != nil {
+				t.Fatalf("%s: encode: %v", name, err)
+			}
+			if binary.LittleEndian.Uint32(stored[headerFlagsOffset:])&FlagStoredBlocks == 0 {
+				t.Fatalf("%s: FlagStoredBlocks not set", name)
+			}
+			got, _, err := decodeGap(bytes.NewReader(stored), DecodeOptions{})
+			if err != nil {
+				t.Fatalf("%s: decode: %v", name, err)
+			}
+			if !bytes.Equal(got.Pix, want.Pix) {
+				t.Fatalf("%s: stored streams decoded differently", name)
+			}
+		}
+	}
+}
+
+// TestCompressModes encodes with each -compress mode across feature sets
+// that change the patch layout, decodes through the split and legacy
+// paths, and expects identical pixels and the right header flags
+func TestCompressModes(t *testing.T) {
+	src := benchRGBA(41, 27)
+	optionSets := []EncodeOptions{
+		{},
+		{DCPred: true, RunIndices: true, SkipFlat: true, AngleDelta: true, HalfMaxVal: true},
+		{DCPred: true, AngleDelta: true, SparseAngles: true},
+		{Matrix: MatrixIdentity, CoeffBits: 12, Compand: true},
+	}
+	for i, opts := range optionSets {
+		opts.S, opts.Threshold = 0.1, 0.5
+		var want *image.RGBA
+		for _, c := range []Compression{CompressRange, CompressNone, CompressGzip, CompressInterleaved} {
+			opts.Compress = c
+			data, err := encodeGap(src, nil, opts, nil)
+			if err != nil {
+				t.Fatalf("%s, set %d: %v", c, i, err)
+			}
+			img, h, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+			if err != nil {
+				t.Fatalf("%s, set %d: decode: %v", c, i, err)
+			}
+			if compressionFromFlags(h.Flags) != c {
+				t.Fatalf("%s, set %d: header flags 0x%x", c, i, h.Flags)
+			}
+			if want == nil {
+				want = img
+			} else if !bytes.Equal(img.Pix, want.Pix) {
+				t.Fatalf("%s, set %d: pixels differ from range coding", c, i)
+			}
+		}
+	}
+	if _, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: true, Compress: CompressGzip}, nil); err == nil {
+		t.Fatalf("lossless gzip accepted")
+	}
+	// Stored split streams keep the features that need them
+	_, img := roundTrip(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: true, CfL: true, Compress: CompressNone})
+	if !math.IsInf(PSNR(src, img), 1) {
+		t.Fatalf("stored streams: lossless round trip is not exact")
+	}
+}
+
+// TestRangeFraming round-trips RangeCompress/RangeDecompress and checks
+// that malformed blobs are rejected rather than decoded.
+func TestRangeFraming(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{42},
+		[]byte("Hello GAP! This is a test of the Range Coder bridge."),
+		bytes.Repeat([]byte{0, 1, 2, 3, 250}, 4000),
+	}
+	for _, in := range inputs {
+		blob, err := RangeCompress(in)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", len(in), err)
+		}
+		out, err := RangeDecompress(blob)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", len(in), err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatalf("%d bytes: round trip mismatch", len(in))
+		}
+	}
+	for _, blob := range [][]byte{nil, {0x80}, {0x05}, {0xFF, 0xFF, 0xFF, 0xFF, 0x7F, 1}} {
+		if _, err := RangeDecompress(blob); err == nil {
+			t.Fatalf("malformed blob %x accepted", blob)
+		}
+	}
+}
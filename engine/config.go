@@ -0,0 +1,89 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+    "strconv"
+)
+
+// Config is a -config file: a JSON object whose keys are the command's
+// flag names without the dash, e.g.
+//
+//	{"s": 0.05, "t": 0.2, "matrix": "709", "bits": 10, "cfl": true}
+//
+// Values are strings, numbers or booleans, parsed exactly as on the
+// command line. Keeping the keys identical to the flags means a config
+// documents an encode in the same terms as its command line.
+type Config map[string]interface{}
+
+// configExcluded are flags that name files or the config itself, which a
+// shared settings file should not fix
+var configExcluded = map[string]bool{"i": true, "o": true, "outdir": true, "config": true}
+
+// LoadConfig reads a -config file
+func LoadConfig(path string) (Config, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read config: %v", err)
+    }
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.UseNumber()
+    var cfg Config
+    if err := dec.Decode(&cfg); err != nil {
+        return nil, fmt.Errorf("invalid config %s: %v", path, err)
+    }
+    return cfg, nil
+}
+
+// applyConfig sets fs's flags from cfg, except those already given on the
+// command line, which override the file. fs must already be parsed.
+func applyConfig(fs *flag.FlagSet, cfg Config, path string) error {
+    explicit := make(map[string]bool)
+    fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+    keys := make([]string, 0, len(cfg))
+    for k := range cfg { keys = append(keys, k) }
+    sort.Strings(keys)
+    for _, key := range keys {
+        if configExcluded[key] {
+            return fmt.Errorf("config %s: %q cannot be set from a config file", path, key)
+        }
+        if fs.Lookup(key) == nil {
+            return fmt.Errorf("config %s: unknown key %q (keys are %s flag names)", path, key, fs.Name())
+        }
+        var value string
+        switch v := cfg[key].(type) {
+        case string:
+            value = v
+        case json.Number:
+            value = v.String()
+        case bool:
+            value = strconv.FormatBool(v)
+        default:
+            return fmt.Errorf("config %s: %q must be a string, number or boolean", path, key)
+        }
+        if explicit[key] {
+            continue
+        }
+        if err := fs.Set(key, value); err != nil {
+            return fmt.Errorf("config %s: %q: %v", path, key, err)
+        }
+    }
+    return nil
+}
+
+// addConfigFlag registers -config on fs; the returned function applies
+// the file, if one was given, once fs is parsed
+func addConfigFlag(fs *flag.FlagSet) func() error {
+    configPtr := fs.String("config", "", "JSON file of flag values (keys are flag names; command-line flags override it)")
+    return func() error {
+        if *configPtr == "" { return nil }
+        cfg, err := LoadConfig(*configPtr)
+        if err != nil { return err }
+        return applyConfig(fs, cfg, *configPtr)
+    }
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"testing"
+)
+
+// TestConfig applies a config to a parsed flag set and expects the
+// command line to win, then expects unknown keys, file flags and
+// non-scalar values to be rejected
+func TestConfig(t *testing.T) {
+	newFlags := func(args ...string) (*flag.FlagSet, *float64, *float64, *bool, error) {
+		fs := flag.NewFlagSet("encode", flag.ContinueOnError)
+		fs.String("o", "", "")
+		s := fs.Float64("s", 0.1, "")
+		thresh := fs.Float64("t", 0.5, "")
+		cfl := fs.Bool("cfl", false, "")
+		return fs, s, thresh, cfl, fs.Parse(args)
+	}
+	fs, s, thresh, cfl, err := newFlags("-t", "0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{"s": json.Number("0.05"), "t": json.Number("0.2"), "cfl": true}
+	if err := applyConfig(fs, cfg, "check.json"); err != nil {
+		t.Fatal(err)
+	}
+	if *s != 0.05 || *thresh != 0.3 || !*cfl {
+		t.Fatalf("got s=%g t=%g cfl=%v, want 0.05 0.3 (command line) true", *s, *thresh, *cfl)
+	}
+	for _, bad := range []Config{{"x": true}, {"o": "out.gap"}, {"s": []interface{}{1}}, {"s": "fast"}} {
+		fs, _, _, _, _ := newFlags()
+		if err := applyConfig(fs, bad, "check.json"); err == nil {
+			t.Fatalf("%v was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// A container bundles unrelated images, such as a burst of photos or the
+// mip levels of a texture: the magic "GAPK", a u32 entry count, the entry
+// table (u16 name length, name, u64 absolute offset, u64 length per
+// entry), and then the entries back to back. Each entry is a complete
+// single-image .gap file and shares nothing with the others, so it
+// decodes with the ordinary decoder and can be read without touching the
+// rest of the container.
+
+var containerMagic = [4]byte{'G', 'A', 'P', 'K'}
+
+// maxContainerEntries and maxEntryName bound the table read from
+// untrusted input
+const (
+    maxContainerEntries = 1 << 16
+    maxEntryName        = 1024
+)
+
+// errContainer is returned by readHeader for a container, which has no
+// image header of its own
+var errContainer = errors.New("file is a multi-image container; use unpack")
+
+// ContainerEntry is one named image of a container. Its bytes are only
+// read when the entry is opened or decoded.
+type ContainerEntry struct {
+    Name   string
+    Offset int64
+    Length int64
+    r      io.ReaderAt
+}
+
+// Open returns a reader over the entry's .gap file
+func (e *ContainerEntry) Open() *io.SectionReader {
+    return io.NewSectionReader(e.r, e.Offset, e.Length)
+}
+
+// Decode decodes the entry like DecodeImageTo, honoring opts
+func (e *ContainerEntry) Decode(opts DecodeOptions) (image.Image, error) {
+    img, _, err := decodeImageTo(e.Open(), opts)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode %s: %v", e.Name, err)
+    }
+    return img, nil
+}
+
+// Container is an opened container: its entry table, in file order
+type Container struct {
+    Entries []ContainerEntry
+}
+
+// Entry returns the entry called name
+func (c *Container) Entry(name string) (*ContainerEntry, bool) {
+    for i := range c.Entries {
+        if c.Entries[i].Name == name { return &c.Entries[i], true }
+    }
+    return nil, false
+}
+
+// validEntryName rejects empty names and names that would leave the
+// output directory when unpacked
+func validEntryName(name string) bool {
+    return name != "" && len(name) <= maxEntryName && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// OpenContainer reads the entry table of a container. Only the table is
+// read; entries decode lazily. When r has a Size method (bytes.Reader,
+// io.SectionReader) entries reaching past the end are rejected up front.
+func OpenContainer(r io.ReaderAt) (*Container, error) {
+    br := bufio.NewReader(io.NewSectionReader(r, 0, 1<<62))
+    var magic [4]byte
+    var count uint32
+    if _, err := io.ReadFull(br, magic[:]); err != nil {
+        return nil, fmt.Errorf("failed to read container magic: %v", err)
+    }
+    if magic != containerMagic {
+        return nil, fmt.Errorf("not a container (magic %q)", magic[:])
+    }
+    if err := binary.Read(br, binary.LittleEndian, &count); err != nil {
+        return nil, fmt.Errorf("failed to read entry count: %v", err)
+    }
+    if count > maxContainerEntries {
+        return nil, fmt.Errorf("invalid entry count %d", count)
+    }
+
+    c := &Container{Entries: make([]ContainerEntry, count)}
+    tableEnd := int64(8)
+    seen := make(map[string]bool, count)
+    for i := range c.Entries {
+        var nameLen uint16
+        if err := binary.Read(br, binary.LittleEndian, &nameLen); err != nil {
+            return nil, fmt.Errorf("failed to read entry %d: %v", i, err)
+        }
+        if nameLen > maxEntryName {
+            return nil, fmt.Errorf("entry %d has an invalid name length %d", i, nameLen)
+        }
+        name := make([]byte, nameLen)
+        var span [2]uint64
+        if _, err := io.ReadFull(br, name); err != nil {
+            return nil, fmt.Errorf("failed to read entry %d: %v", i, err)
+        }
+        if err := binary.Read(br, binary.LittleEndian, &span); err != nil {
+            return nil, fmt.Errorf("failed to read entry %d: %v", i, err)
+        }
+        if !validEntryName(string(name)) {
+            return nil, fmt.Errorf("entry %d has an invalid name %q", i, name)
+        }
+        if seen[string(name)] {
+            return nil, fmt.Errorf("duplicate entry name %q", name)
+        }
+        seen[string(name)] = true
+        if span[0] > 1<<60 || span[1] == 0 || span[1] > 1<<60 {
+            return nil, fmt.Errorf("entry %q has an invalid span", name)
+        }
+        c.Entries[i] = ContainerEntry{Name: string(name), Offset: int64(span[0]), Length: int64(span[1]), r: r}
+        tableEnd += 2 + int64(nameLen) + 16
+    }
+
+    // Entries follow the table in order without overlapping
+    pos := tableEnd
+    for _, e := range c.Entries {
+        if e.Offset < pos {
+            return nil, fmt.Errorf("entry %q overlaps the table or the previous entry", e.Name)
+        }
+        pos = e.Offset + e.Length
+    }
+    if sized, ok := r.(interface{ Size() int64 }); ok && pos > sized.Size() {
+        return nil, fmt.Errorf("container is truncated: entries end at %d, file is %d bytes", pos, sized.Size())
+    }
+    return c, nil
+}
+
+// writeContainer writes a container holding old's entries (old may be
+// nil), copied byte for byte, followed by the new files
+func writeContainer(w io.Writer, old *Container, names []string, files [][]byte) error {
+    var entries []ContainerEntry
+    if old != nil {
+        entries = append(entries, old.Entries...)
+    }
+    for i, name := range names {
+        entries = append(entries, ContainerEntry{Name: name, Length: int64(len(files[i])), r: bytes.NewReader(files[i])})
+    }
+    if len(entries) > maxContainerEntries {
+        return fmt.Errorf("too many entries: %d (max %d)", len(entries), maxContainerEntries)
+    }
+
+    seen := make(map[string]bool, len(entries))
+    pos := int64(8)
+    for _, e := range entries {
+        if !validEntryName(e.Name) {
+            return fmt.Errorf("invalid entry name %q", e.Name)
+        }
+        if seen[e.Name] {
+            return fmt.Errorf("duplicate entry name %q", e.Name)
+        }
+        seen[e.Name] = true
+        pos += 2 + int64(len(e.Name)) + 16
+    }
+
+    bw := bufio.NewWriter(w)
+    bw.Write(containerMagic[:])
+    binary.Write(bw, binary.LittleEndian, uint32(len(entries)))
+    for _, e := range entries {
+        binary.Write(bw, binary.LittleEndian, uint16(len(e.Name)))
+        bw.WriteString(e.Name)
+        binary.Write(bw, binary.LittleEndian, [2]uint64{uint64(pos), uint64(e.Length)})
+        pos += e.Length
+    }
+    for _, e := range entries {
+        if _, err := io.Copy(bw, e.Open()); err != nil {
+            return fmt.Errorf("failed to copy entry %q: %v", e.Name, err)
+        }
+    }
+    return bw.Flush()
+}
+
+// PackContainer encodes each input into one container named after the
+// input files. Inputs that already are .gap files are stored as they
+// are. With appendTo, the entries of an existing container at outputPath
+// are kept in front of the new ones.
+func PackContainer(outputPath string, inputs []string, opts EncodeOptions, appendTo bool) error {
+    var old *Container
+    if appendTo {
+        data, err := os.ReadFile(outputPath)
+        if err != nil {
+            return fmt.Errorf("failed to open container: %v", err)
+        }
+        if old, err = OpenContainer(bytes.NewReader(data)); err != nil {
+            return err
+        }
+    }
+
+    names := make([]string, len(inputs))
+    files := make([][]byte, len(inputs))
+    for i, input := range inputs {
+        names[i] = filepath.Base(input)
+        data, err := os.ReadFile(input)
+        if err != nil {
+            return fmt.Errorf("failed to open %s: %v", input, err)
+        }
+        if h, err := readHeader(bytes.NewReader(data)); err == nil {
+            if h.Flags&FlagFrames != 0 {
+                return fmt.Errorf("%s is a sequence; containers hold single images", input)
+            }
+            logInfof("Storing %s", input)
+            files[i] = data
+            continue
+        }
+        logInfof("Encoding %s", input)
+        var out bytes.Buffer
+        if err := Encode(bytes.NewReader(data), &out, opts); err != nil {
+            return fmt.Errorf("failed to encode %s: %v", input, err)
+        }
+        files[i] = out.Bytes()
+    }
+
+    return writeFileAtomic(outputPath, func(w io.Writer) error {
+        return writeContainer(w, old, names, files)
+    })
+}
+
+// UnpackContainer decodes the named entries (all if names is empty) to
+// PNG files in outDir, or with asGap copies out their .gap files
+func UnpackContainer(inputPath, outDir string, names []string, opts DecodeOptions, asGap bool) error {
+    file, err := os.Open(inputPath)
+    if err != nil {
+        return fmt.Errorf("failed to open input: %v", err)
+    }
+    defer file.Close()
+
+    c, err := OpenContainer(file)
+    if err != nil {
+        return err
+    }
+    entries := c.Entries
+    if len(names) > 0 {
+        entries = nil
+        for _, name := range names {
+            e, ok := c.Entry(name)
+            if !ok {
+                return fmt.Errorf("no entry %q in %s", name, inputPath)
+            }
+            entries = append(entries, *e)
+        }
+    }
+    if outDir != "" {
+        if err := os.MkdirAll(outDir, 0755); err != nil {
+            return fmt.Errorf("failed to create output directory: %v", err)
+        }
+    }
+
+    for _, e := range entries {
+        base := strings.TrimSuffix(e.Name, filepath.Ext(e.Name))
+        if asGap {
+            output := filepath.Join(outDir, base+".gap")
+            logInfof("Extracting %s -> %s", e.Name, output)
+            err = writeFileAtomic(output, func(w io.Writer) error {
+                _, err := io.Copy(w, e.Open())
+                return err
+            })
+        } else {
+            output := filepath.Join(outDir, base+opts.Format.Ext())
+            logInfof("Decoding %s -> %s", e.Name, output)
+            var img image.Image
+            var chunks []GapChunk
+            img, chunks, err = decodeImageTo(e.Open(), opts)
+            if err == nil {
+                err = writeDecoded(output, img, chunks, opts)
+            }
+        }
+        if err != nil {
+            return fmt.Errorf("failed to unpack %s: %v", e.Name, err)
+        }
+    }
+    return nil
+}
+
+// listContainer prints each entry's name, size and dimensions, reading
+// only the entry headers
+func listContainer(w io.Writer, inputPath string) error {
+    file, err := os.Open(inputPath)
+    if err != nil {
+        return fmt.Errorf("failed to open input: %v", err)
+    }
+    defer file.Close()
+
+    c, err := OpenContainer(file)
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(w, "%d entries\n", len(c.Entries))
+    for _, e := range c.Entries {
+        size := "?"
+        if h, err := readHeader(bufio.NewReader(e.Open())); err == nil {
+            size = fmt.Sprintf("%dx%d", h.Width, h.Height)
+        }
+        fmt.Fprintf(w, "  %-32s %10d bytes  %s\n", e.Name, e.Length, size)
+    }
+    return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readRecorder is an io.ReaderAt remembering which byte ranges were read
+type readRecorder struct {
+	r     io.ReaderAt
+	reads [][2]int64
+}
+
+func (rr *readRecorder) ReadAt(p []byte, off int64) (int, error) {
+	n, err := rr.r.ReadAt(p, off)
+	rr.reads = append(rr.reads, [2]int64{off, off + int64(n)})
+	return n, err
+}
+
+// TestContainer packs three files, lists and appends to the container,
+// and decodes one entry reading only its own bytes
+func TestContainer(t *testing.T) {
+	names := []string{"a.png", "b.png", "c.png"}
+	files := make([][]byte, len(names))
+	want := make([]*image.RGBA, len(names))
+	for i := range files {
+		var err error
+		if files[i], err = encodeGap(benchRGBA(24+8*i, 16), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if want[i], _, err = decodeGap(bytes.NewReader(files[i]), DecodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := writeContainer(&buf, nil, names[:2], files[:2]); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := readHeader(bytes.NewReader(buf.Bytes())); !errors.Is(err, errContainer) {
+		t.Fatalf("readHeader gave %v", err)
+	}
+
+	// Appending copies the old entries and adds the new one at the end
+	old, err := OpenContainer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	var appended bytes.Buffer
+	if err := writeContainer(&appended, old, names[2:], files[2:]); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := writeContainer(io.Discard, old, names[:1], files[:1]); err == nil {
+		t.Fatalf("appending a duplicate name succeeded")
+	}
+
+	rec := &readRecorder{r: bytes.NewReader(appended.Bytes())}
+	c, err := OpenContainer(rec)
+	if err != nil {
+		t.Fatalf("open appended: %v", err)
+	}
+	if len(c.Entries) != len(names) {
+		t.Fatalf("%d entries listed, want %d", len(c.Entries), len(names))
+	}
+	for i, e := range c.Entries {
+		got, err := io.ReadAll(e.Open())
+		if e.Name != names[i] || err != nil || !bytes.Equal(got, files[i]) {
+			t.Fatalf("entry %d is %q with different bytes (%v)", i, e.Name, err)
+		}
+	}
+
+	// Decoding one entry reads only the table and that entry
+	rec.reads = nil
+	e, ok := c.Entry("b.png")
+	if !ok {
+		t.Fatalf("entry b.png not found")
+	}
+	img, err := e.Decode(DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rgba, ok := img.(*image.RGBA); !ok || !bytes.Equal(rgba.Pix, want[1].Pix) {
+		t.Fatalf("entry decoded differently from the standalone file")
+	}
+	for _, r := range rec.reads {
+		if r[0] < e.Offset || r[1] > e.Offset+e.Length {
+			t.Fatalf("decoding b.png read bytes %d..%d outside %d..%d", r[0], r[1], e.Offset, e.Offset+e.Length)
+		}
+	}
+
+	truncated := appended.Bytes()[:appended.Len()-1]
+	if _, err := OpenContainer(bytes.NewReader(truncated)); err == nil {
+		t.Fatalf("truncated container opened")
+	}
+
+	// PackContainer stores .gap inputs verbatim and appends with -a
+	dir, err := os.MkdirTemp("", "gap-container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, strings.TrimSuffix(name, ".png")+".gap")
+		if err := os.WriteFile(paths[i], files[i], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundle := filepath.Join(dir, "bundle.gap")
+	if err := PackContainer(bundle, paths[:2], EncodeOptions{}, false); err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+	if err := PackContainer(bundle, paths[2:], EncodeOptions{}, true); err != nil {
+		t.Fatalf("pack -a: %v", err)
+	}
+	packed, err := os.ReadFile(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenContainer(bytes.NewReader(packed))
+	if err != nil || len(c.Entries) != 3 || c.Entries[2].Name != "c.gap" {
+		t.Fatalf("packed container: %v", err)
+	}
+}
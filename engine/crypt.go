@@ -0,0 +1,181 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/pbkdf2"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "strings"
+)
+
+// Payload encryption (FlagEncrypted): AES-256-GCM over everything after
+// the chunks, with the key derived from a passphrase. The header, plane
+// table and chunks stay readable, so info works without the passphrase,
+// and they are authenticated as additional data, so changing a dimension
+// or flag makes the decrypt fail.
+
+// ChunkCrypto holds the key derivation parameters and the GCM nonce when
+// FlagEncrypted is set (see cryptoParams)
+var ChunkCrypto = [4]byte{'C', 'R', 'Y', 'P'}
+
+var (
+    // ErrPassphraseRequired is returned for an encrypted file decoded
+    // without a passphrase
+    ErrPassphraseRequired = errors.New("file is encrypted: a passphrase is required")
+    // ErrWrongPassphrase is returned when the payload does not
+    // authenticate although its checksum is intact: the passphrase is
+    // wrong or the header was modified
+    ErrWrongPassphrase = errors.New("wrong passphrase (or the header was modified)")
+)
+
+// kdfPBKDF2SHA256 is the only key derivation defined so far
+const kdfPBKDF2SHA256 = 1
+
+// DefaultKDFIterations is the PBKDF2 iteration count new files use
+const DefaultKDFIterations = 600000
+
+// maxKDFIterations bounds the work an untrusted file can ask for
+const maxKDFIterations = 50000000
+
+// cryptoParams is the ChunkCrypto payload: u8 KDF id, u32 iterations,
+// 16-byte salt, 12-byte GCM nonce
+type cryptoParams struct {
+    KDF        uint8
+    Iterations uint32
+    Salt       [16]byte
+    Nonce      [12]byte
+}
+
+// newCryptoParams picks a fresh salt and nonce (0 iterations = DefaultKDFIterations)
+func newCryptoParams(iterations int) (*cryptoParams, error) {
+    if iterations == 0 { iterations = DefaultKDFIterations }
+    p := &cryptoParams{KDF: kdfPBKDF2SHA256, Iterations: uint32(iterations)}
+    if _, err := rand.Read(p.Salt[:]); err != nil { return nil, err }
+    if _, err := rand.Read(p.Nonce[:]); err != nil { return nil, err }
+    return p, nil
+}
+
+func (p *cryptoParams) marshal() []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.LittleEndian, p)
+    return buf.Bytes()
+}
+
+func parseCryptoParams(data []byte) (*cryptoParams, error) {
+    p := &cryptoParams{}
+    if len(data) != binary.Size(p) {
+        return nil, fmt.Errorf("encryption parameters are %d bytes, want %d", len(data), binary.Size(p))
+    }
+    binary.Read(bytes.NewReader(data), binary.LittleEndian, p)
+    if p.KDF != kdfPBKDF2SHA256 {
+        return nil, fmt.Errorf("unsupported key derivation %d", p.KDF)
+    }
+    if p.Iterations == 0 || p.Iterations > maxKDFIterations {
+        return nil, fmt.Errorf("invalid key derivation iteration count %d", p.Iterations)
+    }
+    return p, nil
+}
+
+// aead derives the AES-256 key from passphrase
+func (p *cryptoParams) aead(passphrase string) (cipher.AEAD, error) {
+    key, err := pbkdf2.Key(sha256.New, passphrase, p.Salt[:], int(p.Iterations), 32)
+    if err != nil { return nil, fmt.Errorf("failed to derive key: %v", err) }
+    block, err := aes.NewCipher(key)
+    if err != nil { return nil, err }
+    return cipher.NewGCM(block)
+}
+
+// encryptPayload seals file[payloadStart:] in place of the plaintext,
+// with everything before it as additional data
+func encryptPayload(file []byte, payloadStart int, p *cryptoParams, passphrase string) ([]byte, error) {
+    gcm, err := p.aead(passphrase)
+    if err != nil { return nil, err }
+    header := file[:payloadStart:payloadStart]
+    return gcm.Seal(header, p.Nonce[:], file[payloadStart:], header), nil
+}
+
+// headerBytes serializes a parsed header back to its bytes in the file,
+// the additional data of an encrypted payload
+func headerBytes(h *gapFileHeader) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := binary.Write(&buf, binary.LittleEndian, &h.GapHeader); err != nil { return nil, err }
+    if err := binary.Write(&buf, binary.LittleEndian, h.Planes); err != nil { return nil, err }
+    if h.Flags&FlagChunks != 0 {
+        if err := writeChunks(&buf, h.Chunks); err != nil { return nil, err }
+    }
+    return buf.Bytes(), nil
+}
+
+// decryptPayload reads the sealed payload from r and opens it, asking
+// opts.PassphraseFunc when opts.Passphrase is empty
+func decryptPayload(r io.Reader, header *gapFileHeader, opts DecodeOptions) (io.Reader, error) {
+    p, err := parseCryptoParams(findChunk(header.Chunks, ChunkCrypto))
+    if err != nil { return nil, err }
+    passphrase := opts.Passphrase
+    if passphrase == "" && opts.PassphraseFunc != nil {
+        if passphrase, err = opts.PassphraseFunc(); err != nil { return nil, err }
+    }
+    if passphrase == "" { return nil, ErrPassphraseRequired }
+    sealed, err := io.ReadAll(r)
+    if err != nil { return nil, fmt.Errorf("failed to read payload: %v", err) }
+    aad, err := headerBytes(header)
+    if err != nil { return nil, err }
+    gcm, err := p.aead(passphrase)
+    if err != nil { return nil, err }
+    payload, err := gcm.Open(nil, p.Nonce[:], sealed, aad)
+    if err != nil { return nil, ErrWrongPassphrase }
+    return bytes.NewReader(payload), nil
+}
+
+// passphraseEnv supplies the passphrase when no -passphrase flag is given
+const passphraseEnv = "GAP_PASSPHRASE"
+
+// resolvePassphrase returns the -passphrase value, else $GAP_PASSPHRASE,
+// else asks on the terminal (twice with confirm, for encoding)
+func resolvePassphrase(flagValue string, confirm bool) (string, error) {
+    if flagValue != "" { return flagValue, nil }
+    if env := os.Getenv(passphraseEnv); env != "" { return env, nil }
+    passphrase, err := promptPassphrase("Passphrase: ")
+    if err != nil { return "", err }
+    if passphrase == "" { return "", fmt.Errorf("empty passphrase") }
+    if confirm {
+        again, err := promptPassphrase("Repeat passphrase: ")
+        if err != nil { return "", err }
+        if again != passphrase { return "", fmt.Errorf("passphrases do not match") }
+    }
+    return passphrase, nil
+}
+
+// promptPassphrase reads a line from the controlling terminal with echo
+// turned off through stty where available
+func promptPassphrase(prompt string) (string, error) {
+    tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+    if err != nil {
+        return "", fmt.Errorf("no terminal to ask for the passphrase; use -passphrase or %s", passphraseEnv)
+    }
+    defer tty.Close()
+    stty := func(arg string) error {
+        cmd := exec.Command("stty", arg)
+        cmd.Stdin = tty
+        return cmd.Run()
+    }
+    if stty("-echo") == nil {
+        defer stty("echo")
+    }
+    fmt.Fprint(tty, prompt)
+    line, err := bufio.NewReader(tty).ReadString('\n')
+    fmt.Fprintln(tty)
+    if err != nil && line == "" {
+        return "", fmt.Errorf("failed to read passphrase: %v", err)
+    }
+    return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestEncryption seals a file and expects it back only with the right
+// passphrase: a wrong one and a modified header give ErrWrongPassphrase, a
+// flipped payload byte ErrChecksumMismatch, no passphrase
+// ErrPassphraseRequired. The header stays readable throughout.
+func TestEncryption(t *testing.T) {
+	src := benchRGBA(40, 24)
+	for _, lossless := range []bool{false, true} {
+		opts := EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: lossless, StreamChecksums: true}
+		plain, want := roundTrip(t, src, opts)
+		opts.Passphrase, opts.kdfIterations = "correct horse", 1000
+		data, err := encodeGap(src, nil, opts, nil)
+		if err != nil {
+			t.Fatalf("lossless=%v: %v", lossless, err)
+		}
+		header, err := readHeader(bytes.NewReader(data))
+		if err != nil || header.Width != 40 || header.Flags&FlagEncrypted == 0 {
+			t.Fatalf("header not readable in the clear: %v", err)
+		}
+		got, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Passphrase: "correct horse"})
+		if err != nil {
+			t.Fatalf("lossless=%v: decode: %v", lossless, err)
+		}
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Fatalf("lossless=%v: decrypted file decoded differently", lossless)
+		}
+		if bytes.Contains(data, plain[len(plain)-64:len(plain)-checksumSize]) {
+			t.Fatalf("plaintext payload visible in the file")
+		}
+
+		asked := 0
+		ask := func() (string, error) { asked++; return "correct horse", nil }
+		if _, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{PassphraseFunc: ask}); err != nil || asked != 1 {
+			t.Fatalf("prompted decode: %v (asked %d times)", err, asked)
+		}
+		if _, _, err := decodeGap(bytes.NewReader(plain), DecodeOptions{PassphraseFunc: ask}); err != nil || asked != 1 {
+			t.Fatalf("asked for the passphrase of a plain file")
+		}
+		if _, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{}); !errors.Is(err, ErrPassphraseRequired) {
+			t.Fatalf("no passphrase gave %v", err)
+		}
+		if _, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Passphrase: "battery staple"}); !errors.Is(err, ErrWrongPassphrase) {
+			t.Fatalf("wrong passphrase gave %v", err)
+		}
+		corrupt := append([]byte(nil), data...)
+		corrupt[len(corrupt)-40] ^= 1
+		if _, _, err := decodeGap(bytes.NewReader(corrupt), DecodeOptions{Passphrase: "correct horse"}); !errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrWrongPassphrase) {
+			t.Fatalf("corrupt payload gave %v", err)
+		}
+		// The header is additional data: a changed threshold fails to open
+		tampered := append([]byte(nil), data...)
+		tampered[16] ^= 1
+		if _, _, err := decodeGap(bytes.NewReader(tampered), DecodeOptions{Passphrase: "correct horse"}); !errors.Is(err, ErrWrongPassphrase) {
+			t.Fatalf("modified header gave %v", err)
+		}
+		report, err := checkStreams(bytes.NewReader(data), "correct horse")
+		if err != nil || report.corrupt() {
+			t.Fatalf("check: %v %+v", err, report)
+		}
+	}
+}
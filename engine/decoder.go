@@ -4,25 +4,357 @@ import (
     "bufio"
     "compress/gzip"
     "encoding/binary"
+    "errors"
     "fmt"
     "image"
-    "image/color"
     "image/png"
     "io"
     "math"
     "os"
-    "runtime"
+    "strings"
     "sync"
+    "sync/atomic"
     "time"
 )
 
+// coeffPool holds the 128-float coefficient buffers of the sequential
+// interleaved decoder. It is shared by every decode in the process, so
+// getCoeffs zeroes what it hands out rather than trusting the last user.
 var coeffPool = sync.Pool{
 	New: func() any {
 		return make([]float32, 128)
 	},
 }
 
-func DecodeImage(inputPath, outputPath string) error {
+// getCoeffs returns a zeroed 128-float buffer from coeffPool
+func getCoeffs() []float32 {
+    coeffs := coeffPool.Get().([]float32)
+    clear(coeffs)
+    return coeffs
+}
+
+// putCoeffs returns a buffer to coeffPool; the caller must not use it after
+func putCoeffs(coeffs []float32) {
+    if len(coeffs) != 128 { return }
+    coeffPool.Put(coeffs)
+}
+
+// DecodeOptions controls optional decode behavior
+type DecodeOptions struct {
+    StripMetadata bool // Drop stored EXIF instead of embedding it in the PNG
+
+    Format      OutputFormat // Image format written (FormatAuto = from the output file's extension, else PNG)
+    JPEGQuality int          // FormatJPEG quality, 1..100 (0 = DefaultJPEGQuality)
+
+    // Post-processing filters; the zero value runs the full chain
+    SkipDeblock        bool
+    SkipAntialias      bool
+    Deblock            *DeblockParams    // Deblocking strength; nil = DeblockNormal, or DeblockStrong for files coded with a high threshold
+    SkipLineContinuity bool
+    SeamFilter         *SeamFilterParams // Line continuity strength; nil = SeamFilterStrong
+    SkipDespeckle      bool              // Keep the antialiasing but not its impulse-noise despeckle
+    ImpulseThreshold   int               // Despeckle pixels differing from all 8 neighbors by at least this (0 = DefaultImpulseThreshold)
+
+    NoAutoRotate bool // Keep stored pixel orientation instead of applying EXIF Orientation
+    NoGrain      bool // Skip film grain synthesis even if the file requests it
+    Dither       bool // Dither reconstructed 8-bit samples instead of truncating them (not lossless files)
+
+    ChromaUpsample ChromaUpsample // Interpolation of subsampled chroma (default bilinear; not lossless files)
+
+    Crop  image.Rectangle // Decode only this region of the output image, after orientation (zero = all)
+    Scale int             // Decode at 1/Scale of the size: 1, 2 or 4 (0 = 1); always 8-bit, without the lossless residual
+    Gray  bool            // Decode only luma into an 8-bit *image.Gray (see DecodeGray)
+
+    Stats *DecodeStats // If non-nil, stage timings are added to it
+
+    EightBit bool // Write an 8-bit PNG for FlagHighDepth files instead of a 16-bit one
+    NoVerify bool // Skip the FlagChecksum CRC check
+
+    // BestEffort decodes what a truncated or damaged file still holds:
+    // each plane is reconstructed up to its first lost patch, the rest
+    // keeps a neutral level, and a warning says how many patches each
+    // plane lost. Streams failing their FlagStreamCRC checksum count as
+    // lost; the whole-file checksum is skipped.
+    BestEffort bool
+    MarkLost   bool // With BestEffort, paint lost patches with a checkerboard
+
+    Passphrase     string                 // Key for FlagEncrypted files
+    PassphraseFunc func() (string, error) // Asked for the key of a FlagEncrypted file when Passphrase is empty
+
+    MaxPixels int // Refuse images with more pixels than this (0 = DefaultMaxPixels, negative = no limit)
+    MaxMemory int64 // Refuse files whose decode is estimated to allocate more bytes than this (0 = no limit); see decodeMemory
+    Transform PatchTransform // Basis the file was coded in (nil = DefaultTransform); see EncodeOptions.Transform
+    Workers   int // Most goroutines a parallel stage uses; 1 runs everything in order (0 = GAP_THREADS or one per CPU)
+    TileHeight int // Block rows of a plane reconstructed at a time (0 = about splitBandPatches patches); bounds the coefficient buffers
+
+    lossyOnly     bool // Ignore the lossless residual (used by the encoder's own verification decode)
+    interiorEdges bool // Deblock without the seams of one-pixel border blocks (lossless files)
+    fullDepth     bool // decodePlanes: reconstruct FlagHighDepth planes at 16 bits (decodeGap16)
+    dcOnly        bool // decodePlanes: one pixel per patch from its DC term (thumbnails; not with CfL)
+    region        image.Rectangle // decodePlanes: reconstruct only the blocks overlapping this, in stored luma pixels (empty = all)
+    lumaOnly      bool            // decodePlanes: reconstruct plane 0 only; the other planes come back nil
+    planesOnly    bool            // decodePlanes: the planes are the result, no image is built from them (DecodePlanes)
+}
+
+// gapFileHeader is everything that precedes the plane data
+type gapFileHeader struct {
+    GapHeader
+    Planes []PlaneParams // One entry per channel
+    Chunks []GapChunk
+    Frames []uint64 // Absolute frame offsets when FlagFrames is set
+    Chroma ChromaMode // Reduction of subsampled chroma (from ChunkChroma with FlagChromaMode, else 4:2:0)
+}
+
+// maxChannels bounds the per-plane table read from untrusted input
+const maxChannels = 4
+
+// Header validation failures; each *HeaderError wraps one of these
+var (
+    ErrInvalidDimensions  = errors.New("invalid image dimensions")
+    ErrTooManyPixels      = errors.New("image is over the pixel limit")
+    ErrInvalidChannels    = errors.New("invalid channel count")
+    ErrUnsupportedFlags   = errors.New("unsupported flags")
+    ErrInvalidSubsampling = errors.New("inconsistent chroma subsampling")
+    ErrOverMemory         = errors.New("decode is over the memory limit")
+)
+
+// HeaderError is a header rejected before anything is allocated for the
+// image it describes
+type HeaderError struct {
+    Err    error  // ErrInvalidDimensions, ErrTooManyPixels, ...
+    Detail string
+}
+
+func (e *HeaderError) Error() string { return fmt.Sprintf("%v: %s", e.Err, e.Detail) }
+
+func (e *HeaderError) Unwrap() error { return e.Err }
+
+// validateHeader checks the fields the decoder sizes its buffers from:
+// both dimensions non-zero, 1..maxChannels planes, and subsampled chroma
+// that is at least a pixel in each direction.
+func validateHeader(h *GapHeader) error {
+    if h.Width == 0 || h.Height == 0 {
+        return &HeaderError{ErrInvalidDimensions, fmt.Sprintf("%dx%d", h.Width, h.Height)}
+    }
+    if h.Channels == 0 || h.Channels > maxChannels {
+        return &HeaderError{ErrInvalidChannels, fmt.Sprintf("%d (want 1..%d)", h.Channels, maxChannels)}
+    }
+    if h.Flags&FlagFrames != 0 {
+        return nil // frames carry their own headers
+    }
+    if h.Flags&FlagChromaCeil != 0 && h.Flags&FlagSubsampled == 0 {
+        return &HeaderError{ErrInvalidSubsampling, "rounded chroma size without subsampling"}
+    }
+    if h.Flags&FlagSubsampled != 0 {
+        if h.Channels < 3 || matrixFromFlags(h.Flags) == MatrixIdentity {
+            return &HeaderError{ErrInvalidSubsampling, fmt.Sprintf("%d %s planes cannot be subsampled", h.Channels, matrixFromFlags(h.Flags))}
+        }
+        if cw, ch := chromaPlaneSize(int(h.Width), int(h.Height), h.Flags); cw == 0 || ch == 0 {
+            return &HeaderError{ErrInvalidSubsampling, fmt.Sprintf("%dx%d image has %dx%d chroma", h.Width, h.Height, cw, ch)}
+        }
+    }
+    return nil
+}
+
+// checkPixelLimit rejects images over maxPixels (0 = DefaultMaxPixels,
+// negative = no limit) before their planes are allocated
+func checkPixelLimit(h *GapHeader, maxPixels int) error {
+    if maxPixels == 0 { maxPixels = DefaultMaxPixels }
+    if maxPixels > 0 && uint64(h.Width)*uint64(h.Height) > uint64(maxPixels) {
+        return &HeaderError{ErrTooManyPixels, fmt.Sprintf("%dx%d is over %d pixels (see -max-pixels)", h.Width, h.Height, maxPixels)}
+    }
+    return nil
+}
+
+// decodeMemory estimates the most bytes a decode of h with opts holds at
+// once: the reconstructed planes, each plane's band of coefficients (all
+// planes decode at the same time), and the image built from them with
+// its upsampled chroma, filter copies and lossless residual. Scale is
+// taken into account, Crop is not. The compressed streams are left out,
+// as their size is only known once they are read.
+func decodeMemory(h *gapFileHeader, opts DecodeOptions) uint64 {
+    width, height := uint64(h.Width), uint64(h.Height)
+    scale := uint64(max(opts.Scale, 1))
+    deep := opts.fullDepth && h.Flags&FlagHighDepth != 0
+    sample := uint64(1)
+    if deep { sample = 2 }
+    channels := len(h.Planes)
+    if opts.lumaOnly { channels = 1 }
+
+    var total uint64
+    for i := 0; i < channels; i++ {
+        w, ht := h.planeSize(i)
+        s := uint64(planeScale(opts.Scale, h.Flags, i))
+        if h.Flags&FlagCfL != 0 { s = 1 } // Reduced after CfL
+        total += (uint64(w) + s - 1) / s * ((uint64(ht) + s - 1) / s) * sample
+
+        // decodeSplitPatches' coefficient, pixel and angle buffers
+        blocksW, blocksH := (w+7)/8, (ht+7)/8
+        bandRows := opts.TileHeight
+        if bandRows <= 0 { bandRows = max(splitBandPatches/blocksW, 1) }
+        total += uint64(min(bandRows, blocksH)*blocksW) * (128 + 64 + 1) * 4
+    }
+
+    pixels := ((width + scale - 1) / scale) * ((height + scale - 1) / scale)
+    switch {
+    case opts.planesOnly:
+    case opts.lumaOnly:
+        if opts.Dither { total += pixels }
+    case deep:
+        // RGBA64 output and the two 8-bit copies the filters run on
+        total += pixels * 16
+        if h.Flags&FlagSubsampled != 0 { total += pixels * 2 * 2 }
+    default:
+        total += pixels * 4
+        if opts.Dither { total += pixels * 4 }
+        if h.Flags&FlagSubsampled != 0 && scale == 1 { total += pixels * 2 }
+        if h.Flags&FlagLossless != 0 && !opts.lossyOnly { total += pixels * 3 }
+    }
+    return total
+}
+
+// checkMemoryLimit rejects decodes estimated to need more than
+// opts.MaxMemory bytes (0 = no limit) before their planes are allocated
+func checkMemoryLimit(h *gapFileHeader, opts DecodeOptions) error {
+    if opts.MaxMemory <= 0 {
+        return nil
+    }
+    if need := decodeMemory(h, opts); need > uint64(opts.MaxMemory) {
+        return &HeaderError{ErrOverMemory, fmt.Sprintf("%dx%d needs about %d bytes, over %d (see -max-memory)", h.Width, h.Height, need, opts.MaxMemory)}
+    }
+    return nil
+}
+
+// validateFlags rejects unknown flag bits and combinations the decoder
+// would otherwise silently misread, e.g. a future format's bits.
+func validateFlags(flags uint32) error {
+    unsupported := func() error { return &HeaderError{ErrUnsupportedFlags, fmt.Sprintf("0x%x", flags)} }
+    if flags&^knownFlags != 0 {
+        return unsupported()
+    }
+    if flags&FlagGzip != 0 && flags&FlagRangeCoded != 0 {
+        return unsupported() // one entropy coder per file
+    }
+    if matrixFromFlags(flags) > MatrixIdentity {
+        return unsupported()
+    }
+    if flags&FlagFrames != 0 && flags&^(FlagFrames|FlagMatrixMask) != 0 {
+        return unsupported() // a sequence header only describes its frames
+    }
+    // These features are only written into range-coded split streams
+    rangeOnly := uint32(FlagLossless | FlagCfL)
+    if flags&rangeOnly != 0 && flags&FlagRangeCoded == 0 {
+        return unsupported()
+    }
+    if flags&FlagCfL != 0 && (flags&FlagSubsampled == 0 || matrixFromFlags(flags) == MatrixIdentity) {
+        return unsupported()
+    }
+    // Other chroma modes only reduce subsampled 8-bit planes, and CfL
+    // predicts from 4:2:0 luma
+    if flags&FlagChromaMode != 0 && (flags&FlagSubsampled == 0 || flags&(FlagCfL|FlagHighDepth) != 0) {
+        return unsupported()
+    }
+    if depth := (flags & FlagDepthMask) >> flagDepthShift; depth == 1 || depth > 16 {
+        return unsupported()
+    }
+    if flags&(FlagRawStreams|FlagStoredBlocks|FlagStreamCRC) != 0 && flags&FlagRangeCoded == 0 {
+        return unsupported() // only split streams can be stored raw
+    }
+    if flags&FlagHighDepth != 0 && flags&(FlagLossless|FlagCfL|FlagGrain) != 0 {
+        return unsupported() // these work on 8-bit planes
+    }
+    if flags&(FlagHalfMaxVal|FlagCompand) != 0 && flags&FlagQuantized == 0 {
+        return unsupported() // unquantized files carry no maxVals
+    }
+    // Chunk-backed features need the chunk table
+    if flags&(FlagQTable|FlagGrain|FlagEncrypted|FlagChromaMode) != 0 && flags&FlagChunks == 0 {
+        return unsupported()
+    }
+    return nil
+}
+
+// v1Flags are the features a released v1 file may set. v2 is the open,
+// unreleased format: it accepts every flag this decoder knows, and bits
+// added from now on still land in v2 until it is frozen. Freezing it means
+// recording its set here the same way, as v2Flags, before bumping
+// FormatVersion.
+const v1Flags = FlagGzip | FlagQuantized | FlagSubsampled | FlagRangeCoded | FlagChunks | FlagMatrixMask
+
+// versionFlags returns the flag bits a file of the given version may set
+func versionFlags(version uint8) uint32 {
+    if version == 0x01 { return v1Flags }
+    return knownFlags
+}
+
+// readHeader reads the fixed header, the per-plane parameter table (v2+)
+// and, if present, the metadata chunk table.
+func readHeader(r io.Reader) (*gapFileHeader, error) {
+    h := &gapFileHeader{}
+    if err := binary.Read(r, binary.LittleEndian, &h.GapHeader); err != nil {
+        return nil, fmt.Errorf("failed to read header: %v", err)
+    }
+
+    if h.Magic == containerMagic {
+        return nil, errContainer
+    }
+    if string(h.Magic[:3]) != "GAP" {
+        return nil, fmt.Errorf("invalid magic bytes")
+    }
+    version := h.Magic[3]
+    if version == 0 {
+        return nil, fmt.Errorf("invalid format version 0")
+    }
+    if version > FormatVersion {
+        return nil, fmt.Errorf("file is format version %d but this decoder reads up to version %d; decode it with a newer gap", version, FormatVersion)
+    }
+
+    if err := validateFlags(h.Flags); err != nil {
+        return nil, err
+    }
+    if extra := h.Flags &^ versionFlags(version); extra != 0 {
+        return nil, &HeaderError{ErrUnsupportedFlags, fmt.Sprintf("0x%x are not defined in format version %d", extra, version)}
+    }
+    // The earliest v1 encoders left Channels at 0 for one plane
+    if version == 0x01 && h.Channels == 0 { h.Channels = 1 }
+    if err := validateHeader(&h.GapHeader); err != nil {
+        return nil, err
+    }
+
+    h.Planes = make([]PlaneParams, h.Channels)
+    switch version {
+    case 0x01:
+        // Legacy files decode every plane with the header (luma) parameters
+        for i := range h.Planes {
+            h.Planes[i] = PlaneParams{S: h.S, Threshold: h.Threshold}
+        }
+    case 0x02:
+        if err := binary.Read(r, binary.LittleEndian, h.Planes); err != nil {
+            return nil, fmt.Errorf("failed to read plane parameters: %v", err)
+        }
+    }
+
+    if h.Flags&FlagChunks != 0 {
+        var err error
+        h.Chunks, err = readChunks(r)
+        if err != nil { return nil, err }
+    }
+    if h.Flags&FlagChromaMode != 0 {
+        var err error
+        if h.Chroma, err = decodeChromaMode(findChunk(h.Chunks, ChunkChroma)); err != nil {
+            return nil, &HeaderError{ErrInvalidSubsampling, err.Error()}
+        }
+    }
+    if h.Flags&FlagFrames != 0 {
+        var err error
+        h.Frames, err = readFrameIndex(r)
+        if err != nil { return nil, err }
+    }
+    return h, nil
+}
+
+// DecodeImage decodes the .gap file at inputPath into an image file, PNG
+// unless opts.Format or the extension of outputPath says otherwise
+func DecodeImage(inputPath, outputPath string, opts DecodeOptions) error {
     // 1. Open Input
     file, err := os.Open(inputPath)
     if err != nil {
@@ -30,236 +362,996 @@ func DecodeImage(inputPath, outputPath string) error {
     }
     defer file.Close()
 
-    // 2. Read Header
-    var header GapHeader
-    if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
-        return fmt.Errorf("failed to read header: %v", err)
+    logInfof("Decoding %s -> %s", inputPath, outputPath)
+    defer opts.Stats.total(time.Now())
+    if opts.Format.forPath(outputPath) == FormatY4M {
+        planes, err := DecodePlanes(file, opts)
+        if err != nil {
+            return err
+        }
+        return writeFileAtomic(outputPath, planes.WriteY4M)
+    }
+    
+    // Decode fully before creating the output so a corrupt file leaves no partial image
+    finalImg, chunks, err := decodeImageTo(file, opts)
+    if err != nil {
+        return err
+    }
+    return writeDecoded(outputPath, finalImg, chunks, opts)
+}
+
+// Decode reads a .gap stream from r and writes the decoded image to w in
+// opts.Format (PNG for FormatAuto)
+func Decode(r io.Reader, w io.Writer, opts DecodeOptions) error {
+    defer opts.Stats.total(time.Now())
+    if opts.Format == FormatY4M {
+        planes, err := DecodePlanes(r, opts)
+        if err != nil {
+            return err
+        }
+        return planes.WriteY4M(w)
+    }
+    finalImg, chunks, err := decodeImageTo(r, opts)
+    if err != nil {
+        return err
     }
+    return encodeDecoded(w, finalImg, chunks, opts)
+}
 
-    if string(header.Magic[:]) != "GAP\x01" {
-        return fmt.Errorf("invalid magic bytes")
+// DecodeImageTo decodes a .gap stream from r into memory. The result is
+// what decode would write as PNG: post-processing filters, the lossless
+// residual and the EXIF orientation are applied. Lossy single-plane files
+// come back as an *image.Gray.
+func DecodeImageTo(r io.Reader) (image.Image, error) {
+    img, _, err := decodeImageTo(r, DecodeOptions{})
+    if err != nil {
+        return nil, err
     }
+    return img, nil
+}
+
+// decodeImageTo decodes r and applies the EXIF orientation (unless
+// opts.NoAutoRotate), returning the metadata chunks with the orientation
+// tag reset to match the upright pixels.
+// FlagHighDepth files decode to 16 bits per channel unless opts.EightBit,
+// and opts.Gray decodes to an 8-bit *image.Gray. So do lossy single-plane
+// files, which never need RGB: their plane is filtered as it is and
+// written as an 8-bit grayscale PNG.
+func decodeImageTo(r io.Reader, opts DecodeOptions) (image.Image, []GapChunk, error) {
+    br := bufio.NewReaderSize(r, 1024*1024)
+    var img image.Image
+    var header *gapFileHeader
+    var err error
+    if opts.Gray {
+        img, header, err = decodeGray(br, opts)
+    } else if !opts.EightBit && opts.Scale <= 1 && peekHighDepth(br) {
+        img, header, err = decodeGap16(br, opts)
+    } else if peekGrayFile(br) {
+        img, header, err = decodeGray(br, opts)
+    } else {
+        img, header, err = decodeGap(br, opts)
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+    img, chunks := orientUpright(img, header.Chunks, opts)
+    return img, chunks, nil
+}
+
+// orientUpright applies the EXIF orientation stored in chunks to img
+// (unless opts.NoAutoRotate) and resets the tag, so viewers don't rotate
+// the output a second time
+func orientUpright(img image.Image, chunks []GapChunk, opts DecodeOptions) (image.Image, []GapChunk) {
+    exif := findChunk(chunks, ChunkExif)
+    orientation, _ := exifOrientation(exif)
+    if orientation == 1 || opts.NoAutoRotate { return img, chunks }
+    img = orientImage(img, orientation)
+    chunks = append([]GapChunk(nil), chunks...)
+    for i := range chunks {
+        if chunks[i].Tag == ChunkExif { chunks[i].Data = exifWithOrientation(exif, 1) }
+    }
+    return img, chunks
+}
+
+// encodeDecodedPNG writes an upright decoded image (see orientUpright) as
+// PNG, embedding the ICC profile and EXIF chunks. 16-bit images are
+// written as 16-bit PNGs.
+func encodeDecodedPNG(w io.Writer, finalImg image.Image, chunks []GapChunk, opts DecodeOptions) error {
+    // Write Output with buffered writer
+    start := time.Now()
+    bufWriter := bufio.NewWriterSize(w, 1024*1024)
+    var pngOut io.Writer = bufWriter
+    var pngChunks []GapChunk
+    // The ICC profile describes the pixel values, so it is kept even when stripping metadata
+    if icc := findChunk(chunks, ChunkICC); icc != nil {
+        pngChunks = append(pngChunks, GapChunk{Tag: [4]byte{'i', 'C', 'C', 'P'}, Data: iccpChunk(icc)})
+    }
+    if exif := findChunk(chunks, ChunkExif); exif != nil && !opts.StripMetadata {
+        pngChunks = append(pngChunks, GapChunk{Tag: [4]byte{'e', 'X', 'I', 'f'}, Data: exif})
+    }
+    if len(pngChunks) > 0 {
+        pngOut = newPNGChunkInjector(bufWriter, pngChunks)
+    }
+    encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+    if err := encoder.Encode(pngOut, finalImg); err != nil {
+        return fmt.Errorf("failed to encode png: %v", err)
+    }
+    if err := bufWriter.Flush(); err != nil {
+        return fmt.Errorf("failed to flush output: %v", err)
+    }
+    if opts.Stats != nil {
+        opts.Stats.add(&opts.Stats.PNGEncode, start)
+    }
+    return nil
+}
+
+// decodeGap reconstructs the image stored in a .gap stream, including
+// post-processing and the lossless residual, but without applying the
+// EXIF orientation.
+func decodeGap(file io.Reader, opts DecodeOptions) (*image.RGBA, *gapFileHeader, error) {
+    stats := opts.Stats
+    if stats == nil { stats = &DecodeStats{} }
+    start := time.Now()
+    header, err := readHeader(file)
+    if err != nil {
+        return nil, nil, err
+    }
+    stats.add(&stats.HeaderRead, start)
 
     width := int(header.Width)
     height := int(header.Height)
-    channels := int(header.Channels)
-    if channels == 0 { channels = 1 }
+    channels := len(header.Planes)
+    if header.Flags&FlagFrames != 0 {
+        return nil, nil, fmt.Errorf("file holds %d frames; use decode-seq", len(header.Frames))
+    }
 
-    fmt.Printf("Decoding %s (%dx%d, %d ch) -> %s\n", inputPath, width, height, channels, outputPath)
+    logInfof("Image: %dx%d, %d ch, %s", width, height, channels, matrixFromFlags(header.Flags))
+    
+    // A reduced decode has no use for the full-size residual
+    switch opts.Scale {
+    case 0, 1:
+    case 2, 4:
+        if opts.Crop != (image.Rectangle{}) {
+            return nil, nil, fmt.Errorf("cannot crop a scaled decode")
+        }
+        if header.Chroma != Chroma420 {
+            return nil, nil, fmt.Errorf("scaled decodes need 4:2:0 chroma, not %s", header.Chroma)
+        }
+        opts.lossyOnly, opts.Dither = true, false
+    default:
+        return nil, nil, fmt.Errorf("scale must be 1, 2 or 4, got %d", opts.Scale)
+    }
+    scale := max(opts.Scale, 1)
+    
+    // The residual was computed against the default filter chain, which
+    // left a one-pixel last block's seam alone
+    isLossless := (header.Flags & FlagLossless) != 0
+    opts.interiorEdges = isLossless
+    if isLossless && !opts.lossyOnly {
+        opts.SkipDeblock, opts.SkipAntialias, opts.SkipLineContinuity = false, false, false
+        opts.SeamFilter, opts.Deblock = nil, nil
+        opts.SkipDespeckle, opts.ImpulseThreshold = false, 0
+        opts.Dither = false
+        opts.ChromaUpsample = UpsampleBilinear
+    }
+    
+    if opts.Deblock == nil { opts.Deblock = fileDeblock(header) }
+    
+    // A crop reconstructs only its blocks plus a margin, and the rest of
+    // the decode runs on that region as if it were the whole image
+    full := image.Rect(0, 0, width, height)
+    crop := full
+    if opts.Crop != (image.Rectangle{}) {
+        if crop, err = storedCrop(header, opts.Crop, opts.NoAutoRotate); err != nil {
+            return nil, nil, err
+        }
+        margin := crop
+        if header.Chroma == ChromaMono {
+            // Bicubic taps reach two 16-pixel chroma samples out
+            margin = crop.Inset(-cropMargin)
+        }
+        opts.region = cropRegion(margin).Intersect(full)
+    }
+    
+    // CfL predicts chroma from full-size luma, so those planes are
+    // reconstructed in full and reduced afterwards
+    planeOpts := opts
+    isCfL := header.Flags&FlagCfL != 0
+    if isCfL { planeOpts.Scale = 1 }
+    planes, _, residual, err := decodePlanes(file, header, planeOpts, stats)
+    if err != nil {
+        return nil, nil, err
+    }
+    isSubsampled := (header.Flags & FlagSubsampled) != 0
+    start = time.Now()
+    if scale > 1 {
+        // Chroma is reduced 2x less, so it arrives at the luma size
+        width, height = (width+scale-1)/scale, (height+scale-1)/scale
+        full, crop = image.Rect(0, 0, width, height), image.Rect(0, 0, width, height)
+        for i := range planes {
+            if s := planeScale(scale, header.Flags, i); isCfL && s > 1 {
+                planes[i] = blockMeans(planes[i], s)
+            }
+            // Chroma of files without FlagChromaCeil is a column or row short
+            planes[i] = extendPlane(planes[i], width, height)
+        }
+    }
+    region := full
+    if !opts.region.Empty() {
+        region = opts.region
+        for i := range planes {
+            r := region
+            if isSubsampled && (i == 1 || i == 2) {
+                fx, fy := header.Chroma.factors()
+                r = image.Rect(r.Min.X/fx, r.Min.Y/fy, (r.Max.X+fx-1)/fx, (r.Max.Y+fy-1)/fy).Intersect(planes[i].Bounds())
+            }
+            planes[i] = copyPlane(planes[i], r)
+        }
+        if residual != nil {
+            residual = cropResidual(residual, width, region)
+        }
+        width, height = region.Dx(), region.Dy()
+    }
+    
+    stats.add(&stats.Reconstruction, start)
+    
+    // 3. Upsample Chroma in parallel if needed
+    if isSubsampled && channels == 3 && scale == 1 {
+        start = time.Now()
+        parallelFor(2, opts.Workers, func(i int) {
+            planes[i+1] = header.Chroma.upsample(planes[i+1], width, height, opts.ChromaUpsample, opts.Workers)
+        })
+        stats.add(&stats.Upsample, start)
+    }
+
+    // 4. Merge YCbCr -> RGB IN PARALLEL
+    start = time.Now()
+    finalImg := image.NewRGBA(image.Rect(0, 0, width, height))
+    
+    if channels == 3 {
+        yPlane := planes[0]
+        cbPlane := planes[1]
+        crPlane := planes[2]
+        matrix := matrixFromFlags(header.Flags)
+        
+        // Parallel conversion - split by rows
+        numWorkers := workerCount(opts.Workers)
+        rowsPerWorker := (height + numWorkers - 1) / numWorkers
+        
+        var wg sync.WaitGroup
+        for w := 0; w < numWorkers; w++ {
+            startY := w * rowsPerWorker
+            endY := startY + rowsPerWorker
+            if endY > height { endY = height }
+            if startY >= height { continue }
+            
+            wg.Add(1)
+            go func(sy, ey int) {
+                defer wg.Done()
+                for y := sy; y < ey; y++ {
+                    planesToRGBARow(matrix, planeRow(yPlane, y)[:width], planeRow(cbPlane, y), planeRow(crPlane, y), finalImg.Pix[finalImg.PixOffset(0, y):])
+                }
+            }(startY, endY)
+        }
+        wg.Wait()
+    } else {
+        // Grayscale; decodeImageTo keeps lossy ones as an *image.Gray
+        src := planes[0]
+        grayRows(0, height, opts.Workers, func(y0, y1 int) {
+            for y := y0; y < y1; y++ {
+                dst := finalImg.Pix[finalImg.PixOffset(0, y):]
+                for x, v := range planeRow(src, y)[:width] {
+                    dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = v, v, v, 255
+                }
+            }
+        })
+    }
+    
+    stats.add(&stats.ColorMerge, start)
+    
+    if opts.Dither {
+        // The filters would smooth the grain away like noise, so as in
+        // decodeGap16 only their changes beyond one level carry over
+        filtered := image.NewRGBA(finalImg.Bounds())
+        copy(filtered.Pix, finalImg.Pix)
+        applyPostFilters(filtered, opts, stats)
+        for i, f := range filtered.Pix {
+            if d := int(f) - int(finalImg.Pix[i]); d < -1 || d > 1 {
+                finalImg.Pix[i] = f
+            }
+        }
+    } else {
+        applyPostFilters(finalImg, opts, stats)
+    }
+    
+    // 8. Film grain, seeded per patch so the output is reproducible
+    if header.Flags&FlagGrain != 0 && !opts.NoGrain && channels == 3 {
+        start = time.Now()
+        sigmas, err := decodeGrain(findChunk(header.Chunks, ChunkGrain), channels)
+        if err != nil {
+            return nil, nil, fmt.Errorf("invalid grain parameters: %v", err)
+        }
+        // Seeded by the blocks' place in the whole image
+        // Grain averaged over scale x scale pixels is that much weaker
+        for i := range sigmas { sigmas[i] /= float32(scale) }
+        applyGrain(&image.RGBA{Pix: finalImg.Pix, Stride: finalImg.Stride, Rect: region}, sigmas, matrixFromFlags(header.Flags), opts.Workers)
+        stats.add(&stats.Grain, start)
+    }
+    
+    // 9. Add back the lossless residual
+    if residual != nil {
+        start = time.Now()
+        applyResidual(finalImg, residual)
+        stats.add(&stats.Residual, start)
+    }
+    
+    return cropImage(finalImg, crop.Sub(region.Min)).(*image.RGBA), header, nil
+}
+
+// cropMargin is how far outside a crop its pixels depend on: the chroma
+// upsampling and the post-filters reach a few pixels across each seam
+const cropMargin = 16
+
+// cropRegion is the block-aligned area decoded for crop. The margin and
+// the alignment keep the block grid, the chroma sample positions and
+// every filter input inside the crop the same as in a full decode.
+func cropRegion(crop image.Rectangle) image.Rectangle {
+    r := crop.Inset(-cropMargin)
+    r.Min.X, r.Min.Y = max(r.Min.X, 0)/16*16, max(r.Min.Y, 0)/16*16
+    r.Max.X, r.Max.Y = (r.Max.X+15)/16*16, (r.Max.Y+15)/16*16
+    return r
+}
+
+// storedCrop checks crop against the image decode outputs, after the EXIF
+// orientation unless noRotate, and maps it to stored pixels
+func storedCrop(header *gapFileHeader, crop image.Rectangle, noRotate bool) (image.Rectangle, error) {
+    w, h := int(header.Width), int(header.Height)
+    o := 1
+    if !noRotate {
+        o, _ = exifOrientation(findChunk(header.Chunks, ChunkExif))
+    }
+    bounds := orientedRect(image.Rect(0, 0, w, h), o)
+    if crop.Empty() || !crop.In(bounds) {
+        return image.Rectangle{}, fmt.Errorf("crop %v is not inside the %dx%d image", crop, bounds.Dx(), bounds.Dy())
+    }
+    return unorientRect(crop, w, h, o), nil
+}
+
+// DecodeRect decodes only the part of the image inside rect, given in
+// the pixels of the upright image DecodeImageTo returns. Only the blocks
+// near rect are reconstructed, so a small window of a large file decodes
+// in a fraction of the time; the pixels match the same region of a full
+// decode. The result's bounds start at (0, 0).
+func DecodeRect(r io.Reader, rect image.Rectangle, opts DecodeOptions) (image.Image, error) {
+    if rect.Empty() {
+        return nil, fmt.Errorf("crop %v is empty", rect)
+    }
+    opts.Crop = rect
+    img, _, err := decodeImageTo(r, opts)
+    return img, err
+}
+
+// copyPlane copies the r part of p into a plane of its own
+func copyPlane(p *image.Gray, r image.Rectangle) *image.Gray {
+    dst := image.NewGray(image.Rect(0, 0, r.Dx(), r.Dy()))
+    for y := 0; y < r.Dy(); y++ {
+        copy(dst.Pix[y*dst.Stride:], p.Pix[p.PixOffset(r.Min.X, r.Min.Y+y):][:r.Dx()])
+    }
+    return dst
+}
+
+// cropResidual cuts the r part out of a lossless residual of a w pixels
+// wide image
+func cropResidual(residual []byte, w int, r image.Rectangle) []byte {
+    out := make([]byte, 0, r.Dx()*r.Dy()*3)
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        out = append(out, residual[(y*w+r.Min.X)*3:(y*w+r.Max.X)*3]...)
+    }
+    return out
+}
+
+// cropImage copies the r part of a decoded image into an image of the
+// same type with its bounds at (0, 0) (img itself when r is all of it)
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+    if r == img.Bounds() { return img }
+    var src []uint8
+    var stride, bpp int
+    var dst image.Image
+    var dstPix []uint8
+    switch m := img.(type) {
+    case *image.RGBA:
+        src, stride, bpp = m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], m.Stride, 4
+        d := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+        dst, dstPix = d, d.Pix
+    case *image.RGBA64:
+        src, stride, bpp = m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], m.Stride, 8
+        d := image.NewRGBA64(image.Rect(0, 0, r.Dx(), r.Dy()))
+        dst, dstPix = d, d.Pix
+    case *image.Gray16:
+        src, stride, bpp = m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], m.Stride, 2
+        d := image.NewGray16(image.Rect(0, 0, r.Dx(), r.Dy()))
+        dst, dstPix = d, d.Pix
+    case *image.Gray:
+        src, stride, bpp = m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], m.Stride, 1
+        d := image.NewGray(image.Rect(0, 0, r.Dx(), r.Dy()))
+        dst, dstPix = d, d.Pix
+    default:
+        return img
+    }
+    n := r.Dx() * bpp
+    for y := 0; y < r.Dy(); y++ {
+        copy(dstPix[y*n:], src[y*stride:][:n])
+    }
+    return dst
+}
+
+// applyPostFilters runs the deblocking, antialiasing and line continuity
+// filters that opts leaves enabled
+func applyPostFilters(finalImg *image.RGBA, opts DecodeOptions, stats *DecodeStats) {
+    scale := max(opts.Scale, 1) // Reduced decodes have smaller blocks
+    // 5. Apply Parallel Deblocking; its taps reach two pixels each side
+    // of a seam, more than the 2-pixel blocks of a quarter-size decode hold
+    if !opts.SkipDeblock && 8/scale >= 4 {
+        start := time.Now()
+        deblock := DeblockNormal
+        if opts.Deblock != nil { deblock = *opts.Deblock }
+        deblockImage(finalImg, deblock, !opts.interiorEdges, 8/scale, opts.Workers)
+        stats.add(&stats.Deblock, start)
+    }
+    
+    // 6. Apply Edge-Only Antialiasing for whiskers/fine-lines
+    if !opts.SkipAntialias {
+        start := time.Now()
+        impulse := opts.ImpulseThreshold
+        if impulse == 0 { impulse = DefaultImpulseThreshold }
+        if opts.SkipDespeckle { impulse = 0 }
+        applyEdgeAntialiasing(finalImg, impulse, opts.Workers)
+        stats.add(&stats.Antialias, start)
+    }
+    
+    // 7. Apply Line Continuity Filter for block-boundary whisker artifacts
+    if !opts.SkipLineContinuity {
+        start := time.Now()
+        seam := SeamFilterStrong
+        if opts.SeamFilter != nil { seam = *opts.SeamFilter }
+        applyLineContinuityFilter(finalImg, seam.scaled(scale), 8/scale, opts.Workers)
+        stats.add(&stats.LineContinuity, start)
+    }
+}
+
+// decodePlanes reads the plane streams that follow the header and
+// reconstructs each plane at its coded size (chroma not yet upsampled,
+// CfL already applied). The lossless residual is returned alongside
+// unless opts.lossyOnly is set. With opts.fullDepth, FlagHighDepth files
+// are reconstructed into the 16-bit planes instead of the 8-bit ones.
+func decodePlanes(file io.Reader, header *gapFileHeader, opts DecodeOptions, stats *DecodeStats) ([]*image.Gray, []*image.Gray16, []byte, error) {
+    if err := checkPixelLimit(&header.GapHeader, opts.MaxPixels); err != nil {
+        return nil, nil, nil, err
+    }
+    if err := checkMemoryLimit(header, opts); err != nil {
+        return nil, nil, nil, err
+    }
+    width := int(header.Width)
+    height := int(header.Height)
+    channels := len(header.Planes)
     
-    // 3. Decode Planes
     planes := make([]*image.Gray, channels)
+    decoded := channels // Planes reconstructed; the rest are read past
+    if opts.lumaOnly { decoded = 1 }
+    var planes16 []*image.Gray16
+    deep := opts.fullDepth && header.Flags&FlagHighDepth != 0 && !opts.dcOnly
+    if deep {
+        planes16 = make([]*image.Gray16, channels)
+    }
     
     // Check Flags
-    const FlagGzip = 1
-    const FlagSubsampled = 4
-    const FlagRangeCoded = 8
-    
     isGzip := (header.Flags & FlagGzip) != 0
     isSubsampled := (header.Flags & FlagSubsampled) != 0
     isRangeCoded := (header.Flags & FlagRangeCoded) != 0
+    isLossless := (header.Flags & FlagLossless) != 0
+    isCfL := (header.Flags & FlagCfL) != 0
+    if isCfL && channels != 3 {
+        return nil, nil, nil, fmt.Errorf("chroma-from-luma prediction requires three planes")
+    }
+    if isCfL && opts.dcOnly {
+        return nil, nil, nil, fmt.Errorf("DC-only decoding cannot apply chroma-from-luma prediction")
+    }
+    
+    // newPlane allocates plane i's 8-bit output, reduced for a scaled
+    // decode, and the writer that reconstructs into it
+    newPlane := func(i, pWidth, pHeight int, initVal uint8) (*image.Gray, planeWriter) {
+        if s := planeScale(opts.Scale, header.Flags, i); s > 1 {
+            plane := image.NewGray(image.Rect(0, 0, (pWidth+s-1)/s, (pHeight+s-1)/s))
+            fillPlane(plane, initVal)
+            return plane, scaledWriter{plane, s, pWidth, pHeight}
+        }
+        plane := image.NewGray(image.Rect(0, 0, pWidth, pHeight))
+        fillPlane(plane, initVal)
+        return plane, grayWriter{plane, opts.Dither}
+    }
+    
+    // The blocks a crop needs, scaled down for subsampled chroma
+    planeRegion := func(i int) image.Rectangle {
+        r := opts.region
+        if r.Empty() || !isSubsampled || (i != 1 && i != 2) { return r }
+        fx, fy := header.Chroma.factors()
+        return image.Rect(r.Min.X/fx, r.Min.Y/fy, (r.Max.X+fx-1)/fx, (r.Max.Y+fy-1)/fy)
+    }
+    
+    var residual []byte
+    
+    // Verified up front, so a corrupt file fails here rather than as a
+    // stream error or garbage pixels. With stream checksums the decode
+    // goes on far enough to name the bad stream, then fails with fileErr.
+    var fileErr error
+    if header.Flags&FlagChecksum != 0 {
+        payload, err := readPayload(file, header, !opts.NoVerify && !opts.BestEffort)
+        if errors.Is(err, ErrChecksumMismatch) && payload != nil && header.Flags&(FlagStreamCRC|FlagEncrypted) == FlagStreamCRC {
+            fileErr = err
+        } else if err != nil {
+            return nil, nil, nil, err
+        }
+        file = payload
+    }
+    // The checksum covers the sealed bytes, so a corrupt file fails above
+    // and a wrong passphrase here
+    if header.Flags&FlagEncrypted != 0 {
+        var err error
+        if file, err = decryptPayload(file, header, opts); err != nil {
+            return nil, nil, nil, err
+        }
+    }
     
-    coreStart := time.Now()
+    var qtables []QTable
+    if header.Flags&FlagQTable != 0 {
+        data := findChunk(header.Chunks, ChunkQTable)
+        if data == nil {
+            return nil, nil, nil, fmt.Errorf("quantization table flag set but table is missing")
+        }
+        var err error
+        if qtables, err = decodeQTables(data, channels); err != nil {
+            return nil, nil, nil, fmt.Errorf("invalid quantization table: %v", err)
+        }
+    }
+    
+    start := time.Now()
     if isRangeCoded {
-        fmt.Println("Detected Range Coding (Split 5-Stream).")
+        isRaw := header.Flags&FlagRawStreams != 0
+        if isRaw {
+            logInfof("Detected Stored Streams (Split 5-Stream).")
+        } else {
+            logInfof("Detected Range Coding (Split 5-Stream).")
+        }
+        // 1. Pre-read all compressed blocks sequentially for all planes.
+        // With BestEffort the first failed read ends the payload: it and
+        // every later block come back missing.
+        var truncated error
+        readBlock := func(maxLen int) (streamBlock, error) {
+            if truncated != nil { return streamBlock{missing: true}, nil }
+            block, err := readStreamBlock(file, header.Flags, maxLen)
+            if err != nil && fileErr != nil { err = fileErr }
+            if err != nil && opts.BestEffort {
+                truncated = err
+                return streamBlock{missing: true}, nil
+            }
+            if opts.NoVerify { block.hasCRC = false }
+            return block, err
+        }
         
-        // 1. Pre-read all compressed blocks sequentially for all planes
-        type streamBlock struct {
-            uLen uint32
-            cData []byte
+        type planeData struct {
+            blocks [5]streamBlock
+        }
+        allPlaneData := make([]planeData, decoded)
+        
+        // Luma comes first, so a luma-only decode stops reading after it
+        for i := 0; i < decoded; i++ {
+            patches := planePatches(header, i)
+            for s := 0; s < 5; s++ {
+                block, err := readBlock(patches * splitStreamMax[s])
+                if err != nil { return nil, nil, nil, err }
+                allPlaneData[i].blocks[s] = block
+            }
+        }
+        
+        // Chroma-from-luma alphas, one block per chroma plane
+        var alphaBlocks []streamBlock
+        if isCfL && !opts.lumaOnly {
+            alphaBlocks = make([]streamBlock, channels)
+            for i := 1; i < channels; i++ {
+                block, err := readBlock(planePatches(header, i))
+                if err != nil { return nil, nil, nil, fmt.Errorf("failed to read CfL alphas: %v", err) }
+                alphaBlocks[i] = block
+            }
+        }
+        
+        // The lossless residual (if any) follows the plane and alpha streams
+        var residualBlock streamBlock
+        if isLossless && !opts.lossyOnly && !opts.lumaOnly {
+            block, err := readBlock(width * height * 3)
+            if err != nil { return nil, nil, nil, fmt.Errorf("failed to read residual: %v", err) }
+            if !block.missing && int(block.uLen) != width*height*3 {
+                if fileErr != nil { return nil, nil, nil, fileErr }
+                return nil, nil, nil, fmt.Errorf("residual size %d does not match %dx%d image", block.uLen, width, height)
+            }
+            residualBlock = block
+        }
+        
+        stats.add(&stats.StreamRead, start)
+        start = time.Now()
+
+        // 2. Decompress every plane's 5 streams in parallel
+        streams := make([][5][]byte, decoded)
+        streamOK := make([][5]bool, decoded)
+        parallelFor(decoded*5, opts.Workers, func(i int) {
+            pIdx, sIdx := i/5, i%5
+            block := allPlaneData[pIdx].blocks[sIdx]
+            if block.uLen > 0 && !block.missing {
+                streams[pIdx][sIdx] = block.unpack()
+            } else {
+                streams[pIdx][sIdx] = []byte{}
+            }
+            streamOK[pIdx][sIdx] = block.verify(streams[pIdx][sIdx])
+        })
+        var damaged error // BestEffort: the first stream that failed its checksum
+        for i := range streamOK {
+            for s, ok := range streamOK[i] {
+                if ok { continue }
+                err := &StreamChecksumError{Plane: i, Stream: splitStreamNames[s]}
+                if !opts.BestEffort { return nil, nil, nil, err }
+                if damaged == nil { damaged = err }
+                allPlaneData[i].blocks[s].missing = true
+                streams[i][s] = []byte{}
+            }
+        }
+        var cflAlphas [][]byte
+        if alphaBlocks != nil {
+            cflAlphas = make([][]byte, channels)
+            for i := 1; i < channels; i++ {
+                if alphaBlocks[i].missing { continue }
+                cflAlphas[i] = alphaBlocks[i].unpack()
+                if !alphaBlocks[i].verify(cflAlphas[i]) {
+                    err := &StreamChecksumError{Plane: i, Stream: "Alphas"}
+                    if !opts.BestEffort { return nil, nil, nil, err }
+                    if damaged == nil { damaged = err }
+                    alphaBlocks[i].missing = true
+                }
+            }
+        }
+        if isLossless && !opts.lossyOnly && !opts.lumaOnly && !residualBlock.missing {
+            residual = residualBlock.unpack()
+            if !residualBlock.verify(residual) {
+                err := &StreamChecksumError{Plane: -1, Stream: "Residual"}
+                if !opts.BestEffort { return nil, nil, nil, err }
+                if damaged == nil { damaged = err }
+                residual = nil
+            }
+        }
+        if fileErr != nil {
+            return nil, nil, nil, fileErr
+        }
+        // Planes with a missing stream are recovered as far as their
+        // streams go, the rest decode as usual
+        recovering := make([]bool, decoded)
+        for i := range recovering {
+            for _, block := range allPlaneData[i].blocks {
+                recovering[i] = recovering[i] || block.missing
+            }
+        }
+        // Counts hold a byte per patch: a header claiming a bigger image
+        // than the streams describe fails here, before its planes are allocated
+        for i := range streams {
+            if patches := planePatches(header, i); len(streams[i][1]) != patches && !recovering[i] {
+                return nil, nil, nil, fmt.Errorf("plane %d counts stream has %d entries for %d patches", i, len(streams[i][1]), patches)
+            }
+        }
+        stats.add(&stats.StreamDecompress, start)
+        start = time.Now()
+        
+        // 3. Decode all planes in parallel
+        planeErrs := make([]error, decoded)
+        parseErrs := make([]error, decoded) // BestEffort: why a complete plane was recovered
+        recovered := make([]int, decoded) // Patches of recovering planes that decoded
+        parallelFor(decoded, opts.Workers, func(pIdx int) {
+            pWidth, pHeight := header.planeSize(pIdx)
+            initVal := planeFill(pIdx, opts)
+            
+            streams := streams[pIdx]
+            if opts.dcOnly {
+                parser := newPatchParser(&sliceStream{buf: streams[0]}, &sliceStream{buf: streams[1]}, &sliceStream{buf: streams[2]}, &sliceStream{buf: streams[3]}, &sliceStream{buf: streams[4]}, (pWidth+7)/8, header.Flags, planeQTable(qtables, pIdx))
+                planes[pIdx], planeErrs[pIdx] = gapDecodePlaneDC(parser, pWidth, pHeight)
+                return
+            }
+            var dst planeWriter
+            if deep {
+                planes16[pIdx] = newGray16Plane(pWidth, pHeight, initVal)
+                dst = gray16Writer{planes16[pIdx]}
+            } else {
+                planes[pIdx], dst = newPlane(pIdx, pWidth, pHeight, initVal)
+            }
+            salvage := func() {
+                recovered[pIdx] = recoverPatches(streams, dst, pWidth, pHeight, header.Flags, header.Planes[pIdx].S, planeQTable(qtables, pIdx), opts.Transform)
+                if opts.MarkLost { markLost(dst, pWidth, pHeight, recovered[pIdx]) }
+            }
+            if recovering[pIdx] {
+                salvage()
+                return
+            }
+            planeErrs[pIdx] = decodeSplitPatches(streams[0], streams[1], streams[2], streams[3], streams[4], dst, pWidth, pHeight, header.Flags, header.Planes[pIdx].S, planeQTable(qtables, pIdx), opts.Transform, planeRegion(pIdx), opts.TileHeight, opts.Workers)
+            if planeErrs[pIdx] != nil && opts.BestEffort {
+                // Damage the checksums missed shows as a patch that will
+                // not parse; start over and keep the patches before it
+                parseErrs[pIdx], planeErrs[pIdx] = planeErrs[pIdx], nil
+                if deep {
+                    planes16[pIdx] = newGray16Plane(pWidth, pHeight, initVal)
+                    dst = gray16Writer{planes16[pIdx]}
+                } else {
+                    planes[pIdx], dst = newPlane(pIdx, pWidth, pHeight, initVal)
+                }
+                recovering[pIdx] = true
+                salvage()
+            }
+        })
+        for i, err := range planeErrs {
+            if err != nil { return nil, nil, nil, fmt.Errorf("failed to decode plane %d: %w", i, err) }
         }
-        type planeData struct {
-            blocks [5]streamBlock
+        for _, err := range parseErrs {
+            if damaged == nil && err != nil { damaged = err }
         }
-        allPlaneData := make([]planeData, channels)
-        
-        for i := 0; i < channels; i++ {
-            for s := 0; s < 5; s++ {
-                var uLen, cLen uint32
-                if err := binary.Read(file, binary.LittleEndian, &uLen); err != nil { return err }
-                if err := binary.Read(file, binary.LittleEndian, &cLen); err != nil { return err }
-                cData := make([]byte, cLen)
-                if _, err := io.ReadFull(file, cData); err != nil { return err }
-                allPlaneData[i].blocks[s] = streamBlock{uLen, cData}
+        if truncated != nil || damaged != nil {
+            kept := make([]int, decoded)
+            for i := range kept {
+                kept[i] = planePatches(header, i)
+                if recovering[i] { kept[i] = recovered[i] }
             }
+            warnLost(header, truncated, damaged, kept)
         }
         
-        // 2. Decode all planes in parallel
-        var pwg sync.WaitGroup
-        for i := 0; i < channels; i++ {
-            pwg.Add(1)
-            go func(pIdx int) {
-                defer pwg.Done()
-                
-                pWidth, pHeight := width, height
-                if isSubsampled && (pIdx == 1 || pIdx == 2) {
-                    pWidth /= 2
-                    pHeight /= 2
-                }
-                initVal := uint8(0)
-                if pIdx > 0 { initVal = 128 }
-                
-                // Decompress 5 streams in parallel
-                streams := make([][]byte, 5)
-                var dwg sync.WaitGroup
-                for s := 0; s < 5; s++ {
-                    dwg.Add(1)
-                    go func(sIdx int) {
-                        defer dwg.Done()
-                        block := allPlaneData[pIdx].blocks[sIdx]
-                        if block.uLen > 0 {
-                            streams[sIdx] = GapDecompressData(block.cData, int(block.uLen))
-                        } else {
-                            streams[sIdx] = []byte{}
-                        }
-                    }(s)
-                }
-                dwg.Wait()
-                
-                plane, err := gapDecodePlaneSplit(streams[0], streams[1], streams[2], streams[3], streams[4], pWidth, pHeight, header.Flags, initVal, header.S)
-                if err == nil {
-                    planes[pIdx] = plane
+        // Chroma planes decoded as residuals: luma is complete now, add its prediction
+        if alphaBlocks != nil {
+            // Files without FlagChromaCeil have chroma a column or row short
+            lumaDown := downsamplePlane(planes[0], opts.Workers)
+            lumaDown = lumaDown.SubImage(planes[1].Bounds()).(*image.Gray)
+            for i := 1; i < channels; i++ {
+                if alphaBlocks[i].missing { continue } // The residual is all a truncated file has
+                if err := applyCfL(planes[i], lumaDown, cflAlphas[i]); err != nil {
+                    return nil, nil, nil, fmt.Errorf("failed to apply CfL to plane %d: %v", i, err)
                 }
-            }(i)
+            }
         }
-        pwg.Wait()
     } else {
         // Legacy: Gzip or Raw Stream (Keep sequential for now as it's a single stream)
         var reader io.Reader
+        var truncated error // BestEffort: the error that ended the stream
         if isGzip {
-            fmt.Println("Detected Gzip Compression.")
+            logInfof("Detected Gzip Compression.")
             gr, err := gzip.NewReader(file)
-            if err != nil { return fmt.Errorf("failed to create gzip reader: %v", err) }
-            defer gr.Close()
-            reader = bufio.NewReaderSize(gr, 1024*1024)
+            if err != nil && opts.BestEffort {
+                truncated = err
+            } else if err != nil {
+                return nil, nil, nil, fmt.Errorf("failed to create gzip reader: %v", err)
+            } else {
+                defer gr.Close()
+                reader = bufio.NewReaderSize(gr, 1024*1024)
+            }
         } else {
             reader = bufio.NewReaderSize(file, 1024*1024)
         }
         
-        for i := 0; i < channels; i++ {
-            pWidth, pHeight := width, height
-            if isSubsampled && (i == 1 || i == 2) {
-                pWidth /= 2
-                pHeight /= 2
+        kept := make([]int, decoded)
+        for i := 0; i < decoded; i++ {
+            pWidth, pHeight := header.planeSize(i)
+            initVal := planeFill(i, opts)
+            var plane *image.Gray
+            var err error
+            n := 0
+            if opts.dcOnly {
+                plane, err = gapDecodePlaneDC(newInterleavedParser(reader, (pWidth+7)/8, header.Flags, planeQTable(qtables, i)), pWidth, pHeight)
+            } else {
+                var dst planeWriter
+                if deep {
+                    planes16[i] = newGray16Plane(pWidth, pHeight, initVal)
+                    dst = gray16Writer{planes16[i]}
+                } else {
+                    plane, dst = newPlane(i, pWidth, pHeight, initVal)
+                }
+                // Planes after a truncation keep their fill level
+                if truncated == nil {
+                    n, err = decodeInterleavedPatches(reader, dst, pWidth, pHeight, header.Flags, header.Planes[i].S, planeQTable(qtables, i), opts.Transform, planeRegion(i))
+                }
+                if err != nil && opts.BestEffort {
+                    truncated, err = err, nil
+                }
+                if opts.MarkLost && truncated != nil { markLost(dst, pWidth, pHeight, n) }
             }
-            initVal := uint8(0)
-            if i > 0 { initVal = 128 }
-            plane, err := gapDecodePlaneOptimized(reader, pWidth, pHeight, header.Flags, initVal, header.S)
-            if err != nil { return fmt.Errorf("failed to decode plane %d: %v", i, err) }
+            if err != nil { return nil, nil, nil, fmt.Errorf("failed to decode plane %d: %v", i, err) }
+            kept[i] = n
             planes[i] = plane
         }
+        if truncated != nil {
+            warnLost(header, truncated, nil, kept)
+        }
     }
     
-    // 3. Upsample Chroma in parallel if needed
-    if isSubsampled && channels == 3 {
-        var uwg sync.WaitGroup
-        uwg.Add(2)
-        go func() { defer uwg.Done(); planes[1] = upsamplePlane(planes[1], width, height) }()
-        go func() { defer uwg.Done(); planes[2] = upsamplePlane(planes[2], width, height) }()
-        uwg.Wait()
+    stats.add(&stats.Reconstruction, start)
+    return planes, planes16, residual, nil
+}
+
+// planeFill is the level plane i starts at before its patches are
+// written: black luma and neutral chroma, or mid-gray luma for BestEffort
+// so lost patches do not stand out
+func planeFill(i int, opts DecodeOptions) uint8 {
+    if i > 0 || opts.BestEffort { return 128 }
+    return 0
+}
+
+// warnLost reports a BestEffort decode that lost patches: why, and how
+// many of each plane's patches were recovered (kept, one per plane)
+func warnLost(header *gapFileHeader, truncated, damaged error, kept []int) {
+    total, recovered := 0, 0
+    var planes []string
+    for i, n := range kept {
+        patches := planePatches(header, i)
+        total += patches
+        recovered += n
+        planes = append(planes, fmt.Sprintf("plane %d lost %d of %d", i, patches-n, patches))
     }
+    reason := fmt.Sprintf("file is damaged (%v)", damaged)
+    if truncated != nil { reason = fmt.Sprintf("file is truncated (%v)", truncated) }
+    logWarnf("%s; recovered %d of %d patches (%s)", reason, recovered, total, strings.Join(planes, ", "))
+}
 
-    // 4. Merge YCbCr -> RGB IN PARALLEL
-    finalImg := image.NewRGBA(image.Rect(0, 0, width, height))
-    
-    if channels == 3 {
-        yPlane := planes[0]
-        cbPlane := planes[1]
-        crPlane := planes[2]
-        
-        // Parallel conversion - split by rows
-        numWorkers := runtime.NumCPU()
-        rowsPerWorker := (height + numWorkers - 1) / numWorkers
-        
-        var wg sync.WaitGroup
-        for w := 0; w < numWorkers; w++ {
-            startY := w * rowsPerWorker
-            endY := startY + rowsPerWorker
-            if endY > height { endY = height }
-            if startY >= height { continue }
-            
-            wg.Add(1)
-            go func(sy, ey int) {
-                defer wg.Done()
-                for y := sy; y < ey; y++ {
-                    for x := 0; x < width; x++ {
-                        yy := yPlane.GrayAt(x, y).Y
-                        cb := cbPlane.GrayAt(x, y).Y
-                        cr := crPlane.GrayAt(x, y).Y
-                        r, g, b := color.YCbCrToRGB(yy, cb, cr)
-                        
-                        // Direct pixel access (4x faster than Set)
-                        idx := finalImg.PixOffset(x, y)
-                        finalImg.Pix[idx] = r
-                        finalImg.Pix[idx+1] = g
-                        finalImg.Pix[idx+2] = b
-                        finalImg.Pix[idx+3] = 255
-                    }
-                }
-            }(startY, endY)
-        }
-        wg.Wait()
-    } else {
-        // Grayscale
-        src := planes[0]
-        for y := 0; y < height; y++ {
-            for x := 0; x < width; x++ {
-                gray := src.GrayAt(x, y).Y
-                idx := finalImg.PixOffset(x, y)
-                finalImg.Pix[idx] = gray
-                finalImg.Pix[idx+1] = gray
-                finalImg.Pix[idx+2] = gray
-                finalImg.Pix[idx+3] = 255
-            }
-        }
+// markLost paints the patches of a plane from raster index first on with
+// a checkerboard of 4x4 squares, so a salvaged image shows what was lost
+func markLost(dst planeWriter, width, height, first int) {
+    var checker [64]float32
+    for i := range checker {
+        checker[i] = 0.25
+        if (i/8/4+i%8/4)%2 == 1 { checker[i] = 0.75 }
     }
-    
-    // 5. Apply Parallel Deblocking
-    DeblockImageParallel(finalImg)
-    
-    // 6. Apply Edge-Only Antialiasing for whiskers/fine-lines
-    applyEdgeAntialiasing(finalImg)
-    
-    // 7. Apply Line Continuity Filter for block-boundary whisker artifacts
-    applyLineContinuityFilter(finalImg)
-    
-    fmt.Printf("Core Reconstruction (Zig + Go Parallel): %v\n", time.Since(coreStart))
-    
-    // 6. Write Output with buffered writer
-    pngStart := time.Now()
-    outFile, err := os.Create(outputPath)
-    if err != nil {
-        return fmt.Errorf("failed to create output: %v", err)
+    blocksW, blocksH := (width+7)/8, (height+7)/8
+    for i := first; i < blocksW*blocksH; i++ {
+        dst.writePatch(i%blocksW*8, i/blocksW*8, checker[:])
     }
-    defer outFile.Close()
-    
-    bufWriter := bufio.NewWriterSize(outFile, 1024*1024)
-    encoder := png.Encoder{CompressionLevel: png.BestSpeed}
-    if err := encoder.Encode(bufWriter, finalImg); err != nil {
-        return fmt.Errorf("failed to encode png: %v", err)
+}
+
+// planeQTable returns plane i's table, or nil when the file has none
+func planeQTable(tables []QTable, i int) *QTable {
+    if tables == nil { return nil }
+    return &tables[i]
+}
+
+// Stream framing failures, returned before the stream is allocated
+var (
+    ErrTruncatedStream = errors.New("stream is truncated")
+    ErrStreamTooLarge  = errors.New("stream is larger than its plane allows")
+)
+
+// splitStreamMax is the most a patch adds to each split stream: an
+// angle, a count, a float32 maximum, 64 indices and 64 16-bit pairs
+var splitStreamMax = [5]int{1, 1, 4, 64, 256}
+
+// planePatches is the number of 8x8 patches in plane i
+func planePatches(h *gapFileHeader, i int) int {
+    w, ht := h.planeSize(i)
+    return ((w + 7) / 8) * ((ht + 7) / 8)
+}
+
+// streamBlock is one split stream as stored in the file
+type streamBlock struct {
+    uLen   uint32
+    cData  []byte
+    stored bool   // cData is the stream itself, not range-coded
+    crc    uint32 // CRC32-C of the uncompressed stream, if hasCRC
+    hasCRC bool
+    missing bool // Not in the file (BestEffort decode of a truncated file)
+}
+
+// unpack returns the block's uncompressed stream
+func (b streamBlock) unpack() []byte {
+    if b.stored { return b.cData }
+    return GapDecompressData(b.cData, int(b.uLen))
+}
+
+// readStreamBlock reads one length-prefixed compressed stream:
+// u32 uncompressed length, u32 compressed length, data. With
+// FlagStoredBlocks a compressed length carrying storedBlockBit marks
+// data stored as is (as every block is with FlagRawStreams), and with
+// FlagStreamCRC a u32 checksum follows the lengths. Neither length is
+// trusted: an uncompressed length over maxLen fails with
+// ErrStreamTooLarge, data past the end of r with ErrTruncatedStream.
+func readStreamBlock(r io.Reader, flags uint32, maxLen int) (streamBlock, error) {
+    var b streamBlock
+    var cLen uint32
+    if err := binary.Read(r, binary.LittleEndian, &b.uLen); err != nil { return b, err }
+    if err := binary.Read(r, binary.LittleEndian, &cLen); err != nil { return b, err }
+    if flags&FlagStoredBlocks != 0 && cLen&storedBlockBit != 0 {
+        cLen &^= storedBlockBit
+        b.stored = true
     }
-    if err := bufWriter.Flush(); err != nil {
-        return fmt.Errorf("failed to flush output: %v", err)
+    b.stored = b.stored || flags&FlagRawStreams != 0
+    if flags&FlagStreamCRC != 0 {
+        if err := binary.Read(r, binary.LittleEndian, &b.crc); err != nil { return b, err }
+        b.hasCRC = true
+    }
+    if int64(b.uLen) > int64(maxLen) {
+        return b, fmt.Errorf("%w: %d bytes, at most %d", ErrStreamTooLarge, b.uLen, maxLen)
+    }
+    // Stored streams are used in place, so their two lengths must agree
+    if b.stored && b.uLen != cLen {
+        return b, fmt.Errorf("stored stream length %d does not match its %d bytes", b.uLen, cLen)
+    }
+    var err error
+    b.cData, err = readBounded(r, cLen)
+    return b, err
+}
+
+// readBounded reads n bytes without allocating them up front unless r
+// (a bytes.Reader payload) can say they are there. Other readers are read
+// in growing pieces, so a short file fails once its bytes run out.
+func readBounded(r io.Reader, n uint32) ([]byte, error) {
+    if lr, ok := r.(interface{ Len() int }); ok {
+        if int64(n) > int64(lr.Len()) {
+            return nil, fmt.Errorf("%w: %d bytes claimed, %d left", ErrTruncatedStream, n, lr.Len())
+        }
+        buf := make([]byte, n)
+        _, err := io.ReadFull(r, buf)
+        return buf, err
+    }
+    buf, err := io.ReadAll(io.LimitReader(r, int64(n)))
+    if err != nil { return nil, err }
+    if len(buf) < int(n) {
+        return nil, fmt.Errorf("%w: %d bytes claimed, %d left", ErrTruncatedStream, n, len(buf))
+    }
+    return buf, nil
+}
+
+// applyResidual adds the stored per-pixel RGB residual (mod 256) back onto
+// the lossy reconstruction.
+func applyResidual(img *image.RGBA, residual []byte) {
+    b := img.Bounds()
+    w, h := b.Dx(), b.Dy()
+    for y := 0; y < h; y++ {
+        row := img.Pix[y*img.Stride:]
+        res := residual[y*w*3:]
+        for x := 0; x < w; x++ {
+            row[x*4] += res[x*3]
+            row[x*4+1] += res[x*3+1]
+            row[x*4+2] += res[x*3+2]
+        }
     }
-    fmt.Printf("PNG Encoding Time: %v\n", time.Since(pngStart))
-    
-    fmt.Println("Success.")
-    return nil
 }
 
-// upsamplePlane expands dimensions by 2x using Bilinear Interpolation
-func upsamplePlane(src *image.Gray, targetW, targetH int) *image.Gray {
+// upsamplePlane expands a 4:2:0 chroma plane to the luma size targetW x
+// targetH with the interpolation mode. The scale is exactly 2 whatever
+// the sizes: downsamplePlane averages luma pixels 2x and 2x+1 into chroma
+// x (dropping the last column of odd widths), so chroma sample x sits at
+// luma position 2x+0.5. Deriving the scale from the sizes would stretch
+// odd-sized planes by a fraction of a pixel.
+func upsamplePlane(src *image.Gray, targetW, targetH int, mode ChromaUpsample, workers int) *image.Gray {
     dst := image.NewGray(image.Rect(0, 0, targetW, targetH))
-    srcBounds := src.Bounds()
-    srcW, srcH := srcBounds.Dx(), srcBounds.Dy()
-    
-    parallelUpsample(src, dst, srcW, srcH, targetW, targetH)
+    parallelUpsample(src, dst, 0.5, 0.5, mode, workers)
+    return dst
+}
+
+// resizePlane scales src to w x h with bilinear interpolation, aligning
+// pixel centers
+func resizePlane(src *image.Gray, w, h, workers int) *image.Gray {
+    dst := image.NewGray(image.Rect(0, 0, w, h))
+    sb := src.Bounds()
+    parallelUpsample(src, dst, float32(sb.Dx())/float32(w), float32(sb.Dy())/float32(h), UpsampleBilinear, workers)
     return dst
 }
 
-func parallelUpsample(src, dst *image.Gray, srcW, srcH, dstW, dstH int) {
+// parallelUpsample fills dst by interpolating src, sampling destination
+// pixel x at source position (x+0.5)*scaleX-0.5 (likewise y), clamped to
+// the source edges
+func parallelUpsample(src, dst *image.Gray, scaleX, scaleY float32, mode ChromaUpsample, workers int) {
+    srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+    dstW, dstH := dst.Bounds().Dx(), dst.Bounds().Dy()
+    cols := mode.columnTaps(dstW, scaleX, srcW)
+
     var wg sync.WaitGroup
-    workers := runtime.NumCPU()
+    workers = workerCount(workers)
     rowsPerWorker := dstH / workers
     if rowsPerWorker < 1 { rowsPerWorker = 1 }
     
@@ -267,39 +1359,33 @@ func parallelUpsample(src, dst *image.Gray, srcW, srcH, dstW, dstH int) {
         startY := i * rowsPerWorker
         endY := startY + rowsPerWorker
         if i == workers-1 { endY = dstH }
+        if startY >= dstH { break }
         
         wg.Add(1)
         go func(y0, y1 int) {
             defer wg.Done()
             for y := y0; y < y1; y++ {
-                // Map target y to source y
-                srcFy := float32(y) * (float32(srcH) / float32(dstH))
-                yLow := int(srcFy)
-                yHigh := yLow + 1
-                if yHigh >= srcH { yHigh = srcH - 1 }
-                yWeight := srcFy - float32(yLow)
-                
+                ty := mode.taps(y, scaleY, srcH)
+                var srcRows [4][]uint8
+                for j := 0; j < ty.n; j++ {
+                    srcRows[j] = planeRow(src, ty.idx[j])
+                }
                 row := dst.Pix[y*dst.Stride:] 
                 
                 for x := 0; x < dstW; x++ {
-                     // Map target x to source x
-                    srcFx := float32(x) * (float32(srcW) / float32(dstW))
-                    xLow := int(srcFx)
-                    xHigh := xLow + 1
-                    if xHigh >= srcW { xHigh = srcW - 1 }
-                    xWeight := srcFx - float32(xLow)
-                    
-                    // Bilinear interpolation
-                    p00 := float32(src.GrayAt(xLow, yLow).Y)
-                    p10 := float32(src.GrayAt(xHigh, yLow).Y)
-                    p01 := float32(src.GrayAt(xLow, yHigh).Y)
-                    p11 := float32(src.GrayAt(xHigh, yHigh).Y)
-                    
-                    top := p00*(1-xWeight) + p10*xWeight
-                    bottom := p01*(1-xWeight) + p11*xWeight
-                    val := top*(1-yWeight) + bottom*yWeight
-                    
-                    row[x] = uint8(val)
+                    tx := &cols[x]
+                    var val float32
+                    for j := 0; j < ty.n; j++ {
+                        var sum float32
+                        for k := 0; k < tx.n; k++ {
+                            sum += float32(srcRows[j][tx.idx[k]]) * tx.wt[k]
+                        }
+                        val += sum * ty.wt[j]
+                    }
+                    // Bicubic taps can overshoot at edges
+                    if val < 0 { val = 0 }
+                    if val > 255 { val = 255 }
+                    row[x] = uint8(val + 0.5)
                 }
             }
         }(startY, endY)
@@ -307,232 +1393,388 @@ func parallelUpsample(src, dst *image.Gray, srcW, srcH, dstW, dstH int) {
     wg.Wait()
 }
 
-// fillPlane initializes an image with a constant value
 func fillPlane(img *image.Gray, val uint8) {
 	for i := range img.Pix {
 		img.Pix[i] = val
 	}
 }
 
+// fillBlock sets the 8x8 block at (x, y) to v, clipped to the plane
+func fillBlock(img *image.Gray, x, y int, v uint8) { fillSquare(img, x, y, 8, v) }
+
+// fillSquare sets the n x n block at (x, y) to v, clipped to the plane
+func fillSquare(img *image.Gray, x, y, n int, v uint8) {
+    b := img.Bounds()
+    for py := y; py < y+n && py < b.Dy(); py++ {
+        for px := x; px < x+n && px < b.Dx(); px++ {
+            img.Pix[py*img.Stride+px] = v
+        }
+    }
+}
+
+// planeWriter stores reconstructed patches into a plane of some depth
+type planeWriter interface {
+    writePatch(x, y int, patch []float32) // 8x8 samples on the 0..1 scale, clipped to the plane
+    fillBlock(x, y int, level uint8)      // Flat patch at an 8-bit level
+}
+
+// grayWriter reconstructs into an 8-bit plane. Samples are truncated,
+// or with dither rounded against ditherThreshold, which spreads the
+// fraction lost to 8 bits over neighboring pixels instead of letting
+// smooth gradients step in bands.
+type grayWriter struct {
+    img    *image.Gray
+    dither bool
+}
+
+func (w grayWriter) writePatch(x, y int, patch []float32) {
+    width, height := w.img.Rect.Dx(), w.img.Rect.Dy()
+    for py := 0; py < 8 && y+py < height; py++ {
+        row := w.img.Pix[(y+py)*w.img.Stride:]
+        for px := 0; px < 8 && x+px < width; px++ {
+            val := patch[py*8+px]
+            if val < 0 { val = 0 }
+            if val > 1 { val = 1 }
+            if w.dither {
+                row[x+px] = uint8(min(val*255.0+ditherThreshold(x+px, y+py), 255))
+                continue
+            }
+            row[x+px] = uint8(val * 255.0)
+        }
+    }
+}
+
+// ditherThreshold is interleaved gradient noise: a 0..1 threshold per
+// pixel with little low-frequency energy, so the dither reads as fine
+// grain rather than a pattern. It depends only on the position, which
+// keeps dithered decodes reproducible.
+func ditherThreshold(x, y int) float32 {
+    f := 0.06711056*float64(x) + 0.00583715*float64(y)
+    f = 52.9829189 * (f - math.Floor(f))
+    return float32(f - math.Floor(f))
+}
+
+func (w grayWriter) fillBlock(x, y int, level uint8) { fillBlock(w.img, x, y, level) }
+
+// scaledWriter reconstructs a width x height plane into img at 1/scale
+// of the size: each pixel is the rounded mean of the scale x scale
+// samples it covers inside the plane
+type scaledWriter struct {
+    img           *image.Gray
+    scale         int
+    width, height int
+}
+
+func (w scaledWriter) writePatch(x, y int, patch []float32) {
+    s := w.scale
+    for oy := 0; oy < 8/s; oy++ {
+        for ox := 0; ox < 8/s; ox++ {
+            var sum float32
+            n := 0
+            for py := oy * s; py < oy*s+s && y+py < w.height; py++ {
+                for px := ox * s; px < ox*s+s && x+px < w.width; px++ {
+                    sum += min(max(patch[py*8+px], 0), 1)
+                    n++
+                }
+            }
+            if n > 0 {
+                w.img.Pix[(y/s+oy)*w.img.Stride+x/s+ox] = uint8(sum/float32(n)*255.0 + 0.5)
+            }
+        }
+    }
+}
+
+func (w scaledWriter) fillBlock(x, y int, level uint8) { fillSquare(w.img, x/w.scale, y/w.scale, 8/w.scale, level) }
+
+// planeScale is how much plane i shrinks in a decode at 1/scale of the
+// image size; subsampled chroma starts at half size
+func planeScale(scale int, flags uint32, i int) int {
+    if flags&FlagSubsampled != 0 && (i == 1 || i == 2) { return max(scale/2, 1) }
+    return max(scale, 1)
+}
+
 // Optimized plane decoder with batch reading
-func gapDecodePlaneOptimized(reader io.Reader, width, height int, flags uint32, initVal uint8, s_val float32) (*image.Gray, error) {
-    paddedW := (width + 7) / 8 * 8
-    paddedH := (height + 7) / 8 * 8
-    
+func gapDecodePlaneOptimized(reader io.Reader, width, height int, flags uint32, initVal uint8, s_val float32, qtable *QTable) (*image.Gray, error) {
     img := image.NewGray(image.Rect(0, 0, width, height))
     fillPlane(img, initVal)
+    if _, err := decodeInterleavedPatches(reader, grayWriter{img: img}, width, height, flags, s_val, qtable, nil, image.Rectangle{}); err != nil {
+        return nil, err
+    }
+    return img, nil
+}
+
+// decodeInterleavedPatches reconstructs a plane from the legacy
+// interleaved stream into dst and returns how many patches it got
+// through, all of them unless it fails. Every patch is parsed, but with
+// a non-empty region only those overlapping it are reconstructed.
+func decodeInterleavedPatches(reader io.Reader, dst planeWriter, width, height int, flags uint32, s_val float32, qtable *QTable, t PatchTransform, region image.Rectangle) (int, error) {
+    paddedW := (width + 7) / 8 * 8
+    paddedH := (height + 7) / 8 * 8
     
-    isQuantized := (flags & 2) != 0
-    
-    // Preallocate read buffer for batch reading
-    headerBuf := make([]byte, 6) // angle(1) + count(1) + maxVal(4)
+    parser := newInterleavedParser(reader, paddedW/8, flags, qtable)
     
     processed := 0
     for y := 0; y < paddedH; y += 8 {
         for x := 0; x < paddedW; x += 8 {
-            // Batch read header
-            if isQuantized {
-                if _, err := io.ReadFull(reader, headerBuf); err != nil {
-                    return nil, fmt.Errorf("failed to read header at patch %d: %v", processed, err)
-                }
-            } else {
-                if _, err := io.ReadFull(reader, headerBuf[:2]); err != nil {
-                    return nil, fmt.Errorf("failed to read header at patch %d: %v", processed, err)
-                }
+            coeffs := getCoeffs()
+            angle, fill, err := parser.parsePatch(x/8, y/8, coeffs)
+            if err != nil {
+                putCoeffs(coeffs)
+                return processed, fmt.Errorf("failed to read patch %d: %v", processed, err)
             }
-            
-            byteAngle := headerBuf[0]
-            byteCount := headerBuf[1]
-            angle := float32(byteAngle) / 255.0 * 2.0 * math.Pi
-            
-            // Get coeffs from pool
-            coeffs := coeffPool.Get().([]float32)
-            for i := range coeffs { coeffs[i] = 0 }
-            
-            var maxVal float32 = 1.0
-            if isQuantized {
-                maxVal = math.Float32frombits(binary.LittleEndian.Uint32(headerBuf[2:6]))
+            if fill >= 0 {
+                dst.fillBlock(x, y, uint8(fill))
+                putCoeffs(coeffs)
+                processed++
+                continue
             }
-            
-            // Batch read all coefficients for this patch
-            coeffCount := int(byteCount)
-            if coeffCount > 0 {
-                coeffBuf := make([]byte, coeffCount*3) // idx + re + im per coeff
-                if _, err := io.ReadFull(reader, coeffBuf); err != nil {
-                    return nil, fmt.Errorf("failed to read coeffs at patch %d: %v", processed, err)
-                }
-                
-                for k := 0; k < coeffCount; k++ {
-                    idx := coeffBuf[k*3]
-                    qRe := int8(coeffBuf[k*3+1])
-                    qIm := int8(coeffBuf[k*3+2])
-                    
-                    re := float32(qRe) / 127.0 * maxVal
-                    im := float32(qIm) / 127.0 * maxVal
-                    
-                    if int(idx) < 64 {
-                        coeffs[2*int(idx)] = re
-                        coeffs[2*int(idx)+1] = im
-                    }
-                }
+            if !region.Empty() && !image.Rect(x, y, x+8, y+8).Overlaps(region) {
+                putCoeffs(coeffs)
+                processed++
+                continue
             }
             
             // Decompress via Zig FFT
             patchBuffer := make([]float32, 64)
-            if err := GapDecompressPatchTo(coeffs, angle, s_val, patchBuffer); err != nil {
-                return nil, fmt.Errorf("failed to decompress patch %d: %v", processed, err)
-            }
-            
-            // Write to Image
-            for py := 0; py < 8; py++ {
-                for px := 0; px < 8; px++ {
-                    destX := x + px
-                    destY := y + py
-                    
-                    if destX < width && destY < height {
-                        val := patchBuffer[py*8+px]
-                        if val < 0 { val = 0 }
-                        if val > 1 { val = 1 }
-                        
-                        gray := uint8(val * 255.0)
-                        img.Pix[destY*img.Stride+destX] = gray // Direct access
-                    }
-                }
+            err = inversePatch(t, coeffs, angle, s_val, patchBuffer)
+            putCoeffs(coeffs)
+            if err != nil {
+                return processed, fmt.Errorf("failed to decompress patch %d: %v", processed, err)
             }
-            coeffPool.Put(coeffs)
+            dst.writePatch(x, y, patchBuffer)
             processed++
         }
     }
-    return img, nil
+    return processed, nil
 }
 
-// gapDecodePlaneSplit decodes from 5 separate streams with parallel math
-func gapDecodePlaneSplit(angles, counts, maxVals, indices, values []byte, width, height int, flags uint32, initVal uint8, s_val float32) (*image.Gray, error) {
-    paddedW := (width + 7) / 8 * 8
-    paddedH := (height + 7) / 8 * 8
-    
+// gapDecodePlaneSplit decodes from 5 separate streams with parallel math.
+// t is the transform the plane was coded with (nil = DefaultTransform).
+func gapDecodePlaneSplit(angles, counts, maxVals, indices, values []byte, width, height int, flags uint32, initVal uint8, s_val float32, qtable *QTable, t PatchTransform, workers int) (*image.Gray, error) {
     img := image.NewGray(image.Rect(0, 0, width, height))
     fillPlane(img, initVal)
+    if err := decodeSplitPatches(angles, counts, maxVals, indices, values, grayWriter{img: img}, width, height, flags, s_val, qtable, t, image.Rectangle{}, 0, workers); err != nil {
+        return nil, err
+    }
+    return img, nil
+}
+
+// splitBandPatches is about how many patches decodeSplitPatches holds
+// coefficients for at once by default: enough to keep every worker busy,
+// and at 768 bytes a patch only a few MB whatever the image size
+const splitBandPatches = 8192
+
+// decodeSplitPatches reconstructs a plane from its 5 streams into dst.
+// Every patch is parsed, but with a non-empty region only those
+// overlapping it are reconstructed. The plane is decoded in bands of
+// bandRows block rows (0 = about splitBandPatches patches), each parsed,
+// reconstructed in parallel and written before the next one reuses its
+// buffers, so memory does not grow with the image.
+func decodeSplitPatches(angles, counts, maxVals, indices, values []byte, dst planeWriter, width, height int, flags uint32, s_val float32, qtable *QTable, t PatchTransform, region image.Rectangle, bandRows, workers int) error {
+    blocksW := (width + 7) / 8
+    blocksH := (height + 7) / 8
+    numPatches := blocksW * blocksH
     
-    // 1. Pre-calculate number of patches
-    numPatches := (paddedW / 8) * (paddedH / 8)
+    // Every patch has a count, and an angle unless it may be skipped as
+    // flat or empty
+    if len(counts) != numPatches {
+        return fmt.Errorf("counts stream has %d entries for %d patches", len(counts), numPatches)
+    }
+    if flags&(FlagSkipFlat|FlagSparseAngles) == 0 && len(angles) != numPatches {
+        return fmt.Errorf("angles stream has %d entries for %d patches", len(angles), numPatches)
+    }
     
-    // 2. Pre-allocate buffers for parallel work
-    // 565k patches * 128 floats = ~290MB. 
-    allCoeffs := make([]float32, numPatches * 128)
-    allAngles := make([]float32, numPatches)
-    coords := make([]struct{x, y int}, numPatches)
+    // Band buffers, reused by every band
+    if bandRows <= 0 { bandRows = max(splitBandPatches/blocksW, 1) }
+    bandRows = min(bandRows, blocksH)
+    bandCoeffs := make([]float32, bandRows*blocksW*128)
+    bandAngles := make([]float32, bandRows*blocksW)
+    coords := make([]struct{x, y int}, bandRows*blocksW)
+    pixelBuf := make([]float32, bandRows*blocksW*64)
     
-    // 3. Sequential stage: Parse streams (very fast)
-    ptrA, ptrC, ptrMax, ptrIdx, ptrVal := 0, 0, 0, 0, 0
-    pIdx := 0
-    for y := 0; y < paddedH; y += 8 {
-        for x := 0; x < paddedW; x += 8 {
-            if ptrA >= len(angles) || ptrC >= len(counts) || pIdx >= numPatches { break }
-            
-            byteAngle := angles[ptrA]; ptrA++
-            byteCount := counts[ptrC]; ptrC++
-            
-            angle := float32(byteAngle) / 255.0 * 2.0 * math.Pi
-            allAngles[pIdx] = angle
-            coords[pIdx].x = x
-            coords[pIdx].y = y
-            
-            // Read MaxVal
-            var maxVal float32 = 1.0
-            if ptrMax+4 <= len(maxVals) {
-                bits := binary.LittleEndian.Uint32(maxVals[ptrMax : ptrMax+4])
-                maxVal = math.Float32frombits(bits)
-                ptrMax += 4
-            }
-            
-            // Populate Coeffs slice from flat buffer
-            fCoeffs := allCoeffs[pIdx*128 : (pIdx+1)*128]
-            count := int(byteCount)
-            for k := 0; k < count; k++ {
-                if ptrIdx >= len(indices) || ptrVal+1 >= len(values) { break }
-                idx := indices[ptrIdx]; ptrIdx++
-                qRe := int8(values[ptrVal])
-                qIm := int8(values[ptrVal+1]); ptrVal += 2
-                
-                if int(idx) < 64 {
-                    fCoeffs[2*int(idx)] = float32(qRe) / 127.0 * maxVal
-                    fCoeffs[2*int(idx)+1] = float32(qIm) / 127.0 * maxVal
+    streams := []*sliceStream{{buf: angles}, {buf: counts}, {buf: maxVals}, {buf: indices}, {buf: values}}
+    parser := newPatchParser(streams[0], streams[1], streams[2], streams[3], streams[4], blocksW, flags, qtable)
+    for band := 0; band < blocksH; band += bandRows {
+        // 1. Sequential stage: parse the band's patches (very fast)
+        pIdx := 0
+        for by := band; by < min(band+bandRows, blocksH); by++ {
+            for bx := 0; bx < blocksW; bx++ {
+                x, y := bx*8, by*8
+                angle, fill, err := parser.parsePatch(bx, by, bandCoeffs[pIdx*128:(pIdx+1)*128])
+                if err != nil {
+                    return fmt.Errorf("failed to read patch at (%d, %d): %v", x, y, err)
+                }
+                if fill >= 0 {
+                    // Flat patch: written here, no transform needed
+                    dst.fillBlock(x, y, uint8(fill))
+                    continue
+                }
+                if !region.Empty() && !image.Rect(x, y, x+8, y+8).Overlaps(region) {
+                    // The slot is reused by the next patch
+                    clear(bandCoeffs[pIdx*128 : (pIdx+1)*128])
+                    continue
                 }
+                bandAngles[pIdx] = angle
+                coords[pIdx].x = x
+                coords[pIdx].y = y
+                pIdx++
             }
-            pIdx++
+        }
+        
+        // 2. Parallel stage: math and reconstruction of the band
+        if err := reconstructBand(bandCoeffs, bandAngles[:pIdx], pixelBuf, coords, dst, s_val, t, workers); err != nil {
+            return err
+        }
+        // The parser adds into zeroed slots, and the transform may
+        // have overwritten them
+        clear(bandCoeffs[:pIdx*128])
+    }
+    // Leftover bytes mean the counts and the data streams disagree
+    for i, st := range streams {
+        if st.pos != len(st.buf) {
+            return fmt.Errorf("%d unread bytes in stream %d", len(st.buf)-st.pos, i)
         }
     }
+    return nil
+}
+
+// reconstructBand inverts the len(angles) parsed patches of a band
+// (coeffs holds 128 floats each) in parallel chunks and writes them to
+// dst at coords, using pixelBuf (64 floats a patch) as scratch
+func reconstructBand(coeffs, angles, pixelBuf []float32, coords []struct{x, y int}, dst planeWriter, s_val float32, t PatchTransform, workers int) error {
+    n := len(angles)
+    if n == 0 { return nil }
+    numWorkers := min(workerCount(workers), n)
     
-    // 4. Parallel stage: Math + Reconstruction
-    if pIdx > 0 {
-        numWorkers := runtime.NumCPU()
-        if numWorkers > pIdx { numWorkers = pIdx }
-        
-        var wg sync.WaitGroup
-        chunkSize := (pIdx + numWorkers - 1) / numWorkers
+    var wg sync.WaitGroup
+    chunkSize := (n + numWorkers - 1) / numWorkers
+    errs := make([]error, numWorkers)
+    var failed atomic.Bool // Set by the first failing chunk; the others stop early
+    
+    for w := 0; w < numWorkers; w++ {
+        start := w * chunkSize
+        end := min(start+chunkSize, n)
+        if start >= end { continue }
         
-        for w := 0; w < numWorkers; w++ {
-            start := w * chunkSize
-            end := start + chunkSize
-            if end > pIdx { end = pIdx }
-            if start >= end { continue }
+        wg.Add(1)
+        go func(wIdx, s, e int) {
+            defer wg.Done()
+            if failed.Load() { return }
             
-            wg.Add(1)
-            go func(s, e int) {
-                defer wg.Done()
-                
-                // 1. Bulk decompress entire chunk in one CGO call
-                chunkPatches := e - s
-                chunkCoeffs := allCoeffs[s*128 : e*128]
-                chunkAngles := allAngles[s : e]
-                pixelBuf := make([]float32, chunkPatches * 64)
-                
-                if err := GapDecompressPatches(chunkCoeffs, chunkAngles, pixelBuf, s_val); err != nil {
-                    // We can't return an error easily from a goroutine without a channel,
-                    // but for production hardening we should log and maybe use a sync-once error.
-                    // For now, let's just log and ensure we don't panic.
-                    fmt.Printf("Error: bulk decompression failed: %v\n", err)
-                    return 
-                }
-                
-                // 2. Parallel write to Image
-                for i := 0; i < chunkPatches; i++ {
-                    pIdx := s + i
-                    x, y := coords[pIdx].x, coords[pIdx].y
-                    patch := pixelBuf[i*64 : (i+1)*64]
-                    
-                    for py := 0; py < 8; py++ {
-                        for px := 0; px < 8; px++ {
-                            origX := x + px
-                            origY := y + py
-                            if origX < width && origY < height {
-                                val := patch[py*8+px]
-                                if val < 0 { val = 0 }
-                                if val > 1 { val = 1 }
-                                img.Pix[origY*img.Stride+origX] = uint8(val * 255.0)
-                            }
-                        }
-                    }
-                }
-            }(start, end)
+            // 1. Bulk decompress entire chunk in one CGO call
+            chunkPixels := pixelBuf[s*64 : e*64]
+            if err := inversePatches(t, coeffs[s*128:e*128], angles[s:e], chunkPixels, s_val); err != nil {
+                first, last := coords[s], coords[e-1]
+                errs[wIdx] = fmt.Errorf("failed to reconstruct patches (%d, %d) to (%d, %d): %w", first.x, first.y, last.x, last.y, err)
+                failed.Store(true)
+                return
+            }
+            if failed.Load() { return }
+            
+            // 2. Parallel write to Image
+            for i := s; i < e; i++ {
+                dst.writePatch(coords[i].x, coords[i].y, chunkPixels[(i-s)*64:(i-s+1)*64])
+            }
+        }(w, start, end)
+    }
+    wg.Wait()
+    for _, err := range errs {
+        if err != nil { return err }
+    }
+    return nil
+}
+
+// bulkDecompress reconstructs decodeSplitPatches' chunks; a variable so
+// the tests can make it fail
+var bulkDecompress = GapDecompressPatches
+
+// recoverPatches reconstructs a plane whose streams were cut short, in
+// raster order up to the first patch that cannot be parsed or
+// reconstructed, and returns how many it wrote. The rest of the plane
+// keeps its fill level.
+func recoverPatches(streams [5][]byte, dst planeWriter, width, height int, flags uint32, s_val float32, qtable *QTable, t PatchTransform) int {
+    blocksW, blocksH := (width+7)/8, (height+7)/8
+    parser := newPatchParser(&sliceStream{buf: streams[0]}, &sliceStream{buf: streams[1]}, &sliceStream{buf: streams[2]}, &sliceStream{buf: streams[3]}, &sliceStream{buf: streams[4]}, blocksW, flags, qtable)
+    coeffs := make([]float32, 128)
+    patch := make([]float32, 64)
+    for by := 0; by < blocksH; by++ {
+        for bx := 0; bx < blocksW; bx++ {
+            clear(coeffs)
+            angle, fill, err := parser.parsePatch(bx, by, coeffs)
+            if err != nil { return by*blocksW + bx }
+            if fill >= 0 {
+                dst.fillBlock(bx*8, by*8, uint8(fill))
+                continue
+            }
+            if err := inversePatch(t, coeffs, angle, s_val, patch); err != nil { return by*blocksW + bx }
+            dst.writePatch(bx*8, by*8, patch)
         }
-        wg.Wait()
     }
-    
-    return img, nil
+    return blocksW * blocksH
 }
 
 // DeblockImageParallel applies deblocking with parallel horizontal/vertical passes
 func DeblockImageParallel(img *image.RGBA) {
+    deblockImage(img, DeblockNormal, true, 8, 0)
+}
+
+// DeblockParams sets the thresholds of deblockImage. A seam is smoothed
+// where it steps by less than NormThreshold, or HighThreshold when the
+// two pixels on each side differ by less than Beta.
+type DeblockParams struct {
+    Beta          int // Flatness check; lower keeps fine lines
+    NormThreshold int // Steps at or above this are taken for edges
+    HighThreshold int // Same, between two flat sides
+}
+
+// Deblocking presets for -deblock-strength. Normal is the original
+// tuning; weak keeps the edges of clean vector art, and strong hides the
+// blocks of files coded with a high threshold.
+var (
+    DeblockOff    = DeblockParams{}
+    DeblockWeak   = DeblockParams{Beta: 8, NormThreshold: 16, HighThreshold: 24}
+    DeblockNormal = DeblockParams{Beta: 12, NormThreshold: 30, HighThreshold: 45}
+    DeblockStrong = DeblockParams{Beta: 18, NormThreshold: 48, HighThreshold: 72}
+)
+
+// ParseDeblockStrength maps a -deblock-strength name to its preset
+func ParseDeblockStrength(name string) (DeblockParams, error) {
+    switch name {
+    case "off":
+        return DeblockOff, nil
+    case "weak":
+        return DeblockWeak, nil
+    case "normal":
+        return DeblockNormal, nil
+    case "strong":
+        return DeblockStrong, nil
+    }
+    return DeblockParams{}, fmt.Errorf("invalid deblock strength %q (want off, weak, normal or strong)", name)
+}
+
+// strongDeblockThreshold is the luma threshold from which a file's blocks
+// are visible enough to deblock with DeblockStrong by default
+const strongDeblockThreshold = 1.0
+
+// fileDeblock is the default strength for a file: DeblockStrong when its
+// luma was coded with a high threshold, else nil (DeblockNormal). Lossless
+// residuals were computed against DeblockNormal.
+func fileDeblock(header *gapFileHeader) *DeblockParams {
+    if header.Flags&FlagLossless != 0 || len(header.Planes) == 0 || header.Planes[0].Threshold < strongDeblockThreshold {
+        return nil
+    }
+    p := DeblockStrong
+    return &p
+}
+
+// deblockImage filters every seam of the block grid, block pixels apart
+// (8, or less for a reduced decode), with thresholds p. A last block one
+// pixel wide or tall has no q1 beyond its seam, so q0 stands in for it;
+// without borderEdges that seam is skipped, as lossless residuals expect.
+func deblockImage(img *image.RGBA, p DeblockParams, borderEdges bool, block, workers int) {
     bounds := img.Bounds()
     w, h := bounds.Dx(), bounds.Dy()
-    
-    const (
-        Beta          = 12 // More sensitive flatness check for fine lines
-        NormThreshold = 30 // Raised: avoids oversmoothing sharp edges
-        HighThreshold = 45 // Tuned: Balance between deblocking and texture
-    )
+    Beta, NormThreshold, HighThreshold := p.Beta, p.NormThreshold, p.HighThreshold
     
     abs := func(x int) int { if x < 0 { return -x }; return x }
     max3 := func(a, b, c int) int { m := a; if b > m { m = b }; if c > m { m = c }; return m }
@@ -547,12 +1789,16 @@ func DeblockImageParallel(img *image.RGBA) {
         return uint8(val_p1), uint8(val_q0)
     }
     
-    numWorkers := runtime.NumCPU()
+    numWorkers := workerCount(workers)
     var wg sync.WaitGroup
     
+    maxX, maxY := w-1, h-1 // q1 of a one-pixel border block
+    lastX, lastY := w, h
+    if !borderEdges { lastX, lastY = maxX, maxY }
+    
     // Vertical edges - parallelize by edge columns
     edges := make([]int, 0)
-    for x := 8; x < w-1; x += 8 {
+    for x := block; x < lastX; x += block {
         edges = append(edges, x)
     }
     
@@ -570,7 +1816,7 @@ func DeblockImageParallel(img *image.RGBA) {
                     idx_p2 := img.PixOffset(x-2, y)
                     idx_p1 := img.PixOffset(x-1, y)
                     idx_q0 := img.PixOffset(x, y)
-                    idx_q1 := img.PixOffset(x+1, y)
+                    idx_q1 := img.PixOffset(min(x+1, maxX), y)
                     
                     p2R, p2G, p2B := img.Pix[idx_p2], img.Pix[idx_p2+1], img.Pix[idx_p2+2]
                     p1R, p1G, p1B := img.Pix[idx_p1], img.Pix[idx_p1+1], img.Pix[idx_p1+2]
@@ -599,7 +1845,7 @@ func DeblockImageParallel(img *image.RGBA) {
     
     // Horizontal edges - parallelize by edge rows
     hEdges := make([]int, 0)
-    for y := 8; y < h-1; y += 8 {
+    for y := block; y < lastY; y += block {
         hEdges = append(hEdges, y)
     }
     
@@ -617,7 +1863,7 @@ func DeblockImageParallel(img *image.RGBA) {
                     idx_p2 := img.PixOffset(x, y-2)
                     idx_p1 := img.PixOffset(x, y-1)
                     idx_q0 := img.PixOffset(x, y)
-                    idx_q1 := img.PixOffset(x, y+1)
+                    idx_q1 := img.PixOffset(x, min(y+1, maxY))
                     
                     p2R, p2G, p2B := img.Pix[idx_p2], img.Pix[idx_p2+1], img.Pix[idx_p2+2]
                     p1R, p1G, p1B := img.Pix[idx_p1], img.Pix[idx_p1+1], img.Pix[idx_p1+2]
@@ -645,21 +1891,25 @@ func DeblockImageParallel(img *image.RGBA) {
     wg.Wait()
 }
 
+// DefaultImpulseThreshold is the despeckle threshold of
+// applyEdgeAntialiasing unless DecodeOptions.ImpulseThreshold sets one
+const DefaultImpulseThreshold = 100
+
 // applyEdgeAntialiasing uses Directional Guided Antialiasing (DGAA)
 // It detects edge orientation via Sobel and smooths ALONG the edge, not across it.
-func applyEdgeAntialiasing(img *image.RGBA) {
+// First, a pixel whose 8 neighbors all differ from it by at least
+// impulseThreshold is taken for an isolated dot and replaced by their
+// average; impulseThreshold 0 skips that despeckle.
+func applyEdgeAntialiasing(img *image.RGBA, impulseThreshold, workers int) {
     bounds := img.Bounds()
     w, h := bounds.Dx(), bounds.Dy()
     out := image.NewRGBA(bounds)
     copy(out.Pix, img.Pix)
     
-    const (
-        EdgeThreshold    = 30  // Adjusted: ignore very faint noise, focus on real edges
-        ImpulseThreshold = 100 // Threshold for detecting isolated dots
-    )
+    const EdgeThreshold = 30 // Adjusted: ignore very faint noise, focus on real edges
     
     abs := func(x int) int { if x < 0 { return -x }; return x }
-    numWorkers := runtime.NumCPU()
+    numWorkers := workerCount(workers)
     var wg sync.WaitGroup
     
     rowsPerWorker := (h - 2 + numWorkers - 1) / numWorkers
@@ -678,7 +1928,7 @@ func applyEdgeAntialiasing(img *image.RGBA) {
                     pR, pG, pB := img.Pix[idx], img.Pix[idx+1], img.Pix[idx+2]
                     
                     // 1. Impulse Noise Rejection (Despeckle)
-                    isDot := true
+                    isDot := impulseThreshold > 0
                     var rAvg, gAvg, bAvg, neighbors int
                     for dy := -1; dy <= 1; dy++ {
                         for dx := -1; dx <= 1; dx++ {
@@ -686,7 +1936,7 @@ func applyEdgeAntialiasing(img *image.RGBA) {
                             nIdx := img.PixOffset(x+dx, y+dy)
                             nR, nG, nB := img.Pix[nIdx], img.Pix[nIdx+1], img.Pix[nIdx+2]
                             diff := (abs(int(pR)-int(nR)) + abs(int(pG)-int(nG)) + abs(int(pB)-int(nB))) / 3
-                            if diff < ImpulseThreshold {
+                            if diff < impulseThreshold {
                                 isDot = false
                             }
                             rAvg += int(nR); gAvg += int(nG); bAvg += int(nB)
@@ -762,20 +2012,67 @@ func DeblockImage(img *image.RGBA) {
     DeblockImageParallel(img)
 }
 
-// applyLineContinuityFilter applies multi-pass bilateral filtering at block seams
-// This aggressively smooths block boundary artifacts while preserving overall contrast
-func applyLineContinuityFilter(img *image.RGBA) {
+// SeamFilterParams sets the strength of applyLineContinuityFilter
+type SeamFilterParams struct {
+    SeamRadius   int     // Filter pixels within this many pixels of an interior block seam
+    FilterRadius int     // Bilateral filter kernel radius
+    SigmaSpace   float64 // Spatial sigma
+    SigmaColor   float64 // Color sigma; larger smooths across stronger edges
+    Passes       int     // 0 leaves the image untouched
+}
+
+// Seam filter presets for -seam-filter. Strong is the original tuning:
+// two passes with a wide color sigma to hide stubborn blocks. Light only
+// touches the two pixel columns/rows at each seam, once, and keeps edges
+// of more than about 12 levels.
+var (
+    SeamFilterOff    = SeamFilterParams{}
+    SeamFilterLight  = SeamFilterParams{SeamRadius: 1, FilterRadius: 2, SigmaSpace: 1.5, SigmaColor: 12, Passes: 1}
+    SeamFilterStrong = SeamFilterParams{SeamRadius: 2, FilterRadius: 3, SigmaSpace: 2, SigmaColor: 22, Passes: 2}
+)
+
+// ParseSeamFilter maps a -seam-filter name to its preset
+func ParseSeamFilter(name string) (SeamFilterParams, error) {
+    switch name {
+    case "off":
+        return SeamFilterOff, nil
+    case "light":
+        return SeamFilterLight, nil
+    case "strong":
+        return SeamFilterStrong, nil
+    }
+    return SeamFilterParams{}, fmt.Errorf("invalid seam filter %q (want off, light or strong)", name)
+}
+
+// isNearSeam reports whether coordinate v (x or y) lies within radius
+// pixels of a seam of blocks block pixels wide inside an image of size
+// n. The image borders are not seams, so the first and last pixels of
+// the image are only filtered for the perpendicular direction.
+func isNearSeam(v, n, radius, block int) bool {
+    mod := v % block
+    // Just right of (below) the seam at v-mod, or left of (above) the next one
+    return (mod < radius && v-mod > 0) || (mod >= block-radius && v-mod+block < n)
+}
+
+// scaled returns the parameters for an image decoded at 1/scale of its
+// size, where seams are that much closer together
+func (p SeamFilterParams) scaled(scale int) SeamFilterParams {
+    if scale <= 1 { return p }
+    p.SeamRadius = (p.SeamRadius + scale - 1) / scale
+    p.FilterRadius = (p.FilterRadius + scale - 1) / scale
+    p.SigmaSpace /= float64(scale)
+    return p
+}
+
+// applyLineContinuityFilter applies multi-pass bilateral filtering at the
+// seams of blocks block pixels wide. This smooths block boundary
+// artifacts while preserving overall contrast.
+func applyLineContinuityFilter(img *image.RGBA, p SeamFilterParams, block, workers int) {
     bounds := img.Bounds()
     w, h := bounds.Dx(), bounds.Dy()
+    if p.Passes <= 0 || p.SeamRadius <= 0 { return }
     
-    const (
-        BlockSize    = 8
-        SeamRadius   = 2   // Apply filter within this many pixels of block seams
-        FilterRadius = 3   // Bilateral filter kernel radius
-        SigmaSpace   = 2.0 // Spatial sigma
-        SigmaColor   = 22.0 // Increased: better hiding of block edges
-        NumPasses    = 2    // Two passes to target stubborn blocks
-    )
+    FilterRadius, SigmaSpace, SigmaColor := p.FilterRadius, p.SigmaSpace, p.SigmaColor
     
     // Pre-compute spatial weights
     spatialWeights := make([]float64, (2*FilterRadius+1)*(2*FilterRadius+1))
@@ -786,17 +2083,9 @@ func applyLineContinuityFilter(img *image.RGBA) {
         }
     }
     
-    isNearSeam := func(x, y int) bool {
-        xMod := x % BlockSize
-        yMod := y % BlockSize
-        nearX := xMod < SeamRadius || xMod >= (BlockSize-SeamRadius)
-        nearY := yMod < SeamRadius || yMod >= (BlockSize-SeamRadius)
-        return nearX || nearY
-    }
-    
-    numWorkers := runtime.NumCPU()
+    numWorkers := workerCount(workers)
     
-    for pass := 0; pass < NumPasses; pass++ {
+    for pass := 0; pass < p.Passes; pass++ {
         out := image.NewRGBA(bounds)
         copy(out.Pix, img.Pix)
         
@@ -814,7 +2103,7 @@ func applyLineContinuityFilter(img *image.RGBA) {
                 defer wg.Done()
                 for y := yMin; y < yMax; y++ {
                     for x := 0; x < w; x++ {
-                        if !isNearSeam(x, y) { continue }
+                        if !isNearSeam(x, w, p.SeamRadius, block) && !isNearSeam(y, h, p.SeamRadius, block) { continue }
                         
                         idx := img.PixOffset(x, y)
                         pR, pG, pB := float64(img.Pix[idx]), float64(img.Pix[idx+1]), float64(img.Pix[idx+2])
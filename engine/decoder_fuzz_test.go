@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// FuzzDecode feeds arbitrary bytes through Decode; any panic fails. The
+// seeds are small valid files covering a spread of format features, so
+// mutations start from inputs that reach the plane and stream parsers.
+// Run it with `go test -fuzz FuzzDecode`.
+func FuzzDecode(f *testing.F) {
+	src := benchRGBA(40, 24)
+	perceptual := PerceptualQTable()
+	optionSets := []EncodeOptions{
+		{},
+		{DCPred: true, RunIndices: true, SkipFlat: true, AngleDelta: true},
+		{CfL: true, HalfMaxVal: true, Compand: true},
+		{Matrix: MatrixIdentity, Lossless: true},
+		{CoeffBits: 12, Grain: 3},
+		{QTables: []QTable{perceptual, perceptual, perceptual}},
+		{Compress: CompressGzip, SkipFlat: true},
+		{Compress: CompressInterleaved, DCPred: true, HalfMaxVal: true},
+		{Compress: CompressNone, CfL: true},
+	}
+	for i, opts := range optionSets {
+		opts.S, opts.Threshold = 0.1, 0.5
+		data, err := encodeGap(src, nil, opts, nil)
+		if err != nil {
+			f.Fatalf("failed to encode seed %d: %v", i, err)
+		}
+		f.Add(data)
+	}
+
+	// The decoder logs progress; keep it quiet while fuzzing
+	defer SetLogger(SetLogger(nil))
+
+	// Checksums are not verified, so mutations reach the parsers; the
+	// limits keep a mutated dimension from allocating gigabytes
+	opts := DecodeOptions{NoVerify: true, MaxPixels: 1 << 20, MaxMemory: 64 << 20}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Decode(bytes.NewReader(data), io.Discard, opts)
+	})
+}
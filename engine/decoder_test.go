@@ -0,0 +1,1241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestFlagValidation accepts the encoder's own flag combinations and
+// rejects unknown bits and contradictory coders
+func TestFlagValidation(t *testing.T) {
+	valid := []uint32{
+		FlagQuantized | FlagRangeCoded | FlagSubsampled,
+		FlagQuantized | FlagRangeCoded | FlagSubsampled | FlagCfL | FlagChunks | FlagGrain | FlagDCPred | FlagRunIndices,
+		FlagQuantized | FlagRangeCoded | uint32(MatrixIdentity)<<flagMatrixShift | FlagLossless,
+		FlagQuantized | FlagRangeCoded | FlagRawStreams | FlagCfL | FlagSubsampled,
+		FlagGzip | FlagQuantized,
+		FlagFrames | uint32(MatrixBT709)<<flagMatrixShift,
+	}
+	invalid := []uint32{
+		FlagGzip | FlagRangeCoded,
+		1 << 31,
+		FlagQuantized | FlagRangeCoded | 3<<flagMatrixShift,
+		FlagGzip | FlagLossless,
+		FlagQuantized | FlagRangeCoded | FlagQTable,
+		FlagFrames | FlagRangeCoded,
+		FlagQuantized | FlagRawStreams,
+	}
+	for _, f := range valid {
+		if err := validateFlags(f); err != nil {
+			t.Fatalf("flags 0x%x rejected: %v", f, err)
+		}
+	}
+	for _, f := range invalid {
+		if validateFlags(f) == nil {
+			t.Fatalf("flags 0x%x accepted", f)
+		}
+	}
+}
+
+// TestVersionGating rewrites the version byte and flags of an encoded file:
+// a future version must fail with a message naming it, and a v1 header
+// may not use flags introduced in v2
+func TestVersionGating(t *testing.T) {
+	data, err := encodeGap(benchRGBA(16, 16), nil, EncodeOptions{S: 0.1, Threshold: 0.5, DCPred: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := append([]byte(nil), data...)
+	future[3] = FormatVersion + 1
+	_, err = readHeader(bytes.NewReader(future))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("version %d", FormatVersion+1)) {
+		t.Fatalf("future file gave %v", err)
+	}
+	v1 := append([]byte(nil), data...)
+	v1[3] = 0x01
+	if _, err := readHeader(bytes.NewReader(v1)); err == nil {
+		t.Fatalf("v1 header with FlagDCPred accepted")
+	}
+	if _, err := readHeader(bytes.NewReader(data)); err != nil {
+		t.Fatalf("current file rejected: %v", err)
+	}
+}
+
+// allocatedBy returns the bytes fn allocates in total (on any goroutine)
+func allocatedBy(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// TestHeaderValidation decodes hand-built hostile headers and expects
+// each to fail with its typed error before anything image-sized is
+// allocated
+func TestHeaderValidation(t *testing.T) {
+	valid, err := encodeGap(benchRGBA(64, 48), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const capBytes = 1 << 20
+	withHeader := func(edit func(h *GapHeader)) []byte {
+		var h GapHeader
+		binary.Read(bytes.NewReader(valid), binary.LittleEndian, &h)
+		edit(&h)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, &h)
+		return append(buf.Bytes(), valid[buf.Len():]...)
+	}
+	cases := []struct {
+		name string
+		data []byte
+		opts DecodeOptions
+		want error
+	}{
+		{"4G x 4G", withHeader(func(h *GapHeader) { h.Width, h.Height = 0xFFFFFFFF, 0xFFFFFFFF }), DecodeOptions{}, ErrTooManyPixels},
+		{"over -max-pixels", valid, DecodeOptions{MaxPixels: 1000}, ErrTooManyPixels},
+		{"over -max-memory", withHeader(func(h *GapHeader) { h.Width, h.Height = 30000, 30000 }), DecodeOptions{MaxMemory: 1 << 30}, ErrOverMemory},
+		{"zero width", withHeader(func(h *GapHeader) { h.Width = 0 }), DecodeOptions{}, ErrInvalidDimensions},
+		{"zero height", withHeader(func(h *GapHeader) { h.Height = 0 }), DecodeOptions{}, ErrInvalidDimensions},
+		{"0 channels", withHeader(func(h *GapHeader) { h.Channels = 0 }), DecodeOptions{}, ErrInvalidChannels},
+		{"5 channels", withHeader(func(h *GapHeader) { h.Channels = 5 }), DecodeOptions{}, ErrInvalidChannels},
+		{"4G channels", withHeader(func(h *GapHeader) { h.Channels = 0xFFFFFFFF }), DecodeOptions{}, ErrInvalidChannels},
+		{"unknown flag", withHeader(func(h *GapHeader) { h.Flags |= 1 << 31 }), DecodeOptions{}, ErrUnsupportedFlags},
+		{"1x1 subsampled", withHeader(func(h *GapHeader) { h.Width, h.Height, h.Flags = 1, 1, h.Flags&^FlagChromaCeil }), DecodeOptions{}, ErrInvalidSubsampling},
+		{"subsampled rgb", withHeader(func(h *GapHeader) { h.Flags = h.Flags&^FlagMatrixMask | uint32(MatrixIdentity)<<flagMatrixShift }), DecodeOptions{}, ErrInvalidSubsampling},
+		{"subsampled gray", withHeader(func(h *GapHeader) { h.Channels = 1 }), DecodeOptions{}, ErrInvalidSubsampling},
+		{"ceil without subsampling", withHeader(func(h *GapHeader) { h.Flags &^= FlagSubsampled }), DecodeOptions{}, ErrInvalidSubsampling},
+		// Within the pixel limit but far bigger than the streams
+		{"30000 x 30000", withHeader(func(h *GapHeader) { h.Width, h.Height = 30000, 30000 }), DecodeOptions{NoVerify: true}, nil},
+	}
+	for _, c := range cases {
+		var err error
+		allocated := allocatedBy(func() { _, _, err = decodeGap(bytes.NewReader(c.data), c.opts) })
+		if err == nil || (c.want != nil && !errors.Is(err, c.want)) {
+			t.Fatalf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		var he *HeaderError
+		if c.want != nil && !errors.As(err, &he) {
+			t.Fatalf("%s: %T is not a *HeaderError", c.name, err)
+		}
+		if allocated > capBytes {
+			t.Fatalf("%s: allocated %d bytes before failing", c.name, allocated)
+		}
+	}
+	if _, _, err := decodeGap(bytes.NewReader(valid), DecodeOptions{MaxPixels: -1}); err != nil {
+		t.Fatalf("no pixel limit: %v", err)
+	}
+}
+
+// TestMaxMemory checks the -max-memory estimate: a file decodes
+// under exactly its estimate and fails one byte below it, and the
+// estimate grows with full-size chroma and shrinks for a luma-only decode
+func TestMaxMemory(t *testing.T) {
+	estimate := func(data []byte, opts DecodeOptions) (uint64, error) {
+		h, err := readHeader(bytes.NewReader(data))
+		if err != nil {
+			return 0, err
+		}
+		return decodeMemory(h, opts), nil
+	}
+	src := colorWheel(640, 480)
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	need, err := estimate(data, DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if need < 640*480*4 {
+		t.Fatalf("estimate %d is below the RGBA output alone", need)
+	}
+	if _, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{MaxMemory: int64(need)}); err != nil {
+		t.Fatalf("at the estimate: %v", err)
+	}
+	if _, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{MaxMemory: int64(need) - 1}); !errors.Is(err, ErrOverMemory) {
+		t.Fatalf("one byte under the estimate: got %v", err)
+	}
+
+	rgb, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, Matrix: MatrixIdentity}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := estimate(rgb, DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	luma, err := estimate(data, DecodeOptions{lumaOnly: true, lossyOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full <= need || luma >= need {
+		t.Fatalf("estimates luma %d, 4:2:0 %d, 4:4:4 %d; want each above the last", luma, need, full)
+	}
+	if _, err := DecodeGray(bytes.NewReader(data), DecodeOptions{MaxMemory: int64(luma)}); err != nil {
+		t.Fatalf("gray decode at its estimate: %v", err)
+	}
+}
+
+// TestDither decodes a shallow 16-bit gradient at 8 bits with and
+// without dithering. Truncation leaves bands whose column means step
+// away from the source; the dithered decode must follow the source more
+// closely with at most half the largest step, and decode the same every
+// time.
+func TestDither(t *testing.T) {
+	const w, h = 256, 64
+	src := image.NewRGBA64(image.Rect(0, 0, w, h))
+	truth := make([]float64, w)
+	for x := 0; x < w; x++ {
+		truth[x] = 100 + 6*float64(x)/w // 8-bit levels
+		v := uint16(truth[x] * 257)
+		for y := 0; y < h; y++ {
+			src.SetRGBA64(x, y, color.RGBA64{v, v, v, 0xFFFF})
+		}
+	}
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mean distance of the column means from the source, and the largest
+	// step between neighboring column means
+	measure := func(img *image.RGBA) (float64, float64) {
+		var errSum, step, prev float64
+		for x := 0; x < w; x++ {
+			var sum float64
+			for y := 0; y < h; y++ {
+				sum += float64(img.Pix[img.PixOffset(x, y)])
+			}
+			errSum += math.Abs(sum/h - truth[x])
+			if x > 0 {
+				step = max(step, math.Abs(sum/h-prev))
+			}
+			prev = sum / h
+		}
+		return errSum / w, step
+	}
+	plain, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dithered, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Dither: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainErr, plainStep := measure(plain)
+	ditherErr, ditherStep := measure(dithered)
+	t.Logf("gradient  column error  largest step\nplain     %12.3f  %12.3f\ndithered  %12.3f  %12.3f", plainErr, plainStep, ditherErr, ditherStep)
+	if ditherErr >= plainErr || ditherStep >= plainStep/2 {
+		t.Fatalf("dithered gradient is not smoother (error %.3f vs %.3f, steps %.3f vs %.3f)", ditherErr, plainErr, ditherStep, plainStep)
+	}
+	again, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Dither: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Pix, dithered.Pix) {
+		t.Fatalf("two dithered decodes differ")
+	}
+}
+
+// TestCrop decodes windows of files coded in each layout, with
+// chroma-from-luma, grain, a lossless residual, dither, an EXIF rotation
+// and at 16 bits, and expects exactly the pixels a full decode has there
+func TestCrop(t *testing.T) {
+	const w, h = 203, 141
+	src := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := func(c int) uint16 {
+				f := 0.5 + 0.3*math.Sin(float64(x*(c+2))*0.07)*math.Cos(float64(y*(3-c))*0.05)
+				if (x/11+y/7+c)%5 == 0 {
+					f = 1 - f
+				} // hard edges for the filters
+				return uint16(f * 0xFFFF)
+			}
+			src.SetRGBA64(x, y, color.RGBA64{v(0), v(1), v(2), 0xFFFF})
+		}
+	}
+	// A minimal little-endian EXIF block holding only Orientation 6
+	rotated := []byte{'I', 'I', '*', 0, 8, 0, 0, 0, 1, 0, 0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0}
+	crops := []image.Rectangle{
+		image.Rect(60, 40, 124, 90),    // interior
+		image.Rect(0, 0, 17, 9),        // top-left corner
+		image.Rect(150, 100, 203, 141), // bottom-right corner
+		image.Rect(33, 47, 34, 48),     // one pixel
+		image.Rect(0, 0, w, h),         // everything
+	}
+	cases := []struct {
+		name string
+		opts EncodeOptions
+		meta []GapChunk
+		dec  DecodeOptions
+	}{
+		{"lossy", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true}, nil, DecodeOptions{}},
+		{"cfl", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true, CfL: true}, nil, DecodeOptions{}},
+		{"grain", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true, Grain: 4}, nil, DecodeOptions{}},
+		{"lossless", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true, Lossless: true}, nil, DecodeOptions{}},
+		{"gzip", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true, Compress: CompressGzip}, nil, DecodeOptions{}},
+		{"dither", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true}, nil, DecodeOptions{Dither: true}},
+		{"rotated", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true}, []GapChunk{{Tag: ChunkExif, Data: rotated}}, DecodeOptions{}},
+		{"16-bit", EncodeOptions{S: 0.1, Threshold: 0.5}, nil, DecodeOptions{}},
+		{"4:1:1", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true, Chroma: Chroma411}, nil, DecodeOptions{ChromaUpsample: UpsampleBicubic}},
+		{"mono", EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true, Chroma: ChromaMono}, nil, DecodeOptions{ChromaUpsample: UpsampleBicubic}},
+	}
+	for _, c := range cases {
+		data, err := encodeGap(src, c.meta, c.opts, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		full, _, err := decodeImageTo(bytes.NewReader(data), c.dec)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		for _, r := range crops {
+			if c.name == "rotated" {
+				r = image.Rect(r.Min.Y, r.Min.X, r.Max.Y, r.Max.X)
+			} // upright is h x w
+			img, err := DecodeRect(bytes.NewReader(data), r, c.dec)
+			if err != nil {
+				t.Fatalf("%s %v: %v", c.name, r, err)
+			}
+			if img.Bounds() != image.Rect(0, 0, r.Dx(), r.Dy()) {
+				t.Fatalf("%s %v: decoded bounds %v", c.name, r, img.Bounds())
+			}
+			for y := 0; y < r.Dy(); y++ {
+				for x := 0; x < r.Dx(); x++ {
+					if got, want := img.At(x, y), full.At(r.Min.X+x, r.Min.Y+y); got != want {
+						t.Fatalf("%s %v: pixel (%d, %d) is %v, full decode has %v", c.name, r, r.Min.X+x, r.Min.Y+y, got, want)
+					}
+				}
+			}
+		}
+	}
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []image.Rectangle{image.Rect(200, 0, 210, 10), image.Rect(-1, 0, 5, 5), image.Rect(5, 5, 5, 9)} {
+		if _, err := DecodeRect(bytes.NewReader(data), r, DecodeOptions{}); err == nil {
+			t.Fatalf("%v of a %dx%d image decoded without an error", r, w, h)
+		}
+	}
+}
+
+// TestScaledDecode decodes files of each kind at 1/2 and 1/4 and
+// compares the luma against a box-filtered full decode by SSIM
+func TestScaledDecode(t *testing.T) {
+	const w, h = 203, 141
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := func(c int) uint8 {
+				f := 0.5 + 0.35*math.Sin(float64(x*(c+2))*0.04)*math.Cos(float64(y*(3-c))*0.03)
+				if (x/23+y/17+c)%4 == 0 {
+					f = 1 - f
+				}
+				return uint8(f * 255)
+			}
+			src.SetRGBA(x, y, color.RGBA{v(0), v(1), v(2), 255})
+		}
+	}
+	luma := func(img *image.RGBA) *image.Gray {
+		b := img.Bounds()
+		g := image.NewGray(b)
+		for i := range g.Pix {
+			p := img.Pix[i*4:]
+			g.Pix[i] = uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000)
+		}
+		return g
+	}
+	cases := []struct {
+		name string
+		opts EncodeOptions
+	}{
+		{"lossy", EncodeOptions{S: 0.1, Threshold: 0.5}},
+		{"cfl", EncodeOptions{S: 0.1, Threshold: 0.5, CfL: true}},
+		{"gzip", EncodeOptions{S: 0.1, Threshold: 0.5, Compress: CompressGzip}},
+		{"lossless", EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: true}},
+		{"grain", EncodeOptions{S: 0.1, Threshold: 0.5, Grain: 3}},
+	}
+	for _, c := range cases {
+		data, full := roundTrip(t, src, c.opts)
+		for _, scale := range []int{2, 4} {
+			img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Scale: scale})
+			if err != nil {
+				t.Fatalf("%s 1/%d: %v", c.name, scale, err)
+			}
+			want := image.Rect(0, 0, (w+scale-1)/scale, (h+scale-1)/scale)
+			if img.Bounds() != want {
+				t.Fatalf("%s 1/%d: decoded %v, want %v", c.name, scale, img.Bounds(), want)
+			}
+			ssim := ssimPlane(luma(img), blockMeans(luma(full), scale))
+			t.Logf("%-8s 1/%d  SSIM %.4f", c.name, scale, ssim)
+			if ssim < 0.9 {
+				t.Fatalf("%s 1/%d: SSIM %.4f against a downscaled full decode", c.name, scale, ssim)
+			}
+		}
+	}
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Scale: 3}); err == nil {
+		t.Fatalf("1/3 decoded without an error")
+	}
+}
+
+// TestBestEffort truncates files of each stream layout at several
+// points: a normal decode fails, a best-effort one gives an image of the
+// full size, and a complete file decodes the same either way. The first
+// patch of a half-cut grayscale file matches the full decode.
+func TestBestEffort(t *testing.T) {
+	const w, h = 96, 64
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	gray := image.NewGray(src.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			src.SetRGBA(x, y, color.RGBA{uint8(x * 2), uint8(128 + 60*math.Sin(float64(x+y)*0.2)), uint8(y * 3), 255})
+			gray.Pix[y*w+x] = uint8(128 + 60*math.Sin(float64(x+y)*0.2))
+		}
+	}
+	raw := DecodeOptions{SkipDeblock: true, SkipAntialias: true, SkipLineContinuity: true}
+	for _, c := range []struct {
+		name string
+		img  image.Image
+		opts EncodeOptions
+	}{
+		{"range", src, EncodeOptions{S: 0.1, Threshold: 0.5}},
+		{"stored", src, EncodeOptions{S: 0.1, Threshold: 0.5, Compress: CompressNone}},
+		{"gzip", src, EncodeOptions{S: 0.1, Threshold: 0.5, Compress: CompressGzip}},
+		{"lossless", src, EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: true, CfL: true}},
+		{"gray-gzip", gray, EncodeOptions{S: 0.1, Threshold: 0.5, Compress: CompressGzip}},
+	} {
+		data, err := encodeGap(c.img, nil, c.opts, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		full, _, err := decodeGap(bytes.NewReader(data), raw)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		opts := raw
+		opts.BestEffort = true
+		same, _, err := decodeGap(bytes.NewReader(data), opts)
+		if err != nil || !bytes.Equal(same.Pix, full.Pix) {
+			t.Fatalf("%s: complete file decodes differently (%v)", c.name, err)
+		}
+		header, err := readHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		start := len(data) - 4
+		if b, err := headerBytes(header); err == nil {
+			start = len(b)
+		}
+		for _, frac := range []float64{0, 0.25, 0.5, 0.75, 0.95} {
+			cut := data[:start+int(frac*float64(len(data)-start))]
+			if _, _, err := decodeGap(bytes.NewReader(cut), raw); err == nil {
+				t.Fatalf("%s: file cut to %d bytes decoded without -best-effort", c.name, len(cut))
+			}
+			img, _, err := decodeGap(bytes.NewReader(cut), opts)
+			if err != nil {
+				t.Fatalf("%s: file cut to %d bytes: %v", c.name, len(cut), err)
+			}
+			if img.Bounds() != full.Bounds() {
+				t.Fatalf("%s: decoded %v, want %v", c.name, img.Bounds(), full.Bounds())
+			}
+			// Half of the file holds the first luma patches (the deflate
+			// tables take the front); a gray image has no chroma to lose
+			if c.name == "gray-gzip" && frac == 0.5 {
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						i := img.PixOffset(x, y)
+						if d := int(img.Pix[i]) - int(full.Pix[i]); d < -2 || d > 2 {
+							t.Fatalf("%s: the first patch of a half file differs at (%d,%d): %d vs %d", c.name, x, y, img.Pix[i], full.Pix[i])
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestSalvage damages files the checksums cannot pin down. A count no
+// parser accepts loses the patches of its plane from there on, and the
+// warning says so per plane. A file cut right after its header decodes
+// to neutral planes, or with MarkLost to the checkerboard.
+func TestSalvage(t *testing.T) {
+	rec := &recordLogger{}
+	defer SetLogger(SetLogger(rec))
+	src := benchRGBA(96, 64)
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, Compress: CompressNone}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb, err := headerBytes(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Luma's counts block follows its angles block, both stored as is
+	pos := len(hb)
+	pos += blockHeaderSize(header.Flags) + int(binary.LittleEndian.Uint32(data[pos+4:])&^storedBlockBit)
+	patches := planePatches(header, 0)
+	bad := append([]byte(nil), data...)
+	bad[pos+blockHeaderSize(header.Flags)+patches/2] = 200
+	if _, _, err := decodeGap(bytes.NewReader(bad), DecodeOptions{}); err == nil {
+		t.Fatalf("a bad count decoded without -best-effort")
+	}
+	img, _, err := decodeGap(bytes.NewReader(bad), DecodeOptions{BestEffort: true})
+	if err != nil {
+		t.Fatalf("bad count: %v", err)
+	}
+	if img.Bounds() != src.Bounds() {
+		t.Fatalf("bad count decoded %v, want %v", img.Bounds(), src.Bounds())
+	}
+	want := fmt.Sprintf("plane 0 lost %d of %d, plane 1 lost 0 of %d", patches-patches/2, patches, planePatches(header, 1))
+	if len(rec.warn) != 1 || !strings.HasPrefix(rec.warn[0], "file is damaged") || !strings.Contains(rec.warn[0], want) {
+		t.Fatalf("bad count warned %q, want %q", rec.warn, want)
+	}
+
+	cut := data[:len(hb)+4]
+	planes, err := DecodePlanes(bytes.NewReader(cut), DecodeOptions{BestEffort: true, SkipDeblock: true})
+	if err != nil {
+		t.Fatalf("cut file: %v", err)
+	}
+	for i, p := range planes.Planes {
+		if slices.ContainsFunc(p.Pix, func(v uint8) bool { return v != 128 }) {
+			t.Fatalf("lost patches of plane %d are not neutral", i)
+		}
+	}
+	planes, err = DecodePlanes(bytes.NewReader(cut), DecodeOptions{BestEffort: true, MarkLost: true, SkipDeblock: true})
+	if err != nil {
+		t.Fatalf("cut file: %v", err)
+	}
+	for i, p := range planes.Planes {
+		dark, light := p.GrayAt(0, 0).Y, p.GrayAt(4, 0).Y
+		if dark >= light || p.GrayAt(4, 4).Y != dark || p.GrayAt(0, 4).Y != light || p.GrayAt(8, 0).Y != dark {
+			t.Fatalf("lost patches of plane %d are not marked", i)
+		}
+	}
+}
+
+// TestDeblockStrength deblocks an image of flat 8x8 blocks whose
+// seams step by 0 to 80 levels with each preset, expecting the total step
+// across seams to shrink from off to weak, normal and strong. Files coded
+// with a high threshold decode with DeblockStrong by default, others with
+// DeblockNormal.
+func TestDeblockStrength(t *testing.T) {
+	const w, h = 96, 96
+	blocky := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(80 + (x/8*37+y/8*59)%9*10)
+			i := blocky.PixOffset(x, y)
+			blocky.Pix[i], blocky.Pix[i+1], blocky.Pix[i+2], blocky.Pix[i+3] = v, v, v, 255
+		}
+	}
+	seamSteps := func(img *image.RGBA) int {
+		abs := func(x int) int {
+			if x < 0 {
+				return -x
+			}
+			return x
+		}
+		total := 0
+		for y := 0; y < h; y++ {
+			for x := 8; x < w; x += 8 {
+				total += abs(int(img.Pix[img.PixOffset(x-1, y)]) - int(img.Pix[img.PixOffset(x, y)]))
+				total += abs(int(img.Pix[img.PixOffset(y, x-1)]) - int(img.Pix[img.PixOffset(y, x)]))
+			}
+		}
+		return total
+	}
+	last := -1
+	for _, preset := range []string{"off", "weak", "normal", "strong"} {
+		p, err := ParseDeblockStrength(preset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := image.NewRGBA(blocky.Rect)
+		copy(img.Pix, blocky.Pix)
+		deblockImage(img, p, true, 8, 0)
+		steps := seamSteps(img)
+		t.Logf("%-6s seam steps %d", preset, steps)
+		if last >= 0 && steps >= last {
+			t.Fatalf("%s leaves seam steps of %d, no fewer than the preset before it (%d)", preset, steps, last)
+		}
+		last = steps
+	}
+	if _, err := ParseDeblockStrength("max"); err == nil {
+		t.Fatalf("unknown preset accepted")
+	}
+
+	raw := DecodeOptions{SkipAntialias: true, SkipLineContinuity: true}
+	for _, c := range []struct {
+		threshold float32
+		want      DeblockParams
+	}{{0.5, DeblockNormal}, {1.5, DeblockStrong}} {
+		data, err := encodeGap(blocky, nil, EncodeOptions{S: 0.1, Threshold: c.threshold}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auto, _, err := decodeGap(bytes.NewReader(data), raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := raw
+		opts.Deblock = &c.want
+		want, _, err := decodeGap(bytes.NewReader(data), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(auto.Pix, want.Pix) {
+			t.Fatalf("a file coded with -t %g does not default to %+v", c.threshold, c.want)
+		}
+		opts.Deblock = &DeblockWeak
+		if weak, _, err := decodeGap(bytes.NewReader(data), opts); err != nil || bytes.Equal(weak.Pix, want.Pix) {
+			t.Fatalf("-t %g decodes the same with DeblockWeak (%v)", c.threshold, err)
+		}
+	}
+}
+
+// TestDeblockEdge puts a small step at the last block seam of images
+// whose width or height is a multiple of 8 (seam at size-8) or one more
+// (seam at size-1, a one-pixel last block) and expects deblocking to
+// soften it in both directions. Without border edges, as lossless files
+// decode, the one-pixel seam stays, and lossless files of those sizes
+// still round-trip exactly.
+func TestDeblockEdge(t *testing.T) {
+	stepped := func(w, h, seam int, vertical bool) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v, pos := uint8(100), y
+				if vertical {
+					pos = x
+				}
+				if pos >= seam {
+					v = 110
+				}
+				i := img.PixOffset(x, y)
+				img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = v, v, v, 255
+			}
+		}
+		return img
+	}
+	for _, c := range []struct{ size, seam int }{{24, 16}, {25, 24}, {17, 16}} {
+		for _, vertical := range []bool{true, false} {
+			w, h := c.size, 16
+			at := func(img *image.RGBA, pos int) uint8 {
+				if vertical {
+					return img.Pix[img.PixOffset(pos, 5)]
+				}
+				return img.Pix[img.PixOffset(5, pos)]
+			}
+			if !vertical {
+				w, h = h, w
+			}
+			img := stepped(w, h, c.seam, vertical)
+			deblockImage(img, DeblockNormal, true, 8, 0)
+			if at(img, c.seam-1) == 100 || at(img, c.seam) == 110 {
+				t.Fatalf("%dx%d seam at %d not filtered: %d | %d", w, h, c.seam, at(img, c.seam-1), at(img, c.seam))
+			}
+			if c.seam == c.size-1 {
+				img = stepped(w, h, c.seam, vertical)
+				deblockImage(img, DeblockNormal, false, 8, 0)
+				if at(img, c.seam-1) != 100 || at(img, c.seam) != 110 {
+					t.Fatalf("%dx%d seam at %d filtered without border edges", w, h, c.seam)
+				}
+			}
+		}
+	}
+	for _, size := range [][2]int{{17, 9}, {25, 33}} {
+		src := benchRGBA(size[0], size[1])
+		_, got := roundTrip(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: true})
+		if !bytes.Equal(got.Pix, src.Pix) {
+			t.Fatalf("%dx%d lossless file does not round-trip", size[0], size[1])
+		}
+	}
+}
+
+// TestPlaneDecodeErrors makes the bulk patch reconstruction fail, in every
+// chunk and then in one chunk of four, and expects decode to return the
+// error with its plane and patches instead of panicking or leaving the
+// chunk at the fill value
+func TestPlaneDecodeErrors(t *testing.T) {
+	data, err := encodeGap(benchRGBA(128, 96), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved func([]float32, []float32, []float32, float32) error) { bulkDecompress = saved }(bulkDecompress)
+	workerLimit.Store(4)
+	defer workerLimit.Store(0)
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("decode panicked: %v", r)
+		}
+	}()
+
+	injected := errors.New("injected failure")
+	for _, failAll := range []bool{true, false} {
+		var calls atomic.Int32
+		bulkDecompress = func(coeffs, angles, output []float32, s float32) error {
+			// Luma's second chunk; planes may run in any order
+			if failAll || s == 0.1 && calls.Add(1) == 2 {
+				return injected
+			}
+			return GapDecompressPatches(coeffs, angles, output, s)
+		}
+		img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+		if !errors.Is(err, injected) {
+			t.Fatalf("got %v, want the injected failure", err)
+		}
+		if img != nil || !strings.Contains(err.Error(), "plane 0") || !strings.Contains(err.Error(), "failed to reconstruct patches") {
+			t.Fatalf("error lacks its context: %v", err)
+		}
+	}
+}
+
+// TestStreamBounds feeds files whose first split stream claims more
+// bytes than the file holds or than its plane can need, and files cut
+// short, and expects ErrTruncatedStream or ErrStreamTooLarge without a
+// stream-sized allocation, both from a payload that knows its length and
+// from a plain reader
+func TestStreamBounds(t *testing.T) {
+	valid, err := encodeGap(benchRGBA(64, 48), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb, _ := headerBytes(header)
+	start := len(hb)
+	withWord := func(data []byte, off int, v uint32) []byte {
+		data = bytes.Clone(data)
+		binary.LittleEndian.PutUint32(data[start+off:], v)
+		return data
+	}
+	// The same file without its footer is read straight from the reader
+	unsummed := bytes.Clone(valid[:len(valid)-checksumSize])
+	binary.LittleEndian.PutUint32(unsummed[headerFlagsOffset:], header.Flags&^FlagChecksum)
+
+	const capBytes = 1 << 20
+	cases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"4G compressed", withWord(valid, 4, 0x7FFFFFFF), ErrTruncatedStream},
+		{"4G uncompressed", withWord(valid, 0, 0xFFFFFFFF), ErrStreamTooLarge},
+		{"truncated", valid[:start+20], ErrTruncatedStream},
+		{"4G compressed, no footer", withWord(unsummed, 4, 0x7FFFFFFF), ErrTruncatedStream},
+		{"4G uncompressed, no footer", withWord(unsummed, 0, 0xFFFFFFFF), ErrStreamTooLarge},
+		{"truncated, no footer", unsummed[:start+20], ErrTruncatedStream},
+	}
+	for _, c := range cases {
+		var err error
+		// MultiReader hides bytes.Reader's Len, as a file would
+		r := io.MultiReader(bytes.NewReader(c.data))
+		allocated := allocatedBy(func() { _, _, err = decodeGap(r, DecodeOptions{NoVerify: true}) })
+		if !errors.Is(err, c.want) {
+			t.Fatalf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		if allocated > capBytes {
+			t.Fatalf("%s: allocated %d bytes before failing", c.name, allocated)
+		}
+		report, err := checkStreams(bytes.NewReader(c.data), "")
+		if err != nil || !errors.Is(report.Err, c.want) {
+			t.Fatalf("check %s: got %v, %v, want %v", c.name, err, report.Err, c.want)
+		}
+	}
+}
+
+// peakHeap runs fn and returns the highest HeapAlloc seen above the heap
+// in use before it started, sampled every millisecond
+func peakHeap(fn func() error) (uint64, error) {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base, peak := ms.HeapAlloc, ms.HeapAlloc
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak {
+				peak = m.HeapAlloc
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	err := fn()
+	close(done)
+	<-sampled
+	if peak < base {
+		return 0, err
+	}
+	return peak - base, err
+}
+
+// TestBandedDecode decodes a plane spanning several bands and expects
+// the pixels of a patch-by-patch decode, with a peak heap well below the
+// whole-plane coefficient buffer (128 float32s a patch) decoding used to
+// allocate
+func TestBandedDecode(t *testing.T) {
+	const w, h = 4096, 2048
+	plane := benchPlane(w, h)
+	po := planeOptions{S: 0.1, Threshold: 0.5, Flags: FlagQuantized | FlagDCPred}
+	a, c, m, idx, v, err := gapEncodePlane(plane, w, h, po, nil)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	var got *image.Gray
+	peak, err := peakHeap(func() error {
+		var err error
+		got, err = gapDecodePlaneSplit(a, c, m, idx, v, w, h, po.Flags, 0, 0.1, nil, nil, 0)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := image.NewGray(image.Rect(0, 0, w, h))
+	if n := recoverPatches([5][]byte{a, c, m, idx, v}, grayWriter{img: want}, w, h, po.Flags, 0.1, nil, nil); n != w/8*h/8 {
+		t.Fatalf("reference decode stopped at patch %d", n)
+	}
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Fatalf("pixels differ from a patch-by-patch decode")
+	}
+	patches := uint64(w / 8 * h / 8)
+	t.Logf("%dx%d plane peak heap: %d KB (whole-plane coefficients: %d KB)", w, h, peak/1024, patches*128*4/1024)
+	if limit := uint64(w*h) + patches*128*4/4; peak > limit {
+		t.Fatalf("peaked at %d bytes, limit %d", peak, limit)
+	}
+}
+
+// TestTileHeight decodes a file with several tile heights, including
+// one covering whole planes, and expects the same pixels each time, then
+// checks that short tiles bring the peak heap well below whole planes
+func TestTileHeight(t *testing.T) {
+	data, want := roundTrip(t, benchRGBA(200, 120), EncodeOptions{S: 0.1, Threshold: 0.5})
+	for _, rows := range []int{1, 2, 7, 1 << 20} {
+		got, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{TileHeight: rows})
+		if err != nil {
+			t.Fatalf("tile height %d: %v", rows, err)
+		}
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Fatalf("tile height %d: pixels differ from the default", rows)
+		}
+	}
+
+	const w, h = 2048, 2048
+	data, err := encodeGap(benchRGBA(w, h), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	var peaks [2]uint64
+	for i, rows := range []int{1 << 20, 4} {
+		peaks[i], err = peakHeap(func() error {
+			_, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{TileHeight: rows})
+			return err
+		})
+		if err != nil {
+			t.Fatalf("tile height %d: %v", rows, err)
+		}
+	}
+	t.Logf("%dx%d peak heap: %d KB whole planes, %d KB in 4-row tiles", w, h, peaks[0]/1024, peaks[1]/1024)
+	if peaks[1] > peaks[0]/2 {
+		t.Fatalf("4-row tiles peaked at %d bytes, whole planes at %d", peaks[1], peaks[0])
+	}
+}
+
+// TestDecodeImageTo encodes a synthetic image, decodes it once to PNG and
+// once to memory, and expects the same pixels
+func TestDecodeImageTo(t *testing.T) {
+	data, err := encodeGap(benchRGBA(48, 40), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Decode(bytes.NewReader(data), &buf, DecodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeImageTo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != want.Bounds() || !math.IsInf(PSNR(got, want), 1) {
+		t.Fatalf("image differs from the PNG output")
+	}
+	if _, err := DecodeImageTo(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Fatalf("truncated stream accepted")
+	}
+}
+
+// TestSeamFilter runs each preset over a blocky image: off must leave
+// it untouched, strong must change more pixels than light, and the image
+// borders (which are not seams) must only change within radius of a seam
+// running across them.
+func TestSeamFilter(t *testing.T) {
+	const w, h = 37, 29 // Partial last blocks in both directions
+	blocky := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x/8)*40 + (y/8)*25)
+			blocky.SetRGBA(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	changed := func(p SeamFilterParams) (int, error) {
+		img := image.NewRGBA(blocky.Rect)
+		copy(img.Pix, blocky.Pix)
+		applyLineContinuityFilter(img, p, 8, 0)
+		n := 0
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				i := img.PixOffset(x, y)
+				if img.Pix[i] == blocky.Pix[i] {
+					continue
+				}
+				n++
+				if (x == 0 || x == w-1) && !isNearSeam(y, h, p.SeamRadius, 8) {
+					return 0, fmt.Errorf("border pixel (%d,%d) changed away from any seam", x, y)
+				}
+				if (y == 0 || y == h-1) && !isNearSeam(x, w, p.SeamRadius, 8) {
+					return 0, fmt.Errorf("border pixel (%d,%d) changed away from any seam", x, y)
+				}
+			}
+		}
+		return n, nil
+	}
+	off, err := changed(SeamFilterOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	light, err := changed(SeamFilterLight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strong, err := changed(SeamFilterStrong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != 0 || light == 0 || strong <= light {
+		t.Fatalf("changed pixels off=%d light=%d strong=%d", off, light, strong)
+	}
+	if _, err := ParseSeamFilter("medium"); err == nil {
+		t.Fatalf("unknown preset accepted")
+	}
+}
+
+// TestDespeckle antialiases a dark field with a white single-pixel
+// star: the default threshold averages it away, while impulse threshold 0
+// (-no-despeckle) or one above the star's contrast keeps it
+func TestDespeckle(t *testing.T) {
+	star := func() *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		for i := range img.Pix {
+			img.Pix[i] = 20
+			if i%4 == 3 {
+				img.Pix[i] = 255
+			}
+		}
+		img.SetRGBA(8, 8, color.RGBA{250, 250, 250, 255})
+		return img
+	}
+	for _, tc := range []struct {
+		threshold int
+		keep      bool
+	}{{DefaultImpulseThreshold, false}, {0, true}, {240, true}} {
+		img := star()
+		applyEdgeAntialiasing(img, tc.threshold, 0)
+		if kept := img.RGBAAt(8, 8).R == 250; kept != tc.keep {
+			t.Fatalf("threshold %d left the star at %d", tc.threshold, img.RGBAAt(8, 8).R)
+		}
+	}
+}
+
+// TestConcurrentDecode decodes several files from many goroutines at
+// once, after leaving garbage in coeffPool, and expects each to match its
+// sequential decode. The legacy layouts take the pooled path.
+func TestConcurrentDecode(t *testing.T) {
+	var files, want [][]byte
+	for i, c := range []Compression{CompressGzip, CompressInterleaved, CompressRange, CompressInterleaved} {
+		src := benchRGBA(40+i*13, 24+i*7)
+		if i == 3 {
+			src = colorWheel(64, 48)
+		}
+		opts := EncodeOptions{S: 0.1, Threshold: 0.5, Compress: c, SkipFlat: i%2 == 1}
+		data, img := roundTrip(t, src, opts)
+		files, want = append(files, data), append(want, img.Pix)
+	}
+
+	dirty := make([]float32, 128)
+	for i := range dirty {
+		dirty[i] = float32(i) + 0.5
+	}
+	coeffPool.Put(dirty)
+	if c := getCoeffs(); slices.ContainsFunc(c, func(v float32) bool { return v != 0 }) {
+		t.Fatalf("getCoeffs returned a used buffer")
+	}
+
+	const goroutines, rounds = 8, 5
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rounds {
+				// Leave a dirty buffer behind as a careless caller would
+				coeffPool.Put(slices.Repeat([]float32{float32(g + r + 1)}, 128))
+				i := (g + r) % len(files)
+				img, _, err := decodeGap(bytes.NewReader(files[i]), DecodeOptions{Workers: 1})
+				if err != nil {
+					t.Errorf("file %d: %v", i, err)
+					return
+				}
+				if !bytes.Equal(img.Pix, want[i]) {
+					t.Errorf("file %d differs from its sequential decode", i)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestLegacyZeroChannels decodes a v1 gray file whose Channels field is
+// 0, as the earliest encoders wrote it, to the same pixels as with 1
+func TestLegacyZeroChannels(t *testing.T) {
+	data, err := legacyGzipGap(benchRGBA(40, 24), 0.1, 0.5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _, err := decodeImageTo(bytes.NewReader(data), DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(zero[24:], 0)
+	got, _, err := decodeImageTo(bytes.NewReader(zero), DecodeOptions{})
+	if err != nil {
+		t.Fatalf("Channels 0: %v", err)
+	}
+	g, ok := got.(*image.Gray)
+	if !ok || !bytes.Equal(g.Pix, want.(*image.Gray).Pix) {
+		t.Fatalf("Channels 0 decoded to a %T unlike Channels 1", got)
+	}
+}
+
+// TestStreamValidation encodes a small plane, then decodes corrupted
+// copies of its streams; each corruption must be reported as an error.
+func TestStreamValidation(t *testing.T) {
+	const w, h = 32, 24
+	plane := benchPlane(w, h)
+	for _, flags := range []uint32{FlagQuantized, FlagQuantized | FlagRunIndices | FlagSkipFlat} {
+		a, c, m, idx, v, err := gapEncodePlane(plane, w, h, planeOptions{S: 0.1, Threshold: 0.5, Flags: flags}, nil)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		if _, err := gapDecodePlaneSplit(a, c, m, idx, v, w, h, flags, 0, 0.1, nil, nil, 0); err != nil {
+			t.Fatalf("intact streams rejected: %v", err)
+		}
+
+		clone := func(b []byte) []byte { return append([]byte(nil), b...) }
+		badCount := clone(c)
+		badCount[0] = 65
+		badIndex := clone(idx)
+		badIndex[0] = 200
+		cases := []struct {
+			name    string
+			streams [5][]byte
+		}{
+			{"short counts", [5][]byte{a, c[:len(c)-1], m, idx, v}},
+			{"short values", [5][]byte{a, c, m, idx, v[:len(v)-1]}},
+			{"extra indices", [5][]byte{a, c, m, append(clone(idx), 0), v}},
+			{"extra maxVals", [5][]byte{a, c, append(clone(m), 0, 0, 0, 0), idx, v}},
+			{"count over 64", [5][]byte{a, badCount, m, idx, v}},
+			{"index out of range", [5][]byte{a, c, m, badIndex, v}},
+		}
+		for _, tc := range cases {
+			s := tc.streams
+			if _, err := gapDecodePlaneSplit(s[0], s[1], s[2], s[3], s[4], w, h, flags, 0, 0.1, nil, nil, 0); err == nil {
+				t.Fatalf("%s accepted (flags 0x%x)", tc.name, flags)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodePlaneSplit(b *testing.B) {
+	plane := benchPlane(benchW, benchH)
+	angles, counts, maxVals, indices, values, err := gapEncodePlane(plane, benchW, benchH, benchPlaneOptions, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(benchW * benchH))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := gapDecodePlaneSplit(angles, counts, maxVals, indices, values, benchW, benchH, FlagQuantized, 0, 0.1, nil, nil, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchDecodePlanes decodes the planes of one image coded with c,
+// skipping the post-filters, so range coding and stored streams can be
+// compared on the part they differ in.
+func benchDecodePlanes(b *testing.B, c Compression) {
+	data, err := encodeGap(benchRGBA(benchW, benchH), nil, EncodeOptions{S: 0.1, Threshold: 0.5, Compress: c}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// The decoder logs the stream layout every time
+	defer SetLogger(SetLogger(nil))
+	b.SetBytes(int64(benchW * benchH))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(data)
+		header, err := readHeader(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, _, err := decodePlanes(r, header, DecodeOptions{}, &DecodeStats{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePlanesRange(b *testing.B)  { benchDecodePlanes(b, CompressRange) }
+func BenchmarkDecodePlanesStored(b *testing.B) { benchDecodePlanes(b, CompressNone) }
+
+// benchDecode runs the whole decode, filters included, of a 4:2:0 image
+// to RGBA or, with gray, to its luma alone
+func benchDecode(b *testing.B, gray bool) {
+	data, err := encodeGap(benchRGBA(benchW, benchH), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer SetLogger(SetLogger(nil))
+	b.SetBytes(int64(benchW * benchH))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeImageTo(bytes.NewReader(data), DecodeOptions{Gray: gray}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeRGBA(b *testing.B) { benchDecode(b, false) }
+func BenchmarkDecodeGray(b *testing.B) { benchDecode(b, true) }
+
+// benchDecodePNG runs what decode -bench times: the whole decode of a
+// 4:2:0 image and its PNG encoding, with the stage timings collected when
+// timed, so the instrumentation's own cost shows against the plain run
+func benchDecodePNG(b *testing.B, timed bool) {
+	data, err := encodeGap(benchRGBA(benchW, benchH), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer SetLogger(SetLogger(nil))
+	b.SetBytes(int64(benchW * benchH))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		opts := DecodeOptions{}
+		if timed {
+			opts.Stats = &DecodeStats{}
+		}
+		if err := Decode(bytes.NewReader(data), io.Discard, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePNG(b *testing.B)      { benchDecodePNG(b, false) }
+func BenchmarkDecodePNGTimed(b *testing.B) { benchDecodePNG(b, true) }
+
+func BenchmarkDeblock(b *testing.B) {
+	src := benchRGBA(benchW, benchH)
+	img := image.NewRGBA(src.Rect)
+	b.SetBytes(int64(benchW * benchH))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		copy(img.Pix, src.Pix)
+		b.StartTimer()
+		DeblockImageParallel(img)
+	}
+}
+
+// BenchmarkPlanesToRGBA4K merges three 4K planes into RGBA row by row;
+// BenchmarkPlanesToRGBA4KScalar does it per pixel through color.YCbCrToRGB, as
+// the decoder used to.
+func BenchmarkPlanesToRGBA4K(b *testing.B) {
+	y, cb, cr := benchPlane(3840, 2160), benchPlane(3840, 2160), benchPlane(3840, 2160)
+	dst := image.NewRGBA(y.Rect)
+	b.SetBytes(3840 * 2160)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for row := 0; row < 2160; row++ {
+			planesToRGBARow(MatrixBT601, planeRow(y, row), planeRow(cb, row), planeRow(cr, row), dst.Pix[dst.PixOffset(0, row):])
+		}
+	}
+}
+
+func BenchmarkPlanesToRGBA4KScalar(b *testing.B) {
+	y, cb, cr := benchPlane(3840, 2160), benchPlane(3840, 2160), benchPlane(3840, 2160)
+	dst := image.NewRGBA(y.Rect)
+	b.SetBytes(3840 * 2160)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for row := 0; row < 2160; row++ {
+			for x := 0; x < 3840; x++ {
+				r, g, bl := color.YCbCrToRGB(y.GrayAt(x, row).Y, cb.GrayAt(x, row).Y, cr.GrayAt(x, row).Y)
+				o := dst.PixOffset(x, row)
+				dst.Pix[o], dst.Pix[o+1], dst.Pix[o+2], dst.Pix[o+3] = r, g, bl, 255
+			}
+		}
+	}
+}
+
+func BenchmarkUpsample(b *testing.B) {
+	plane := benchPlane(benchW/2, benchH/2)
+	b.SetBytes(int64(benchW * benchH))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		upsamplePlane(plane, benchW, benchH, UpsampleBilinear, 0)
+	}
+}
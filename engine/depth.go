@@ -0,0 +1,297 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "sync"
+    "time"
+)
+
+// chromaZero16 is the neutral chroma level on the 16-bit scale, 128 * 257,
+// so 8-bit reconstructions of a 16-bit plane keep 128 as neutral
+const chromaZero16 = 128 * 257
+
+// isHighDepth reports whether img carries 16 bits per channel: 16-bit PNGs
+// decode to these color models (image.DecodeConfig reports the same)
+func isHighDepth(img image.Image) bool {
+    switch img.ColorModel() {
+    case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+        return true
+    }
+    return false
+}
+
+func clampToUint16(v float32) uint16 {
+    if v < 0 { return 0 }
+    if v > 65535 { return 65535 }
+    return uint16(v + 0.5)
+}
+
+// rgbToPlanes16 is rgbToPlanes on 16-bit samples
+func rgbToPlanes16(m ColorMatrix, r, g, b uint16) (uint16, uint16, uint16) {
+    fr, fg, fb := float32(r), float32(g), float32(b)
+    switch m {
+    case MatrixBT709:
+        y := float32(0.2126*fr) + float32(0.7152*fg) + float32(0.0722*fb)
+        return clampToUint16(y), clampToUint16((fb-y)/1.8556 + chromaZero16), clampToUint16((fr-y)/1.5748 + chromaZero16)
+    case MatrixIdentity:
+        return r, g, b
+    }
+    // Products rounded separately, as in rgbToPlanes, so no FMA fusing
+    y := float32(0.299*fr) + float32(0.587*fg) + float32(0.114*fb)
+    cb := float32(-0.168736*fr) - float32(0.331264*fg) + float32(0.5*fb) + chromaZero16
+    cr := float32(0.5*fr) - float32(0.418688*fg) - float32(0.081312*fb) + chromaZero16
+    return clampToUint16(y), clampToUint16(cb), clampToUint16(cr)
+}
+
+// planesToRGB16 is the inverse of rgbToPlanes16
+func planesToRGB16(m ColorMatrix, y, cb, cr uint16) (uint16, uint16, uint16) {
+    if m == MatrixIdentity {
+        return y, cb, cr
+    }
+    r, g, b := planeDeltaToRGB(m, 0, float32(cb)-chromaZero16, float32(cr)-chromaZero16)
+    fy := float32(y)
+    return clampToUint16(fy + r), clampToUint16(fy + g), clampToUint16(fy + b)
+}
+
+// splitImagePlanes16 is splitImagePlanes for 16-bit sources
+func splitImagePlanes16(src image.Image, m ColorMatrix, workers int) (*image.Gray16, *image.Gray16, *image.Gray16) {
+    bounds := src.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    rect := image.Rect(0, 0, width, height)
+    p0, p1, p2 := image.NewGray16(rect), image.NewGray16(rect), image.NewGray16(rect)
+    src64, _ := src.(image.RGBA64Image)
+
+    numWorkers := workerCount(workers)
+    rowsPerWorker := (height + numWorkers - 1) / numWorkers
+
+    var wg sync.WaitGroup
+    for w := 0; w < numWorkers; w++ {
+        startY := w * rowsPerWorker
+        endY := startY + rowsPerWorker
+        if endY > height { endY = height }
+        if startY >= height { continue }
+
+        wg.Add(1)
+        go func(sy, ey int) {
+            defer wg.Done()
+            for y := sy; y < ey; y++ {
+                for x := 0; x < width; x++ {
+                    var r, g, b uint16
+                    if src64 != nil {
+                        c := src64.RGBA64At(bounds.Min.X+x, bounds.Min.Y+y)
+                        r, g, b = c.R, c.G, c.B
+                    } else {
+                        r32, g32, b32, _ := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+                        r, g, b = uint16(r32), uint16(g32), uint16(b32)
+                    }
+                    v0, v1, v2 := rgbToPlanes16(m, r, g, b)
+                    p0.SetGray16(x, y, color.Gray16{Y: v0})
+                    p1.SetGray16(x, y, color.Gray16{Y: v1})
+                    p2.SetGray16(x, y, color.Gray16{Y: v2})
+                }
+            }
+        }(startY, endY)
+    }
+    wg.Wait()
+    return p0, p1, p2
+}
+
+// downsamplePlane16 is downsamplePlane for 16-bit planes
+func downsamplePlane16(src *image.Gray16) *image.Gray16 {
+    w, h := src.Bounds().Dx(), src.Bounds().Dy()
+    newW, newH := chromaPlaneSize(w, h, FlagChromaCeil)
+    dst := image.NewGray16(image.Rect(0, 0, newW, newH))
+    for y := 0; y < newH; y++ {
+        y2 := min(y*2+1, h-1)
+        for x := 0; x < newW; x++ {
+            x2 := min(x*2+1, w-1)
+            sum := int(src.Gray16At(x*2, y*2).Y) + int(src.Gray16At(x2, y*2).Y) +
+                int(src.Gray16At(x*2, y2).Y) + int(src.Gray16At(x2, y2).Y)
+            dst.SetGray16(x, y, color.Gray16{Y: uint16(sum / 4)})
+        }
+    }
+    return dst
+}
+
+// upsamplePlane16 is upsamplePlane for 16-bit planes: exactly 2x,
+// chroma sample x sitting at luma position 2x+0.5
+func upsamplePlane16(src *image.Gray16, targetW, targetH int, mode ChromaUpsample, workers int) *image.Gray16 {
+    srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+    dst := image.NewGray16(image.Rect(0, 0, targetW, targetH))
+    cols := mode.columnTaps(targetW, 0.5, srcW)
+
+    var wg sync.WaitGroup
+    numWorkers := workerCount(workers)
+    rowsPerWorker := (targetH + numWorkers - 1) / numWorkers
+    for startY := 0; startY < targetH; startY += rowsPerWorker {
+        wg.Add(1)
+        go func(y0, y1 int) {
+            defer wg.Done()
+            for y := y0; y < y1; y++ {
+                ty := mode.taps(y, 0.5, srcH)
+                for x := 0; x < targetW; x++ {
+                    tx := &cols[x]
+                    var val float32
+                    for j := 0; j < ty.n; j++ {
+                        var sum float32
+                        for k := 0; k < tx.n; k++ {
+                            sum += float32(src.Gray16At(tx.idx[k], ty.idx[j]).Y) * tx.wt[k]
+                        }
+                        val += sum * ty.wt[j]
+                    }
+                    dst.SetGray16(x, y, color.Gray16{Y: clampToUint16(val)})
+                }
+            }
+        }(startY, min(startY+rowsPerWorker, targetH))
+    }
+    wg.Wait()
+    return dst
+}
+
+// newGray16Plane allocates a 16-bit plane filled with an 8-bit level
+func newGray16Plane(width, height int, level uint8) *image.Gray16 {
+    img := image.NewGray16(image.Rect(0, 0, width, height))
+    for i := 0; i < len(img.Pix); i += 2 {
+        img.Pix[i], img.Pix[i+1] = level, level // level * 257
+    }
+    return img
+}
+
+// gray16Writer reconstructs into a 16-bit plane
+type gray16Writer struct{ img *image.Gray16 }
+
+func (w gray16Writer) writePatch(x, y int, patch []float32) {
+    width, height := w.img.Rect.Dx(), w.img.Rect.Dy()
+    for py := 0; py < 8 && y+py < height; py++ {
+        row := w.img.Pix[(y+py)*w.img.Stride:]
+        for px := 0; px < 8 && x+px < width; px++ {
+            v := clampToUint16(patch[py*8+px] * 65535)
+            row[(x+px)*2], row[(x+px)*2+1] = uint8(v>>8), uint8(v)
+        }
+    }
+}
+
+func (w gray16Writer) fillBlock(x, y int, level uint8) {
+    b := w.img.Bounds()
+    for py := y; py < y+8 && py < b.Dy(); py++ {
+        for px := x; px < x+8 && px < b.Dx(); px++ {
+            i := py*w.img.Stride + px*2
+            w.img.Pix[i], w.img.Pix[i+1] = level, level
+        }
+    }
+}
+
+// peekHeader reads the fixed header of the .gap stream buffered in br
+// without consuming anything; ok is false if br does not hold one
+func peekHeader(br *bufio.Reader) (h GapHeader, ok bool) {
+    buf, err := br.Peek(binary.Size(GapHeader{}))
+    if err != nil {
+        return h, false
+    }
+    if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+        return h, false
+    }
+    return h, string(h.Magic[:3]) == "GAP"
+}
+
+// peekHighDepth reports whether the .gap stream buffered in br has
+// FlagHighDepth set, without consuming anything
+func peekHighDepth(br *bufio.Reader) bool {
+    h, ok := peekHeader(br)
+    return ok && h.Flags&FlagHighDepth != 0
+}
+
+// decodeGap16 is decodeGap for FlagHighDepth files, reconstructing the
+// planes at 16 bits into an *image.RGBA64 (or *image.Gray16 for a single
+// plane). The post-filters work on 8-bit pixels, so they run on an 8-bit
+// copy and only the changes they make beyond its rounding are carried
+// over; other pixels keep their full precision.
+func decodeGap16(file io.Reader, opts DecodeOptions) (image.Image, *gapFileHeader, error) {
+    stats := opts.Stats
+    if stats == nil { stats = &DecodeStats{} }
+    start := time.Now()
+    header, err := readHeader(file)
+    if err != nil {
+        return nil, nil, err
+    }
+    stats.add(&stats.HeaderRead, start)
+
+    width, height := int(header.Width), int(header.Height)
+    channels := len(header.Planes)
+    if header.Flags&FlagFrames != 0 {
+        return nil, nil, fmt.Errorf("file holds %d frames; use decode-seq", len(header.Frames))
+    }
+    logInfof("Image: %dx%d, %d ch, %s, 16-bit", width, height, channels, matrixFromFlags(header.Flags))
+    if opts.Deblock == nil { opts.Deblock = fileDeblock(header) }
+    // 16-bit crops decode the whole image and cut it
+    crop := image.Rect(0, 0, width, height)
+    if opts.Crop != (image.Rectangle{}) {
+        if crop, err = storedCrop(header, opts.Crop, opts.NoAutoRotate); err != nil {
+            return nil, nil, err
+        }
+    }
+
+    opts.fullDepth = true
+    _, planes, _, err := decodePlanes(file, header, opts, stats)
+    if err != nil {
+        return nil, nil, err
+    }
+    if planes == nil {
+        return nil, nil, fmt.Errorf("file is not 16-bit")
+    }
+
+    if header.Flags&FlagSubsampled != 0 && channels == 3 {
+        start = time.Now()
+        planes[1] = upsamplePlane16(planes[1], width, height, opts.ChromaUpsample, opts.Workers)
+        planes[2] = upsamplePlane16(planes[2], width, height, opts.ChromaUpsample, opts.Workers)
+        stats.add(&stats.Upsample, start)
+    }
+    start = time.Now()
+    img := image.NewRGBA64(image.Rect(0, 0, width, height))
+    matrix := matrixFromFlags(header.Flags)
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            v := planes[0].Gray16At(x, y).Y
+            r, g, b := v, v, v
+            if channels == 3 {
+                r, g, b = planesToRGB16(matrix, v, planes[1].Gray16At(x, y).Y, planes[2].Gray16At(x, y).Y)
+            }
+            img.SetRGBA64(x, y, color.RGBA64{R: r, G: g, B: b, A: 0xFFFF})
+        }
+    }
+    stats.add(&stats.ColorMerge, start)
+
+    if !opts.SkipDeblock || !opts.SkipAntialias || !opts.SkipLineContinuity {
+        before := image.NewRGBA(img.Bounds())
+        for i := range before.Pix {
+            before.Pix[i] = uint8((int(img.Pix[i*2])<<8 | int(img.Pix[i*2+1]) + 128) / 257)
+        }
+        filtered := image.NewRGBA(img.Bounds())
+        copy(filtered.Pix, before.Pix)
+        applyPostFilters(filtered, opts, stats)
+        for i, f := range filtered.Pix {
+            // A one-level change is within the 8-bit copy's rounding
+            if d := int(f) - int(before.Pix[i]); d < -1 || d > 1 {
+                v := clampToUint16(float32(int(img.Pix[i*2])<<8|int(img.Pix[i*2+1])) + float32(d*257))
+                img.Pix[i*2], img.Pix[i*2+1] = uint8(v>>8), uint8(v)
+            }
+        }
+    }
+
+    if channels == 1 {
+        gray := image.NewGray16(img.Bounds())
+        for y := 0; y < height; y++ {
+            for x := 0; x < width; x++ {
+                gray.SetGray16(x, y, color.Gray16{Y: img.RGBA64At(x, y).R})
+            }
+        }
+        return cropImage(gray, crop), header, nil
+    }
+    return cropImage(img, crop), header, nil
+}
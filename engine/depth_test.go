@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// TestHighDepth codes a shallow 16-bit gradient (four 8-bit levels
+// across 256 pixels, so 8-bit coding turns it into bands) at full depth
+// and with -8bit, and expects the 16-bit decode to follow the ramp at
+// least twice as closely. -8bit decoding of the 16-bit file must still
+// give an 8-bit PNG.
+func TestHighDepth(t *testing.T) {
+	src := image.NewRGBA64(image.Rect(0, 0, 256, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 256; x++ {
+			v := uint16(20000 + x*4)
+			src.SetRGBA64(x, y, color.RGBA64{R: v, G: v + 3000, B: v - 2000, A: 0xFFFF})
+		}
+	}
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	rmsError := func(opts EncodeOptions, dopts DecodeOptions) (float64, color.Model, error) {
+		var gapBuf, out bytes.Buffer
+		if err := Encode(bytes.NewReader(pngBuf.Bytes()), &gapBuf, opts); err != nil {
+			return 0, nil, err
+		}
+		if err := Decode(bytes.NewReader(gapBuf.Bytes()), &out, dopts); err != nil {
+			return 0, nil, err
+		}
+		img, err := png.Decode(&out)
+		if err != nil {
+			return 0, nil, err
+		}
+		var sum float64
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 256; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				c := src.RGBA64At(x, y)
+				for _, d := range []float64{float64(r) - float64(c.R), float64(g) - float64(c.G), float64(b) - float64(c.B)} {
+					sum += d * d
+				}
+			}
+		}
+		return math.Sqrt(sum / (256 * 32 * 3)), img.ColorModel(), nil
+	}
+
+	deep, model, err := rmsError(EncodeOptions{S: 0.1, Threshold: 0.5}, DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model != color.RGBA64Model {
+		t.Fatalf("decoded PNG is not 16-bit")
+	}
+	shallow, _, err := rmsError(EncodeOptions{S: 0.1, Threshold: 0.5, EightBit: true}, DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, model, err := rmsError(EncodeOptions{S: 0.1, Threshold: 0.5}, DecodeOptions{EightBit: true}); err != nil {
+		t.Fatal(err)
+	} else if model != color.RGBAModel {
+		t.Fatalf("-8bit decode is not an 8-bit PNG")
+	}
+	t.Logf("RMS error (16-bit units): %.1f at 16 bits, %.1f at 8 bits", deep, shallow)
+	if deep*2 > shallow {
+		t.Fatalf("RMS error %.1f is not under half the 8-bit path's %.1f", deep, shallow)
+	}
+}
@@ -2,16 +2,16 @@ package main
 
 import (
     "bytes"
+    "compress/gzip"
     "encoding/binary"
     "fmt"
     "image"
-    "image/color"
-    _ "image/jpeg"
-    _ "image/png"
+    "io"
     "math"
     "os"
+    "slices"
     "sync"
-    "runtime"
+    "time"
 )
 
 var patchPool = sync.Pool{
@@ -20,6 +20,14 @@ var patchPool = sync.Pool{
 	},
 }
 
+// streamPool holds range-coder output buffers, so writing a file's
+// stream blocks reuses one scratch buffer instead of allocating per stream
+var streamPool = sync.Pool{
+	New: func() any {
+		return new([]byte)
+	},
+}
+
 // GapHeader structure matches the spec
 type GapHeader struct {
     Magic     [4]byte
@@ -28,199 +36,1095 @@ type GapHeader struct {
     S         float32
     Threshold float32
     Flags     uint32
-    Channels  uint32 // New for v1.4
+    Channels  uint32 // Plane count; 0 in the earliest files means 1
+}
+
+// FormatVersion is the version byte written in Magic[3].
+// v1: single S/Threshold in the header (chroma planes decoded with luma s)
+// v2: per-plane parameter table follows the header
+// Decoders reject versions above their own, and flags a version predates
+// (see versionFlags).
+const FormatVersion = 0x02
+
+// PlaneParams records the transform parameters used for one plane
+type PlaneParams struct {
+    S         float32
+    Threshold float32
 }
 
-func EncodeImage(inputPath, outputPath string, s, threshold float32) error {
-    // 1. Load Image
-    file, err := os.Open(inputPath)
+// Header flag bits
+const (
+    FlagGzip       = 1
+    FlagQuantized  = 2
+    FlagSubsampled = 4
+    FlagRangeCoded = 8
+    FlagChunks     = 16 // Metadata chunk table follows the header
+    FlagMatrixMask = 0x60 // 2-bit ColorMatrix code
+    FlagLossless   = 0x80 // RGB residual stream follows the plane streams
+    FlagDCPred     = 0x100 // DC coded as a residual against left/top neighbors
+    FlagRunIndices = 0x200 // Indices are zero-run lengths in frequency scan order
+    FlagQTable     = 0x400 // Per-bin quantization weights stored in ChunkQTable
+    FlagFrames     = 0x800 // Sequence container: frame index follows, frames are complete .gap streams
+    FlagCfL        = 0x1000 // Chroma predicted from luma; per-patch alpha blocks follow the plane streams
+    FlagGrain      = 0x2000 // Per-plane grain sigma stored in ChunkGrain for decoder-side synthesis
+    FlagSkipFlat   = 0x4000 // Flat patches coded as count 0xFF plus one level byte; count precedes angle
+    FlagAngleDelta = 0x8000 // Angles stored as the difference (mod 256) from the left patch in the block row
+    FlagDepthMask  = 0x1F0000 // Coefficient bit depth 2..16 (0 = 8); depths above 8 store int16 values
+    FlagHalfMaxVal = 0x200000 // Per-patch maxVal stored as IEEE half precision (2 bytes) instead of float32
+    FlagCompand    = 0x400000 // AC coefficients quantized on a square-root curve (see quantizeCompanded)
+    FlagRawStreams = 0x800000 // With FlagRangeCoded: the split streams are stored without entropy coding
+    FlagHighDepth  = 0x1000000 // Planes hold 16-bit samples; decoders can reconstruct them to a 16-bit PNG
+    FlagChromaCeil = 0x2000000 // Subsampled chroma planes round odd sizes up (see chromaPlaneSize)
+    FlagChecksum   = 0x4000000 // A CRC32-C of everything after the chunks ends the file (see appendChecksum)
+    FlagStoredBlocks = 0x8000000 // With FlagRangeCoded: blocks whose compressed length has storedBlockBit set are stored
+    FlagStreamCRC  = 0x10000000 // With FlagRangeCoded: each block carries a CRC32-C of its uncompressed data
+    FlagEncrypted  = 0x20000000 // Everything after the chunks is AES-256-GCM sealed (see ChunkCrypto)
+    FlagSparseAngles = 0x40000000 // Patches with no coefficients store no angle byte; count precedes angle
+    FlagChromaMode = 0x80000000 // Subsampled chroma is reduced as ChunkChroma says (4:1:1 or mono) instead of 4:2:0
+
+    flagMatrixShift = 5
+    flagDepthShift  = 16
+
+    // headerFlagsOffset is the byte offset of GapHeader.Flags
+    headerFlagsOffset = 20
+
+    // knownFlags is every bit this decoder understands
+    knownFlags = FlagGzip | FlagQuantized | FlagSubsampled | FlagRangeCoded | FlagChunks | FlagMatrixMask |
+        FlagLossless | FlagDCPred | FlagRunIndices | FlagQTable | FlagFrames | FlagCfL | FlagGrain | FlagSkipFlat |
+        FlagAngleDelta | FlagDepthMask | FlagHalfMaxVal | FlagCompand | FlagRawStreams |
+        FlagHighDepth | FlagChromaCeil | FlagChecksum | FlagStoredBlocks | FlagStreamCRC | FlagEncrypted |
+        FlagSparseAngles | FlagChromaMode
+)
+
+// EncodeOptions holds the encoder parameters
+type EncodeOptions struct {
+    S          float32     // PLTM decay
+    Threshold  float32     // Coefficient cutoff
+    ChromaS    float32     // Chroma plane decay (0 = 0.4*S)
+    ChromaT    float32     // Chroma plane cutoff (0 = 0.44*Threshold)
+    Matrix     ColorMatrix // RGB -> plane transform
+    Lossless   bool        // Append a residual so decode reproduces the input exactly
+    DCPred     bool        // Predict each patch's DC from its neighbors
+    RunIndices bool        // Code indices as zero runs in frequency scan order
+    QTables    []QTable    // Per-plane quantization weights (nil = plain maxVal quantization)
+    Adaptive   bool        // Scale the threshold per patch by local activity
+    DeadZone   int         // Drop AC coefficients whose quantized re and im are both below this (0 = keep all)
+    CfL        bool        // Predict chroma patches from the reconstructed luma
+    Chroma     ChromaMode  // Chroma subsampling of YCbCr images (default 4:2:0)
+    Perceptual bool        // Raise the threshold for dark and bright patches
+    SkipFlat   bool        // Code uniform patches as a single level byte
+    AngleDelta bool        // Delta-code angles along each block row
+    SparseAngles bool      // Store no angle for patches left with no coefficients
+    CoeffBits  int         // Coefficient bit depth, 2..16 (0 = 8)
+    HalfMaxVal bool        // Store each patch's maxVal as float16
+    Compand    bool        // Quantize AC coefficients on a square-root curve so small ones survive
+    LowMem     bool        // Convert and code the image in row bands (see lowMemBandRows)
+    Compress   Compression // Stream layout and entropy coder (default range-coded split streams)
+    Verify     bool        // EncodeWithStats: decode the result and report PSNR and SSIM in Stats.Quality
+    Grain      float32     // Luma grain sigma in 8-bit levels for the decoder to add (0 = off, GrainAuto = estimate per plane)
+    EightBit   bool        // Code 16-bit sources at 8 bits per sample, as before FlagHighDepth
+    MaxPixels  int         // Largest width*height accepted (0 = DefaultMaxPixels, negative = no limit)
+    StreamChecksums bool   // Store a CRC32-C per split stream so corruption can be traced to one stream
+    Passphrase string      // Encrypt the payload with AES-256-GCM under a key derived from this ("" = no encryption)
+    Transform  PatchTransform // Basis patches are coded in (nil = DefaultTransform); the file does not record it
+    Workers    int         // Most goroutines a parallel stage uses; 1 runs everything in order (0 = GAP_THREADS or one per CPU)
+
+    kdfIterations int // Key derivation iterations (0 = DefaultKDFIterations; lowered by the tests)
+
+    sourcePlanes []*image.Gray // Planes already at their coded sizes (used by Transcode); replaces the source image
+}
+
+// DefaultMaxPixels is the largest image the encoder accepts unless
+// EncodeOptions.MaxPixels says otherwise
+const DefaultMaxPixels = 1000 * 1000 * 1000
+
+// checkDimensions rejects sizes the encoder cannot or will not code:
+// empty images, sides beyond the header's uint32 fields, and more than
+// maxPixels pixels (see EncodeOptions.MaxPixels)
+func checkDimensions(width, height, maxPixels int) error {
+    if width <= 0 || height <= 0 {
+        return fmt.Errorf("invalid image dimensions %dx%d", width, height)
+    }
+    if uint64(width) > math.MaxUint32 || uint64(height) > math.MaxUint32 {
+        return fmt.Errorf("image dimensions %dx%d exceed the format's 32-bit limit", width, height)
+    }
+    if maxPixels == 0 { maxPixels = DefaultMaxPixels }
+    if maxPixels > 0 && uint64(width)*uint64(height) > uint64(maxPixels) {
+        return fmt.Errorf("image is %dx%d, over the %d-pixel limit (see -max-pixels)", width, height, maxPixels)
+    }
+    return nil
+}
+
+// chromaSubsampled reports whether the chroma planes of a width x height
+// image under m are coded at half size. Halving a 1-pixel side would
+// leave an empty plane, so such images keep their chroma at full size.
+func chromaSubsampled(m ColorMatrix, width, height int) bool {
+    return m != MatrixIdentity && width >= 2 && height >= 2
+}
+
+// chromaPlaneSize is the size of a subsampled chroma plane of a width x
+// height image. Odd sizes round up, so the last luma column and row keep
+// chroma of their own; files without FlagChromaCeil rounded down, which
+// dropped them.
+func chromaPlaneSize(width, height int, flags uint32) (int, int) {
+    if flags&FlagChromaCeil != 0 {
+        return (width + 1) / 2, (height + 1) / 2
+    }
+    return width / 2, height / 2
+}
+
+// EncodeImage encodes the image file at inputPath into a .gap file
+func EncodeImage(inputPath, outputPath string, opts EncodeOptions) error {
+    in, err := os.Open(inputPath)
     if err != nil {
         return fmt.Errorf("failed to open input: %v", err)
     }
-    defer file.Close()
+    defer in.Close()
+
+    logInfof("Encoding %s -> %s", inputPath, outputPath)
+    
+    // Encode fully before touching the output so a failure leaves no partial file
+    var out bytes.Buffer
+    if err := Encode(in, &out, opts); err != nil {
+        return err
+    }
+    return writeBytesAtomic(outputPath, out.Bytes())
+}
+
+// Encode reads an image in any supportedFormats from r and writes the
+// .gap stream to w. The output depends only on the input and opts: it is
+// byte-identical across runs, GOMAXPROCS and worker counts. Encrypted
+// files are the exception, since each gets a fresh salt and nonce.
+func Encode(r io.Reader, w io.Writer, opts EncodeOptions) error {
+    _, err := EncodeWithStats(r, w, opts)
+    return err
+}
+
+// EncodeWithStats is Encode, also reporting per-plane stream sizes and
+// stage timings. Pass io.Discard as w for a dry run.
+func EncodeWithStats(r io.Reader, w io.Writer, opts EncodeOptions) (*Stats, error) {
+    // 1. Load Image (keep raw bytes around for metadata extraction)
+    stats := &Stats{}
+    start := time.Now()
+    srcData, err := io.ReadAll(r)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read input: %v", err)
+    }
 
-    srcImg, _, err := image.Decode(file)
+    // Check the size before allocating the pixels
+    if cfg, _, err := image.DecodeConfig(bytes.NewReader(srcData)); err == nil {
+        if err := checkDimensions(cfg.Width, cfg.Height, opts.MaxPixels); err != nil {
+            return nil, err
+        }
+    }
+    srcImg, err := decodeSource(srcData)
     if err != nil {
-        return fmt.Errorf("failed to decode image: %v", err)
+        return nil, fmt.Errorf("failed to decode image: %v", err)
     }
+    stats.stage("decode input", start)
 
     bounds := srcImg.Bounds()
+    logInfof("Image: %dx%d (%s)", bounds.Dx(), bounds.Dy(), opts.Matrix)
+
+    out, err := encodeGap(srcImg, sourceMetadata(srcData), opts, stats)
+    if err != nil {
+        return nil, err
+    }
+
+    // Verify against the already-decoded source; only the decode is extra
+    if opts.Verify {
+        start = time.Now()
+        decoded, _, err := decodeGap(bytes.NewReader(out), DecodeOptions{Passphrase: opts.Passphrase, Transform: opts.Transform, Workers: opts.Workers})
+        if err != nil {
+            return nil, fmt.Errorf("failed to decode for verification: %v", err)
+        }
+        q := &Quality{Ratio: float64(bounds.Dx()*bounds.Dy()*3) / float64(len(out))}
+        q.PSNR, q.Overall = psnrChannels(srcImg, decoded)
+        q.SSIM, q.MSSSIM = structural(srcImg, decoded)
+        stats.Quality = q
+        stats.stage("verify", start)
+    }
+    
+    // 2. Write Output
+    if _, err := w.Write(out); err != nil {
+        return nil, fmt.Errorf("failed to write output: %v", err)
+    }
+    return stats, nil
+}
+
+// sourceMetadata collects the EXIF and ICC chunks carried by the raw
+// JPEG/PNG input bytes. A CMYK source's profile describes inks, not the
+// RGB the decoder writes, so it is dropped, as is any block too large
+// for a chunk.
+func sourceMetadata(srcData []byte) []GapChunk {
+    var chunks []GapChunk
+    exif := extractJPEGExif(srcData)
+    if len(exif) > maxChunkSize {
+        logWarnf("dropping the source's EXIF: larger than %d bytes", maxChunkSize)
+        exif = nil
+    }
+    if exif != nil {
+        chunks = append(chunks, GapChunk{Tag: ChunkExif, Data: exif})
+    }
+    icc := extractJPEGICC(srcData)
+    if icc == nil { icc = extractPNGICC(srcData) }
+    if iccColorSpace(icc) == "CMYK" {
+        logWarnf("dropping the source's CMYK ICC profile; colors are converted without it")
+        icc = nil
+    }
+    if len(icc) > maxChunkSize {
+        logWarnf("dropping the source's ICC profile: larger than %d bytes", maxChunkSize)
+        icc = nil
+    }
+    if icc != nil {
+        chunks = append(chunks, GapChunk{Tag: ChunkICC, Data: icc})
+    }
+    return chunks
+}
+
+// encodeGap encodes one image into a complete single-image .gap stream,
+// storing the given metadata chunks alongside it. stats, if non-nil,
+// receives the stream sizes and stage timings.
+func encodeGap(srcImg image.Image, metadata []GapChunk, opts EncodeOptions, stats *Stats) ([]byte, error) {
+    s, threshold := opts.S, opts.Threshold
+
+    var bounds image.Rectangle
+    if opts.sourcePlanes != nil {
+        if opts.Lossless || opts.LowMem {
+            return nil, fmt.Errorf("lossless and low-memory modes need the source image")
+        }
+        bounds = opts.sourcePlanes[0].Bounds()
+    } else {
+        bounds = srcImg.Bounds()
+    }
     width := bounds.Dx()
     height := bounds.Dy()
-    
-    fmt.Printf("Encoding %s (%dx%d) -> %s (YCbCr)\n", inputPath, width, height, outputPath)
+    if err := checkDimensions(width, height, opts.MaxPixels); err != nil {
+        return nil, err
+    }
 
-    // 2. Prepare Planes (Y, Cb, Cr)
-    yPlane := image.NewGray(bounds)
-    cbPlane := image.NewGray(bounds)
-    crPlane := image.NewGray(bounds)
-    
-    for y := 0; y < height; y++ {
-        for x := 0; x < width; x++ {
-            r, g, b, _ := srcImg.At(bounds.Min.X + x, bounds.Min.Y + y).RGBA()
-            yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
-            
-            yPlane.SetGray(bounds.Min.X + x, bounds.Min.Y + y, color.Gray{Y: yy})
-            cbPlane.SetGray(bounds.Min.X + x, bounds.Min.Y + y, color.Gray{Y: cb})
-            crPlane.SetGray(bounds.Min.X + x, bounds.Min.Y + y, color.Gray{Y: cr})
+    if opts.Grain != 0 && opts.Lossless {
+        return nil, fmt.Errorf("grain synthesis cannot be combined with lossless mode")
+    }
+    if opts.CoeffBits != 0 && (opts.CoeffBits < 2 || opts.CoeffBits > 16) {
+        return nil, fmt.Errorf("coefficient depth must be 2..16 bits, got %d", opts.CoeffBits)
+    }
+    if opts.CfL && opts.Matrix == MatrixIdentity {
+        return nil, fmt.Errorf("chroma-from-luma prediction needs a YCbCr matrix")
+    }
+    if (opts.ChromaS != 0 || opts.ChromaT != 0) && opts.Matrix == MatrixIdentity {
+        return nil, fmt.Errorf("chroma parameters need a YCbCr matrix; rgb codes every plane with s and threshold")
+    }
+    if opts.Chroma != Chroma420 && (opts.Matrix == MatrixIdentity || opts.CfL) {
+        return nil, fmt.Errorf("%s chroma needs a YCbCr matrix and no chroma-from-luma prediction", opts.Chroma)
+    }
+    if opts.Chroma > ChromaMono {
+        return nil, fmt.Errorf("unknown chroma mode %d", int(opts.Chroma))
+    }
+    if opts.Compress.interleaved() && (opts.CfL || opts.Lossless) {
+        return nil, fmt.Errorf("chroma-from-luma and lossless mode need split streams, not %s", opts.Compress)
+    }
+    if opts.Compress.interleaved() && opts.StreamChecksums {
+        return nil, fmt.Errorf("stream checksums need split streams, not %s", opts.Compress)
+    }
+    // Gray sources are coded as a single plane, so nothing that works on
+    // chroma applies
+    gray := srcImg != nil && opts.sourcePlanes == nil && isGraySource(srcImg)
+    if gray && (opts.CfL || opts.Grain != 0) {
+        logInfof("Note: coding the gray source as one plane, without -cfl and -grain")
+        opts.CfL, opts.Grain = false, 0
+    }
+    if gray && len(opts.QTables) > 1 {
+        opts.QTables = opts.QTables[:1]
+    }
+    numPlanes := 3
+    if gray { numPlanes = 1 }
+    subsample := !gray && chromaSubsampled(opts.Matrix, width, height)
+    if opts.CfL && !subsample {
+        logInfof("Note: coding a %dx%d image without -cfl (it predicts half-size chroma)", width, height)
+        opts.CfL = false
+    }
+
+    var chunks []GapChunk
+    if opts.QTables != nil {
+        chunks = append(chunks, GapChunk{Tag: ChunkQTable, Data: encodeQTables(opts.QTables)})
+    }
+    if subsample && opts.Chroma != Chroma420 {
+        chunks = append(chunks, GapChunk{Tag: ChunkChroma, Data: []byte{byte(opts.Chroma)}})
+    }
+    chunks = append(chunks, metadata...)
+    var crypto *cryptoParams
+    if opts.Passphrase != "" {
+        var err error
+        if crypto, err = newCryptoParams(opts.kdfIterations); err != nil {
+            return nil, fmt.Errorf("failed to set up encryption: %v", err)
         }
+        chunks = append(chunks, GapChunk{Tag: ChunkCrypto, Data: crypto.marshal()})
     }
 
-    // 3. Open Output
-    outFile, err := os.Create(outputPath)
-    if err != nil {
-        return fmt.Errorf("failed to create output: %v", err)
+    // Low-memory mode codes the planes band by band, so features that need
+    // a whole reconstructed plane are not available
+    bandable := !opts.CfL && !opts.Lossless && opts.Grain != GrainAuto && opts.sourcePlanes == nil
+    if opts.LowMem && !bandable {
+        return nil, fmt.Errorf("low-memory mode cannot be combined with -cfl, -lossless or -grain auto")
+    }
+    lowMem := opts.LowMem || (bandable && width*height > lowMemAutoPixels)
+
+    // 16-bit sources keep their precision up to the coefficient quantizer,
+    // unless a feature that works on 8-bit planes is in use
+    deep := srcImg != nil && opts.sourcePlanes == nil && !opts.EightBit && isHighDepth(srcImg)
+    if deep && (lowMem || opts.Lossless || opts.CfL || opts.SkipFlat || opts.Grain != 0 || opts.Chroma != Chroma420) {
+        logInfof("Note: coding the 16-bit source at 8 bits (low-memory, -lossless, -cfl, -skip-flat, -grain and -chroma work on 8-bit planes)")
+        deep = false
     }
-    defer outFile.Close()
 
-    // 4. Write Header
+    // 1. Prepare Planes (Y, Cb, Cr or R, G, B)
+    start := time.Now()
+    isRGB := opts.Matrix == MatrixIdentity
+
+    // Downsample Chroma Planes (4:2:0 unless opts.Chroma). R/G/B planes all carry full detail,
+    // so identity mode keeps them at full resolution with luma parameters.
+    planeSizes := []image.Point{{width, height}, {width, height}, {width, height}}
+    chromaS, chromaThreshold := s, threshold
+    if subsample {
+        cw, ch := opts.Chroma.planeSize(width, height, FlagChromaCeil)
+        planeSizes[1] = image.Point{cw, ch}
+        planeSizes[2] = planeSizes[1]
+    }
+    if !isRGB {
+        // Chroma channels: Derived from input parameters
+        // Factor 0.4 roughly matches the optimized 0.04/0.22 ratio for base defaults (s=0.1, t=0.5)
+        chromaS = s * 0.4
+        chromaThreshold = threshold * 0.44
+        if opts.ChromaS != 0 { chromaS = opts.ChromaS }
+        if opts.ChromaT != 0 { chromaThreshold = opts.ChromaT }
+    }
+    var planes []*image.Gray
+    var planes16 []*image.Gray16
+    if deep {
+        p0, p1, p2 := splitImagePlanes16(srcImg, opts.Matrix, opts.Workers)
+        planes16 = []*image.Gray16{p0, p1, p2}
+        if subsample {
+            planes16[1] = downsamplePlane16(p1)
+            planes16[2] = downsamplePlane16(p2)
+        }
+    } else if opts.sourcePlanes != nil {
+        // Copied: CfL replaces the chroma planes with residuals
+        planes = append(planes, opts.sourcePlanes...)
+    } else if !lowMem {
+        yPlane, cbPlane, crPlane := splitImagePlanes(srcImg, opts.Matrix, opts.Workers)
+        planes = []*image.Gray{yPlane, cbPlane, crPlane}
+        if subsample {
+            planes[1] = opts.Chroma.downsample(cbPlane, opts.Workers)
+            planes[2] = opts.Chroma.downsample(crPlane, opts.Workers)
+        }
+    }
+    
+    if planes != nil { planes = planes[:numPlanes] }
+    if planes16 != nil { planes16 = planes16[:numPlanes] }
+    planeSizes = planeSizes[:numPlanes]
+    sValues := []float32{s, chromaS, chromaS}[:numPlanes]
+    threshValues := []float32{threshold, chromaThreshold, chromaThreshold}[:numPlanes]
+    stats.stage("prepare planes", start)
+
+    // 2. Assemble the file in memory (lossless mode decodes it back before writing)
+    var out bytes.Buffer
+
+    // 3. Build Header
     header := GapHeader{
-        Magic:     [4]byte{'G', 'A', 'P', 0x01},
+        Magic:     [4]byte{'G', 'A', 'P', FormatVersion},
         Width:     uint32(width),
         Height:    uint32(height),
         S:         s,
         Threshold: threshold,
-        Flags:     2 | 4 | 8, // Quantized(2) | Subsampled(4) | Range(8)
-        Channels:  3, // YCbCr
+        Flags:     FlagQuantized | FlagRangeCoded | FlagChecksum | uint32(opts.Matrix)<<flagMatrixShift,
+        Channels:  uint32(numPlanes),
+    }
+    if subsample {
+        header.Flags |= FlagSubsampled | FlagChromaCeil
+        if opts.Chroma != Chroma420 {
+            header.Flags |= FlagChromaMode
+        }
+    }
+    switch opts.Compress {
+    case CompressGzip:
+        header.Flags = header.Flags&^FlagRangeCoded | FlagGzip
+    case CompressNone:
+        header.Flags |= FlagRawStreams
+    case CompressInterleaved:
+        header.Flags &^= FlagRangeCoded
+    }
+    if len(chunks) > 0 {
+        header.Flags |= FlagChunks
+    }
+    if opts.StreamChecksums {
+        header.Flags |= FlagStreamCRC
+    }
+    if opts.Lossless {
+        header.Flags |= FlagLossless
+    }
+    if opts.DCPred {
+        header.Flags |= FlagDCPred
+    }
+    if opts.RunIndices {
+        header.Flags |= FlagRunIndices
+    }
+    if opts.QTables != nil {
+        header.Flags |= FlagQTable
+    }
+    if opts.CfL {
+        header.Flags |= FlagCfL
+    }
+    if opts.SkipFlat {
+        header.Flags |= FlagSkipFlat
+    }
+    if opts.AngleDelta {
+        header.Flags |= FlagAngleDelta
+    }
+    if opts.SparseAngles {
+        header.Flags |= FlagSparseAngles
+    }
+    if opts.CoeffBits != 0 && opts.CoeffBits != 8 {
+        header.Flags |= uint32(opts.CoeffBits) << flagDepthShift
+    }
+    if opts.HalfMaxVal {
+        header.Flags |= FlagHalfMaxVal
+    }
+    if opts.Compand {
+        header.Flags |= FlagCompand
+    }
+    if deep {
+        header.Flags |= FlagHighDepth
+    }
+    if opts.Grain != 0 {
+        // Set up front: the grain chunk itself is added once the planes are coded
+        header.Flags |= FlagGrain | FlagChunks
     }
     
-    if err := binary.Write(outFile, binary.LittleEndian, &header); err != nil {
-        return fmt.Errorf("failed to write header: %v", err)
+    // 4. Encode planes IN PARALLEL for speed
+    planeOpts := func(idx int) planeOptions {
+        return planeOptions{
+            S: sValues[idx], Threshold: threshValues[idx], Flags: header.Flags, QTable: planeQTable(opts.QTables, idx),
+            Adaptive: opts.Adaptive, DeadZone: opts.DeadZone, Transform: opts.Transform,
+            // Luminance masking applies to the luma plane, or to each channel in RGB mode
+            Perceptual: opts.Perceptual && (idx == 0 || isRGB),
+        }
     }
-
-    // 5. Encode planes IN PARALLEL for speed
-    runtime.GOMAXPROCS(runtime.NumCPU())
     
-
+    results := make([]planeResult, numPlanes)
+    encodePlane := func(idx int) {
+        // Use actual dimensions
+        var p image.Image
+        if deep {
+            p = planes16[idx]
+        } else {
+            p = planes[idx]
+        }
+        pBounds := p.Bounds()
+        
+        // Generate Split Streams
+        var stats keptStats
+        angles, counts, maxVals, indices, values, err := gapEncodePlane(p, pBounds.Dx(), pBounds.Dy(), planeOpts(idx), &stats)
+        results[idx] = planeResult{angles: angles, counts: counts, maxVals: maxVals, indices: indices, values: values, stats: stats, err: err}
+    }
     
-    // Downsample Chroma Planes (4:2:0)
-    cbSmall := downsamplePlane(cbPlane)
-    crSmall := downsamplePlane(crPlane)
+    // Chroma-from-luma needs the luma plane as the decoder will see it,
+    // so luma is encoded and reconstructed before the chroma planes
+    start = time.Now()
+    var alphas [][]byte
+    first := 0
+    if lowMem {
+        logInfof("Low-memory mode: %d-row bands", lowMemBandRows)
+        var err error
+        if results, err = encodePlanesBanded(srcImg, opts.Matrix, opts.Chroma, planeSizes, planeOpts, opts.Workers); err != nil {
+            return nil, err
+        }
+        first = numPlanes
+    } else if opts.CfL {
+        encodePlane(0)
+        r := results[0]
+        if r.err != nil { return nil, fmt.Errorf("failed to encode plane 0: %v", r.err) }
+        luma, err := gapDecodePlaneSplit(r.angles, r.counts, r.maxVals, r.indices, r.values, width, height, header.Flags, 0, sValues[0], planeQTable(opts.QTables, 0), opts.Transform, opts.Workers)
+        if err != nil { return nil, fmt.Errorf("failed to reconstruct luma: %v", err) }
+        lumaDown := downsamplePlane(luma, opts.Workers)
+        alphas = make([][]byte, 3)
+        for i := 1; i < 3; i++ {
+            planes[i], alphas[i] = cflResidual(planes[i], lumaDown)
+        }
+        first = 1
+    }
     
-    planes := []*image.Gray{yPlane, cbSmall, crSmall}
+    parallelFor(numPlanes-first, opts.Workers, func(i int) { encodePlane(first + i) })
     
-    // Chroma channels: Derived from input parameters
-    // Factor 0.4 roughly matches the optimized 0.04/0.22 ratio for base defaults (s=0.1, t=0.5)
-    chromaS := s * 0.4         
-    chromaThreshold := threshold * 0.44 
+    // Check for errors
+    for i, r := range results {
+        if r.err != nil { return nil, fmt.Errorf("failed to encode plane %d: %v", i, r.err) }
+    }
+    stats.stage("code planes", start)
     
-    sValues := []float32{s, chromaS, chromaS}
-    threshValues := []float32{threshold, chromaThreshold, chromaThreshold}
+    // Grain: the decoder re-adds noise of the strength the coding removed
+    if opts.Grain != 0 {
+        start = time.Now()
+        sigmas := make([]float32, 3)
+        if opts.Grain == GrainAuto {
+            for i, r := range results {
+                pb := planes[i].Bounds()
+                recon, err := gapDecodePlaneSplit(r.angles, r.counts, r.maxVals, r.indices, r.values, pb.Dx(), pb.Dy(), header.Flags, 0, sValues[i], planeQTable(opts.QTables, i), opts.Transform, opts.Workers)
+                if err != nil { return nil, fmt.Errorf("failed to reconstruct plane %d: %v", i, err) }
+                sigmas[i] = estimateGrain(planes[i], recon)
+            }
+        } else {
+            sigmas[0] = opts.Grain
+        }
+        logInfof("Grain Sigma: %.2f %.2f %.2f", sigmas[0], sigmas[1], sigmas[2])
+        chunks = append(chunks, GapChunk{Tag: ChunkGrain, Data: encodeGrain(sigmas)})
+        stats.stage("grain", start)
+    }
     
-    type planeResult struct {
-        angles  []byte
-        counts  []byte
-        maxVals []byte
-        indices []byte
-        values  []byte
-        err     error
+    // Header, plane table and chunks (written after coding so measured chunks can be included)
+    start = time.Now()
+    if err := binary.Write(&out, binary.LittleEndian, &header); err != nil {
+        return nil, fmt.Errorf("failed to write header: %v", err)
+    }
+    // v2: per-plane parameter table, so the decoder uses the s each plane was encoded with
+    for i := range sValues {
+        params := PlaneParams{S: sValues[i], Threshold: threshValues[i]}
+        if err := binary.Write(&out, binary.LittleEndian, &params); err != nil {
+            return nil, fmt.Errorf("failed to write plane parameters: %v", err)
+        }
     }
+    if len(chunks) > 0 {
+        if err := writeChunks(&out, chunks); err != nil {
+            return nil, fmt.Errorf("failed to write metadata: %v", err)
+        }
+    }
+    payloadStart := out.Len()
     
-    results := make([]planeResult, 3)
-    var wg sync.WaitGroup
+    // 5. Write Compressed Data (Range Coded Split Streams)
+    // Order: Angles, Counts, MaxVals, Indices, Values
+    // The legacy layouts instead interleave each plane's patches into one
+    // stream, gzip-compressed or not.
+    // A stream the range coder rejects is stored instead; the first one
+    // sets FlagStoredBlocks in the header already in out
+    writeBlock := func(w io.Writer, data []byte) error {
+        if opts.Compress == CompressNone {
+            return writeStoredBlock(w, data, opts.StreamChecksums)
+        }
+        stored, err := writeStreamBlock(w, data, opts.StreamChecksums)
+        if stored && header.Flags&FlagStoredBlocks == 0 {
+            header.Flags |= FlagStoredBlocks
+            binary.LittleEndian.PutUint32(out.Bytes()[headerFlagsOffset:], header.Flags)
+        }
+        return err
+    }
+    var gz *gzip.Writer
+    if opts.Compress == CompressGzip {
+        gz = gzip.NewWriter(&out)
+    }
+    chromaBytes := 0
+    for i := range results {
+        streams := [][]byte{results[i].angles, results[i].counts, results[i].maxVals, results[i].indices, results[i].values}
+        rawTotal := 0
+        ps := PlaneStats{Width: planeSizes[i].X, Height: planeSizes[i].Y, Patches: results[i].stats.Patches}
+        if opts.Compress.interleaved() {
+            data, err := interleavePatches(streams[0], streams[1], streams[2], streams[3], streams[4], header.Flags)
+            if err != nil {
+                return nil, fmt.Errorf("failed to interleave plane %d: %v", i, err)
+            }
+            before := out.Len()
+            if gz != nil {
+                // Flushed per plane so the stats can attribute bytes to it
+                _, err = gz.Write(data)
+                if err == nil { err = gz.Flush() }
+            } else {
+                _, err = out.Write(data)
+            }
+            if err != nil {
+                return nil, fmt.Errorf("failed to write plane %d: %v", i, err)
+            }
+            rawTotal = len(data)
+            ps.Streams = append(ps.Streams, StreamStats{Name: "Patches", Raw: len(data), Compressed: out.Len() - before})
+            ps.Bytes = out.Len() - before
+        } else {
+            for sIdx, data := range streams {
+                before := out.Len()
+                if err := writeBlock(&out, data); err != nil {
+                    return nil, fmt.Errorf("failed to write %s for plane %d: %v", splitStreamNames[sIdx], i, err)
+                }
+                rawTotal += len(data)
+                // Block size minus the length words (and checksum)
+                ps.Streams = append(ps.Streams, StreamStats{Name: splitStreamNames[sIdx], Raw: len(data), Compressed: out.Len() - before - blockHeaderSize(header.Flags)})
+                ps.Bytes += out.Len() - before
+            }
+        }
+        if i > 0 { chromaBytes += ps.Bytes }
+        if stats != nil {
+            if ps.Patches > 0 { ps.CoeffsPerPatch = float64(results[i].stats.Kept) / float64(ps.Patches) }
+            stats.Planes = append(stats.Planes, ps)
+        }
+        logInfof("Plane %d Raw: %d bytes", i, rawTotal)
+        if opts.Adaptive || opts.Perceptual {
+            st := results[i].stats
+            base := float64(st.BaseKept) / float64(st.Patches)
+            kept := float64(st.Kept) / float64(st.Patches)
+            change := 0.0
+            if base > 0 { change = (kept - base) / base * 100 }
+            logInfof("Plane %d Threshold Scaling: %.2f -> %.2f coeffs/patch (%+.1f%%)", i, base, kept, change)
+        }
+    }
     
-    for i := 0; i < 3; i++ {
-        wg.Add(1)
-        go func(idx int) {
-            defer wg.Done()
-            // Use actual dimensions
-            p := planes[idx]
-            pBounds := p.Bounds()
-            
-            // Generate Split Streams
-            angles, counts, maxVals, indices, values, err := gapEncodePlane(p, pBounds.Dx(), pBounds.Dy(), sValues[idx], threshValues[idx])
-            results[idx] = planeResult{angles: angles, counts: counts, maxVals: maxVals, indices: indices, values: values, err: err}
-        }(i)
+    if header.Flags&FlagChromaMode != 0 {
+        cs := newChromaStats(opts.Chroma, width, height, chromaBytes)
+        logInfof("Chroma %s: %d samples per plane, %.1f%% fewer than 4:2:0 (%d), %d bytes coded", cs.Mode, cs.Samples, cs.Saved(), cs.Samples420, cs.Bytes)
+        if stats != nil { stats.Chroma = cs }
+    }
+
+    if gz != nil {
+        if err := gz.Close(); err != nil {
+            return nil, fmt.Errorf("failed to finish gzip stream: %v", err)
+        }
     }
     
-    wg.Wait()
+    if opts.CfL {
+        for i := 1; i < 3; i++ {
+            if err := writeBlock(&out, alphas[i]); err != nil {
+                return nil, fmt.Errorf("failed to write CfL alphas for plane %d: %v", i, err)
+            }
+        }
+    }
+    stats.stage("entropy coding", start)
     
-    // Check for errors
-    for i, r := range results {
-        if r.err != nil { return fmt.Errorf("failed to encode plane %d: %v", i, r.err) }
+    // 6. Lossless: decode our own output and store what it got wrong
+    if opts.Lossless {
+        start = time.Now()
+        // The decoder expects the footer; checksum a copy so out can grow
+        lossyFile := appendChecksum(slices.Clip(out.Bytes()), payloadStart)
+        lossy, _, err := decodeGap(bytes.NewReader(lossyFile), DecodeOptions{lossyOnly: true, Transform: opts.Transform, Workers: opts.Workers})
+        if err != nil {
+            return nil, fmt.Errorf("failed to decode lossy layer: %v", err)
+        }
+        residual := computeResidual(srcImg, lossy)
+        if err := writeBlock(&out, residual); err != nil {
+            return nil, fmt.Errorf("failed to write residual: %v", err)
+        }
+        logInfof("Lossless Residual Raw: %d bytes", len(residual))
+        stats.stage("lossless residual", start)
     }
     
-    // 6. Write Compressed Data (Range Coded Split Streams)
-    // Order: Angles, Counts, MaxVals, Indices, Values
-    for i := 0; i < 3; i++ {
-        // Helper to Compress and Write
-        writeStream := func(name string, data []byte) error {
-            uncompressedLen := uint32(len(data))
-            
-            compressed := GapCompressData(data)
-            if compressed == nil {
-                 if uncompressedLen == 0 {
-                    binary.Write(outFile, binary.LittleEndian, uint32(0)) // U
-                    binary.Write(outFile, binary.LittleEndian, uint32(0)) // C
-                    return nil
-                 }
-                return fmt.Errorf("failed to compress %s for plane %d", name, i)
-            }
-            compressedLen := uint32(len(compressed))
-            
-            if err := binary.Write(outFile, binary.LittleEndian, uncompressedLen); err != nil { return err }
-            if err := binary.Write(outFile, binary.LittleEndian, compressedLen); err != nil { return err }
-            if _, err := outFile.Write(compressed); err != nil { return err }
-            
-            return nil
+    // Sealed last: the lossless pass above decodes the plaintext. The
+    // flag goes in first, as the header is the additional data.
+    file := out.Bytes()
+    if crypto != nil {
+        start = time.Now()
+        header.Flags |= FlagEncrypted
+        binary.LittleEndian.PutUint32(file[headerFlagsOffset:], header.Flags)
+        var err error
+        if file, err = encryptPayload(file, payloadStart, crypto, opts.Passphrase); err != nil {
+            return nil, fmt.Errorf("failed to encrypt: %v", err)
         }
-        
-        if err := writeStream("Angles", results[i].angles); err != nil { return err }
-        if err := writeStream("Counts", results[i].counts); err != nil { return err }
-        if err := writeStream("MaxVals", results[i].maxVals); err != nil { return err }
-        if err := writeStream("Indices", results[i].indices); err != nil { return err }
-        if err := writeStream("Values", results[i].values); err != nil { return err }
-        
-        rawTotal := len(results[i].angles) + len(results[i].counts) + len(results[i].maxVals) + len(results[i].indices) + len(results[i].values)
-        fmt.Printf("Plane %d Raw: %d bytes\n", i, rawTotal)
+        stats.stage("encrypt", start)
     }
     
-    return nil
+    // The footer covers everything written since the chunks; the file is
+    // assembled in memory, so it is computed over the buffer once here
+    file = appendChecksum(file, payloadStart)
+    if stats != nil {
+        stats.Width, stats.Height = width, height
+        stats.TotalBytes = len(file)
+        stats.BitsPerPixel = stats.bpp(len(file))
+        for i := range stats.Planes {
+            stats.Planes[i].BitsPerPixel = stats.bpp(stats.Planes[i].Bytes)
+        }
+    }
+    return file, nil
+}
+
+// planeResult holds one plane's coded streams
+type planeResult struct {
+    angles  []byte
+    counts  []byte
+    maxVals []byte
+    indices []byte
+    values  []byte
+    stats   keptStats
+    err     error
+}
+
+// lowMemBandRows is the band height of low-memory encoding. It is a
+// multiple of 16 so both luma and 4:2:0 chroma bands hold whole block rows.
+const lowMemBandRows = 256
+
+// lowMemAutoPixels is the image size above which low-memory mode is
+// used automatically (when the options allow it)
+const lowMemAutoPixels = 64 * 1000 * 1000
+
+// encodePlanesBanded is the low-memory plane stage: the source is
+// converted and coded lowMemBandRows rows at a time, so only one band of
+// planes exists at once instead of three full planes. The streams are
+// identical to coding the full planes. Only the first len(sizes) planes
+// are coded, so gray sources code luma alone.
+func encodePlanesBanded(src image.Image, m ColorMatrix, chroma ChromaMode, sizes []image.Point, planeOpts func(int) planeOptions, workers int) ([]planeResult, error) {
+    bounds := src.Bounds()
+    results := make([]planeResult, len(sizes))
+    encoders := make([]*planeEncoder, len(sizes))
+    for i := range encoders {
+        encoders[i] = newPlaneEncoder(sizes[i].X, sizes[i].Y, planeOpts(i), &results[i].stats)
+    }
+
+    errs := make([]error, len(sizes))
+    for y := 0; y < bounds.Dy(); y += lowMemBandRows {
+        endY := y + lowMemBandRows
+        if endY > bounds.Dy() { endY = bounds.Dy() }
+        band := subImage(src, image.Rect(bounds.Min.X, bounds.Min.Y+y, bounds.Max.X, bounds.Min.Y+endY))
+
+        p0, p1, p2 := splitImagePlanes(band, m, workers)
+        bandPlanes := []*image.Gray{p0, p1, p2}
+        if len(sizes) > 1 && sizes[1] != sizes[0] {
+            // Bands start on multiples of 16 rows, so chroma averaging never straddles two bands
+            bandPlanes[1] = chroma.downsample(p1, workers)
+            bandPlanes[2] = chroma.downsample(p2, workers)
+        }
+
+        parallelFor(len(encoders), workers, func(i int) { errs[i] = encoders[i].encodeBand(bandPlanes[i]) })
+        for i, err := range errs {
+            if err != nil { return nil, fmt.Errorf("failed to encode plane %d: %v", i, err) }
+        }
+    }
+
+    for i, e := range encoders {
+        results[i].angles, results[i].counts, results[i].maxVals = e.angles, e.counts, e.maxVals
+        results[i].indices, results[i].values = e.indices, e.values
+    }
+    return results, nil
+}
+
+// boundedImage restricts an image that has no SubImage method to r
+type boundedImage struct {
+    image.Image
+    r image.Rectangle
+}
+
+func (b boundedImage) Bounds() image.Rectangle { return b.r }
+
+// subImage returns the part of img inside r, sharing its pixels
+func subImage(img image.Image, r image.Rectangle) image.Image {
+    if s, ok := img.(interface{ SubImage(image.Rectangle) image.Image }); ok {
+        return s.SubImage(r)
+    }
+    return boundedImage{img, r}
 }
 
-// downsamplePlane reduces dimensions by 2x using 2x2 averaging
-func downsamplePlane(src *image.Gray) *image.Gray {
+// writeStoredBlock writes data in the stream block framing without
+// entropy coding: both length words equal len(data)
+func writeStoredBlock(w io.Writer, data []byte, withCRC bool) error {
+    if err := writeBlockHeader(w, uint32(len(data)), uint32(len(data)), data, withCRC); err != nil { return err }
+    _, err := w.Write(data)
+    return err
+}
+
+// storedBlockBit marks a FlagStoredBlocks block's compressed length:
+// the data after it is stored as is
+const storedBlockBit = 1 << 31
+
+// rangeCompress is the coder writeStreamBlock uses, swapped out by the
+// tests to simulate a rejected stream
+var rangeCompress = GapCompressDataInto
+
+// writeStreamBlock range-codes data and writes it as
+// u32 uncompressed length, u32 compressed length, compressed bytes.
+// If the coder rejects data it is written as a stored block instead
+// (compressed length | storedBlockBit) and stored reports it. withCRC
+// adds the FlagStreamCRC checksum after the length words.
+func writeStreamBlock(w io.Writer, data []byte, withCRC bool) (stored bool, err error) {
+    uncompressedLen := uint32(len(data))
+    
+    scratch := streamPool.Get().(*[]byte)
+    defer streamPool.Put(scratch)
+    compressed, cerr := rangeCompress(data, *scratch)
+    if cap(compressed) > cap(*scratch) {
+        *scratch = compressed[:0] // Keep the grown buffer
+    }
+    if cerr != nil {
+        if len(data) >= storedBlockBit {
+            return false, fmt.Errorf("range coder failed on a %d-byte stream too large to store: %v", len(data), cerr)
+        }
+        logInfof("Note: storing a %d-byte stream uncompressed (%v)", len(data), cerr)
+        if err := writeBlockHeader(w, uncompressedLen, uncompressedLen|storedBlockBit, data, withCRC); err != nil { return false, err }
+        _, err := w.Write(data)
+        return true, err
+    }
+    compressedLen := uint32(len(compressed))
+    
+    if err := writeBlockHeader(w, uncompressedLen, compressedLen, data, withCRC); err != nil { return false, err }
+    _, err = w.Write(compressed)
+    return false, err
+}
+
+// computeResidual returns (original - decoded) mod 256 for each RGB sample,
+// row-major with 3 bytes per pixel.
+func computeResidual(src image.Image, decoded *image.RGBA) []byte {
+    bounds := src.Bounds()
+    w, h := bounds.Dx(), bounds.Dy()
+    residual := make([]byte, w*h*3)
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            r, g, b, _ := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+            idx := decoded.PixOffset(x, y)
+            off := (y*w + x) * 3
+            residual[off] = uint8(r>>8) - decoded.Pix[idx]
+            residual[off+1] = uint8(g>>8) - decoded.Pix[idx+1]
+            residual[off+2] = uint8(b>>8) - decoded.Pix[idx+2]
+        }
+    }
+    return residual
+}
+
+// downsamplePlane reduces dimensions by 2x using 2x2 averaging, with
+// output rows split across workers. Odd sizes round up (FlagChromaCeil):
+// the last column or row is averaged with itself.
+func downsamplePlane(src *image.Gray, workers int) *image.Gray {
     b := src.Bounds()
     w, h := b.Dx(), b.Dy()
-    newW, newH := w/2, h/2
+    newW, newH := chromaPlaneSize(w, h, FlagChromaCeil)
     dst := image.NewGray(image.Rect(0, 0, newW, newH))
     
-    for y := 0; y < newH; y++ {
-        for x := 0; x < newW; x++ {
-            // Average 2x2 block with clamping for odd dimensions
-            srcX, srcY := x*2, y*2
-            x2 := srcX + 1
-            y2 := srcY + 1
-            if x2 >= w { x2 = w - 1 }
-            if y2 >= h { y2 = h - 1 }
-
-            sum := int(src.GrayAt(srcX, srcY).Y) +
-                   int(src.GrayAt(x2, srcY).Y) +
-                   int(src.GrayAt(srcX, y2).Y) +
-                   int(src.GrayAt(x2, y2).Y)
-            dst.SetGray(x, y, color.Gray{Y: uint8(sum / 4)})
-        }
+    var wg sync.WaitGroup
+    workers = workerCount(workers)
+    rowsPerWorker := (newH + workers - 1) / workers
+    if rowsPerWorker < 1 { rowsPerWorker = 1 }
+    
+    for startY := 0; startY < newH; startY += rowsPerWorker {
+        endY := startY + rowsPerWorker
+        if endY > newH { endY = newH }
+        
+        wg.Add(1)
+        go func(y0, y1 int) {
+            defer wg.Done()
+            for y := y0; y < y1; y++ {
+                // Average 2x2 block with clamping for odd dimensions
+                srcY := y * 2
+                y2 := srcY + 1
+                if y2 >= h { y2 = h - 1 }
+                row0 := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+srcY):]
+                row1 := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y2):]
+                out := dst.Pix[y*dst.Stride:]
+                
+                for x := 0; x < newW; x++ {
+                    srcX := x * 2
+                    x2 := srcX + 1
+                    if x2 >= w { x2 = w - 1 }
+                    sum := int(row0[srcX]) + int(row0[x2]) + int(row1[srcX]) + int(row1[x2])
+                    out[x] = uint8(sum / 4)
+                }
+            }
+        }(startY, endY)
     }
+    wg.Wait()
     return dst
 }
 
-// gapEncodePlane encodes a single grayscale plane into split streams
-func gapEncodePlane(img *image.Gray, width, height int, s, threshold float32) ([]byte, []byte, []byte, []byte, []byte, error) {
+// quantizeAngle maps an angle in radians onto the 0..255 byte scale
+// used by the angles stream (same truncation as the Zig gradient map).
+func quantizeAngle(angle float32) uint8 {
+    normAngle := float64(angle)
+    for normAngle < 0 { normAngle += 2 * math.Pi }
+    return uint8((normAngle / (2 * math.Pi)) * 255.0)
+}
+
+// dequantizeAngle is the inverse of quantizeAngle
+func dequantizeAngle(b uint8) float32 {
+    return float32(b) / 255.0 * 2.0 * math.Pi
+}
+
+// keptStats counts coefficients kept per plane, with and without the
+// adaptive threshold, so the encoder can report the difference.
+type keptStats struct {
+    Patches  int
+    Kept     int // Nonzero coefficients actually coded
+    BaseKept int // Nonzero coefficients at the global threshold (before dead zone)
+    DCOnly   int // Patches coded without the transform (see dcOnlyPatch)
+}
+
+// adaptiveRefVariance is the patch variance (on the 0..1 pixel scale,
+// about 13 gray levels of standard deviation) at which the adaptive
+// threshold equals the global one.
+const adaptiveRefVariance = 0.0025
+
+// adaptiveThresholdScale maps a patch's pixel variance to a threshold
+// multiplier: 1.5 for perfectly flat patches, 1.0 at adaptiveRefVariance,
+// approaching 0.5 for heavily textured ones.
+func adaptiveThresholdScale(patch []float32) float32 {
+    var sum, sumSq float32
+    for _, v := range patch {
+        sum += v
+        sumSq += v * v
+    }
+    mean := sum / 64
+    variance := sumSq/64 - mean*mean
+    if variance < 0 { variance = 0 }
+    return 0.5 + 1.0/(1.0+variance/adaptiveRefVariance)
+}
+
+func absInt(v int) int {
+    if v < 0 { return -v }
+    return v
+}
+
+// countNonzero returns how many of the 64 complex coefficients are nonzero
+func countNonzero(coeffs []float32) int {
+    n := 0
+    for k := 0; k < 64; k++ {
+        if coeffs[2*k] != 0 || coeffs[2*k+1] != 0 { n++ }
+    }
+    return n
+}
+
+// perceptualThresholdScale raises the threshold for dark and bright
+// patches, where the eye tolerates more error: 1.0 for mean levels in
+// 30..225, rising linearly to 2.0 at black and at white.
+func perceptualThresholdScale(patch []float32) float32 {
+    var sum float32
+    for _, v := range patch { sum += v }
+    mean := sum / 64 * 255
+    switch {
+    case mean < 30:
+        return 1 + (30-mean)/30
+    case mean > 225:
+        return 1 + (mean-225)/30
+    }
+    return 1
+}
+
+// flatPatchLevel reports whether a patch is uniform to within one gray
+// level and, if so, the level to fill it with.
+func flatPatchLevel(patch []float32) (uint8, bool) {
+    lo, hi := patch[0], patch[0]
+    var sum float32
+    for _, v := range patch {
+        if v < lo { lo = v }
+        if v > hi { hi = v }
+        sum += v
+    }
+    if hi-lo > 1.5/255 {
+        return 0, false
+    }
+    return clampToByte(sum / 64 * 255), true
+}
+
+// dcOnlyPatch reports whether no AC coefficient of patch can reach
+// threshold, so the transform would keep at most the DC term, and
+// returns that term (the sample sum). By Parseval each |X_k|^2 is at
+// most 64 * sum((x - mean)^2), and the polylog filter only attenuates;
+// half the threshold energy is left as margin for FFT rounding.
+func dcOnlyPatch(patch []float32, threshold float32) (float32, bool) {
+    var sum float32
+    for _, v := range patch {
+        sum += v
+    }
+    mean := sum / 64
+    var energy float32
+    for _, v := range patch {
+        d := v - mean
+        energy += d * d
+    }
+    return sum, 64*energy < threshold*threshold/2
+}
+
+// planeOptions carries the encoder settings for one plane
+type planeOptions struct {
+    S          float32
+    Threshold  float32
+    Flags      uint32  // Header flags (format features such as DC prediction)
+    QTable     *QTable // nil = plain maxVal quantization
+    Adaptive   bool    // Scale each patch's threshold by its activity
+    Perceptual bool    // Scale each patch's threshold by its mean level
+    DeadZone   int     // Drop AC coefficients quantizing below this in both re and im
+    FullTransform bool // Transform flat patches too instead of coding their DC directly
+    RoundCodes bool    // Round to the nearest code instead of truncating (for already-quantized input)
+    Transform  PatchTransform // nil = DefaultTransform
+}
+
+// gapEncodePlane encodes a single grayscale plane (*image.Gray, or
+// *image.Gray16 for FlagHighDepth) into split streams.
+// stats, if non-nil, receives the kept-coefficient counts.
+func gapEncodePlane(img image.Image, width, height int, po planeOptions, stats *keptStats) ([]byte, []byte, []byte, []byte, []byte, error) {
+    enc := newPlaneEncoder(width, height, po, stats)
+    enc.reserve()
+    if err := enc.encodeBand(img); err != nil {
+        return nil, nil, nil, nil, nil, err
+    }
+    return enc.angles, enc.counts, enc.maxVals, enc.indices, enc.values, nil
+}
+
+// planeEncoder codes a plane's patches in raster order. The plane can be
+// fed whole or in horizontal bands (see encodeBand); the streams are the
+// same either way.
+type planeEncoder struct {
+    po            planeOptions
+    width, height int
+    stats         *keptStats
+    dcRow         []float32 // DC predictor state carried across bands
+    nextY         int       // First plane row of the next band
+    prevAngle     uint8     // Last angle coded: the delta reference, reset per block row like the decoder
+
+    angles, counts, maxVals, indices, values []byte
+}
+
+func newPlaneEncoder(width, height int, po planeOptions, stats *keptStats) *planeEncoder {
+    paddedW := (width + 7) / 8 * 8
+    return &planeEncoder{
+        po: po, width: width, height: height, stats: stats,
+        dcRow: make([]float32, paddedW/8),
+    }
+}
+
+// reserve preallocates the streams from typical per-patch sizes. The
+// banded encoder skips it and lets them grow with the coded data.
+func (e *planeEncoder) reserve() {
+    numPatches := ((e.width + 7) / 8) * ((e.height + 7) / 8)
+    e.angles = make([]byte, 0, numPatches)
+    e.counts = make([]byte, 0, numPatches)
+    e.maxVals = make([]byte, 0, numPatches * 4) // float32
+    e.indices = make([]byte, 0, numPatches * 16)
+    e.values = make([]byte, 0, numPatches * 32)
+}
+
+// encodeBand codes the plane rows in band, which continue from the
+// previous band. Every band but the last must be a whole number of block
+// rows; the last one ends at the plane height and gets the edge padding.
+// band is an *image.Gray or, for FlagHighDepth, an *image.Gray16.
+func (e *planeEncoder) encodeBand(band image.Image) error {
+    po, width, height, stats := e.po, e.width, e.height, e.stats
+    s, threshold, flags := po.S, po.Threshold, po.Flags
     paddedW := (width + 7) / 8 * 8
-    paddedH := (height + 7) / 8 * 8
     
-    // Estimate sizes
-    numPatches := (paddedW / 8) * (paddedH / 8)
-    angles := make([]byte, 0, numPatches)
-    counts := make([]byte, 0, numPatches)
-    maxVals := make([]byte, 0, numPatches * 4) // float32
-    indices := make([]byte, 0, numPatches * 16)
-    values := make([]byte, 0, numPatches * 32)
+    bb := band.Bounds()
+    if bb.Dy() == 0 { return nil }
+    bandY := e.nextY
+    endY := bandY + bb.Dy()
+    if endY >= height {
+        endY = (height + 7) / 8 * 8
+    } else if bb.Dy()%8 != 0 {
+        return fmt.Errorf("band of %d rows is not a whole number of block rows", bb.Dy())
+    }
+    e.nextY += bb.Dy()
+
+    // Samples are read from Pix directly, on the 0..1 scale either way
+    var pix []uint8
+    var stride, bytesPer int
+    switch b := band.(type) {
+    case *image.Gray:
+        pix, stride, bytesPer = b.Pix[b.PixOffset(bb.Min.X, bb.Min.Y):], b.Stride, 1
+    case *image.Gray16:
+        pix, stride, bytesPer = b.Pix[b.PixOffset(bb.Min.X, bb.Min.Y):], b.Stride, 2
+    default:
+        return fmt.Errorf("unsupported plane type %T", band)
+    }
     
-    // Buffers for binary writing
-    maxValBuf := new(bytes.Buffer)
+    skipFlat := flags&FlagSkipFlat != 0
+    dcCoeffs := make([]float32, 128) // Coefficients of DC-only patches
     
-    for y := 0; y < paddedH; y += 8 {
+    for y := bandY; y < endY; y += 8 {
         for x := 0; x < paddedW; x += 8 {
             patchBuffer := patchPool.Get().([]float32)
             
@@ -233,60 +1137,213 @@ func gapEncodePlane(img *image.Gray, width, height int, s, threshold float32) ([
                     origX := x + px
                     if origX >= width { origX = width - 1 }
                     
-                    val := float32(img.GrayAt(origX, origY).Y) / 255.0
-                    patchBuffer[py*8+px] = val
+                    off := (origY-bandY)*stride + origX*bytesPer
+                    if bytesPer == 2 {
+                        patchBuffer[py*8+px] = float32(uint16(pix[off])<<8|uint16(pix[off+1])) / 65535.0
+                    } else {
+                        patchBuffer[py*8+px] = float32(pix[off]) / 255.0
+                    }
                 }
             }
             
-            // Compress
-            angle, cCoeffs, _, err := GapCompressPatch(patchBuffer, s, threshold)
-            if err != nil {
-                return nil, nil, nil, nil, nil, fmt.Errorf("failed to compress patch at (%d, %d): %v", x, y, err)
+            // Flat patch: one level byte instead of angle, maxVal and coefficients.
+            // It leaves the DC predictor state alone, as the decoder does.
+            if skipFlat {
+                if level, ok := flatPatchLevel(patchBuffer); ok {
+                    e.codeFlat(x/8, level)
+                    if stats != nil {
+                        stats.Patches++
+                    }
+                    patchPool.Put(patchBuffer)
+                    continue
+                }
             }
             
-            // Quantize Angle
-            normAngle := float64(angle)
-            for normAngle < 0 { normAngle += 2 * math.Pi }
-            byteAngle := uint8((normAngle / (2 * math.Pi)) * 255.0)
-
-            // Find MaxVal
-            var maxVal float32 = 0
-            for k := 0; k < 64; k++ {
-                re := cCoeffs[2*k]
-                im := cCoeffs[2*k+1]
-                mag := math.Sqrt(float64(re*re + im*im))
-                if mag > 0 {
-                    if float32(math.Abs(float64(re))) > maxVal { maxVal = float32(math.Abs(float64(re))) }
-                    if float32(math.Abs(float64(im))) > maxVal { maxVal = float32(math.Abs(float64(im))) }
-                }
+            // Compress (the Zig core does not modify the patch, so the
+            // baseline count for scaled thresholds can reuse it)
+            patchThreshold := threshold
+            if po.Adaptive {
+                patchThreshold *= adaptiveThresholdScale(patchBuffer)
             }
-            if maxVal == 0 { maxVal = 1.0 }
-
-            actualCount := 0
-            for k := 0; k < 64; k++ {
-                re := cCoeffs[2*k]
-                im := cCoeffs[2*k+1]
-                mag := math.Sqrt(float64(re*re + im*im))
-                
-                if mag > 0 { 
-                     indices = append(indices, uint8(k))
-                     qRe := int8(re / maxVal * 127.0)
-                     qIm := int8(im / maxVal * 127.0)
-                     values = append(values, byte(qRe), byte(qIm))
-                     actualCount++
+            if po.Perceptual {
+                patchThreshold *= perceptualThresholdScale(patchBuffer)
+            }
+            var byteAngle uint8
+            var cCoeffs []float32
+            // The shortcut knows only the core's transform
+            if dc, ok := dcOnlyPatch(patchBuffer, min(threshold, patchThreshold)); ok && !po.FullTransform && isPLTM(po.Transform) {
+                // Nearly flat: only the DC term could survive, so the transform
+                // is skipped. Any angle decodes the same; repeating the last
+                // one codes cheapest.
+                byteAngle = e.prevAngle
+                if x == 0 { byteAngle = 0 }
+                clear(dcCoeffs)
+                if dc*dc >= patchThreshold*patchThreshold { dcCoeffs[0] = dc }
+                cCoeffs = dcCoeffs
+                if stats != nil {
+                    stats.Patches++
+                    stats.DCOnly++
+                    if dc*dc >= threshold*threshold { stats.BaseKept++ }
                 }
+            } else {
+                angle, coeffs, err := forwardPatch(po.Transform, patchBuffer, s, patchThreshold)
+                if err != nil {
+                    return fmt.Errorf("failed to compress patch at (%d, %d): %v", x, y, err)
+                }
+                if stats != nil {
+                    stats.Patches++
+                    if patchThreshold != threshold {
+                        _, baseCoeffs, err := forwardPatch(po.Transform, patchBuffer, s, threshold)
+                        if err != nil {
+                            return fmt.Errorf("failed to compress patch at (%d, %d): %v", x, y, err)
+                        }
+                        stats.BaseKept += countNonzero(baseCoeffs)
+                    } else {
+                        stats.BaseKept += countNonzero(coeffs)
+                    }
+                }
+                byteAngle = quantizeAngle(angle)
+                cCoeffs = coeffs
             }
-
-            // Append to streams
-            angles = append(angles, byteAngle)
-            counts = append(counts, uint8(actualCount))
             
-            maxValBuf.Reset()
-            binary.Write(maxValBuf, binary.LittleEndian, maxVal)
-            maxVals = append(maxVals, maxValBuf.Bytes()...)
-
+            err := e.codePatch(x/8, y/8, byteAngle, cCoeffs)
             patchPool.Put(patchBuffer)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// codeFlat appends a flat patch (FlagSkipFlat) of the given level at
+// block column bx
+func (e *planeEncoder) codeFlat(bx int, level uint8) {
+    if bx == 0 { e.prevAngle = 0 }
+    e.counts = append(e.counts, flatPatchCount)
+    e.values = append(e.values, level)
+}
+
+// codePatch quantizes the coefficients of the patch at block (bx, by)
+// (128 floats; DC prediction rewrites the DC) and appends it to the
+// streams. Patches must come in raster order.
+func (e *planeEncoder) codePatch(bx, by int, byteAngle uint8, cCoeffs []float32) error {
+    flags, qtable, deadZone, stats := e.po.Flags, e.po.QTable, e.po.DeadZone, e.stats
+    // DC prediction tracks the decoder's reconstructed DC per block column
+    dcPred := flags&FlagDCPred != 0
+    dcRow := e.dcRow
+    runIndices := flags&FlagRunIndices != 0
+    angleDelta := flags&FlagAngleDelta != 0
+    halfMaxVal := flags&FlagHalfMaxVal != 0
+    compand := flags&FlagCompand != 0
+    depth := coeffDepth(flags)
+    qMax := coeffQMax(depth)
+    if bx == 0 { e.prevAngle = 0 }
+
+    // Replace DC with its residual against the neighbors' reconstruction
+    var dcPrediction float32
+    if dcPred {
+        dcPrediction = predictDC(dcRow, bx, by)
+        cCoeffs[0] -= dcPrediction
+        cCoeffs[1] = 0
+    }
+
+    // Find MaxVal
+    var maxVal float32 = 0
+    for k := 0; k < 64; k++ {
+        re := cCoeffs[2*k]
+        im := cCoeffs[2*k+1]
+        mag := math.Sqrt(float64(re*re + im*im))
+        if mag > 0 {
+            if float32(math.Abs(float64(re))) > maxVal { maxVal = float32(math.Abs(float64(re))) }
+            if float32(math.Abs(float64(im))) > maxVal { maxVal = float32(math.Abs(float64(im))) }
+        }
+    }
+    if maxVal == 0 { maxVal = 1.0 }
+    // Quantize against the value the decoder will see. Rounding up
+    // keeps every coefficient within +-qMax.
+    var maxValHalf uint16
+    if halfMaxVal {
+        maxValHalf = halfFromFloat32Ceil(maxVal)
+        maxVal = halfToFloat32(maxValHalf)
+        if math.IsInf(float64(maxVal), 0) {
+            return fmt.Errorf("patch at (%d, %d): maxVal exceeds the float16 range", bx*8, by*8)
+        }
+    }
+
+    actualCount := 0
+    var dcResidual float32
+    lastPos := -1
+    for pos := 0; pos < 64; pos++ {
+        // Raw indices keep natural order; run mode walks low to high frequency
+        k := pos
+        if runIndices { k = int(coeffScanOrder[pos]) }
+        re := cCoeffs[2*k]
+        im := cCoeffs[2*k+1]
+        mag := math.Sqrt(float64(re*re + im*im))
+        
+        if mag > 0 { 
+             qRe := int(re / maxVal * qMax)
+             qIm := int(im / maxVal * qMax)
+             if halfMaxVal || e.po.RoundCodes {
+                 // Truncating against the rounded-up maxVal would cost the
+                 // largest coefficient a whole step, so round instead
+                 qRe = int(math.Round(float64(re / maxVal * qMax)))
+                 qIm = int(math.Round(float64(im / maxVal * qMax)))
+             }
+             step := quantStep(maxVal, qtable, k)
+             if compand && k != 0 {
+                 qRe = quantizeCompanded(re, step, qMax)
+                 qIm = quantizeCompanded(im, step, qMax)
+             } else if qtable != nil {
+                 qRe = quantizeWeighted(re, step, qMax)
+                 qIm = quantizeWeighted(im, step, qMax)
+             }
+             // Dead zone: codes of +-1 cost 3 bytes and are mostly noise.
+             // DC is always kept so flat areas keep their level.
+             if k != 0 && absInt(qRe) < deadZone && absInt(qIm) < deadZone {
+                 continue
+             }
+             if runIndices {
+                 e.indices = append(e.indices, uint8(pos-lastPos-1))
+                 lastPos = pos
+             } else {
+                 e.indices = append(e.indices, uint8(k))
+             }
+             if depth > 8 {
+                 e.values = binary.LittleEndian.AppendUint16(e.values, uint16(int16(qRe)))
+                 e.values = binary.LittleEndian.AppendUint16(e.values, uint16(int16(qIm)))
+             } else {
+                 e.values = append(e.values, byte(int8(qRe)), byte(int8(qIm)))
+             }
+             actualCount++
+             if k == 0 { dcResidual = dequantCoeff(qRe, qMax, step) }
         }
     }
-    return angles, counts, maxVals, indices, values, nil
+    if dcPred {
+        dcRow[bx] = dcPrediction + dcResidual
+    }
+
+    if stats != nil {
+        stats.Kept += actualCount
+    }
+
+    // Append to streams; an empty patch decodes the same at any angle,
+    // so sparse-angle files drop it and the delta reference stays put
+    if actualCount > 0 || flags&FlagSparseAngles == 0 {
+        if angleDelta {
+            e.angles = append(e.angles, byteAngle-e.prevAngle) // mod 256
+        } else {
+            e.angles = append(e.angles, byteAngle)
+        }
+        e.prevAngle = byteAngle
+    }
+    e.counts = append(e.counts, uint8(actualCount))
+    
+    if halfMaxVal {
+        e.maxVals = binary.LittleEndian.AppendUint16(e.maxVals, maxValHalf)
+    } else {
+        e.maxVals = binary.LittleEndian.AppendUint32(e.maxVals, math.Float32bits(maxVal))
+    }
+    return nil
 }
@@ -0,0 +1,1257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests and benchmarks run on images generated in code; only the golden
+// digests and the WebP input come from testdata.
+
+// benchW x benchH is the synthetic image size used by every benchmark
+const benchW, benchH = 1024, 768
+
+// benchPlane generates a deterministic plane mixing a gradient, hard
+// edges and hashed noise, so patches keep a realistic number of
+// coefficients.
+func benchPlane(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	seed := uint32(12345)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			seed = seed*1664525 + 1013904223
+			v := (x+y)/8 + int(seed>>28)
+			if (x/64+y/48)%2 == 0 {
+				v += 60
+			}
+			img.Pix[y*img.Stride+x] = uint8(v)
+		}
+	}
+	return img
+}
+
+// benchRGBA expands benchPlane into a gray RGBA image
+func benchRGBA(w, h int) *image.RGBA {
+	plane := benchPlane(w, h)
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i, v := range plane.Pix {
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = v, v, v, 255
+	}
+	return img
+}
+
+// benchFlatPlane is a photo-like plane that is mostly flat: a smooth sky
+// over the top half, a uniform wall at the lower left and benchPlane's
+// texture at the lower right
+func benchFlatPlane(w, h int) *image.Gray {
+	img := benchPlane(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			switch {
+			case y < h/2:
+				img.Pix[y*img.Stride+x] = uint8(150 + 60*y/h + 20*x/w)
+			case x < w/2:
+				img.Pix[y*img.Stride+x] = 96
+			}
+		}
+	}
+	return img
+}
+
+// genericImage hides the concrete type of an image, forcing the
+// per-pixel At() path
+type genericImage struct{ image.Image }
+
+// colorWheel draws hue by angle around the center and saturation by
+// radius, so the chroma planes carry as much structure as luma
+func colorWheel(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x-w/2), float64(y-h/2)
+			hue := (math.Atan2(dy, dx) + math.Pi) / (2 * math.Pi) * 6
+			sat := math.Min(1, math.Hypot(dx, dy)/float64(w/2))
+			var rgb [3]float64
+			for c := range rgb {
+				// Piecewise-linear hue ramps, 120 degrees apart
+				d := math.Mod(hue+float64(4-2*c), 6)
+				rgb[c] = math.Max(0, math.Min(1, math.Abs(d-3)-1))
+				rgb[c] = 1 - sat + sat*rgb[c]
+			}
+			img.SetRGBA(x, y, color.RGBA{uint8(rgb[0] * 255), uint8(rgb[1] * 255), uint8(rgb[2] * 255), 255})
+		}
+	}
+	return img
+}
+
+// roundTrip encodes src with opts and decodes the file with default
+// options, failing the test on either error
+func roundTrip(t *testing.T, src image.Image, opts EncodeOptions) ([]byte, *image.RGBA) {
+	t.Helper()
+	data, img := roundTrip(t, src, opts)
+	return data, img
+}
+
+// streamBytes encodes src with opts and returns the file with the coded
+// size of each split stream, summed over the planes
+func streamBytes(t *testing.T, src image.Image, opts EncodeOptions) ([]byte, map[string]int) {
+	t.Helper()
+	var st Stats
+	data, err := encodeGap(src, nil, opts, &st)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	sizes := make(map[string]int)
+	for _, p := range st.Planes {
+		for _, s := range p.Streams {
+			sizes[s.Name] += s.Compressed
+		}
+	}
+	return data, sizes
+}
+
+// TestLossless round-trips a color image and odd-sized ones through
+// -lossless with each matrix and with CfL: every decode must equal the
+// source byte for byte, though the lossy layer alone does not
+func TestLossless(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  *image.RGBA
+		opts EncodeOptions
+	}{
+		{"rgb", colorWheel(64, 48), EncodeOptions{}},
+		{"rgb identity", colorWheel(64, 48), EncodeOptions{Matrix: MatrixIdentity}},
+		{"rgb cfl", colorWheel(64, 48), EncodeOptions{CfL: true}},
+		{"odd", colorWheel(37, 23), EncodeOptions{}},
+		{"odd bt709", colorWheel(37, 23), EncodeOptions{Matrix: MatrixBT709}},
+		{"odd texture", benchRGBA(51, 29), EncodeOptions{StreamChecksums: true}},
+	} {
+		opts := tc.opts
+		opts.S, opts.Threshold, opts.Lossless = 0.1, 0.5, true
+		data, img := roundTrip(t, tc.src, opts)
+		if img.Bounds() != tc.src.Bounds() {
+			t.Fatalf("%s: decoded %v, want %v", tc.name, img.Bounds(), tc.src.Bounds())
+		}
+		if !bytes.Equal(img.Pix, tc.src.Pix) {
+			t.Fatalf("%s: lossless decode is not exact", tc.name)
+		}
+		lossy, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{lossyOnly: true})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if bytes.Equal(lossy.Pix, tc.src.Pix) {
+			t.Fatalf("%s: the lossy layer is already exact", tc.name)
+		}
+	}
+}
+
+// TestDCPred codes smooth images with and without DC prediction. The
+// predicted DC no longer sets each patch's maximum, so the MaxVals stream
+// must shrink, and the file must decode about as well.
+func TestDCPred(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  image.Image
+	}{
+		{"sky", benchFlatPlane(256, 192)},
+		{"wheel", colorWheel(128, 96)},
+	} {
+		var maxVals [2]int
+		var psnr [2]float64
+		for i, pred := range []bool{false, true} {
+			data, sizes := streamBytes(t, tc.src, EncodeOptions{S: 0.1, Threshold: 0.5, DCPred: pred})
+			img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+			if err != nil {
+				t.Fatalf("%s dcpred=%v: %v", tc.name, pred, err)
+			}
+			maxVals[i], psnr[i] = sizes["MaxVals"], PSNR(img, tc.src)
+		}
+		if maxVals[1] >= maxVals[0] {
+			t.Fatalf("%s: MaxVals stream is %d bytes with DC prediction, %d without", tc.name, maxVals[1], maxVals[0])
+		}
+		if psnr[1] < psnr[0]-0.5 {
+			t.Fatalf("%s: %.2f dB with DC prediction, %.2f dB without", tc.name, psnr[1], psnr[0])
+		}
+	}
+}
+
+// TestRunIndices codes a mostly flat plane, whose patches keep a few
+// low-frequency coefficients, with raw and run-coded indices. The
+// indices stream must shrink and the decode must not change.
+func TestRunIndices(t *testing.T) {
+	src := benchFlatPlane(256, 192)
+	var indices [2]int
+	var outputs [2]*image.RGBA
+	for i, run := range []bool{false, true} {
+		data, sizes := streamBytes(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, RunIndices: run})
+		img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+		if err != nil {
+			t.Fatalf("runs=%v: %v", run, err)
+		}
+		indices[i], outputs[i] = sizes["Indices"], img
+	}
+	if indices[1] >= indices[0] {
+		t.Fatalf("indices stream is %d bytes run-coded, %d raw", indices[1], indices[0])
+	}
+	if !bytes.Equal(outputs[0].Pix, outputs[1].Pix) {
+		t.Fatalf("run-coded indices decode differently")
+	}
+}
+
+// TestThreads encodes and decodes with one worker and with eight and
+// expects identical files and pixels, through the CfL, grain, banded and
+// lossless paths and the luma-only decode. A decode with two workers must
+// keep the goroutine count within what its nested stages can start, and
+// a Workers option must override the process-wide limit.
+func TestThreads(t *testing.T) {
+	src := benchRGBA(200, 136)
+	for _, opts := range []EncodeOptions{
+		{S: 0.1, Threshold: 0.5, CfL: true, Grain: GrainAuto},
+		{S: 0.1, Threshold: 0.5, LowMem: true},
+		{S: 0.1, Threshold: 0.5, Lossless: true},
+	} {
+		var files [2][]byte
+		var pixels, gray [2][]byte
+		for i, workers := range []int{1, 8} {
+			opts.Workers = workers
+			data, err := encodeGap(src, nil, opts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[i] = data
+			img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Workers: workers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pixels[i] = img.Pix
+			g, err := DecodeGray(bytes.NewReader(data), DecodeOptions{Workers: workers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gray[i] = g.Pix
+		}
+		if !bytes.Equal(files[0], files[1]) {
+			t.Fatalf("%+v encodes differently with 1 and 8 workers", opts)
+		}
+		if !bytes.Equal(pixels[0], pixels[1]) || !bytes.Equal(gray[0], gray[1]) {
+			t.Fatalf("%+v decodes differently with 1 and 8 workers", opts)
+		}
+	}
+
+	// Plane decoding and chroma upsampling run two-deep: the decoding
+	// goroutine, 2 plane workers and 2 more under each of them
+	data, err := encodeGap(benchRGBA(512, 512), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := runtime.NumGoroutine()
+	done := make(chan error)
+	go func() {
+		_, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Workers: 2})
+		done <- err
+	}()
+	peak := 0
+	for running := true; running; {
+		select {
+		case err = <-done:
+			running = false
+		default:
+			peak = max(peak, runtime.NumGoroutine()-base)
+			runtime.Gosched()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("peak goroutines with 2 workers: %d", peak)
+	if peak > 1+2+2*2 {
+		t.Fatalf("decoding with 2 workers peaked at %d extra goroutines", peak)
+	}
+
+	prev := workerLimit.Swap(3)
+	defer workerLimit.Store(prev)
+	if workerCount(0) != 3 || workerCount(5) != 5 {
+		t.Fatalf("worker counts %d and %d under a limit of 3, want 3 and 5", workerCount(0), workerCount(5))
+	}
+}
+
+// TestLowMem encodes images whose heights leave partial (and, for
+// chroma, empty) last bands in both modes and expects identical files,
+// then encodes a tall image and checks the banded encoder stays well
+// below the three full planes the normal path allocates.
+func TestLowMem(t *testing.T) {
+	synth := func(w, h int) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				i := img.PixOffset(x, y)
+				img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(x*3+y/7), uint8(y/3), uint8(128+(y/40%2)*60), 255
+			}
+		}
+		return img
+	}
+
+	optionSets := []EncodeOptions{
+		{},
+		{Matrix: MatrixIdentity},
+		{DCPred: true, RunIndices: true, SkipFlat: true, AngleDelta: true, HalfMaxVal: true, Adaptive: true, Perceptual: true},
+	}
+	for _, size := range []image.Point{{50, 513}, {37, 300}} {
+		src := synth(size.X, size.Y)
+		for i, opts := range optionSets {
+			opts.S, opts.Threshold = 0.1, 0.5
+			want, err := encodeGap(src, nil, opts, nil)
+			if err != nil {
+				t.Fatalf("%v: %v", size, err)
+			}
+			opts.LowMem = true
+			got, err := encodeGap(src, nil, opts, nil)
+			if err != nil {
+				t.Fatalf("%v: %v", size, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%v option set %d: banded output differs", size, i)
+			}
+		}
+	}
+
+	if _, err := encodeGap(synth(16, 16), nil, EncodeOptions{S: 0.1, Threshold: 0.5, CfL: true, LowMem: true}, nil); err == nil {
+		t.Fatalf("accepted -cfl")
+	}
+
+	// A smooth source keeps the coded streams small, so the peak is
+	// dominated by the working planes
+	const w, h = 64, 20000
+	src := synth(w, h)
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	var peaks [2]uint64
+	for i, lowMem := range []bool{false, true} {
+		opts := EncodeOptions{S: 0.1, Threshold: 0.5, LowMem: lowMem}
+		peak, err := peakHeap(func() error {
+			_, err := encodeGap(src, nil, opts, nil)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("tall image: %v", err)
+		}
+		peaks[i] = peak
+	}
+	t.Logf("%dx%d peak heap: %d KB whole planes, %d KB banded", w, h, peaks[0]/1024, peaks[1]/1024)
+	if limit := uint64(w * h * 3 / 2); peaks[1] > limit {
+		t.Fatalf("banded encode peaked at %d bytes, limit %d", peaks[1], limit)
+	}
+}
+
+// TestTinyImages round-trips color and grayscale gradients smaller
+// than (or exactly) one patch, including 1-pixel-wide ones whose chroma
+// cannot be halved: lossless must come back exact and lossy close, at the
+// source size. Empty images and images over MaxPixels must be rejected.
+func TestTinyImages(t *testing.T) {
+	sizes := []image.Point{{1, 1}, {3, 5}, {7, 9}, {8, 8}, {1, 20}, {20, 1}}
+	for _, size := range sizes {
+		rgb := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+		gray := image.NewGray(rgb.Bounds())
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				rgb.SetRGBA(x, y, color.RGBA{R: uint8(90 + 5*x), G: uint8(120 + 4*y), B: uint8(170 - 3*x), A: 255})
+				gray.Pix[y*gray.Stride+x] = uint8(80 + 3*x + 2*y)
+			}
+		}
+		for _, src := range []image.Image{rgb, gray} {
+			for _, opts := range []EncodeOptions{
+				{S: 0.05, Threshold: 0.1},
+				{S: 0.05, Threshold: 0.1, Lossless: true},
+				{S: 0.05, Threshold: 0.1, Matrix: MatrixIdentity},
+				{S: 0.05, Threshold: 0.1, CfL: true},
+			} {
+				_, img := roundTrip(t, src, opts)
+				if img.Bounds().Size() != size {
+					t.Fatalf("%v %T decoded at %v", size, src, img.Bounds().Size())
+				}
+				p := PSNR(src, img)
+				if opts.Lossless && !math.IsInf(p, 1) {
+					t.Fatalf("%v %T lossless PSNR %.2f dB", size, src, p)
+				}
+				if p < 25 {
+					t.Fatalf("%v %T matrix %s cfl %v: PSNR %.2f dB", size, src, opts.Matrix, opts.CfL, p)
+				}
+			}
+		}
+	}
+
+	if _, err := encodeGap(image.NewRGBA(image.Rect(0, 0, 0, 0)), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil); err == nil {
+		t.Fatalf("a 0x0 image was accepted")
+	}
+	if _, err := encodeGap(benchRGBA(100, 100), nil, EncodeOptions{S: 0.1, Threshold: 0.5, MaxPixels: 5000}, nil); err == nil {
+		t.Fatalf("a 100x100 image passed a 5000-pixel limit")
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, benchRGBA(100, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Encode(bytes.NewReader(buf.Bytes()), io.Discard, EncodeOptions{S: 0.1, Threshold: 0.5, MaxPixels: 5000}); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Fatalf("Encode ignored the pixel limit (%v)", err)
+	}
+}
+
+// TestDeterministicMode encodes and decodes with deterministic set,
+// as GAP_DETERMINISTIC=1 does, twice each, expecting identical bytes and
+// pixels, the same file as the default parallel encode, and one worker
+// whatever workerLimit says
+func TestDeterministicMode(t *testing.T) {
+	src := colorWheel(96, 80)
+	opts := EncodeOptions{S: 0.1, Threshold: 0.5, CfL: true, Grain: GrainAuto}
+	parallel, err := encodeGap(src, nil, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deterministic.Store(true)
+	defer deterministic.Store(false)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	workerLimit.Store(8)
+	defer workerLimit.Store(0)
+	if n := workerCount(0); n != 1 {
+		t.Fatalf("%d workers", n)
+	}
+	var files [][]byte
+	var pixels [][]byte
+	for run := 0; run < 2; run++ {
+		data, img := roundTrip(t, src, opts)
+		files, pixels = append(files, data), append(pixels, img.Pix)
+	}
+	if !bytes.Equal(files[0], files[1]) || !bytes.Equal(pixels[0], pixels[1]) {
+		t.Fatalf("two runs differ")
+	}
+	if !bytes.Equal(files[0], parallel) {
+		t.Fatalf("file differs from the parallel encode")
+	}
+}
+
+// TestDeterminism encodes a reference image with several option sets
+// on one thread and then repeatedly with many, expecting byte-identical
+// files every time, and compares the golden fixture digests.
+func TestDeterminism(t *testing.T) {
+	src := colorWheel(96, 80)
+	optionSets := []EncodeOptions{
+		{S: 0.1, Threshold: 0.5},
+		{S: 0.1, Threshold: 0.5, DCPred: true, RunIndices: true, AngleDelta: true, CfL: true},
+		{S: 0.1, Threshold: 0.5, Lossless: true},
+		{S: 0.1, Threshold: 0.5, Adaptive: true, Perceptual: true, Grain: GrainAuto},
+		{S: 0.1, Threshold: 0.5, LowMem: true, Compress: CompressNone},
+	}
+	digest := func(opts EncodeOptions, procs, workers int) (string, error) {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+		workerLimit.Store(int32(workers))
+		defer workerLimit.Store(0)
+		data, err := encodeGap(src, nil, opts, nil)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	for i, opts := range optionSets {
+		want, err := digest(opts, 1, 1)
+		if err != nil {
+			t.Fatalf("option set %d: %v", i, err)
+		}
+		for run := 0; run < 3; run++ {
+			got, err := digest(opts, max(8, runtime.NumCPU()), 32)
+			if err != nil {
+				t.Fatalf("option set %d: %v", i, err)
+			}
+			if got != want {
+				t.Fatalf("option set %d run %d: %s, want %s as on one thread", i, run, got, want)
+			}
+		}
+	}
+}
+
+//go:embed testdata/golden.txt
+var goldenDigests string
+
+// goldenFixtures are the inputs whose digests testdata/golden.txt pins.
+// They are built with integer math only, so they are the same everywhere.
+func goldenFixtures() (map[string]func() (image.Image, EncodeOptions), error) {
+	gopher, err := decodeSource(webpFixture)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]func() (image.Image, EncodeOptions){
+		"pattern-709-qtable": func() (image.Image, EncodeOptions) {
+			img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+			for y := 0; y < 48; y++ {
+				for x := 0; x < 64; x++ {
+					img.SetRGBA(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 5), B: uint8(x * y), A: 255})
+				}
+			}
+			return img, EncodeOptions{S: 0.1, Threshold: 0.5, Matrix: MatrixBT709, QTables: []QTable{PerceptualQTable(), PerceptualQTable(), PerceptualQTable()}}
+		},
+		"gopher-dcpred": func() (image.Image, EncodeOptions) {
+			return gopher, EncodeOptions{S: 0.1, Threshold: 0.5, DCPred: true}
+		},
+		"ramp-1x20": func() (image.Image, EncodeOptions) {
+			return benchRGBA(1, 20), EncodeOptions{S: 0.1, Threshold: 0.5}
+		},
+	}, nil
+}
+
+// encodeDigest hashes the parts of encoding src that do not come from
+// the Zig core: the file's header, plane table and chunks, and the planes
+// handed to the core. The coded streams depend on the core build, so
+// TestDeterminism covers them by comparing runs instead.
+func encodeDigest(src image.Image, opts EncodeOptions) (string, error) {
+	data, err := encodeGap(src, nil, opts, nil)
+	if err != nil {
+		return "", err
+	}
+	r := bytes.NewReader(data)
+	if _, err := readHeader(r); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(data[:len(data)-r.Len()])
+	p0, p1, p2 := splitImagePlanes(src, opts.Matrix, 0)
+	if chromaSubsampled(opts.Matrix, src.Bounds().Dx(), src.Bounds().Dy()) {
+		p1, p2 = downsamplePlane(p1, 0), downsamplePlane(p2, 0)
+	}
+	for _, p := range []*image.Gray{p0, p1, p2} {
+		h.Write(p.Pix)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TestGolden compares each fixture's encodeDigest with the one in
+// testdata/golden.txt ("name digest" lines). A mismatch means the file
+// layout or the plane conversion changed; if that is intended, bump
+// FormatVersion as needed and replace the line with the printed digest.
+func TestGolden(t *testing.T) {
+	fixtures, err := goldenFixtures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(goldenDigests), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("malformed line %q", line)
+		}
+		fixture, ok := fixtures[fields[0]]
+		if !ok {
+			t.Fatalf("unknown fixture %s", fields[0])
+		}
+		got, err := encodeDigest(fixture())
+		if err != nil {
+			t.Fatalf("%s: %v", fields[0], err)
+		}
+		if got != fields[1] {
+			t.Fatalf("%s digest %s, want %s", fields[0], got, fields[1])
+		}
+		seen[fields[0]] = true
+	}
+	for name := range fixtures {
+		if !seen[name] {
+			t.Fatalf("no digest for %s", name)
+		}
+	}
+}
+
+// TestDeadZoneSweep encodes a synthetic noisy photograph-like image at
+// increasing dead-zone cutoffs, printing size and PSNR. Files must shrink
+// (or stay equal) as the cutoff rises and quality must stay finite and
+// above a floor, i.e. dropping coefficients must not introduce artifacts.
+func TestDeadZoneSweep(t *testing.T) {
+	const w, h = 96, 64
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	seed := uint32(1)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			seed = seed*1664525 + 1013904223
+			noise := int(seed>>24)%32 - 16
+			off := src.PixOffset(x, y)
+			src.Pix[off] = clampToByte(float32(x*2 + noise + 40))
+			src.Pix[off+1] = clampToByte(float32(y*3 + noise + 30))
+			src.Pix[off+2] = clampToByte(float32((x+y)%64*2 + noise + 60))
+			src.Pix[off+3] = 255
+		}
+	}
+
+	t.Log("deadzone   bytes   PSNR")
+	prevSize := -1
+	for _, dz := range []int{0, 1, 2, 3, 4} {
+		data, decoded := roundTrip(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, DeadZone: dz})
+		quality := PSNR(src, decoded)
+		t.Logf("%8d %7d %6.2f", dz, len(data), quality)
+		if math.IsNaN(quality) || quality < 20 {
+			t.Fatalf("deadzone %d: PSNR %.2f dB below 20 dB floor", dz, quality)
+		}
+		if prevSize >= 0 && len(data) > prevSize {
+			t.Fatalf("deadzone %d: file grew from %d to %d bytes", dz, prevSize, len(data))
+		}
+		prevSize = len(data)
+	}
+}
+
+// TestCfL encodes a synthetic cartoon (flat colored discs on a
+// flat background) with and without chroma-from-luma prediction, printing
+// both sizes, and checks the predicted file still decodes cleanly.
+func TestCfL(t *testing.T) {
+	const w, h = 128, 96
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	discs := []struct {
+		cx, cy, r int
+		c         [3]uint8
+	}{
+		{32, 32, 20, [3]uint8{220, 40, 40}},
+		{80, 50, 28, [3]uint8{40, 90, 210}},
+		{50, 75, 16, [3]uint8{250, 210, 60}},
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := [3]uint8{70, 160, 90}
+			for _, d := range discs {
+				if (x-d.cx)*(x-d.cx)+(y-d.cy)*(y-d.cy) <= d.r*d.r {
+					c = d.c
+				}
+			}
+			off := src.PixOffset(x, y)
+			copy(src.Pix[off:off+3], c[:])
+			src.Pix[off+3] = 255
+		}
+	}
+
+	sizes := make([]int, 2)
+	for i, cfl := range []bool{false, true} {
+		data, decoded := roundTrip(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, CfL: cfl})
+		quality := PSNR(src, decoded)
+		if math.IsNaN(quality) || quality < 20 {
+			t.Fatalf("cfl=%v: PSNR %.2f dB below 20 dB floor", cfl, quality)
+		}
+		sizes[i] = len(data)
+		t.Logf("cfl=%-5v %7d bytes %6.2f dB", cfl, len(data), quality)
+	}
+	t.Logf("CfL size change: %+.1f%%", float64(sizes[1]-sizes[0])/float64(sizes[0])*100)
+}
+
+// TestAdaptiveThreshold codes a gently rippled plane and a busy one
+// with and without -adaptive over a range of thresholds. The flat plane
+// must never keep more coefficients and the busy one never fewer, each
+// changing at some threshold, and an adaptive file must decode.
+func TestAdaptiveThreshold(t *testing.T) {
+	const w, h = 96, 64
+	ripple := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			ripple.Pix[y*ripple.Stride+x] = uint8(128 + 6*math.Sin(float64(x)*0.4)*math.Cos(float64(y)*0.3))
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		plane *image.Gray
+		sign  int // Of the kept-count change under -adaptive
+	}{
+		{"flat", ripple, -1},
+		{"textured", benchPlane(w, h), 1},
+	} {
+		changed := false
+		for _, threshold := range []float32{0.05, 0.1, 0.2, 0.5, 1} {
+			var kept [2]int
+			for i, adaptive := range []bool{false, true} {
+				var st keptStats
+				po := planeOptions{S: 0.1, Threshold: threshold, Flags: FlagQuantized, Adaptive: adaptive}
+				if _, _, _, _, _, err := gapEncodePlane(tc.plane, w, h, po, &st); err != nil {
+					t.Fatalf("%s: %v", tc.name, err)
+				}
+				kept[i] = st.Kept
+			}
+			if d := kept[1] - kept[0]; d*tc.sign < 0 {
+				t.Fatalf("%s threshold %g: %d coefficients kept with -adaptive, %d without", tc.name, threshold, kept[1], kept[0])
+			} else if d != 0 {
+				changed = true
+			}
+		}
+		if !changed {
+			t.Fatalf("%s: -adaptive never changed the kept coefficients", tc.name)
+		}
+	}
+
+	// Ripple over the top half, texture below
+	src := benchRGBA(w, h)
+	for i, v := range ripple.Pix[:w*h/2] {
+		src.Pix[i*4], src.Pix[i*4+1], src.Pix[i*4+2] = v, v, v
+	}
+	_, img := roundTrip(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, Adaptive: true})
+	if img.Bounds() != src.Bounds() {
+		t.Fatalf("decoded %v, want %v", img.Bounds(), src.Bounds())
+	}
+}
+
+// TestPerceptualThreshold encodes a textured image with deep shadows,
+// midtones and bright sky with and without -perceptual. The perceptual
+// file must not be larger, and a midtone-only plane must code to exactly
+// the same coefficient counts either way.
+func TestPerceptualThreshold(t *testing.T) {
+	const w, h = 96, 96
+	texture := func(x, y int) int { return int(uint32(x*7919+y*104729)>>3)%9 - 4 }
+	level := func(y int) int {
+		switch {
+		case y < 32:
+			return 12 // shadows
+		case y < 64:
+			return 128 // midtones
+		}
+		return 242 // sky
+	}
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := clampToByte(float32(level(y) + texture(x, y) + x/12))
+			off := src.PixOffset(x, y)
+			src.Pix[off], src.Pix[off+1], src.Pix[off+2], src.Pix[off+3] = v, v, v, 255
+		}
+	}
+
+	sizes := make([]int, 2)
+	for i, perceptual := range []bool{false, true} {
+		data, decoded := roundTrip(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, Perceptual: perceptual})
+		sizes[i] = len(data)
+		t.Logf("perceptual=%-5v %7d bytes %6.2f dB", perceptual, len(data), PSNR(src, decoded))
+	}
+	if sizes[1] > sizes[0] {
+		t.Fatalf("perceptual file is larger (%d > %d bytes)", sizes[1], sizes[0])
+	}
+
+	mid := image.NewGray(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			mid.Pix[y*mid.Stride+x] = clampToByte(float32(128 + texture(x, y) + x/4))
+		}
+	}
+	var counts [2][]byte
+	for i, perceptual := range []bool{false, true} {
+		po := planeOptions{S: 0.1, Threshold: 0.5, Flags: FlagQuantized, Perceptual: perceptual}
+		_, c, _, _, _, err := gapEncodePlane(mid, 64, 32, po, nil)
+		if err != nil {
+			t.Fatalf("midtone plane: %v", err)
+		}
+		counts[i] = c
+	}
+	if !bytes.Equal(counts[0], counts[1]) {
+		t.Fatalf("midtone coefficient counts changed under -perceptual")
+	}
+}
+
+// TestDCOnlyFastPath codes a mostly flat plane with and without the
+// DC-only fast path. Every patch the fast path takes must keep no AC
+// coefficient through the real transform, and the decoded planes must
+// match; the encode times are printed for comparison.
+func TestDCOnlyFastPath(t *testing.T) {
+	const w, h = 256, 192
+	plane := benchFlatPlane(w, h)
+	for _, flags := range []uint32{
+		FlagQuantized,
+		FlagQuantized | FlagDCPred | FlagAngleDelta,
+		FlagQuantized | FlagRunIndices | FlagCompand | FlagHalfMaxVal,
+	} {
+		var recon [2]*image.Gray
+		var elapsed [2]time.Duration
+		var stats keptStats
+		for i, full := range []bool{false, true} {
+			po := planeOptions{S: 0.1, Threshold: 0.5, Flags: flags, FullTransform: full}
+			st := &keptStats{}
+			start := time.Now()
+			a, c, m, idx, v, err := gapEncodePlane(plane, w, h, po, st)
+			elapsed[i] = time.Since(start)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if !full {
+				stats = *st
+			}
+			if recon[i], err = gapDecodePlaneSplit(a, c, m, idx, v, w, h, flags, 0, 0.1, nil, nil, 0); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+		}
+		t.Logf("flags 0x%x: %d of %d patches DC-only, encode %v -> %v", flags, stats.DCOnly, stats.Patches, elapsed[1].Round(time.Microsecond), elapsed[0].Round(time.Microsecond))
+		if stats.DCOnly < stats.Patches/2 {
+			t.Fatalf("flags 0x%x: only %d of %d patches took the fast path", flags, stats.DCOnly, stats.Patches)
+		}
+		for i := range recon[0].Pix {
+			if d := int(recon[0].Pix[i]) - int(recon[1].Pix[i]); d < -1 || d > 1 {
+				t.Fatalf("flags 0x%x: pixel %d is %d with the fast path, %d without", flags, i, recon[0].Pix[i], recon[1].Pix[i])
+			}
+		}
+	}
+
+	// Near-flat patches around the cutoff: whenever the bound says DC-only,
+	// the transform must agree
+	seed := uint32(7)
+	patch := make([]float32, 64)
+	for n := 0; n < 2000; n++ {
+		amp := float32(n%40) / 255 / 8
+		for k := range patch {
+			seed = seed*1664525 + 1013904223
+			patch[k] = 0.5 + amp*(float32(seed>>24)/255-0.5)
+		}
+		if _, ok := dcOnlyPatch(patch, 0.5); !ok {
+			continue
+		}
+		_, coeffs, _, err := GapCompressPatch(patch, 0.1, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coeffs[0], coeffs[1] = 0, 0
+		if kept := countNonzero(coeffs); kept != 0 {
+			t.Fatalf("patch %d judged flat keeps %d AC coefficients", n, kept)
+		}
+	}
+}
+
+// TestSkipFlat encodes a screenshot-like image (uniform panels,
+// one busy region) with and without -skipflat and expects a smaller file
+// with identical pixels, then checks that an image with no flat blocks
+// decodes identically either way.
+func TestSkipFlat(t *testing.T) {
+	const w, h = 160, 96
+	screenshot := image.NewRGBA(image.Rect(0, 0, w, h))
+	noisy := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := [3]uint8{240, 240, 240} // window background
+			switch {
+			case y < 16:
+				c = [3]uint8{40, 60, 120} // title bar
+			case x < 32:
+				c = [3]uint8{200, 205, 210} // sidebar
+			case x >= 64 && x < 128 && y >= 32 && y < 64:
+				v := uint8((x*37 + y*11) % 200) // "text" region
+				c = [3]uint8{v, v, v}
+			}
+			off := screenshot.PixOffset(x, y)
+			copy(screenshot.Pix[off:off+3], c[:])
+			screenshot.Pix[off+3] = 255
+			v := uint8(60 + (x*31+y*17)%97)
+			noisy.Pix[off], noisy.Pix[off+1], noisy.Pix[off+2], noisy.Pix[off+3] = v, v/2+40, 255-v, 255
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		src       *image.RGBA
+		wantSaved bool
+	}{{"screenshot", screenshot, true}, {"no flat blocks", noisy, false}} {
+		var sizes [2]int
+		var outputs [2]*image.RGBA
+		for i, skip := range []bool{false, true} {
+			data, err := encodeGap(tc.src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, SkipFlat: skip}, nil)
+			if err != nil {
+				t.Fatalf("%s skipflat=%v: encode: %v", tc.name, skip, err)
+			}
+			outputs[i], _, err = decodeGap(bytes.NewReader(data), DecodeOptions{})
+			if err != nil {
+				t.Fatalf("%s skipflat=%v: decode: %v", tc.name, skip, err)
+			}
+			sizes[i] = len(data)
+		}
+		t.Logf("%-15s %7d -> %7d bytes", tc.name, sizes[0], sizes[1])
+		if tc.wantSaved && sizes[1] >= sizes[0] {
+			t.Fatalf("%s: skip-flat saved nothing", tc.name)
+		}
+		if !tc.wantSaved && !bytes.Equal(outputs[0].Pix, outputs[1].Pix) {
+			t.Fatalf("%s: output changed with skip-flat", tc.name)
+		}
+	}
+}
+
+// TestAngleDelta codes a plane with slowly rotating structure
+// (concentric rings, similar to natural orientation fields) with raw and
+// delta angles, prints both range-coded stream sizes and checks the
+// reconstructions match.
+func TestAngleDelta(t *testing.T) {
+	const w, h = 128, 128
+	plane := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x-w/2), float64(y-h/2)
+			plane.Pix[y*plane.Stride+x] = uint8(128 + 100*math.Sin(math.Sqrt(dx*dx+dy*dy)/3))
+		}
+	}
+
+	var sizes [2]int
+	var recon [2]*image.Gray
+	for i, flags := range []uint32{FlagQuantized, FlagQuantized | FlagAngleDelta} {
+		po := planeOptions{S: 0.1, Threshold: 0.5, Flags: flags}
+		a, c, m, idx, v, err := gapEncodePlane(plane, w, h, po, nil)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		coded, err := GapCompressData(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = len(coded)
+		recon[i], err = gapDecodePlaneSplit(a, c, m, idx, v, w, h, flags, 0, 0.1, nil, nil, 0)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+	}
+	t.Logf("angles stream: raw %d bytes, delta %d bytes", sizes[0], sizes[1])
+	if !bytes.Equal(recon[0].Pix, recon[1].Pix) {
+		t.Fatalf("reconstruction differs from raw angles")
+	}
+}
+
+// TestSparseAngles codes a plane of flat panels and a textured
+// region with DC prediction, which leaves the panels' patches empty. With
+// sparse angles the angles stream must hold exactly one byte per patch
+// that kept a coefficient, and the reconstruction must not change, with
+// raw or delta angles and alongside skip-flat. Whole files must shrink
+// and decode identically.
+func TestSparseAngles(t *testing.T) {
+	const w, h = 96, 64
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(200)
+			if x >= 32 && x < 64 && y >= 16 && y < 48 {
+				v = uint8((x*37 + y*11) % 200)
+			} else if y < 16 {
+				v = 60
+			}
+			i := src.PixOffset(x, y)
+			src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = v, v, v/2, 255
+		}
+	}
+	plane, _, _ := splitImagePlanes(src, MatrixBT601, 0)
+
+	for _, extra := range []uint32{0, FlagAngleDelta, FlagAngleDelta | FlagSkipFlat | FlagRunIndices} {
+		flags := FlagQuantized | FlagDCPred | extra
+		var recon [2]*image.Gray
+		for i, f := range []uint32{flags, flags | FlagSparseAngles} {
+			a, c, m, idx, v, err := gapEncodePlane(plane, w, h, planeOptions{S: 0.1, Threshold: 0.5, Flags: f}, nil)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if f&FlagSparseAngles != 0 {
+				coded, empty := 0, 0
+				for _, n := range c {
+					switch n {
+					case 0:
+						empty++
+					case flatPatchCount:
+					default:
+						coded++
+					}
+				}
+				// Skip-flat codes the panels as flat patches instead
+				if len(a) != coded || empty == 0 && f&FlagSkipFlat == 0 {
+					t.Fatalf("flags 0x%x: %d angle bytes for %d coded and %d empty patches", f, len(a), coded, empty)
+				}
+			}
+			if recon[i], err = gapDecodePlaneSplit(a, c, m, idx, v, w, h, f, 0, 0.1, nil, nil, 0); err != nil {
+				t.Fatalf("flags 0x%x: decode: %v", f, err)
+			}
+		}
+		if !bytes.Equal(recon[0].Pix, recon[1].Pix) {
+			t.Fatalf("flags 0x%x: reconstruction differs without the empty patches' angles", flags)
+		}
+	}
+
+	var sizes [2]int
+	var outputs [2]*image.RGBA
+	for i, sparse := range []bool{false, true} {
+		data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, DCPred: true, SparseAngles: sparse}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outputs[i], _, err = decodeGap(bytes.NewReader(data), DecodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = len(data)
+	}
+	t.Logf("file: %d -> %d bytes", sizes[0], sizes[1])
+	if sizes[1] >= sizes[0] {
+		t.Fatalf("saved nothing")
+	}
+	if !bytes.Equal(outputs[0].Pix, outputs[1].Pix) {
+		t.Fatalf("output changed")
+	}
+}
+
+// TestCoeffDepth encodes a textured plane at several coefficient
+// depths. An explicit 8-bit depth field must produce the same streams as
+// no field, and plane error must not grow as the depth increases.
+func TestCoeffDepth(t *testing.T) {
+	const w, h = 64, 64
+	plane := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			plane.Pix[y*plane.Stride+x] = uint8(128 + 60*math.Sin(float64(x)/3)*math.Cos(float64(y)/5) + float64((x*13+y*7)%11))
+		}
+	}
+
+	_, _, _, _, legacy, err := gapEncodePlane(plane, w, h, planeOptions{S: 0.1, Threshold: 0.5, Flags: FlagQuantized}, nil)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	prevErr := math.Inf(1)
+	for _, depth := range []int{4, 6, 8, 12, 16} {
+		flags := uint32(FlagQuantized | depth<<flagDepthShift)
+		a, c, m, idx, v, err := gapEncodePlane(plane, w, h, planeOptions{S: 0.1, Threshold: 0.5, Flags: flags}, nil)
+		if err != nil {
+			t.Fatalf("depth %d: encode: %v", depth, err)
+		}
+		if depth == 8 && !bytes.Equal(v, legacy) {
+			t.Fatalf("depth 8: values differ from the legacy int8 layout")
+		}
+		recon, err := gapDecodePlaneSplit(a, c, m, idx, v, w, h, flags, 0, 0.1, nil, nil, 0)
+		if err != nil {
+			t.Fatalf("depth %d: decode: %v", depth, err)
+		}
+		var sumSq float64
+		for i := range plane.Pix {
+			d := float64(plane.Pix[i]) - float64(recon.Pix[i])
+			sumSq += d * d
+		}
+		rmse := math.Sqrt(sumSq / float64(len(plane.Pix)))
+		t.Logf("%2d bits: values %6d bytes, RMSE %.3f", depth, len(v), rmse)
+		// Allow a little slack: the transform itself, not quantization, dominates at high depth
+		if rmse > prevErr+0.05 {
+			t.Fatalf("depth %d: RMSE %.3f worse than the coarser depth (%.3f)", depth, rmse, prevErr)
+		}
+		prevErr = rmse
+	}
+}
+
+// TestCompand checks the companded quantizer round trip, then
+// codes a texture-heavy plane with the linear and the square-root
+// quantizer and prints the SSIM and size of each. The companded plane
+// must not score lower.
+func TestCompand(t *testing.T) {
+	const qMax, step = 127, 3.5
+	for q := -127; q <= 127; q++ {
+		if got := quantizeCompanded(dequantCompanded(q, qMax, step), step, qMax); got != q {
+			t.Fatalf("code %d requantizes to %d", q, got)
+		}
+	}
+
+	const w, h = 128, 128
+	plane := image.NewGray(image.Rect(0, 0, w, h))
+	seed := uint32(7)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// Fine weave over a soft gradient, with a little hashed grit
+			seed = seed*1664525 + 1013904223
+			v := 90 + float64(x+y)/4 + 18*math.Sin(float64(x)*1.3)*math.Sin(float64(y)*0.9) + 6*math.Sin(float64(x*y)/7) + float64(seed>>29)
+			plane.Pix[y*plane.Stride+x] = clampToByte(float32(v))
+		}
+	}
+
+	var sizes [2]int
+	var ssim [2]float64
+	for i, flags := range []uint32{FlagQuantized, FlagQuantized | FlagCompand} {
+		po := planeOptions{S: 0.1, Threshold: 0.5, Flags: flags}
+		a, c, m, idx, v, err := gapEncodePlane(plane, w, h, po, nil)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		recon, err := gapDecodePlaneSplit(a, c, m, idx, v, w, h, flags, 0, 0.1, nil, nil, 0)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		cv, err := RangeCompress(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cidx, err := RangeCompress(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = len(cv) + len(cidx)
+		ssim[i] = ssimPlane(plane, recon)
+	}
+	t.Logf("texture  SSIM %.4f -> %.4f, coefficients %d -> %d bytes coded", ssim[0], ssim[1], sizes[0], sizes[1])
+	if ssim[1] < ssim[0] {
+		t.Fatalf("SSIM dropped from %.4f to %.4f", ssim[0], ssim[1])
+	}
+}
+
+// TestHalfMaxVal checks the float16 conversion on edge values,
+// then codes a few synthetic planes with float32 and float16 maxVals: the
+// maxVals stream must halve and PSNR may drop by less than 0.15 dB
+// (on flat synthetic blocks a few DC levels near .5 round the other way).
+func TestHalfMaxVal(t *testing.T) {
+	for _, v := range []float32{1, 0.1, 64, 1e-6, 3e-8, 65504, 12345.678} {
+		h := halfFromFloat32Ceil(v)
+		if got := halfToFloat32(h); got < v || (h > 0 && halfToFloat32(h-1) >= v) {
+			t.Fatalf("%g rounds up to %g, not the nearest half above", v, got)
+		}
+	}
+
+	planes := map[string]func(x, y int) float64{
+		"rings": func(x, y int) float64 {
+			dx, dy := float64(x-64), float64(y-64)
+			return 128 + 100*math.Sin(math.Sqrt(dx*dx+dy*dy)/3)
+		},
+		"texture": func(x, y int) float64 {
+			return 128 + 60*math.Sin(float64(x)/3)*math.Cos(float64(y)/5) + float64((x*13+y*7)%11)
+		},
+		"edges": func(x, y int) float64 { return float64(40 + 160*((x/16+y/16)%2) + (x+y)%5) },
+	}
+	const w, h = 128, 128
+	for name, pixel := range planes {
+		plane := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				plane.Pix[y*plane.Stride+x] = clampToByte(float32(pixel(x, y)))
+			}
+		}
+
+		var sizes [2]int
+		var quality [2]float64
+		for i, flags := range []uint32{FlagQuantized | FlagDCPred, FlagQuantized | FlagDCPred | FlagHalfMaxVal} {
+			po := planeOptions{S: 0.1, Threshold: 0.5, Flags: flags}
+			a, c, m, idx, v, err := gapEncodePlane(plane, w, h, po, nil)
+			if err != nil {
+				t.Fatalf("%s: encode: %v", name, err)
+			}
+			recon, err := gapDecodePlaneSplit(a, c, m, idx, v, w, h, flags, 0, 0.1, nil, nil, 0)
+			if err != nil {
+				t.Fatalf("%s: decode: %v", name, err)
+			}
+			var sumSq float64
+			for j := range plane.Pix {
+				d := float64(plane.Pix[j]) - float64(recon.Pix[j])
+				sumSq += d * d
+			}
+			sizes[i] = len(m)
+			quality[i] = 10 * math.Log10(255*255/(sumSq/float64(len(plane.Pix))))
+		}
+		t.Logf("%-8s maxVals %d -> %d bytes, PSNR %.3f -> %.3f dB", name, sizes[0], sizes[1], quality[0], quality[1])
+		if sizes[1]*2 != sizes[0] {
+			t.Fatalf("%s: maxVals stream is %d bytes, want %d", name, sizes[1], sizes[0]/2)
+		}
+		if quality[0]-quality[1] >= 0.15 {
+			t.Fatalf("%s: float16 maxVal costs %.3f dB", name, quality[0]-quality[1])
+		}
+	}
+}
+
+var benchPlaneOptions = planeOptions{S: 0.1, Threshold: 0.5, Flags: FlagQuantized}
+
+func BenchmarkEncodePlane(b *testing.B) {
+	plane := benchPlane(benchW, benchH)
+	b.SetBytes(int64(benchW * benchH))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, _, _, err := gapEncodePlane(plane, benchW, benchH, benchPlaneOptions, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchEncodeFlatPlane codes benchFlatPlane, with the DC-only fast path
+// for flat patches or (full) through the transform for every patch
+func benchEncodeFlatPlane(b *testing.B, full bool) {
+	plane := benchFlatPlane(benchW, benchH)
+	po := benchPlaneOptions
+	po.FullTransform = full
+	b.SetBytes(int64(benchW * benchH))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, _, _, err := gapEncodePlane(plane, benchW, benchH, po, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeFlatPlane(b *testing.B)     { benchEncodeFlatPlane(b, false) }
+func BenchmarkEncodeFlatPlaneFull(b *testing.B) { benchEncodeFlatPlane(b, true) }
+
+// BenchmarkSplitPlanes12MP converts a 4000x3000 RGBA image through the direct Pix
+// path; BenchmarkSplitPlanes12MPGeneric runs the same image through At().
+func BenchmarkSplitPlanes12MP(b *testing.B) {
+	src := benchRGBA(4000, 3000)
+	b.SetBytes(4000 * 3000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		splitImagePlanes(src, MatrixBT601, 0)
+	}
+}
+
+func BenchmarkSplitPlanes12MPGeneric(b *testing.B) {
+	src := genericImage{benchRGBA(4000, 3000)}
+	b.SetBytes(4000 * 3000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		splitImagePlanes(src, MatrixBT601, 0)
+	}
+}
+
+// BenchmarkDownsample4K uses a 4K plane so the row split has work to divide
+func BenchmarkDownsample4K(b *testing.B) {
+	plane := benchPlane(3840, 2160)
+	b.SetBytes(3840 * 2160)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		downsamplePlane(plane, 0)
+	}
+}
+
+// benchImageStreams returns the five streams of each of three planes, as
+// written for one image
+func benchImageStreams(b *testing.B) [][]byte {
+	plane := benchPlane(benchW, benchH)
+	var streams [][]byte
+	for i := 0; i < 3; i++ {
+		a, c, m, idx, v, err := gapEncodePlane(plane, benchW, benchH, benchPlaneOptions, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		streams = append(streams, a, c, m, idx, v)
+	}
+	return streams
+}
+
+// BenchmarkStreamBlocks writes one image's stream blocks per iteration through
+// the pooled scratch buffer; BenchmarkStreamBlocksAlloc allocates per stream
+// as before, for comparing allocations.
+func BenchmarkStreamBlocks(b *testing.B) {
+	streams := benchImageStreams(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range streams {
+			if _, err := writeStreamBlock(io.Discard, s, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkStreamBlocksAlloc(b *testing.B) {
+	streams := benchImageStreams(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range streams {
+			compressed, err := GapCompressData(s)
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Discard.Write(compressed)
+		}
+	}
+}
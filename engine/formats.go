@@ -0,0 +1,31 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    _ "image/jpeg"
+    _ "image/png"
+
+    _ "golang.org/x/image/bmp"
+    _ "golang.org/x/image/tiff"
+    _ "golang.org/x/image/webp"
+)
+
+// Input formats the encoder reads. 16-bit PNGs and TIFFs take the
+// FlagHighDepth path; CMYK JPEGs decode to *image.CMYK and are converted
+// to RGB by cmykToRGB before the color matrix.
+const supportedFormats = "png, jpeg, bmp, tiff, webp"
+
+// sourceExtensions are the file extensions batch encoding picks up
+var sourceExtensions = []string{".png", ".jpg", ".jpeg", ".bmp", ".tif", ".tiff", ".webp"}
+
+// decodeSource decodes an input image, naming the supported formats when
+// the data is none of them
+func decodeSource(data []byte) (image.Image, error) {
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err == image.ErrFormat {
+        return nil, fmt.Errorf("%v (supported: %s)", err, supportedFormats)
+    }
+    return img, err
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// cmykJPEG writes img as a baseline 4-component Adobe CMYK JPEG (stored
+// inverted, as Photoshop does) with each 8x8 block flat at the ink of its
+// top-left pixel and icc, if any, in APP2. The stdlib cannot write CMYK
+// JPEGs; DC-only blocks keep this short and decode exactly.
+func cmykJPEG(img *image.CMYK, icc []byte) []byte {
+	var out bytes.Buffer
+	segment := func(marker byte, payload []byte) {
+		out.Write([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)})
+		out.Write(payload)
+	}
+	out.Write([]byte{0xFF, 0xD8})
+	segment(0xEE, []byte{'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, 0}) // Transform 0: CMYK, not YCCK
+	if icc != nil {
+		segment(0xE2, append([]byte("ICC_PROFILE\x00\x01\x01"), icc...))
+	}
+	qt := make([]byte, 65)
+	for i := 1; i < 65; i++ {
+		qt[i] = 1
+	}
+	segment(0xDB, qt)
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	sof := []byte{8, byte(h >> 8), byte(h), byte(w >> 8), byte(w), 4}
+	for c := byte(1); c <= 4; c++ {
+		sof = append(sof, c, 0x11, 0)
+	}
+	segment(0xC0, sof)
+	// The standard luminance DC table, and an AC table holding only EOB
+	dcBits := []byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}
+	dht := append([]byte{0x00}, dcBits...)
+	dht = append(dht, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+	dht = append(dht, 0x10, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	segment(0xC4, dht)
+	sos := []byte{4}
+	for c := byte(1); c <= 4; c++ {
+		sos = append(sos, c, 0x00)
+	}
+	segment(0xDA, append(sos, 0, 63, 0))
+
+	// Canonical codes of the DC table, by category
+	var dcCode [12]uint32
+	var dcLen [12]int
+	code, sym := uint32(0), 0
+	for l, n := range dcBits {
+		for ; n > 0; n-- {
+			dcCode[sym], dcLen[sym] = code, l+1
+			code++
+			sym++
+		}
+		code <<= 1
+	}
+	var acc uint32
+	nbits := 0
+	put := func(v uint32, n int) {
+		for i := n - 1; i >= 0; i-- {
+			acc = acc<<1 | v>>uint(i)&1
+			if nbits++; nbits == 8 {
+				out.WriteByte(byte(acc))
+				if acc == 0xFF {
+					out.WriteByte(0)
+				}
+				acc, nbits = 0, 0
+			}
+		}
+	}
+	var pred [4]int
+	for by := 0; by < (h+7)/8; by++ {
+		for bx := 0; bx < (w+7)/8; bx++ {
+			ink := img.Pix[img.PixOffset(bx*8, by*8):]
+			for c := 0; c < 4; c++ {
+				dc := 8 * (int(255-ink[c]) - 128)
+				diff := dc - pred[c]
+				pred[c] = dc
+				mag, cat := diff, 0
+				if mag < 0 {
+					mag = -mag
+				}
+				for ; mag > 0; mag >>= 1 {
+					cat++
+				}
+				put(dcCode[cat], dcLen[cat])
+				if diff < 0 {
+					diff += 1<<cat - 1
+				}
+				put(uint32(diff), cat)
+				put(0, 1) // EOB
+			}
+		}
+	}
+	if nbits > 0 {
+		put(0x7F, 8-nbits)
+	}
+	out.Write([]byte{0xFF, 0xD9})
+	return out.Bytes()
+}
+
+// TestCMYK encodes a CMYK JPEG of flat color patches, tagged with a
+// CMYK ICC profile, and expects each patch to decode close to the RGB
+// its inks give and the profile to be left out of the file
+func TestCMYK(t *testing.T) {
+	const w, h = 64, 48
+	src := image.NewCMYK(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// Ink levels change per block and run from none to full
+			b := (y/8)*(w/8) + x/8
+			src.SetCMYK(x, y, color.CMYK{C: uint8(b * 37 % 256), M: uint8(b * 91 % 256), Y: uint8(b * 53 % 256), K: uint8(b * 29 % 200)})
+		}
+	}
+	icc := make([]byte, 132)
+	binary.BigEndian.PutUint32(icc, 132)
+	copy(icc[16:], "CMYK")
+	copy(icc[36:], "acsp")
+	data := cmykJPEG(src, icc)
+
+	decoded, err := decodeSource(data)
+	if err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+	if _, ok := decoded.(*image.CMYK); !ok {
+		t.Fatalf("fixture decodes to %T", decoded)
+	}
+	if !bytes.Equal(decoded.(*image.CMYK).Pix, src.Pix) {
+		t.Fatalf("fixture does not decode to its inks")
+	}
+
+	var gapBuf bytes.Buffer
+	if err := Encode(bytes.NewReader(data), &gapBuf, EncodeOptions{S: 0.05, Threshold: 0.2}); err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(gapBuf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findChunk(header.Chunks, ChunkICC) != nil {
+		t.Fatalf("the CMYK ICC profile was kept")
+	}
+	got, err := DecodeImageTo(bytes.NewReader(gapBuf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block interiors, away from the seams the filters smooth
+	worst := 0
+	for y := 2; y < h; y += 8 {
+		for x := 2; x < w; x += 8 {
+			ink := src.CMYKAt(x, y)
+			r, g, b := color.CMYKToRGB(ink.C, ink.M, ink.Y, ink.K)
+			gr, gg, gb, _ := got.At(x+2, y+2).RGBA()
+			for _, d := range []int{int(gr>>8) - int(r), int(gg>>8) - int(g), int(gb>>8) - int(b)} {
+				worst = max(worst, d, -d)
+			}
+		}
+	}
+	if worst > 12 {
+		t.Fatalf("a patch decodes %d levels from the RGB of its inks", worst)
+	}
+}
+
+//go:embed testdata/gopher.lossless.webp
+var webpFixture []byte
+
+// TestInputFormats encodes a BMP, an 8-bit and a 16-bit TIFF, a WebP
+// fixture and a CMYK image, expecting each to decode close to its source
+// (and the 16-bit TIFF to keep FlagHighDepth), and checks that an unknown
+// format's error lists the supported ones. The WebP is black-and-white line
+// art, so it is coded losslessly.
+func TestInputFormats(t *testing.T) {
+	wheel := colorWheel(64, 48)
+	deep := image.NewRGBA64(wheel.Bounds())
+	cmyk := image.NewCMYK(wheel.Bounds())
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			c := wheel.RGBAAt(x, y)
+			deep.Set(x, y, c)
+			cc, m, yy, k := color.RGBToCMYK(c.R, c.G, c.B)
+			cmyk.SetCMYK(x, y, color.CMYK{C: cc, M: m, Y: yy, K: k})
+		}
+	}
+
+	type input struct {
+		name     string
+		data     []byte
+		lossless bool
+	}
+	var inputs []input
+	for _, in := range []struct {
+		name   string
+		encode func(io.Writer) error
+	}{
+		{"bmp", func(w io.Writer) error { return bmp.Encode(w, wheel) }},
+		{"tiff", func(w io.Writer) error { return tiff.Encode(w, wheel, nil) }},
+		{"tiff16", func(w io.Writer) error { return tiff.Encode(w, deep, nil) }},
+	} {
+		var buf bytes.Buffer
+		if err := in.encode(&buf); err != nil {
+			t.Fatalf("%s: %v", in.name, err)
+		}
+		inputs = append(inputs, input{in.name, buf.Bytes(), false})
+	}
+	inputs = append(inputs, input{"webp", webpFixture, true})
+
+	opts := EncodeOptions{S: 0.05, Threshold: 0.2}
+	for _, in := range inputs {
+		opts := opts
+		opts.Lossless = in.lossless
+		src, err := decodeSource(in.data)
+		if err != nil {
+			t.Fatalf("%s: %v", in.name, err)
+		}
+		var gapBuf bytes.Buffer
+		if err := Encode(bytes.NewReader(in.data), &gapBuf, opts); err != nil {
+			t.Fatalf("%s: %v", in.name, err)
+		}
+		header, err := readHeader(bytes.NewReader(gapBuf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", in.name, err)
+		}
+		if (header.Flags&FlagHighDepth != 0) != (in.name == "tiff16") {
+			t.Fatalf("%s: FlagHighDepth is %v", in.name, header.Flags&FlagHighDepth != 0)
+		}
+		decoded, err := DecodeImageTo(bytes.NewReader(gapBuf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", in.name, err)
+		}
+		if psnr := PSNR(src, decoded); psnr < 30 {
+			t.Fatalf("%s: PSNR %.2f dB", in.name, psnr)
+		}
+	}
+
+	_, decoded := roundTrip(t, cmyk, opts)
+	if psnr := PSNR(cmyk, decoded); psnr < 30 {
+		t.Fatalf("PSNR %.2f dB", psnr)
+	}
+
+	err := Encode(bytes.NewReader([]byte("not an image")), io.Discard, opts)
+	if err == nil || !strings.Contains(err.Error(), supportedFormats) {
+		t.Fatalf("unknown format error %q does not list the supported formats", err)
+	}
+}
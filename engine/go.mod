@@ -1,3 +1,10 @@
 module gap-engine
 
 go 1.25.5
+
+require (
+	github.com/tetratelabs/wazero v1.12.0
+	golang.org/x/image v0.25.0
+)
+
+require golang.org/x/sys v0.44.0 // indirect
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "math"
+    "sync"
+)
+
+// ChunkGrain holds one float32 grain sigma (in 8-bit levels) per plane
+// when FlagGrain is set.
+var ChunkGrain = [4]byte{'G', 'R', 'A', 'N'}
+
+// GrainAuto asks the encoder to estimate the grain strength per plane
+const GrainAuto = -1
+
+// estimateGrain measures the noise the encoder removed from a plane: the
+// standard deviation of the high-pass part (residual minus its 3x3 local
+// mean) of original - reconstruction, so smooth coding error that
+// deblocking already hides is not counted as grain.
+func estimateGrain(orig, recon *image.Gray) float32 {
+    b := orig.Bounds()
+    w, h := b.Dx(), b.Dy()
+    if w < 3 || h < 3 { return 0 }
+
+    diff := make([]float32, w*h)
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            diff[y*w+x] = float32(orig.Pix[y*orig.Stride+x]) - float32(recon.Pix[y*recon.Stride+x])
+        }
+    }
+
+    var sumSq float64
+    n := 0
+    for y := 1; y < h-1; y++ {
+        for x := 1; x < w-1; x++ {
+            var local float32
+            for dy := -1; dy <= 1; dy++ {
+                for dx := -1; dx <= 1; dx++ {
+                    local += diff[(y+dy)*w+x+dx]
+                }
+            }
+            hp := float64(diff[y*w+x] - local/9)
+            sumSq += hp * hp
+            n++
+        }
+    }
+    return float32(math.Sqrt(sumSq / float64(n)))
+}
+
+// encodeGrain serializes the per-plane sigmas for ChunkGrain
+func encodeGrain(sigmas []float32) []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.LittleEndian, sigmas)
+    return buf.Bytes()
+}
+
+// decodeGrain parses ChunkGrain for the given number of planes
+func decodeGrain(data []byte, planes int) ([]float32, error) {
+    if len(data) != planes*4 {
+        return nil, fmt.Errorf("grain chunk is %d bytes, want %d", len(data), planes*4)
+    }
+    sigmas := make([]float32, planes)
+    binary.Read(bytes.NewReader(data), binary.LittleEndian, sigmas)
+    for i, s := range sigmas {
+        if !(s >= 0) || s > 64 {
+            return nil, fmt.Errorf("plane %d grain sigma %g out of range", i, s)
+        }
+    }
+    return sigmas, nil
+}
+
+// grainRNG is a small xorshift generator; the decoder seeds one per 8x8
+// patch from its coordinates so grain is reproducible and independent of
+// how the work is split across goroutines.
+type grainRNG uint64
+
+func newGrainRNG(bx, by, plane int) grainRNG {
+    // splitmix64 of the patch coordinates
+    z := uint64(bx)*0x9E3779B97F4A7C15 ^ uint64(by)*0xBF58476D1CE4E5B9 ^ uint64(plane+1)*0x94D049BB133111EB
+    z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+    z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+    z ^= z >> 31
+    if z == 0 { z = 1 }
+    return grainRNG(z)
+}
+
+func (r *grainRNG) next() uint64 {
+    x := uint64(*r)
+    x ^= x << 13
+    x ^= x >> 7
+    x ^= x << 17
+    *r = grainRNG(x)
+    return x
+}
+
+// gaussian returns a standard normal sample (Box-Muller)
+func (r *grainRNG) gaussian() float32 {
+    u1 := (float64(r.next()>>11) + 1) / (1 << 53)
+    u2 := float64(r.next()>>11) / (1 << 53)
+    return float32(math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2))
+}
+
+// applyGrain adds Gaussian grain of the given per-plane sigma to img,
+// converting the plane-domain noise to RGB through the color matrix.
+// The noise is seeded by absolute block position, so a crop whose bounds
+// start on the block grid gets the grain of the whole image.
+func applyGrain(img *image.RGBA, sigmas []float32, m ColorMatrix, workers int) {
+    b := img.Bounds()
+    w, h := b.Dx(), b.Dy()
+    blocksH := (h + 7) / 8
+
+    numWorkers := workerCount(workers)
+    var wg sync.WaitGroup
+    rows := make(chan int, blocksH)
+    for by := 0; by < blocksH; by++ { rows <- by }
+    close(rows)
+
+    for wk := 0; wk < numWorkers; wk++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            var noise [3][64]float32
+            for by := range rows {
+                for bx := 0; bx*8 < w; bx++ {
+                    for p, sigma := range sigmas {
+                        if sigma == 0 { continue }
+                        rng := newGrainRNG(b.Min.X/8+bx, b.Min.Y/8+by, p)
+                        for i := range noise[p] {
+                            noise[p][i] = rng.gaussian() * sigma
+                        }
+                    }
+                    for py := 0; py < 8 && by*8+py < h; py++ {
+                        for px := 0; px < 8 && bx*8+px < w; px++ {
+                            i := py*8 + px
+                            var d [3]float32
+                            for p := range sigmas {
+                                if sigmas[p] != 0 { d[p] = noise[p][i] }
+                            }
+                            dr, dg, db := planeDeltaToRGB(m, d[0], d[1], d[2])
+                            off := img.PixOffset(b.Min.X+bx*8+px, b.Min.Y+by*8+py)
+                            img.Pix[off] = clampToByte(float32(img.Pix[off]) + dr)
+                            img.Pix[off+1] = clampToByte(float32(img.Pix[off+1]) + dg)
+                            img.Pix[off+2] = clampToByte(float32(img.Pix[off+2]) + db)
+                        }
+                    }
+                }
+            }
+        }()
+    }
+    wg.Wait()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "sync"
+    "time"
+)
+
+// DecodeGray decodes only the luma of a .gap stream. The chroma streams
+// are read past without being decompressed, nothing is upsampled or
+// converted to RGB, and the post-filters run on the single plane. The
+// result is upright like DecodeImageTo's and 8-bit even for FlagHighDepth
+// files. The lossless residual corrects RGB, so lossless files decode
+// like lossy ones.
+func DecodeGray(r io.Reader, opts DecodeOptions) (*image.Gray, error) {
+    opts.Gray = true
+    img, _, err := decodeImageTo(r, opts)
+    if err != nil {
+        return nil, err
+    }
+    return img.(*image.Gray), nil
+}
+
+// peekGrayFile reports whether the .gap stream buffered in br holds a
+// single plane that decodeGray reproduces in full. The lossless residual
+// corrects RGB, so lossless files still decode through decodeGap.
+func peekGrayFile(br *bufio.Reader) bool {
+    h, ok := peekHeader(br)
+    return ok && h.Channels <= 1 && h.Flags&FlagLossless == 0
+}
+
+// isGraySource reports whether img has a single channel, which the
+// encoder codes as a one-plane file
+func isGraySource(img image.Image) bool {
+    switch img.(type) {
+    case *image.Gray, *image.Gray16:
+        return true
+    }
+    return false
+}
+
+// decodeGray is decodeGap for plane 0 alone, without the EXIF orientation
+func decodeGray(file io.Reader, opts DecodeOptions) (*image.Gray, *gapFileHeader, error) {
+    stats := opts.Stats
+    if stats == nil { stats = &DecodeStats{} }
+    start := time.Now()
+    header, err := readHeader(file)
+    if err != nil {
+        return nil, nil, err
+    }
+    stats.add(&stats.HeaderRead, start)
+    if header.Flags&FlagFrames != 0 {
+        return nil, nil, fmt.Errorf("file holds %d frames; use decode-seq", len(header.Frames))
+    }
+    if len(header.Planes) == 1 {
+        logInfof("Image: %dx%d, 1 ch, gray", header.Width, header.Height)
+    } else {
+        logInfof("Image: %dx%d, luma only", header.Width, header.Height)
+    }
+
+    switch opts.Scale {
+    case 0, 1:
+    case 2, 4:
+        if opts.Crop != (image.Rectangle{}) {
+            return nil, nil, fmt.Errorf("cannot crop a scaled decode")
+        }
+        opts.Dither = false
+    default:
+        return nil, nil, fmt.Errorf("scale must be 1, 2 or 4, got %d", opts.Scale)
+    }
+    opts.lossyOnly, opts.lumaOnly = true, true
+    opts.interiorEdges = header.Flags&FlagLossless != 0
+    if opts.Deblock == nil { opts.Deblock = fileDeblock(header) }
+
+    full := image.Rect(0, 0, int(header.Width), int(header.Height))
+    crop := full
+    if opts.Crop != (image.Rectangle{}) {
+        if crop, err = storedCrop(header, opts.Crop, opts.NoAutoRotate); err != nil {
+            return nil, nil, err
+        }
+        opts.region = cropRegion(crop).Intersect(full)
+    }
+
+    planes, _, _, err := decodePlanes(file, header, opts, stats)
+    if err != nil {
+        return nil, nil, err
+    }
+    img := planes[0]
+    if opts.region.Empty() {
+        crop = img.Bounds() // Already reduced by a scaled decode
+    } else {
+        img = copyPlane(img, opts.region)
+        crop = crop.Sub(opts.region.Min)
+    }
+
+    if opts.Dither {
+        // As in decodeGap, only filter changes beyond one level carry over
+        filtered := image.NewGray(img.Bounds())
+        copy(filtered.Pix, img.Pix)
+        applyGrayPostFilters(filtered, opts, stats)
+        for i, f := range filtered.Pix {
+            if d := int(f) - int(img.Pix[i]); d < -1 || d > 1 {
+                img.Pix[i] = f
+            }
+        }
+    } else {
+        applyGrayPostFilters(img, opts, stats)
+    }
+    return cropImage(img, crop).(*image.Gray), header, nil
+}
+
+// applyGrayPostFilters is applyPostFilters for a single plane. Each
+// filter gives what its RGB version gives on an image with R = G = B.
+func applyGrayPostFilters(img *image.Gray, opts DecodeOptions, stats *DecodeStats) {
+    scale := max(opts.Scale, 1)
+    if !opts.SkipDeblock && 8/scale >= 4 {
+        start := time.Now()
+        deblock := DeblockNormal
+        if opts.Deblock != nil { deblock = *opts.Deblock }
+        deblockGray(img, deblock, !opts.interiorEdges, 8/scale, opts.Workers)
+        stats.add(&stats.Deblock, start)
+    }
+    if !opts.SkipAntialias {
+        start := time.Now()
+        impulse := opts.ImpulseThreshold
+        if impulse == 0 { impulse = DefaultImpulseThreshold }
+        if opts.SkipDespeckle { impulse = 0 }
+        antialiasGray(img, impulse, opts.Workers)
+        stats.add(&stats.Antialias, start)
+    }
+    if !opts.SkipLineContinuity {
+        start := time.Now()
+        seam := SeamFilterStrong
+        if opts.SeamFilter != nil { seam = *opts.SeamFilter }
+        seamFilterGray(img, seam.scaled(scale), 8/scale, opts.Workers)
+        stats.add(&stats.LineContinuity, start)
+    }
+}
+
+// grayRows splits rows [lo, hi) among the workers
+func grayRows(lo, hi, workers int, fn func(y0, y1 int)) {
+    numWorkers := workerCount(workers)
+    rowsPerWorker := (hi - lo + numWorkers - 1) / numWorkers
+    var wg sync.WaitGroup
+    for y0 := lo; y0 < hi; y0 += rowsPerWorker {
+        wg.Add(1)
+        go func(y0, y1 int) {
+            defer wg.Done()
+            fn(y0, y1)
+        }(y0, min(y0+rowsPerWorker, hi))
+    }
+    wg.Wait()
+}
+
+// deblockGray is deblockImage on one plane
+func deblockGray(img *image.Gray, p DeblockParams, borderEdges bool, block, workers int) {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    Beta, NormThreshold, HighThreshold := p.Beta, p.NormThreshold, p.HighThreshold
+    abs := func(x int) int { if x < 0 { return -x }; return x }
+    pix := img.Pix
+
+    // filter smooths the seam between p1 and q0, given their offsets and
+    // those of the pixels beyond them
+    filter := func(p2, p1, q0, q1 int) {
+        threshold := NormThreshold
+        if abs(int(pix[p2])-int(pix[p1])) < Beta && abs(int(pix[q0])-int(pix[q1])) < Beta {
+            threshold = HighThreshold
+        }
+        if abs(int(pix[p1])-int(pix[q0])) < threshold {
+            v1 := (int(pix[p2]) + 2*int(pix[p1]) + int(pix[q0]) + 2) / 4
+            v0 := (int(pix[p1]) + 2*int(pix[q0]) + int(pix[q1]) + 2) / 4
+            pix[p1], pix[q0] = uint8(v1), uint8(v0)
+        }
+    }
+
+    maxX, maxY := w-1, h-1 // q1 of a one-pixel border block
+    lastX, lastY := w, h
+    if !borderEdges { lastX, lastY = maxX, maxY }
+
+    // Vertical edges, then horizontal ones; seams are at least 4 pixels
+    // apart, so no pixel is touched by two of them
+    grayRows(0, h, workers, func(y0, y1 int) {
+        for y := y0; y < y1; y++ {
+            row := img.PixOffset(0, y)
+            for x := block; x < lastX; x += block {
+                filter(row+x-2, row+x-1, row+x, row+min(x+1, maxX))
+            }
+        }
+    })
+    var edges []int
+    for y := block; y < lastY; y += block {
+        edges = append(edges, y)
+    }
+    grayRows(0, len(edges), workers, func(e0, e1 int) {
+        for _, y := range edges[e0:e1] {
+            p2, p1, q0, q1 := img.PixOffset(0, y-2), img.PixOffset(0, y-1), img.PixOffset(0, y), img.PixOffset(0, min(y+1, maxY))
+            for x := 0; x < w; x++ {
+                filter(p2+x, p1+x, q0+x, q1+x)
+            }
+        }
+    })
+}
+
+// antialiasGray is applyEdgeAntialiasing on one plane
+func antialiasGray(img *image.Gray, impulseThreshold, workers int) {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    out := image.NewGray(img.Rect)
+    copy(out.Pix, img.Pix)
+
+    const EdgeThreshold = 30
+    abs := func(x int) int { if x < 0 { return -x }; return x }
+    at := func(x, y int) int { return int(img.Pix[img.PixOffset(x, y)]) }
+
+    grayRows(1, h-1, workers, func(y0, y1 int) {
+        for y := y0; y < y1; y++ {
+            for x := 1; x < w-1; x++ {
+                p := at(x, y)
+
+                // Despeckle: replace a dot unlike all 8 neighbors by their average
+                isDot := impulseThreshold > 0
+                sum := 0
+                for dy := -1; dy <= 1; dy++ {
+                    for dx := -1; dx <= 1; dx++ {
+                        if dx == 0 && dy == 0 { continue }
+                        n := at(x+dx, y+dy)
+                        if abs(p-n) < impulseThreshold { isDot = false }
+                        sum += n
+                    }
+                }
+                idx := out.PixOffset(x, y)
+                if isDot {
+                    out.Pix[idx] = uint8(sum / 8)
+                    continue
+                }
+
+                // Smooth along edges found by Sobel, not across them
+                gx := -at(x-1, y-1) + at(x+1, y-1) - 2*at(x-1, y) + 2*at(x+1, y) - at(x-1, y+1) + at(x+1, y+1)
+                gy := -at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1) + at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1)
+                if int(math.Sqrt(float64(gx*gx+gy*gy))) > EdgeThreshold {
+                    if abs(gx) > abs(gy) {
+                        out.Pix[idx] = uint8((2*p + at(x, y-1) + at(x, y+1)) / 4)
+                    } else {
+                        out.Pix[idx] = uint8((2*p + at(x-1, y) + at(x+1, y)) / 4)
+                    }
+                }
+            }
+        }
+    })
+    copy(img.Pix, out.Pix)
+}
+
+// seamFilterGray is applyLineContinuityFilter on one plane. The color
+// distance is that of a gray RGB pixel, sqrt(3) times the level difference.
+func seamFilterGray(img *image.Gray, p SeamFilterParams, block, workers int) {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    if p.Passes <= 0 || p.SeamRadius <= 0 { return }
+
+    r := p.FilterRadius
+    spatialWeights := make([]float64, (2*r+1)*(2*r+1))
+    for dy := -r; dy <= r; dy++ {
+        for dx := -r; dx <= r; dx++ {
+            dist := math.Sqrt(float64(dx*dx + dy*dy))
+            spatialWeights[(dy+r)*(2*r+1)+(dx+r)] = math.Exp(-dist * dist / (2 * p.SigmaSpace * p.SigmaSpace))
+        }
+    }
+
+    for pass := 0; pass < p.Passes; pass++ {
+        out := image.NewGray(img.Rect)
+        copy(out.Pix, img.Pix)
+        grayRows(0, h, workers, func(y0, y1 int) {
+            for y := y0; y < y1; y++ {
+                for x := 0; x < w; x++ {
+                    if !isNearSeam(x, w, p.SeamRadius, block) && !isNearSeam(y, h, p.SeamRadius, block) { continue }
+                    v := float64(img.Pix[img.PixOffset(x, y)])
+                    var sum, wSum float64
+                    for dy := -r; dy <= r; dy++ {
+                        ny := y + dy
+                        if ny < 0 || ny >= h { continue }
+                        for dx := -r; dx <= r; dx++ {
+                            nx := x + dx
+                            if nx < 0 || nx >= w { continue }
+                            n := float64(img.Pix[img.PixOffset(nx, ny)])
+                            colorDist := math.Sqrt(3 * (v - n) * (v - n))
+                            weight := spatialWeights[(dy+r)*(2*r+1)+(dx+r)] * math.Exp(-colorDist*colorDist/(2*p.SigmaColor*p.SigmaColor))
+                            sum += n * weight
+                            wSum += weight
+                        }
+                    }
+                    if wSum > 0 {
+                        out.Pix[out.PixOffset(x, y)] = uint8(sum / wSum)
+                    }
+                }
+            }
+        })
+        copy(img.Pix, out.Pix)
+    }
+}
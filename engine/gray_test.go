@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// TestGrayDecode decodes luma alone from files of each stream layout
+// and compares it with the Y of an unfiltered full decode, which differs
+// only by the rounding of the RGB round trip. Filtered, a gray decode
+// must equal the RGB filters run on its unfiltered luma as R = G = B, and
+// a cropped or scaled one the same part of a full gray decode.
+func TestGrayDecode(t *testing.T) {
+	const w, h = 101, 67
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := func(c int) uint8 { return uint8(128 + 50*math.Sin(float64(x*(c+1)+y*(3-c))*0.07)) }
+			src.SetRGBA(x, y, color.RGBA{v(0), v(1), v(2), 255})
+		}
+	}
+	raw := DecodeOptions{SkipDeblock: true, SkipAntialias: true, SkipLineContinuity: true}
+	for _, c := range []struct {
+		name string
+		opts EncodeOptions
+	}{
+		{"range", EncodeOptions{S: 0.1, Threshold: 0.5}},
+		{"stored", EncodeOptions{S: 0.1, Threshold: 0.5, Compress: CompressNone}},
+		{"gzip", EncodeOptions{S: 0.1, Threshold: 0.5, Compress: CompressGzip}},
+		{"cfl", EncodeOptions{S: 0.1, Threshold: 0.5, CfL: true}},
+		{"lossless", EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: true}},
+	} {
+		data, err := encodeGap(src, nil, c.opts, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		fullOpts := raw
+		fullOpts.lossyOnly = true
+		full, header, err := decodeGap(bytes.NewReader(data), fullOpts)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		gray, err := DecodeGray(bytes.NewReader(data), raw)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if gray.Bounds() != full.Bounds() {
+			t.Fatalf("%s: decoded %v, want %v", c.name, gray.Bounds(), full.Bounds())
+		}
+		m := matrixFromFlags(header.Flags)
+		for i, v := range gray.Pix {
+			p := full.Pix[i*4:]
+			y, _, _ := rgbToPlanes(m, p[0], p[1], p[2])
+			if d := int(v) - int(y); d < -2 || d > 2 {
+				t.Fatalf("%s: pixel %d is %d, the full decode's Y %d", c.name, i, v, y)
+			}
+		}
+
+		rgb := image.NewRGBA(gray.Bounds())
+		for i, v := range gray.Pix {
+			rgb.Pix[i*4], rgb.Pix[i*4+1], rgb.Pix[i*4+2], rgb.Pix[i*4+3] = v, v, v, 255
+		}
+		applyPostFilters(rgb, DecodeOptions{interiorEdges: c.opts.Lossless}, &DecodeStats{})
+		filtered, err := DecodeGray(bytes.NewReader(data), DecodeOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		for i, v := range filtered.Pix {
+			if v != rgb.Pix[i*4] {
+				t.Fatalf("%s: filtered pixel %d is %d, the RGB filters give %d", c.name, i, v, rgb.Pix[i*4])
+			}
+		}
+
+		rect := image.Rect(37, 21, 70, 50)
+		cropped, err := DecodeGray(bytes.NewReader(data), DecodeOptions{Crop: rect})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if want := cropImage(filtered, rect); !bytes.Equal(cropped.Pix, want.(*image.Gray).Pix) {
+			t.Fatalf("%s: crop %v differs from the full gray decode", c.name, rect)
+		}
+		small, err := DecodeGray(bytes.NewReader(data), DecodeOptions{Scale: 2})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if want := image.Rect(0, 0, (w+1)/2, (h+1)/2); small.Bounds() != want {
+			t.Fatalf("%s: 1/2 decoded %v, want %v", c.name, small.Bounds(), want)
+		}
+	}
+}
+
+// TestGrayFile decodes a single-plane file: it must come back as an
+// *image.Gray equal to the R of the RGB path, filters included, and be
+// written as an 8-bit grayscale PNG
+func TestGrayFile(t *testing.T) {
+	data, err := legacyGzipGap(benchRGBA(101, 67), 0.1, 0.5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := DecodeImageTo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("decoded to %T, want *image.Gray", img)
+	}
+	rgb, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range gray.Pix {
+		if p := rgb.Pix[i*4:]; v != p[0] || v != p[1] || v != p[2] {
+			t.Fatalf("pixel %d is %d, the RGB path gives %v", i, v, p[:3])
+		}
+	}
+	raw, _, err := decodeImageTo(bytes.NewReader(data), DecodeOptions{SkipDeblock: true, SkipAntialias: true, SkipLineContinuity: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(raw.(*image.Gray).Pix, gray.Pix) {
+		t.Fatalf("the filters left the plane untouched")
+	}
+
+	var out bytes.Buffer
+	if err := Decode(bytes.NewReader(data), &out, DecodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// IHDR follows the 8-byte signature and its own length and type
+	if ihdr := out.Bytes()[16:29]; ihdr[8] != 8 || ihdr[9] != 0 {
+		t.Fatalf("PNG bit depth %d, color type %d, want 8-bit grayscale", ihdr[8], ihdr[9])
+	}
+	decoded, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := decoded.(*image.Gray); !ok || !bytes.Equal(g.Pix, gray.Pix) {
+		t.Fatalf("the PNG holds other pixels")
+	}
+}
+
+// TestGrayEncode encodes an *image.Gray: the file must hold a single
+// plane, be smaller than the same pixels coded as RGB and decode to an
+// *image.Gray as close to the source. Low-memory coding gives the same
+// bytes, and a lossless file comes back exact.
+func TestGrayEncode(t *testing.T) {
+	const w, h = 101, 67
+	src := benchPlane(w, h)
+	opts := EncodeOptions{S: 0.1, Threshold: 0.5}
+	data, err := encodeGap(src, nil, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Channels != 1 || len(header.Planes) != 1 {
+		t.Fatalf("header has %d channels and %d plane entries, want 1", header.Channels, len(header.Planes))
+	}
+	rgbSrc := benchRGBA(w, h)
+	rgbData, err := encodeGap(rgbSrc, nil, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(rgbData) {
+		t.Fatalf("gray file is %d bytes, the RGB one %d", len(data), len(rgbData))
+	}
+
+	img, _, err := decodeImageTo(bytes.NewReader(data), DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("decoded to %T, want *image.Gray", img)
+	}
+	if gray.Bounds() != src.Bounds() {
+		t.Fatalf("decoded %v, want %v", gray.Bounds(), src.Bounds())
+	}
+	rgb, _, err := decodeGap(bytes.NewReader(rgbData), DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := PSNR(gray, src), PSNR(rgb, rgbSrc); got < want-0.5 {
+		t.Fatalf("gray decode is %.2f dB, the RGB one %.2f dB", got, want)
+	}
+
+	lowMem := opts
+	lowMem.LowMem = true
+	banded, err := encodeGap(src, nil, lowMem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(banded, data) {
+		t.Fatalf("low-memory coding changed the file")
+	}
+
+	lossless := opts
+	lossless.Lossless = true
+	data, err = encodeGap(src, nil, lossless, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exact, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range src.Pix {
+		if p := exact.Pix[i*4:]; p[0] != v || p[1] != v || p[2] != v {
+			t.Fatalf("lossless pixel %d is %v, want %d", i, p[:3], v)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// Logger receives the codec's status lines: what a file turned out to
+// hold, per-plane sizes, notes on the choices made, and warnings about
+// output that is not what was asked for. Lines carry no trailing newline.
+type Logger interface {
+    Infof(format string, args ...any)
+    Warnf(format string, args ...any)
+}
+
+// NewLogger writes each line to w, warnings prefixed "Warning: ". A quiet
+// logger drops everything but the warnings.
+func NewLogger(w io.Writer, quiet bool) Logger {
+    return &writerLogger{w: w, quiet: quiet}
+}
+
+type writerLogger struct {
+    mu    sync.Mutex // Parallel stages and batch jobs log concurrently
+    w     io.Writer
+    quiet bool
+}
+
+func (l *writerLogger) Infof(format string, args ...any) {
+    if !l.quiet { l.printf("", format, args) }
+}
+
+func (l *writerLogger) Warnf(format string, args ...any) { l.printf("Warning: ", format, args) }
+
+func (l *writerLogger) printf(prefix, format string, args []any) {
+    line := prefix + strings.TrimSuffix(fmt.Sprintf(format, args...), "\n") + "\n"
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    io.WriteString(l.w, line)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(string, ...any) {}
+func (nopLogger) Warnf(string, ...any) {}
+
+// loggerBox lets atomic.Pointer hold an interface
+type loggerBox struct{ Logger }
+
+var logger atomic.Pointer[loggerBox]
+
+func init() { SetLogger(NewLogger(os.Stderr, false)) }
+
+// SetLogger routes the status lines of every later encode and decode to
+// l, nil silencing them, and returns the logger it replaces. The default
+// logs everything to stderr.
+func SetLogger(l Logger) Logger {
+    if l == nil { l = nopLogger{} }
+    if old := logger.Swap(&loggerBox{l}); old != nil {
+        return old.Logger
+    }
+    return nil
+}
+
+func logInfof(format string, args ...any) { logger.Load().Infof(format, args...) }
+func logWarnf(format string, args ...any) { logger.Load().Warnf(format, args...) }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordLogger keeps the lines logged to it
+type recordLogger struct {
+	mu         sync.Mutex
+	info, warn []string
+}
+
+func (l *recordLogger) Infof(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.info = append(l.info, fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Warnf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warn = append(l.warn, fmt.Sprintf(format, args...))
+}
+
+// TestLogger routes an encode and decode through a recording logger,
+// expecting info lines and no warnings, then a best-effort decode of a
+// truncated file, expecting its warning. A quiet NewLogger writes only
+// that warning.
+func TestLogger(t *testing.T) {
+	rec := &recordLogger{}
+	defer SetLogger(SetLogger(rec))
+	data, err := encodeGap(benchRGBA(48, 32), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.info) == 0 || len(rec.warn) != 0 {
+		t.Fatalf("encode and decode logged %d info lines and warnings %q", len(rec.info), rec.warn)
+	}
+	cut := data[:len(data)/2]
+	if _, _, err := decodeGap(bytes.NewReader(cut), DecodeOptions{BestEffort: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.warn) != 1 || !strings.HasPrefix(rec.warn[0], "file is truncated") {
+		t.Fatalf("a truncated decode warned %q", rec.warn)
+	}
+
+	var buf bytes.Buffer
+	SetLogger(NewLogger(&buf, true))
+	if _, _, err := decodeGap(bytes.NewReader(cut), DecodeOptions{BestEffort: true}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], "Warning: file is truncated") {
+		t.Fatalf("a quiet logger wrote %q", buf.String())
+	}
+}
@@ -1,26 +1,89 @@
 package main
 
 import (
+    "bytes"
+    "cmp"
+    "encoding/json"
+    "errors"
     "flag"
     "fmt"
+    "image"
+    "io"
     "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
 )
 
 func main() {
-    if len(os.Args) < 2 {
+    profile, args, err := parseProfileArg(os.Args[1:])
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    if len(args) < 1 {
         printUsage()
         os.Exit(1)
     }
 
-    command := os.Args[1]
+    command := args[0]
+    removeTempsOnInterrupt()
+    if os.Getenv(deterministicEnv) == "1" {
+        deterministic.Store(true)
+        runtime.GOMAXPROCS(1)
+    }
+    // workerCount reads the variable itself; a bad value is an error here
+    if v := os.Getenv(threadsEnv); v != "" && envThreads() == 0 {
+        fmt.Fprintf(os.Stderr, "Error: %s must be a positive integer, got %q\n", threadsEnv, v)
+        os.Exit(1)
+    }
+    
+    // Profiles cover commands that return normally; error exits skip them
+    if profile != "" {
+        stop, err := startProfile(profile)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+            os.Exit(1)
+        }
+        defer func() {
+            if err := stop(); err != nil {
+                fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+                os.Exit(1)
+            }
+        }()
+    }
     
     switch command {
     case "encode":
-        runEncode(os.Args[2:])
+        runEncode(args[1:])
     case "decode":
-        runDecode(os.Args[2:])
-    case "test":
-        runSanityCheck()
+        runDecode(args[1:])
+    case "encode-batch":
+        runEncodeBatch(args[1:])
+    case "encode-seq":
+        runEncodeSeq(args[1:])
+    case "decode-seq":
+        runDecodeSeq(args[1:])
+    case "info":
+        runInfo(args[1:])
+    case "check":
+        runCheck(args[1:])
+    case "pack":
+        runPack(args[1:])
+    case "unpack":
+        runUnpack(args[1:])
+    case "transcode":
+        runTranscode(args[1:])
+    case "requantize":
+        runRequantize(args[1:])
+    case "thumbnail":
+        runThumbnail(args[1:])
+    case "compare":
+        runCompare(args[1:])
+    case "verify":
+        runVerify(args[1:])
     default:
         fmt.Printf("Unknown command: %s\n", command)
         printUsage()
@@ -31,71 +94,958 @@ func main() {
 func printUsage() {
     fmt.Println("GAP Engine CLI v1.1")
     fmt.Println("Usage:")
-    fmt.Println("  gap-engine encode -i input.jpg -o output.gap [-s 0.1] [-t 0.5]")
-    fmt.Println("  gap-engine decode -i input.gap -o output.png")
+    fmt.Println("  gap-engine encode -i input.png|jpg|bmp|tif|webp -o output.gap [-s 0.1] [-t 0.5] [-cs 0.04] [-ct 0.22] [-matrix 601|709|rgb] [-lossless] [-dcpred] [-runidx] [-adaptive] [-deadzone 0] [-cfl] [-chroma 420|411|mono] [-perceptual] [-skipflat] [-angledelta] [-sparse-angles] [-bits 8] [-halfmax] [-compand] [-grain off|auto|sigma] [-qtable flat|perceptual|file.json] [-lowmem] [-8bit] [-max-pixels N] [-compress range|none|gzip|interleaved] [-stream-crc] [-encrypt [-passphrase p]] [-stats|-dry-run] [-json] [-verify] [-min-psnr dB] [-threads N] [-quiet]")
+    fmt.Println("  gap-engine decode -i input.gap -o output.png|jpg|bmp|tif|ppm|pgm|y4m [-planes dir] [-strip-metadata] [-no-rotate] [-no-grain] [-8bit] [-raw | -filters deblock,aa,seam] [-seam-filter off|light|strong] [-deblock-strength off|weak|normal|strong] [-no-despeckle] [-impulse-threshold 100] [-no-verify] [-passphrase p] [-max-pixels N] [-max-memory bytes] [-dither] [-chroma-upsample nearest|bilinear|bicubic] [-crop x,y,w,h] [-scale 1/2|1/4] [-gray] [-best-effort] [-mark-lost] [-threads N] [-tile-height N] [-format png|jpeg|bmp|tiff|ppm|pgm|y4m] [-jpeg-quality 90] [-quiet] [-stats text|json|off] [-bench N]")
+    fmt.Println("  gap-engine encode|decode -i a -i b ... | -i dir [-r] [-outdir dir] [-jobs N] [flags]   (batch)")
+    fmt.Println("  gap-engine encode-batch -i 'in/*.png' [-i dir -r] [-o outdir] [-j N] [encode flags]")
+    fmt.Println("  gap-engine encode-seq -i 'frame%03d.png' -o output.gap [encode flags]")
+    fmt.Println("  gap-engine decode-seq -i input.gap -o 'frame%03d.png'|anim.gif [-frame N] [-delay 10] [decode flags]")
+    fmt.Println("  gap-engine pack -o bundle.gap [-a] [encode flags] img1.png img2.png|entry.gap ...   (multi-image container; -a appends)")
+    fmt.Println("  gap-engine unpack -i bundle.gap [-o outdir] [-entry name ...] [-list] [-gap] [decode flags]")
+    fmt.Println("  gap-engine transcode -i input.gap -o output.gap [encode flags]   (-o may be the input)")
+    fmt.Println("  gap-engine requantize -i input.gap -o output.gap [-bits 6] [-t 0.8] [-ct 0.3]   (coefficient domain, no pixel round trip)")
+    fmt.Println("  gap-engine thumbnail -i input.gap -o thumb.png [-max 256]")
+    fmt.Println("  gap-engine info -i input.gap")
+    fmt.Println("  gap-engine compare a.png|gap b.png|gap [-diff heatmap.png] [-gain 8]   (MSE, PSNR per channel, largest difference)")
+    fmt.Println("  gap-engine verify -i original.png [-tolerance N] [encode flags]   (in-memory round trip: max and mean error, worst pixel)")
+    fmt.Println("  gap-engine check -i input.gap [-passphrase p]   (per-stream status; exits 1 if anything is corrupt)")
+    fmt.Println("  Use - for -i/-o with encode and decode to read stdin / write stdout.")
+    fmt.Println("  gap-engine --profile cpu|mem[=file.prof] <command> ...   (pprof output, default cpu.prof / mem.prof)")
 }
 
 func runDecode(args []string) {
     fs := flag.NewFlagSet("decode", flag.ExitOnError)
-    inputPtr := fs.String("i", "", "Input gap file path")
-    outputPtr := fs.String("o", "", "Output png file path")
+    var inputs stringList
+    fs.Var(&inputs, "i", "Input gap file path (- for stdin); repeat or give a directory for a batch")
+    outputPtr := fs.String("o", "", "Output image path, format from the extension (- for stdout, png unless -format)")
+    planesPtr := fs.String("planes", "", "Also (or instead of -o) write the coded planes as PGMs in this directory")
+    benchPtr := fs.Int("bench", 0, "Decode the input this many times and report per-stage min/mean/max timings and throughput (-o optional, written once)")
+    decodeOpts := addDecodeFlags(fs)
+    statsPtr := addDecodeStatsFlag(fs)
+    batch := addBatchFlags(fs)
+    applyConfigFile := addConfigFlag(fs)
+    
+    fs.Parse(args)
+    if err := applyConfigFile(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    
+    batchMode := isBatch(inputs)
+    if len(inputs) == 0 || (*outputPtr == "" && *planesPtr == "" && *benchPtr == 0 && !batchMode) {
+        fmt.Fprintln(os.Stderr, "Error: -i and -o (or -planes) are required")
+        fs.PrintDefaults()
+        os.Exit(1)
+    }
+    if *benchPtr < 0 || (*benchPtr > 0 && (batchMode || *planesPtr != "")) {
+        fmt.Fprintln(os.Stderr, "Error: -bench takes a positive run count and a single input, without -planes")
+        os.Exit(1)
+    }
+    if *planesPtr != "" && (batchMode || (inputs[0] == "-" && *outputPtr != "")) {
+        fmt.Fprintln(os.Stderr, "Error: -planes takes a single input, and with stdin no -o")
+        os.Exit(1)
+    }
+    
+    opts, err := decodeOpts()
+    if err == nil {
+        opts.Stats, err = newDecodeStats(*statsPtr)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    
+    if batchMode {
+        // Per-file timings would interleave, so batches only print the summary
+        opts.Stats = nil
+        runBatchCommand(inputs, *outputPtr, batch, []string{".gap"}, opts.Format.Ext(), func(input, output string) error {
+            return DecodeImage(input, output, opts)
+        })
+        return
+    }
+    
+    if *benchPtr > 0 {
+        if err := runDecodeBench(inputs[0], *outputPtr, *benchPtr, *statsPtr, opts); err != nil {
+            fmt.Fprintf(os.Stderr, "Decoding failed: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+    if *planesPtr != "" {
+        if err := decodePlaneFiles(inputs[0], *planesPtr, opts); err != nil {
+            fmt.Fprintf(os.Stderr, "Decoding failed: %v\n", err)
+            os.Exit(1)
+        }
+        if *outputPtr == "" {
+            logInfof("Success.")
+            return
+        }
+    }
+    err = decodeStream(inputs[0], *outputPtr, opts)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Decoding failed: %v\n", err)
+        os.Exit(1)
+    }
+    
+    reportDecodeStats(*statsPtr, opts.Stats, *outputPtr == "-")
+    logInfof("Success.")
+}
+
+func runDecodeSeq(args []string) {
+    fs := flag.NewFlagSet("decode-seq", flag.ExitOnError)
+    inputPtr := fs.String("i", "", "Input gap sequence path")
+    outputPtr := fs.String("o", "", "Output PNG pattern (frame%03d.png) or animated .gif")
+    framePtr := fs.Int("frame", -1, "Decode only this frame (default all)")
+    delayPtr := fs.Int("delay", 10, "GIF frame delay in 1/100 s")
+    decodeOpts := addDecodeFlags(fs)
+    statsPtr := addDecodeStatsFlag(fs)
     
     fs.Parse(args)
     
     if *inputPtr == "" || *outputPtr == "" {
-        fmt.Println("Error: -i and -o are required")
+        fmt.Fprintln(os.Stderr, "Error: -i and -o are required")
+        fs.PrintDefaults()
+        os.Exit(1)
+    }
+    
+    opts, err := decodeOpts()
+    if err == nil {
+        opts.Stats, err = newDecodeStats(*statsPtr)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    
+    start := time.Now()
+    err = DecodeSequence(*inputPtr, *outputPtr, opts, *framePtr, *delayPtr)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Decoding failed: %v\n", err)
+        os.Exit(1)
+    }
+    opts.Stats.total(start)
+    reportDecodeStats(*statsPtr, opts.Stats, false)
+}
+
+// addDecodeStatsFlag registers -stats for decode and decode-seq
+func addDecodeStatsFlag(fs *flag.FlagSet) *string {
+    return fs.String("stats", "off", "Decode timing report: text, json or off")
+}
+
+// newDecodeStats validates the -stats format and returns the struct to
+// collect into, or nil when the report is off
+func newDecodeStats(format string) (*DecodeStats, error) {
+    switch format {
+    case "text", "json":
+        return &DecodeStats{}, nil
+    case "off":
+        return nil, nil
+    }
+    return nil, fmt.Errorf("invalid -stats %q (want text, json or off)", format)
+}
+
+// reportDecodeStats prints the timings: text on stderr with the other
+// status lines, json on stdout unless the image itself goes there
+func reportDecodeStats(format string, stats *DecodeStats, imageOnStdout bool) {
+    switch format {
+    case "text":
+        stats.WriteTable(os.Stderr)
+    case "json":
+        w := os.Stdout
+        if imageOnStdout { w = os.Stderr }
+        json.NewEncoder(w).Encode(stats)
+    }
+}
+
+// addDecodeFlags registers the flags shared by decode and decode-seq and
+// returns a function building DecodeOptions from them after parsing.
+func addDecodeFlags(fs *flag.FlagSet) func() (DecodeOptions, error) {
+    stripPtr := fs.Bool("strip-metadata", false, "Drop stored EXIF metadata from the output")
+    rawPtr := fs.Bool("raw", false, "Skip all post-processing filters")
+    noRotatePtr := fs.Bool("no-rotate", false, "Do not apply the stored EXIF orientation")
+    noGrainPtr := fs.Bool("no-grain", false, "Skip film grain synthesis")
+    filtersPtr := fs.String("filters", "", "Comma-separated filters to run: deblock,aa,seam (default all)")
+    seamPtr := fs.String("seam-filter", "strong", "Block seam smoothing: off, light or strong")
+    deblockPtr := fs.String("deblock-strength", "auto", "Deblocking: off, weak, normal, strong, or auto (strong for files coded with -t 1 or more)")
+    eightBitPtr := fs.Bool("8bit", false, "Write an 8-bit PNG even for 16-bit files")
+    noDespecklePtr := fs.Bool("no-despeckle", false, "Keep isolated single-pixel dots that antialiasing would average away")
+    noVerifyPtr := fs.Bool("no-verify", false, "Skip the CRC32 check of files that carry one")
+    impulsePtr := fs.Int("impulse-threshold", DefaultImpulseThreshold, "Despeckle pixels differing from all 8 neighbors by at least this many levels")
+    passphrasePtr := fs.String("passphrase", "", "Passphrase of encrypted files (default $GAP_PASSPHRASE, else a prompt)")
+    maxPixelsPtr := fs.Int("max-pixels", DefaultMaxPixels, "Refuse files claiming more pixels than this (negative = no limit)")
+    maxMemoryPtr := fs.Int64("max-memory", 0, "Refuse files whose decode is estimated to allocate more bytes than this (0 = no limit)")
+    ditherPtr := fs.Bool("dither", false, "Dither reconstructed samples to reduce banding in smooth gradients")
+    upsamplePtr := fs.String("chroma-upsample", "bilinear", "Chroma interpolation: nearest, bilinear or bicubic")
+    bestEffortPtr := fs.Bool("best-effort", false, "Decode what a truncated or damaged file still holds instead of failing")
+    markLostPtr := fs.Bool("mark-lost", false, "With -best-effort, paint lost patches with a checkerboard (implies -best-effort)")
+    scalePtr := fs.String("scale", "1", "Decode at reduced size: 1, 1/2 or 1/4")
+    cropPtr := fs.String("crop", "", "Decode only the region x,y,w,h (in upright pixels)")
+    grayPtr := fs.Bool("gray", false, "Decode only luma to an 8-bit grayscale PNG")
+    threadsPtr := fs.Int("threads", 0, "Most goroutines per parallel stage; 1 decodes sequentially (0 = $GAP_THREADS, else one per CPU)")
+    formatPtr := fs.String("format", "auto", "Output image format: png, jpeg, bmp, tiff, ppm, pgm, y4m, or auto (from the -o extension, else png)")
+    jpegQualityPtr := fs.Int("jpeg-quality", DefaultJPEGQuality, "Quality of JPEG output, 1-100")
+    tileHeightPtr := fs.Int("tile-height", 0, "Block rows of each plane reconstructed at a time, bounding memory on huge images (0 = automatic)")
+    quietPtr := fs.Bool("quiet", false, "Log only warnings and errors")
+    
+    return func() (DecodeOptions, error) {
+        opts := DecodeOptions{StripMetadata: *stripPtr, NoAutoRotate: *noRotatePtr, NoGrain: *noGrainPtr, EightBit: *eightBitPtr, SkipDespeckle: *noDespecklePtr, ImpulseThreshold: *impulsePtr, NoVerify: *noVerifyPtr, MaxPixels: *maxPixelsPtr, MaxMemory: *maxMemoryPtr, Dither: *ditherPtr, BestEffort: *bestEffortPtr || *markLostPtr, MarkLost: *markLostPtr, Gray: *grayPtr, Workers: *threadsPtr, TileHeight: *tileHeightPtr}
+        // Only asked for (once) when a file turns out to be encrypted
+        opts.Passphrase = cmp.Or(*passphrasePtr, os.Getenv(passphraseEnv))
+        opts.PassphraseFunc = sync.OnceValues(func() (string, error) { return resolvePassphrase("", false) })
+        if *quietPtr { SetLogger(NewLogger(os.Stderr, true)) }
+        if *impulsePtr < 1 {
+            return opts, fmt.Errorf("-impulse-threshold must be at least 1 (use -no-despeckle to turn it off)")
+        }
+        if *threadsPtr < 0 {
+            return opts, fmt.Errorf("-threads must not be negative")
+        }
+        if *tileHeightPtr < 0 {
+            return opts, fmt.Errorf("-tile-height must not be negative")
+        }
+        if *maxMemoryPtr < 0 {
+            return opts, fmt.Errorf("-max-memory must not be negative (0 = no limit)")
+        }
+        if *jpegQualityPtr < 1 || *jpegQualityPtr > 100 {
+            return opts, fmt.Errorf("-jpeg-quality must be 1 to 100")
+        }
+        opts.JPEGQuality = *jpegQualityPtr
+        if *rawPtr {
+            opts.SkipDeblock, opts.SkipAntialias, opts.SkipLineContinuity = true, true, true
+        } else if *filtersPtr != "" {
+            if err := parseFilterList(*filtersPtr, &opts); err != nil {
+                return opts, err
+            }
+        }
+        seam, err := ParseSeamFilter(*seamPtr)
+        if err != nil {
+            return opts, err
+        }
+        if opts.Format, err = ParseOutputFormat(*formatPtr); err != nil {
+            return opts, err
+        }
+        if seam == SeamFilterOff {
+            opts.SkipLineContinuity = true
+        } else {
+            opts.SeamFilter = &seam
+        }
+        if *deblockPtr != "auto" {
+            deblock, err := ParseDeblockStrength(*deblockPtr)
+            if err != nil {
+                return opts, err
+            }
+            if deblock == DeblockOff {
+                opts.SkipDeblock = true
+            } else {
+                opts.Deblock = &deblock
+            }
+        }
+        if opts.ChromaUpsample, err = ParseChromaUpsample(*upsamplePtr); err != nil {
+            return opts, err
+        }
+        switch *scalePtr {
+        case "1":
+        case "1/2":
+            opts.Scale = 2
+        case "1/4":
+            opts.Scale = 4
+        default:
+            return opts, fmt.Errorf("-scale must be 1, 1/2 or 1/4, got %q", *scalePtr)
+        }
+        if *cropPtr != "" {
+            if opts.Crop, err = parseCrop(*cropPtr); err != nil {
+                return opts, err
+            }
+        }
+        return opts, nil
+    }
+}
+
+// encodeStream runs the encoder, mapping "-" to stdin/stdout
+func encodeStream(input, output string, opts EncodeOptions) error {
+    if input != "-" && output != "-" {
+        return EncodeImage(input, output, opts)
+    }
+    in, err := openInput(input)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    
+    var out bytes.Buffer
+    if err := Encode(in, &out, opts); err != nil {
+        return err
+    }
+    return writeOutput(output, out.Bytes())
+}
+
+// decodeStream runs the decoder, mapping "-" to stdin/stdout
+func decodeStream(input, output string, opts DecodeOptions) error {
+    if input != "-" && output != "-" {
+        return DecodeImage(input, output, opts)
+    }
+    in, err := openInput(input)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    
+    opts.Format = opts.Format.forPath(output)
+    var out bytes.Buffer
+    if err := Decode(in, &out, opts); err != nil {
+        return err
+    }
+    return writeOutput(output, out.Bytes())
+}
+
+// runDecodeBench decodes input runs times from memory and prints the
+// stage timings, as JSON with -stats json. The first run's output is
+// written to output, if given. Status lines are quiet between runs.
+func runDecodeBench(input, output string, runs int, statsFormat string, opts DecodeOptions) error {
+    in, err := openInput(input)
+    if err != nil {
+        return err
+    }
+    data, err := io.ReadAll(in)
+    in.Close()
+    if err != nil {
+        return fmt.Errorf("failed to read input: %v", err)
+    }
+    var out *bytes.Buffer
+    var w io.Writer
+    if output != "" {
+        out = &bytes.Buffer{}
+        w = out
+        opts.Format = opts.Format.forPath(output)
+    }
+
+    logInfof("Decoding %s %d times", input, runs)
+    prev := SetLogger(NewLogger(os.Stderr, true))
+    b, err := BenchmarkDecode(data, runs, w, opts)
+    SetLogger(prev)
+    if err != nil {
+        return err
+    }
+    if out != nil {
+        if err := writeOutput(output, out.Bytes()); err != nil {
+            return err
+        }
+    }
+
+    report := io.Writer(os.Stdout)
+    if output == "-" { report = os.Stderr }
+    if statsFormat == "json" {
+        return json.NewEncoder(report).Encode(b)
+    }
+    b.WriteTable(report)
+    return nil
+}
+
+// decodePlaneFiles writes the coded planes of input as PGMs in dir
+func decodePlaneFiles(input, dir string, opts DecodeOptions) error {
+    in, err := openInput(input)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    planes, err := DecodePlanes(in, opts)
+    if err != nil {
+        return err
+    }
+    paths, err := planes.WritePGM(dir)
+    for _, path := range paths {
+        logInfof("Wrote %s", path)
+    }
+    return err
+}
+
+// openInput opens path for reading, or stdin for "-"
+func openInput(path string) (io.ReadCloser, error) {
+    if path == "-" {
+        return io.NopCloser(os.Stdin), nil
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open input: %v", err)
+    }
+    return f, nil
+}
+
+// writeOutput writes data to path, or to stdout for "-"
+func writeOutput(path string, data []byte) error {
+    if path == "-" {
+        if _, err := os.Stdout.Write(data); err != nil {
+            return fmt.Errorf("failed to write output: %v", err)
+        }
+        return nil
+    }
+    return writeBytesAtomic(path, data)
+}
+
+// parseGrain reads the -grain flag: off, auto, or a positive sigma
+func parseGrain(v string) (float32, error) {
+    switch v {
+    case "off", "":
+        return 0, nil
+    case "auto":
+        return GrainAuto, nil
+    }
+    sigma, err := strconv.ParseFloat(v, 32)
+    if err != nil || !(sigma > 0) || sigma > 64 {
+        return 0, fmt.Errorf("invalid -grain %q (want off, auto or a sigma in (0, 64])", v)
+    }
+    return float32(sigma), nil
+}
+
+// parseFilterList enables only the named post-processing filters
+func parseFilterList(list string, opts *DecodeOptions) error {
+    opts.SkipDeblock, opts.SkipAntialias, opts.SkipLineContinuity = true, true, true
+    for _, name := range strings.Split(list, ",") {
+        switch strings.TrimSpace(name) {
+        case "deblock":
+            opts.SkipDeblock = false
+        case "aa":
+            opts.SkipAntialias = false
+        case "seam":
+            opts.SkipLineContinuity = false
+        case "none", "":
+        default:
+            return fmt.Errorf("unknown filter %q (want deblock, aa, seam)", name)
+        }
+    }
+    return nil
+}
+
+// parseCrop parses a -crop region given as x,y,w,h
+func parseCrop(s string) (image.Rectangle, error) {
+    parts := strings.Split(s, ",")
+    if len(parts) != 4 {
+        return image.Rectangle{}, fmt.Errorf("-crop wants x,y,w,h, got %q", s)
+    }
+    var v [4]int
+    for i, part := range parts {
+        n, err := strconv.Atoi(strings.TrimSpace(part))
+        if err != nil || n < 0 {
+            return image.Rectangle{}, fmt.Errorf("invalid -crop value %q", part)
+        }
+        v[i] = n
+    }
+    if v[2] == 0 || v[3] == 0 {
+        return image.Rectangle{}, fmt.Errorf("-crop width and height must be positive")
+    }
+    return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+func runInfo(args []string) {
+    fs := flag.NewFlagSet("info", flag.ExitOnError)
+    inputPtr := fs.String("i", "", "Input gap file path")
+    
+    fs.Parse(args)
+    
+    if *inputPtr == "" {
+        fmt.Println("Error: -i is required")
+        fs.PrintDefaults()
+        os.Exit(1)
+    }
+    
+    file, err := os.Open(*inputPtr)
+    if err != nil {
+        fmt.Printf("Failed to open input: %v\n", err)
+        os.Exit(1)
+    }
+    defer file.Close()
+    
+    header, err := readHeader(file)
+    if errors.Is(err, errContainer) {
+        fmt.Printf("File:       %s (container)\n", *inputPtr)
+        err = listContainer(os.Stdout, *inputPtr)
+    }
+    if err != nil {
+        fmt.Printf("Failed to read header: %v\n", err)
+        os.Exit(1)
+    }
+    if header == nil {
+        return
+    }
+    
+    fmt.Printf("File:       %s\n", *inputPtr)
+    fmt.Printf("Version:    %d\n", header.Magic[3])
+    fmt.Printf("Dimensions: %dx%d\n", header.Width, header.Height)
+    fmt.Printf("Channels:   %d\n", header.Channels)
+    fmt.Printf("S:          %g\n", header.S)
+    fmt.Printf("Threshold:  %g\n", header.Threshold)
+    fmt.Printf("Flags:      0x%x\n", header.Flags)
+    fmt.Printf("Matrix:     %s\n", matrixFromFlags(header.Flags))
+    fmt.Printf("Streams:    %s\n", compressionFromFlags(header.Flags))
+    if header.Flags&FlagSubsampled != 0 {
+        fmt.Printf("Chroma:     %s\n", header.Chroma)
+    }
+    if header.Flags&FlagHighDepth != 0 {
+        fmt.Println("Depth:      16-bit planes")
+    }
+    if header.Flags&FlagEncrypted != 0 {
+        if p, err := parseCryptoParams(findChunk(header.Chunks, ChunkCrypto)); err == nil {
+            fmt.Printf("Encryption: AES-256-GCM, PBKDF2-SHA256 x %d\n", p.Iterations)
+        } else {
+            fmt.Printf("Encryption: invalid (%v)\n", err)
+        }
+    }
+    if header.Flags&FlagQuantized != 0 {
+        if header.Flags&FlagHalfMaxVal != 0 {
+            fmt.Println("MaxVal:     float16")
+        } else {
+            fmt.Println("MaxVal:     float32")
+        }
+        if header.Flags&FlagCompand != 0 {
+            fmt.Println("Quantizer:  square-root (companded AC)")
+        }
+    }
+    for i, p := range header.Planes {
+        fmt.Printf("Plane %d:    s=%g t=%g\n", i, p.S, p.Threshold)
+    }
+    if header.Flags&FlagFrames != 0 {
+        fmt.Printf("Frames:     %d\n", len(header.Frames))
+    }
+    if header.Flags&FlagGrain != 0 {
+        if sigmas, err := decodeGrain(findChunk(header.Chunks, ChunkGrain), len(header.Planes)); err == nil {
+            fmt.Printf("Grain:      %v\n", sigmas)
+        } else {
+            fmt.Printf("Grain:      invalid (%v)\n", err)
+        }
+    }
+    chunks := header.Chunks
+    if header.Flags&FlagQTable != 0 {
+        if tables, err := decodeQTables(findChunk(chunks, ChunkQTable), int(header.Channels)); err == nil {
+            for i, t := range tables {
+                fmt.Printf("QTable %d:   dc=%g max=%g\n", i, t[0], t[32])
+            }
+        } else {
+            fmt.Printf("QTable:     invalid (%v)\n", err)
+        }
+    }
+    
+    if exif := findChunk(chunks, ChunkExif); exif != nil {
+        orientation, _ := exifOrientation(exif)
+        fmt.Printf("EXIF:       present (%d bytes, orientation %d)\n", len(exif), orientation)
+    } else {
+        fmt.Println("EXIF:       none")
+    }
+    if icc := findChunk(chunks, ChunkICC); icc != nil {
+        fmt.Printf("ICC:        present (%d bytes)\n", len(icc))
+    } else {
+        fmt.Println("ICC:        none")
+    }
+}
+
+// runCheck lists every split stream of a file with its checksum status,
+// exiting 1 if the file footer or any stream fails
+func runCheck(args []string) {
+    fs := flag.NewFlagSet("check", flag.ExitOnError)
+    inputPtr := fs.String("i", "", "Input gap file path")
+    passphrasePtr := fs.String("passphrase", "", "Passphrase of an encrypted file (default $GAP_PASSPHRASE)")
+    
+    fs.Parse(args)
+    
+    if *inputPtr == "" {
+        fmt.Println("Error: -i is required")
         fs.PrintDefaults()
         os.Exit(1)
     }
     
-    err := DecodeImage(*inputPtr, *outputPtr)
+    file, err := os.Open(*inputPtr)
+    if err != nil {
+        fmt.Printf("Failed to open input: %v\n", err)
+        os.Exit(1)
+    }
+    defer file.Close()
+    
+    report, err := checkStreams(file, cmp.Or(*passphrasePtr, os.Getenv(passphraseEnv)))
     if err != nil {
-        fmt.Printf("Decoding failed: %v\n", err)
+        fmt.Printf("Failed to check: %v\n", err)
         os.Exit(1)
     }
+    
+    fmt.Printf("File:       %s\n", *inputPtr)
+    fmt.Printf("Checksum:   %s\n", report.Checksum)
+    for _, st := range report.Streams {
+        kind := "range"
+        if st.Stored { kind = "stored" }
+        fmt.Printf("%-18s %-9s %8d -> %8d bytes (%s)\n", st.name(), st.Status, st.Raw, st.Compressed, kind)
+    }
+    if report.Err != nil {
+        fmt.Printf("Error:      %v\n", report.Err)
+    }
+    if report.corrupt() {
+        fmt.Println("Result:     CORRUPT")
+        os.Exit(1)
+    }
+    fmt.Println("Result:     OK")
 }
 
 func runEncode(args []string) {
     fs := flag.NewFlagSet("encode", flag.ExitOnError)
-    inputPtr := fs.String("i", "", "Input image path")
-    outputPtr := fs.String("o", "", "Output gap file path")
-    sPtr := fs.Float64("s", 0.1, "PLTM Decay (s)")
-    tPtr := fs.Float64("t", 0.5, "Threshold")
+    statsPtr := fs.Bool("stats", false, "Print per-plane stream sizes, bits per pixel and stage timings")
+    dryRunPtr := fs.Bool("dry-run", false, "Compute -stats without writing the output file (-o not needed)")
+    jsonPtr := fs.Bool("json", false, "Print stats as JSON")
+    verifyPtr := fs.Bool("verify", false, "Decode the result in memory and print PSNR and compression ratio")
+    minPSNRPtr := fs.Float64("min-psnr", 0, "Fail if the verified PSNR is below this many dB (implies -verify)")
+    batch := addBatchFlags(fs)
+    runEncodeCommand(fs, "Input image path (- for stdin); repeat or give a directory for a batch", args, batch, func(input, output string, opts EncodeOptions) error {
+        opts.Verify = *verifyPtr || *minPSNRPtr > 0
+        if !*statsPtr && !*dryRunPtr && !*jsonPtr && !opts.Verify {
+            return encodeStream(input, output, opts)
+        }
+        report := statsReport{DryRun: *dryRunPtr, JSON: *jsonPtr, Table: *statsPtr || *dryRunPtr, MinPSNR: *minPSNRPtr}
+        return encodeWithStats(input, output, opts, report)
+    })
+}
+
+// runEncodeBatch encodes many images at once: -i takes files,
+// directories or glob patterns, -o the output directory and -j the
+// number of files encoded concurrently
+func runEncodeBatch(args []string) {
+    fs := flag.NewFlagSet("encode-batch", flag.ExitOnError)
+    batch := addEncodeBatchFlags(fs)
+    runEncodeCommand(fs, "Input images, directories or glob patterns such as 'in/*.png'; repeatable", args, batch, encodeStream)
+}
+
+func runEncodeSeq(args []string) {
+    fs := flag.NewFlagSet("encode-seq", flag.ExitOnError)
+    runEncodeCommand(fs, "Input frame pattern, e.g. frame%03d.png", args, nil, EncodeSequence)
+}
+
+// runPack encodes the images named after the flags into one container;
+// -a adds them to an existing one
+func runPack(args []string) {
+    fs := flag.NewFlagSet("pack", flag.ExitOnError)
+    outputPtr := fs.String("o", "", "Output container path")
+    appendPtr := fs.Bool("a", false, "Append to the existing container at -o")
+    encodeOpts := addEncodeFlags(fs)
+    applyConfigFile := addConfigFlag(fs)
     
     fs.Parse(args)
+    if err := applyConfigFile(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    if *outputPtr == "" || fs.NArg() == 0 {
+        fmt.Fprintln(os.Stderr, "Error: -o and at least one input are required")
+        fs.PrintDefaults()
+        os.Exit(1)
+    }
     
-    if *inputPtr == "" || *outputPtr == "" {
-        fmt.Println("Error: -i and -o are required")
+    opts, err := encodeOpts()
+    if err == nil {
+        err = PackContainer(*outputPtr, fs.Args(), opts, *appendPtr)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Packing failed: %v\n", err)
+        os.Exit(1)
+    }
+    logInfof("Success.")
+}
+
+// runUnpack lists or extracts the entries of a container
+func runUnpack(args []string) {
+    fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+    inputPtr := fs.String("i", "", "Input container path")
+    outDirPtr := fs.String("o", "", "Output directory (default current)")
+    var entries stringList
+    fs.Var(&entries, "entry", "Extract only this entry; repeatable")
+    listPtr := fs.Bool("list", false, "List the entries instead of extracting them")
+    gapPtr := fs.Bool("gap", false, "Copy entries out as .gap files instead of decoding them")
+    decodeOpts := addDecodeFlags(fs)
+    
+    fs.Parse(args)
+    if *inputPtr == "" {
+        fmt.Fprintln(os.Stderr, "Error: -i is required")
         fs.PrintDefaults()
         os.Exit(1)
     }
     
-    err := EncodeImage(*inputPtr, *outputPtr, float32(*sPtr), float32(*tPtr))
+    if *listPtr {
+        if err := listContainer(os.Stdout, *inputPtr); err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+    opts, err := decodeOpts()
+    if err == nil {
+        err = UnpackContainer(*inputPtr, *outDirPtr, entries, opts, *gapPtr)
+    }
     if err != nil {
-        fmt.Printf("Encoding failed: %v\n", err)
+        fmt.Fprintf(os.Stderr, "Unpacking failed: %v\n", err)
+        os.Exit(1)
+    }
+    logInfof("Success.")
+}
+
+// runTranscode re-encodes a .gap file with the encode flags. -s, -t and
+// -chroma default to the source's values rather than the encoder defaults.
+func runTranscode(args []string) {
+    fs := flag.NewFlagSet("transcode", flag.ExitOnError)
+    runEncodeCommand(fs, "Input .gap file (- for stdin)", args, nil, func(input, output string, opts EncodeOptions) error {
+        set := map[string]bool{}
+        fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+        if set["matrix"] {
+            return fmt.Errorf("transcode keeps the source's color matrix")
+        }
+        in, err := openInput(input)
+        if err != nil {
+            return err
+        }
+        data, err := io.ReadAll(in)
+        in.Close()
+        if err != nil {
+            return fmt.Errorf("failed to read input: %v", err)
+        }
+        header, err := readHeader(bytes.NewReader(data))
+        if err != nil {
+            return err
+        }
+        // Chroma keeps the source's parameters unless luma changes
+        chroma := len(header.Planes) == 3 && matrixFromFlags(header.Flags) != MatrixIdentity
+        if !set["s"] {
+            opts.S = header.S
+            if !set["cs"] && chroma { opts.ChromaS = header.Planes[1].S }
+        }
+        if !set["t"] {
+            opts.Threshold = header.Threshold
+            if !set["ct"] && chroma { opts.ChromaT = header.Planes[1].Threshold }
+        }
+        if !set["chroma"] {
+            opts.Chroma = header.Chroma
+        }
+
+        out, rep, err := Transcode(data, opts)
+        if err != nil {
+            return err
+        }
+        if err := writeOutput(output, out); err != nil {
+            return err
+        }
+        change := float64(rep.NewBytes-rep.OldBytes) / float64(rep.OldBytes) * 100
+        logInfof("Transcoded: %d -> %d bytes (%+.1f%%), %.2f dB PSNR against the source decode", rep.OldBytes, rep.NewBytes, change, rep.PSNR)
+        return nil
+    })
+}
+
+// runRequantize shrinks a .gap file by requantizing its coefficients
+func runRequantize(args []string) {
+    fs := flag.NewFlagSet("requantize", flag.ExitOnError)
+    inputPtr := fs.String("i", "", "Input .gap file (- for stdin)")
+    outputPtr := fs.String("o", "", "Output .gap file (- for stdout; may be the input)")
+    bitsPtr := fs.Int("bits", 0, "New coefficient bit depth, 2 up to the file's (0 = keep)")
+    tPtr := fs.Float64("t", 0, "Drop luma coefficients below this magnitude (0 = keep all)")
+    ctPtr := fs.Float64("ct", 0, "Chroma threshold (0 = -t scaled like the file's chroma)")
+    
+    fs.Parse(args)
+    if *inputPtr == "" || *outputPtr == "" {
+        fmt.Fprintln(os.Stderr, "Error: -i and -o are required")
+        fs.PrintDefaults()
         os.Exit(1)
     }
     
-    fmt.Println("Success.")
+    err := func() error {
+        in, err := openInput(*inputPtr)
+        if err != nil {
+            return err
+        }
+        data, err := io.ReadAll(in)
+        in.Close()
+        if err != nil {
+            return fmt.Errorf("failed to read input: %v", err)
+        }
+        out, rep, err := Requantize(data, RequantizeOptions{CoeffBits: *bitsPtr, Threshold: float32(*tPtr), ChromaT: float32(*ctPtr)})
+        if err != nil {
+            return err
+        }
+        if err := writeOutput(*outputPtr, out); err != nil {
+            return err
+        }
+        change := float64(rep.NewBytes-rep.OldBytes) / float64(rep.OldBytes) * 100
+        logInfof("Requantized: %d -> %d bytes (%+.1f%%), %d -> %d coefficients", rep.OldBytes, rep.NewBytes, change, rep.OldCoeffs, rep.NewCoeffs)
+        return nil
+    }()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Requantizing failed: %v\n", err)
+        os.Exit(1)
+    }
 }
 
-func runSanityCheck() {
-	fmt.Println("Running GAP Engine Sanity Check...")
+// statsReport selects what encodeWithStats prints and checks
+type statsReport struct {
+    DryRun  bool    // Do not write the output file
+    JSON    bool    // Print the stats as JSON
+    Table   bool    // Print the full stats table (otherwise only verification)
+    MinPSNR float64 // Fail below this PSNR (0 = no gate)
+}
+
+// encodeWithStats encodes input and prints the encoder stats, to stderr
+// when the file itself goes to stdout.
+func encodeWithStats(input, output string, opts EncodeOptions, rep statsReport) error {
+    in, err := openInput(input)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    var out bytes.Buffer
+    stats, err := EncodeWithStats(in, &out, opts)
+    if err != nil {
+        return err
+    }
+    if !rep.DryRun {
+        if err := writeOutput(output, out.Bytes()); err != nil {
+            return err
+        }
+    }
+
+    report := io.Writer(os.Stdout)
+    if output == "-" && !rep.DryRun {
+        report = os.Stderr
+    }
+    switch {
+    case rep.JSON:
+        enc := json.NewEncoder(report)
+        enc.SetIndent("", "  ")
+        if err := enc.Encode(stats); err != nil {
+            return err
+        }
+    case rep.Table:
+        stats.WriteTable(report)
+    case stats.Quality != nil:
+        stats.Quality.WriteTable(report)
+    }
 
-	// Test Range Coder Bridge
-	input := []byte("Hello GAP! This is a test of the Range Coder bridge.")
-	compressed := GapCompressData(input)
-	if compressed == nil {
-		fmt.Println("FAILED: GapCompressData returned nil")
-		os.Exit(1)
-	}
+    if q := stats.Quality; q != nil && rep.MinPSNR > 0 && q.Overall < rep.MinPSNR {
+        return fmt.Errorf("PSNR %.2f dB is below -min-psnr %.2f", q.Overall, rep.MinPSNR)
+    }
+    return nil
+}
 
-	decompressed := GapDecompressData(compressed, len(input))
-	if string(decompressed) != string(input) {
-		fmt.Printf("FAILED: Decompression mismatch.\nExpected: %s\nGot: %s\n", string(input), string(decompressed))
-		os.Exit(1)
-	}
+// addEncodeFlags registers the flags shared by the encoding commands and
+// returns a function building EncodeOptions from them after parsing.
+// -encrypt asks for the passphrase when that function runs.
+func addEncodeFlags(fs *flag.FlagSet) func() (EncodeOptions, error) {
+    sPtr := fs.Float64("s", 0.1, "PLTM Decay (s)")
+    tPtr := fs.Float64("t", 0.5, "Threshold")
+    csPtr := fs.Float64("cs", 0, "Chroma PLTM decay (0 = 0.4 x -s)")
+    ctPtr := fs.Float64("ct", 0, "Chroma threshold (0 = 0.44 x -t)")
+    matrixPtr := fs.String("matrix", "601", "Color matrix: 601, 709 or rgb")
+    losslessPtr := fs.Bool("lossless", false, "Store a residual so decoding reproduces the input exactly")
+    dcPredPtr := fs.Bool("dcpred", false, "Predict patch DC from left/top neighbors")
+    runIdxPtr := fs.Bool("runidx", false, "Code coefficient indices as zero runs in frequency order")
+    adaptivePtr := fs.Bool("adaptive", false, "Scale the threshold per patch by local activity")
+    deadZonePtr := fs.Int("deadzone", 0, "Drop AC coefficients whose quantized magnitudes are both below this (0 = off)")
+    cflPtr := fs.Bool("cfl", false, "Predict chroma from the reconstructed luma")
+    chromaPtr := fs.String("chroma", "420", "Chroma subsampling: 420, 411 (quarter width) or mono (one sample per 16x16)")
+    bitsPtr := fs.Int("bits", 8, "Coefficient bit depth, 2..16 (above 8 stores 16-bit values)")
+    halfMaxPtr := fs.Bool("halfmax", false, "Store each patch's scale as float16 (2 bytes instead of 4)")
+    compandPtr := fs.Bool("compand", false, "Quantize AC coefficients on a square-root curve to keep fine texture")
+    angleDeltaPtr := fs.Bool("angledelta", false, "Delta-code patch angles along each block row")
+    skipFlatPtr := fs.Bool("skipflat", false, "Code uniform 8x8 patches as a single level byte")
+    sparseAnglesPtr := fs.Bool("sparse-angles", false, "Store no angle byte for patches left with no coefficients")
+    perceptualPtr := fs.Bool("perceptual", false, "Raise the threshold up to 2x in very dark and very bright patches")
+    grainPtr := fs.String("grain", "off", "Film grain for the decoder to add: off, auto, or a luma sigma in 8-bit levels")
+    qtablePtr := fs.String("qtable", "", "Quantization table: flat, perceptual, or path to a JSON table")
+    lowMemPtr := fs.Bool("lowmem", false, "Convert and code the image in row bands to bound memory (automatic above 64 MP)")
+    maxPixelsPtr := fs.Int("max-pixels", DefaultMaxPixels, "Reject images with more pixels than this (negative = no limit)")
+    eightBitPtr := fs.Bool("8bit", false, "Code 16-bit sources at 8 bits per sample")
+    compressPtr := fs.String("compress", "range", "Stream coding: range or none (split streams), gzip or interleaved (legacy single stream)")
+    streamCRCPtr := fs.Bool("stream-crc", false, "Store a checksum per split stream so check and decode can name a corrupt stream")
+    encryptPtr := fs.Bool("encrypt", false, "Encrypt the payload with AES-256-GCM (passphrase from -passphrase, $GAP_PASSPHRASE or a prompt)")
+    passphrasePtr := fs.String("passphrase", "", "Passphrase for -encrypt")
+    threadsPtr := fs.Int("threads", 0, "Most goroutines per parallel stage; 1 encodes sequentially (0 = $GAP_THREADS, else one per CPU)")
+    quietPtr := fs.Bool("quiet", false, "Log only warnings and errors")
+    
+    return func() (EncodeOptions, error) {
+        if *quietPtr { SetLogger(NewLogger(os.Stderr, true)) }
+        matrix, err := ParseColorMatrix(*matrixPtr)
+        if err != nil {
+            return EncodeOptions{}, err
+        }
+    
+        opts := EncodeOptions{S: float32(*sPtr), Threshold: float32(*tPtr), ChromaS: float32(*csPtr), ChromaT: float32(*ctPtr), Matrix: matrix, Lossless: *losslessPtr, DCPred: *dcPredPtr, RunIndices: *runIdxPtr, Adaptive: *adaptivePtr, DeadZone: *deadZonePtr, CfL: *cflPtr, Perceptual: *perceptualPtr, SkipFlat: *skipFlatPtr, AngleDelta: *angleDeltaPtr, SparseAngles: *sparseAnglesPtr, CoeffBits: *bitsPtr, HalfMaxVal: *halfMaxPtr, Compand: *compandPtr, LowMem: *lowMemPtr, EightBit: *eightBitPtr, MaxPixels: *maxPixelsPtr, StreamChecksums: *streamCRCPtr, Workers: *threadsPtr}
+        if *threadsPtr < 0 {
+            return opts, fmt.Errorf("-threads must not be negative")
+        }
+        if opts.Compress, err = ParseCompression(*compressPtr); err != nil {
+            return opts, err
+        }
+        if opts.Grain, err = parseGrain(*grainPtr); err != nil {
+            return opts, err
+        }
+        if opts.Chroma, err = ParseChromaMode(*chromaPtr); err != nil {
+            return opts, err
+        }
+        if *passphrasePtr != "" && !*encryptPtr {
+            return opts, fmt.Errorf("-passphrase needs -encrypt")
+        }
+        if *encryptPtr {
+            if opts.Passphrase, err = resolvePassphrase(*passphrasePtr, true); err != nil {
+                return opts, err
+            }
+        }
+        if *qtablePtr != "" {
+            if opts.QTables, err = LoadQTables(*qtablePtr); err != nil {
+                return opts, err
+            }
+        }
+        return opts, nil
+    }
+}
 
-	fmt.Println("Range Coder Bridge: OK")
-	fmt.Println("Sanity Check PASSED.")
+// runEncodeCommand parses the encoder flags shared by encode and
+// encode-seq into fs and runs the given encoder, once per file when batch
+// is non-nil and the inputs call for it.
+func runEncodeCommand(fs *flag.FlagSet, inputHelp string, args []string, batch *batchFlags, encode func(input, output string, opts EncodeOptions) error) {
+    var inputs stringList
+    fs.Var(&inputs, "i", inputHelp)
+    outputPtr := fs.String("o", "", "Output gap file path (- for stdout with encode)")
+    encodeOpts := addEncodeFlags(fs)
+    applyConfigFile := addConfigFlag(fs)
+    
+    fs.Parse(args)
+    if err := applyConfigFile(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    
+    // A dry run writes nothing, so it needs no -o
+    dryRun := false
+    if f := fs.Lookup("dry-run"); f != nil {
+        dryRun = f.Value.String() == "true"
+    }
+    batchMode := batch != nil && (batch.toDir || isBatch(inputs))
+    if len(inputs) == 0 || (*outputPtr == "" && !dryRun && !batchMode) {
+        fmt.Fprintln(os.Stderr, "Error: -i and -o are required")
+        fs.PrintDefaults()
+        os.Exit(1)
+    }
+    
+    opts, err := encodeOpts()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    
+    if batchMode {
+        runBatchCommand(inputs, *outputPtr, batch, sourceExtensions, ".gap", func(input, output string) error {
+            return encode(input, output, opts)
+        })
+        return
+    }
+    if len(inputs) > 1 {
+        fmt.Fprintln(os.Stderr, "Error: -i takes a single input here")
+        os.Exit(1)
+    }
+    
+    err = encode(inputs[0], *outputPtr, opts)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Encoding failed: %v\n", err)
+        os.Exit(1)
+    }
+    
+    logInfof("Success.")
 }
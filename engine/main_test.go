@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestMain lets the test binary stand in for the CLI: runPipe starts it
+// again with GAP_TEST_MAIN set, and it then runs main with the arguments
+// it was given instead of the tests
+func TestMain(m *testing.M) {
+	if os.Getenv("GAP_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runPipe runs the CLI in a child process (the test binary, see TestMain)
+// with args, feeding stdin and returning stdout
+func runPipe(stdin []byte, args ...string) ([]byte, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), "GAP_TEST_MAIN=1")
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", args[0], err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// TestPipes pipes a PNG through `encode -i - -o -` and
+// `decode -i - -o -` in child processes and checks both outputs parse
+func TestPipes(t *testing.T) {
+	src := benchRGBA(48, 40)
+	var in bytes.Buffer
+	if err := png.Encode(&in, src); err != nil {
+		t.Fatal(err)
+	}
+	gapData, err := runPipe(in.Bytes(), "encode", "-i", "-", "-o", "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(gapData, []byte("GAP")) {
+		t.Fatalf("encode stdout does not start with a .gap header")
+	}
+	pngData, err := runPipe(gapData, "decode", "-i", "-", "-o", "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		t.Fatalf("decode stdout is not a PNG: %v", err)
+	}
+	if decoded.Bounds() != src.Bounds() {
+		t.Fatalf("decoded %v, want %v", decoded.Bounds(), src.Bounds())
+	}
+	if p := PSNR(src, decoded); p < 20 {
+		t.Fatalf("round trip PSNR %.2f dB", p)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+    "bytes"
+    "compress/zlib"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "image"
+    "io"
+)
+
+// Chunk tags for the optional metadata block that follows the header
+// when FlagChunks is set.
+var (
+    ChunkExif = [4]byte{'E', 'X', 'I', 'F'}
+    ChunkICC  = [4]byte{'I', 'C', 'C', 'P'}
+)
+
+// maxChunkSize caps a single metadata chunk. One JPEG APP1 segment holds
+// at most 64KB of EXIF, but profiles and EXIF gathered from several
+// segments can grow past any fixed bound, so the writer enforces the same
+// cap as the reader and every file it produces reads back.
+const maxChunkSize = 16 * 1024 * 1024
+
+// GapChunk is a type-tagged, length-prefixed metadata block.
+type GapChunk struct {
+    Tag  [4]byte
+    Data []byte
+}
+
+// writeChunks writes the chunk table: u32 count, then per chunk
+// tag(4) + u32 length + data.
+func writeChunks(w io.Writer, chunks []GapChunk) error {
+    for _, c := range chunks {
+        if len(c.Data) > maxChunkSize {
+            return fmt.Errorf("chunk %q too large: %d bytes (limit %d)", string(c.Tag[:]), len(c.Data), maxChunkSize)
+        }
+    }
+    if err := binary.Write(w, binary.LittleEndian, uint32(len(chunks))); err != nil { return err }
+    for _, c := range chunks {
+        if _, err := w.Write(c.Tag[:]); err != nil { return err }
+        if err := binary.Write(w, binary.LittleEndian, uint32(len(c.Data))); err != nil { return err }
+        if _, err := w.Write(c.Data); err != nil { return err }
+    }
+    return nil
+}
+
+// readChunks parses the chunk table written by writeChunks.
+func readChunks(r io.Reader) ([]GapChunk, error) {
+    var count uint32
+    if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+        return nil, fmt.Errorf("failed to read chunk count: %v", err)
+    }
+    chunks := make([]GapChunk, 0)
+    for i := uint32(0); i < count; i++ {
+        var c GapChunk
+        var length uint32
+        if _, err := io.ReadFull(r, c.Tag[:]); err != nil {
+            return nil, fmt.Errorf("failed to read chunk %d tag: %v", i, err)
+        }
+        if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+            return nil, fmt.Errorf("failed to read chunk %d length: %v", i, err)
+        }
+        if length > maxChunkSize {
+            return nil, fmt.Errorf("chunk %q too large: %d bytes", string(c.Tag[:]), length)
+        }
+        c.Data = make([]byte, length)
+        if _, err := io.ReadFull(r, c.Data); err != nil {
+            return nil, fmt.Errorf("failed to read chunk %q: %v", string(c.Tag[:]), err)
+        }
+        chunks = append(chunks, c)
+    }
+    return chunks, nil
+}
+
+// findChunk returns the data of the first chunk with the given tag, or nil.
+func findChunk(chunks []GapChunk, tag [4]byte) []byte {
+    for _, c := range chunks {
+        if c.Tag == tag { return c.Data }
+    }
+    return nil
+}
+
+// extractJPEGExif walks the JPEG marker structure and returns the TIFF
+// payload of the first EXIF APP1 segment (without the "Exif\0\0" prefix).
+// Returns nil for non-JPEG input or when no EXIF is present.
+func extractJPEGExif(data []byte) []byte {
+    if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+        return nil
+    }
+    pos := 2
+    for pos+4 <= len(data) {
+        if data[pos] != 0xFF { return nil }
+        marker := data[pos+1]
+        // Fill bytes and standalone markers carry no length
+        if marker == 0xFF { pos++; continue }
+        if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { pos += 2; continue }
+        // Start of Scan / End of Image: metadata segments are over
+        if marker == 0xDA || marker == 0xD9 { return nil }
+
+        segLen := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+        if segLen < 2 || pos+2+segLen > len(data) { return nil }
+        payload := data[pos+4 : pos+2+segLen]
+
+        if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+            exif := make([]byte, len(payload)-6)
+            copy(exif, payload[6:])
+            return exif
+        }
+        pos += 2 + segLen
+    }
+    return nil
+}
+
+// extractJPEGICC reassembles an ICC profile split across APP2
+// "ICC_PROFILE" segments (each carries a 1-based sequence number and
+// the total count). Returns nil if absent or incomplete.
+func extractJPEGICC(data []byte) []byte {
+    if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+        return nil
+    }
+    const sig = "ICC_PROFILE\x00"
+    var parts [][]byte
+    pos := 2
+    for pos+4 <= len(data) {
+        if data[pos] != 0xFF { break }
+        marker := data[pos+1]
+        if marker == 0xFF { pos++; continue }
+        if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { pos += 2; continue }
+        if marker == 0xDA || marker == 0xD9 { break }
+
+        segLen := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+        if segLen < 2 || pos+2+segLen > len(data) { break }
+        payload := data[pos+4 : pos+2+segLen]
+
+        if marker == 0xE2 && len(payload) > len(sig)+2 && string(payload[:len(sig)]) == sig {
+            seq, total := int(payload[len(sig)]), int(payload[len(sig)+1])
+            if parts == nil { parts = make([][]byte, total) }
+            if total == len(parts) && seq >= 1 && seq <= total {
+                parts[seq-1] = payload[len(sig)+2:]
+            }
+        }
+        pos += 2 + segLen
+    }
+
+    var profile []byte
+    for _, p := range parts {
+        if p == nil { return nil }
+        profile = append(profile, p...)
+    }
+    return profile
+}
+
+// iccColorSpace is the data color space signature of an ICC profile
+// ("RGB ", "GRAY", "CMYK", ...), or "" when profile is too short to have one
+func iccColorSpace(profile []byte) string {
+    if len(profile) < 20 { return "" }
+    return string(profile[16:20])
+}
+
+// extractPNGICC returns the decompressed profile from a PNG iCCP chunk,
+// or nil for non-PNG input or when no profile is present. Decompression
+// stops one byte past maxChunkSize, so a zlib bomb costs at most that
+// much memory and the caller can see the profile is oversized.
+func extractPNGICC(data []byte) []byte {
+    if len(data) < 8 || string(data[:8]) != "\x89PNG\r\n\x1a\n" {
+        return nil
+    }
+    pos := 8
+    for pos+8 <= len(data) {
+        length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+        tag := string(data[pos+4 : pos+8])
+        if length < 0 || pos+12+length > len(data) { return nil }
+        body := data[pos+8 : pos+8+length]
+
+        switch tag {
+        case "iCCP":
+            // name (1-79 bytes), NUL, compression method (0 = zlib), data
+            nul := bytes.IndexByte(body, 0)
+            if nul < 1 || nul+2 > len(body) || body[nul+1] != 0 { return nil }
+            zr, err := zlib.NewReader(bytes.NewReader(body[nul+2:]))
+            if err != nil { return nil }
+            defer zr.Close()
+            profile, err := io.ReadAll(io.LimitReader(zr, maxChunkSize+1))
+            if err != nil { return nil }
+            return profile
+        case "IDAT", "IEND":
+            // iCCP must precede image data
+            return nil
+        }
+        pos += 12 + length
+    }
+    return nil
+}
+
+// iccpChunk builds the body of a PNG iCCP chunk for the given profile.
+func iccpChunk(profile []byte) []byte {
+    var buf bytes.Buffer
+    buf.WriteString("ICC Profile")
+    buf.WriteByte(0) // name terminator
+    buf.WriteByte(0) // compression method: zlib
+    zw := zlib.NewWriter(&buf)
+    zw.Write(profile)
+    zw.Close()
+    return buf.Bytes()
+}
+
+// exifOrientation parses IFD0 of a TIFF-structured EXIF block and returns
+// the Orientation tag (1..8) and the byte offset of its value, so callers
+// can rewrite it in place. Returns (1, -1) when the tag is absent.
+func exifOrientation(exif []byte) (int, int) {
+    if len(exif) < 8 { return 1, -1 }
+
+    var order binary.ByteOrder
+    switch string(exif[:4]) {
+    case "II*\x00":
+        order = binary.LittleEndian
+    case "MM\x00*":
+        order = binary.BigEndian
+    default:
+        return 1, -1
+    }
+
+    ifd := int(order.Uint32(exif[4:8]))
+    if ifd < 8 || ifd+2 > len(exif) { return 1, -1 }
+    numEntries := int(order.Uint16(exif[ifd : ifd+2]))
+
+    for i := 0; i < numEntries; i++ {
+        entry := ifd + 2 + i*12
+        if entry+12 > len(exif) { break }
+        tag := order.Uint16(exif[entry : entry+2])
+        typ := order.Uint16(exif[entry+2 : entry+4])
+        if tag == 0x0112 && typ == 3 { // Orientation, SHORT
+            val := int(order.Uint16(exif[entry+8 : entry+10]))
+            if val < 1 || val > 8 { return 1, -1 }
+            return val, entry + 8
+        }
+    }
+    return 1, -1
+}
+
+// exifWithOrientation returns a copy of exif with the Orientation tag
+// rewritten, or exif unchanged when the tag is absent.
+func exifWithOrientation(exif []byte, orientation int) []byte {
+    _, off := exifOrientation(exif)
+    if off < 0 { return exif }
+    out := make([]byte, len(exif))
+    copy(out, exif)
+    if out[0] == 'I' {
+        binary.LittleEndian.PutUint16(out[off:], uint16(orientation))
+    } else {
+        binary.BigEndian.PutUint16(out[off:], uint16(orientation))
+    }
+    return out
+}
+
+// applyOrientation transforms img so that an EXIF Orientation of o
+// (1..8) displays upright. Orientations 5-8 swap width and height.
+func applyOrientation(img *image.RGBA, o int) *image.RGBA {
+    if o <= 1 || o > 8 { return img }
+    b := img.Bounds()
+    dst := image.NewRGBA(orientedRect(b, o))
+    orientPixels(dst.Pix, dst.Stride, img.Pix[img.PixOffset(b.Min.X, b.Min.Y):], img.Stride, b.Dx(), b.Dy(), 4, o)
+    return dst
+}
+
+// orientImage is applyOrientation for any decoded image type
+func orientImage(img image.Image, o int) image.Image {
+    if o <= 1 || o > 8 { return img }
+    b := img.Bounds()
+    switch src := img.(type) {
+    case *image.RGBA:
+        return applyOrientation(src, o)
+    case *image.RGBA64:
+        dst := image.NewRGBA64(orientedRect(b, o))
+        orientPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, b.Dx(), b.Dy(), 8, o)
+        return dst
+    case *image.Gray16:
+        dst := image.NewGray16(orientedRect(b, o))
+        orientPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, b.Dx(), b.Dy(), 2, o)
+        return dst
+    case *image.Gray:
+        dst := image.NewGray(orientedRect(b, o))
+        orientPixels(dst.Pix, dst.Stride, src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, b.Dx(), b.Dy(), 1, o)
+        return dst
+    }
+    return img
+}
+
+// orientedRect is the bounds of b after orientation o
+func orientedRect(b image.Rectangle, o int) image.Rectangle {
+    if o >= 5 { return image.Rect(0, 0, b.Dy(), b.Dx()) }
+    return image.Rect(0, 0, b.Dx(), b.Dy())
+}
+
+// unorientRect maps r, in the pixels of a w x h image after orientation
+// o, back to the stored pixels it came from
+func unorientRect(r image.Rectangle, w, h, o int) image.Rectangle {
+    stored := func(dx, dy int) image.Point {
+        switch o {
+        case 2: return image.Pt(w-1-dx, dy)
+        case 3: return image.Pt(w-1-dx, h-1-dy)
+        case 4: return image.Pt(dx, h-1-dy)
+        case 5: return image.Pt(dy, dx)
+        case 6: return image.Pt(dy, h-1-dx)
+        case 7: return image.Pt(w-1-dy, h-1-dx)
+        case 8: return image.Pt(w-1-dy, dx)
+        }
+        return image.Pt(dx, dy)
+    }
+    a, b := stored(r.Min.X, r.Min.Y), stored(r.Max.X-1, r.Max.Y-1)
+    return image.Rect(min(a.X, b.X), min(a.Y, b.Y), max(a.X, b.X)+1, max(a.Y, b.Y)+1)
+}
+
+// orientPixels copies the w x h pixels of src (bpp bytes each) into dst,
+// transformed for orientation o
+func orientPixels(dst []uint8, dstStride int, src []uint8, srcStride, w, h, bpp, o int) {
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            var dx, dy int
+            switch o {
+            case 2: dx, dy = w-1-x, y         // mirror horizontal
+            case 3: dx, dy = w-1-x, h-1-y     // rotate 180
+            case 4: dx, dy = x, h-1-y         // mirror vertical
+            case 5: dx, dy = y, x             // transpose
+            case 6: dx, dy = h-1-y, x         // rotate 90 CW
+            case 7: dx, dy = h-1-y, w-1-x     // transverse
+            case 8: dx, dy = y, w-1-x         // rotate 90 CCW
+            }
+            si := y*srcStride + x*bpp
+            di := dy*dstStride + dx*bpp
+            copy(dst[di:di+bpp], src[si:si+bpp])
+        }
+    }
+}
+
+// pngChunkInjector wraps the PNG byte stream produced by image/png and
+// inserts extra ancillary chunks right after IHDR.
+type pngChunkInjector struct {
+    w      io.Writer
+    chunks []GapChunk
+    head   []byte
+    done   bool
+}
+
+// pngHeadLen is the signature (8) plus the IHDR chunk (4+4+13+4)
+const pngHeadLen = 33
+
+func newPNGChunkInjector(w io.Writer, chunks []GapChunk) *pngChunkInjector {
+    return &pngChunkInjector{w: w, chunks: chunks, head: make([]byte, 0, pngHeadLen)}
+}
+
+func (p *pngChunkInjector) Write(b []byte) (int, error) {
+    if p.done {
+        return p.w.Write(b)
+    }
+    n := pngHeadLen - len(p.head)
+    if n > len(b) { n = len(b) }
+    p.head = append(p.head, b[:n]...)
+    if len(p.head) < pngHeadLen {
+        return len(b), nil
+    }
+
+    if _, err := p.w.Write(p.head); err != nil { return 0, err }
+    for _, c := range p.chunks {
+        if err := writePNGChunk(p.w, c.Tag, c.Data); err != nil { return 0, err }
+    }
+    p.done = true
+
+    if _, err := p.w.Write(b[n:]); err != nil { return 0, err }
+    return len(b), nil
+}
+
+// writePNGChunk writes one PNG chunk with its CRC.
+func writePNGChunk(w io.Writer, tag [4]byte, data []byte) error {
+    if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil { return err }
+    crc := crc32.NewIEEE()
+    crc.Write(tag[:])
+    crc.Write(data)
+    if _, err := w.Write(tag[:]); err != nil { return err }
+    if _, err := w.Write(data); err != nil { return err }
+    return binary.Write(w, binary.BigEndian, crc.Sum32())
+}
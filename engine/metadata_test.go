@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestICCRoundTrip writes a profile through the PNG chunk injector and
+// reads it back with extractPNGICC
+func TestICCRoundTrip(t *testing.T) {
+	profile := make([]byte, 560)
+	copy(profile[36:], "acsp")
+	copy(profile[48:], "Display P3")
+	var pngBuf bytes.Buffer
+	injector := newPNGChunkInjector(&pngBuf, []GapChunk{{Tag: [4]byte{'i', 'C', 'C', 'P'}, Data: iccpChunk(profile)}})
+	if err := png.Encode(injector, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("PNG encode with ICC profile: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(pngBuf.Bytes())); err != nil {
+		t.Fatalf("PNG with injected iCCP is unreadable: %v", err)
+	}
+	if got := extractPNGICC(pngBuf.Bytes()); !bytes.Equal(got, profile) {
+		t.Fatalf("ICC profile mismatch (got %d bytes, want %d)", len(got), len(profile))
+	}
+}
+
+// TestOrientation marks the stored top-left pixel of a 3x2 image and
+// checks where each EXIF orientation puts it
+func TestOrientation(t *testing.T) {
+	wantCorner := map[int][2]int{1: {0, 0}, 2: {2, 0}, 3: {2, 1}, 4: {0, 1}, 5: {0, 0}, 6: {1, 0}, 7: {1, 2}, 8: {0, 2}}
+	for o := 1; o <= 8; o++ {
+		src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+		src.Pix[0] = 255
+		dst := applyOrientation(src, o)
+		want := wantCorner[o]
+		if dst.Pix[dst.PixOffset(want[0], want[1])] != 255 {
+			t.Fatalf("orientation %d did not move the corner to %v", o, want)
+		}
+	}
+}
+
+// TestICCLimit decompresses a PNG profile just over maxChunkSize: reading
+// stops one byte past the limit, the encoder drops the profile with a
+// warning and writeChunks refuses a chunk that size
+func TestICCLimit(t *testing.T) {
+	var pngBuf bytes.Buffer
+	injector := newPNGChunkInjector(&pngBuf, []GapChunk{{Tag: [4]byte{'i', 'C', 'C', 'P'}, Data: iccpChunk(make([]byte, 2*maxChunkSize))}})
+	if err := png.Encode(injector, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(extractPNGICC(pngBuf.Bytes())); n != maxChunkSize+1 {
+		t.Fatalf("extracted %d bytes, want %d", n, maxChunkSize+1)
+	}
+	rec := &recordLogger{}
+	defer SetLogger(SetLogger(rec))
+	if chunks := sourceMetadata(pngBuf.Bytes()); len(chunks) != 0 {
+		t.Fatalf("oversized profile kept (%d chunks)", len(chunks))
+	}
+	if len(rec.warn) != 1 || !strings.Contains(rec.warn[0], "ICC profile") {
+		t.Fatalf("warnings %q, want one about the ICC profile", rec.warn)
+	}
+	err := writeChunks(io.Discard, []GapChunk{{Tag: ChunkICC, Data: make([]byte, maxChunkSize+1)}})
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("writeChunks gave %v for an oversized chunk", err)
+	}
+}
+
+// TestExifLimit stores EXIF of exactly maxChunkSize, which must read
+// back, and one byte more, which the encode must refuse rather than
+// write a file the decoder rejects
+func TestExifLimit(t *testing.T) {
+	src := benchRGBA(16, 16)
+	opts := EncodeOptions{S: 0.1, Threshold: 0.5}
+	data, err := encodeGap(src, []GapChunk{{Tag: ChunkExif, Data: make([]byte, maxChunkSize)}}, opts, nil)
+	if err != nil {
+		t.Fatalf("EXIF at the limit: %v", err)
+	}
+	h, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("EXIF at the limit: %v", err)
+	}
+	if exif := findChunk(h.Chunks, ChunkExif); len(exif) != maxChunkSize {
+		t.Fatalf("EXIF at the limit read back as %d bytes", len(exif))
+	}
+	if _, err := encodeGap(src, []GapChunk{{Tag: ChunkExif, Data: make([]byte, maxChunkSize+1)}}, opts, nil); err == nil {
+		t.Fatalf("EXIF over the limit encoded")
+	}
+}
+
+// pngChunk returns the body of the first chunk of the given type in a
+// PNG file, or nil
+func pngChunk(data []byte, tag string) []byte {
+	for pos := 8; pos+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		if pos+12+n > len(data) {
+			return nil
+		}
+		if string(data[pos+4:pos+8]) == tag {
+			return data[pos+8 : pos+8+n]
+		}
+		pos += 12 + n
+	}
+	return nil
+}
+
+// TestJPEGExif encodes a JPEG carrying EXIF in an APP1 segment: the
+// block must be stored whole in the .gap file, and the decoded PNG must
+// carry it in eXIf with the orientation it applied reset to 1
+func TestJPEGExif(t *testing.T) {
+	// Little-endian TIFF header, then an IFD with Orientation 6 and
+	// Software "gap"
+	exif := []byte{'I', 'I', '*', 0, 8, 0, 0, 0, 2, 0,
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0,
+		0x31, 0x01, 2, 0, 4, 0, 0, 0, 'g', 'a', 'p', 0,
+		0, 0, 0, 0}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, benchRGBA(32, 16), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(2+6+len(exif)))
+	app1 = append(append(app1, "Exif\x00\x00"...), exif...)
+	src := append(append(append([]byte(nil), jpg.Bytes()[:2]...), app1...), jpg.Bytes()[2:]...)
+
+	var gap bytes.Buffer
+	if err := Encode(bytes.NewReader(src), &gap, EncodeOptions{S: 0.1, Threshold: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := readHeader(bytes.NewReader(gap.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := findChunk(h.Chunks, ChunkExif); !bytes.Equal(got, exif) {
+		t.Fatalf("stored EXIF is % x, want % x", got, exif)
+	}
+
+	for _, strip := range []bool{false, true} {
+		var out bytes.Buffer
+		if err := Decode(bytes.NewReader(gap.Bytes()), &out, DecodeOptions{StripMetadata: strip}); err != nil {
+			t.Fatal(err)
+		}
+		got := pngChunk(out.Bytes(), "eXIf")
+		if strip {
+			if got != nil {
+				t.Fatalf("stripped PNG still carries EXIF")
+			}
+			continue
+		}
+		if want := exifWithOrientation(exif, 1); !bytes.Equal(got, want) {
+			t.Fatalf("PNG EXIF is % x, want % x", got, want)
+		}
+		cfg, err := png.DecodeConfig(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != 16 || cfg.Height != 32 {
+			t.Fatalf("decoded %dx%d, want the rotated 16x32", cfg.Width, cfg.Height)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Package metrics compares decoded images with their sources: MSE, PSNR
+// and the mean and largest sample differences overall and per RGB
+// channel, where the largest difference is, SSIM and MS-SSIM on luma, and
+// a heatmap of the differences. Samples are compared at 8 bits; images
+// are compared relative to their own Min corners.
+package metrics
+
+import (
+    "fmt"
+    "image"
+    "math"
+)
+
+// Channels names the channels the per-channel figures are in
+var Channels = [3]string{"R", "G", "B"}
+
+// Result is the comparison of two equally sized images
+type Result struct {
+    MSE        [3]float64  // Mean squared error per channel
+    MSEOverall float64     // Over all three channels
+    PSNR       [3]float64  // Per channel, dB (+Inf where equal)
+    Overall    float64     // Over all three channels, dB
+    MAE        [3]float64  // Mean absolute difference per channel
+    MAEOverall float64     // Over all three channels
+    MaxDiffs   [3]int      // Largest absolute difference per channel
+    MaxDiff    int         // Largest absolute sample difference, 0..255
+    MaxDiffAt  image.Point // First pixel with it, relative to the images' Min corners
+    MaxChannel int         // Channel of MaxDiff (index into Channels)
+}
+
+// Compare measures how far b is from a. Images of different size are an
+// error.
+func Compare(a, b image.Image) (*Result, error) {
+    ab, bb := a.Bounds(), b.Bounds()
+    if ab.Size() != bb.Size() {
+        return nil, fmt.Errorf("images differ in size: %dx%d and %dx%d", ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy())
+    }
+    if ab.Empty() {
+        return nil, fmt.Errorf("images are empty")
+    }
+
+    r := &Result{}
+    var sumSq, sumAbs [3]float64
+    pa, pb := make([]uint8, ab.Dx()*3), make([]uint8, ab.Dx()*3)
+    for y := 0; y < ab.Dy(); y++ {
+        rgbRow(a, ab.Min.Y+y, pa)
+        rgbRow(b, bb.Min.Y+y, pb)
+        for i := range pa {
+            d := int(pa[i]) - int(pb[i])
+            sumSq[i%3] += float64(d * d)
+            if d < 0 { d = -d }
+            sumAbs[i%3] += float64(d)
+            r.MaxDiffs[i%3] = max(r.MaxDiffs[i%3], d)
+            if d > r.MaxDiff {
+                r.MaxDiff, r.MaxDiffAt, r.MaxChannel = d, image.Pt(i/3, y), i%3
+            }
+        }
+    }
+
+    n := float64(ab.Dx() * ab.Dy())
+    for c := range r.MSE {
+        r.MSE[c] = sumSq[c] / n
+        r.PSNR[c] = PSNRFromMSE(r.MSE[c])
+        r.MAE[c] = sumAbs[c] / n
+    }
+    r.MSEOverall = (sumSq[0] + sumSq[1] + sumSq[2]) / (3 * n)
+    r.MAEOverall = (sumAbs[0] + sumAbs[1] + sumAbs[2]) / (3 * n)
+    r.Overall = PSNRFromMSE(r.MSEOverall)
+    return r, nil
+}
+
+// PSNR returns the peak signal-to-noise ratio in dB over the RGB channels
+// of a and b: +Inf for identical images, 0 for images of different size
+func PSNR(a, b image.Image) float64 {
+    r, err := Compare(a, b)
+    if err != nil { return 0 }
+    return r.Overall
+}
+
+// PSNRFromMSE converts a mean squared error of 8-bit samples to dB
+func PSNRFromMSE(mse float64) float64 {
+    if mse == 0 { return math.Inf(1) }
+    return 10 * math.Log10(255*255/mse)
+}
+
+// DiffImage is a heatmap of how far b is from a: each pixel's largest
+// channel difference, multiplied by gain, runs from black through red and
+// yellow to white. Identical pixels are black.
+func DiffImage(a, b image.Image, gain float64) (*image.RGBA, error) {
+    ab, bb := a.Bounds(), b.Bounds()
+    if ab.Size() != bb.Size() {
+        return nil, fmt.Errorf("images differ in size: %dx%d and %dx%d", ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy())
+    }
+    out := image.NewRGBA(image.Rect(0, 0, ab.Dx(), ab.Dy()))
+    pa, pb := make([]uint8, ab.Dx()*3), make([]uint8, ab.Dx()*3)
+    for y := 0; y < ab.Dy(); y++ {
+        rgbRow(a, ab.Min.Y+y, pa)
+        rgbRow(b, bb.Min.Y+y, pb)
+        row := out.Pix[out.PixOffset(0, y):]
+        for x := 0; x < ab.Dx(); x++ {
+            d := 0
+            for c := 0; c < 3; c++ {
+                d = max(d, absDiff(pa[x*3+c], pb[x*3+c]))
+            }
+            heat(row[x*4:x*4+4], math.Min(float64(d)*gain/255, 1))
+        }
+    }
+    return out, nil
+}
+
+// heat writes the heatmap color of t in 0..1 to px
+func heat(px []uint8, t float64) {
+    v := t * 3 // Black to red, red to yellow, yellow to white
+    px[0] = uint8(math.Round(255 * math.Min(v, 1)))
+    px[1] = uint8(math.Round(255 * math.Min(math.Max(v-1, 0), 1)))
+    px[2] = uint8(math.Round(255 * math.Min(math.Max(v-2, 0), 1)))
+    px[3] = 255
+}
+
+func absDiff(a, b uint8) int {
+    if a > b { return int(a - b) }
+    return int(b - a)
+}
+
+// rgbRow fills row with the 8-bit RGB samples of line y of img. RGBA and
+// Gray rows, what the decoder returns, are read from their pixels; the
+// rest go through the color model.
+func rgbRow(img image.Image, y int, row []uint8) {
+    b := img.Bounds()
+    switch m := img.(type) {
+    case *image.RGBA:
+        src := m.Pix[m.PixOffset(b.Min.X, y):]
+        for x := 0; x < b.Dx(); x++ {
+            row[x*3], row[x*3+1], row[x*3+2] = src[x*4], src[x*4+1], src[x*4+2]
+        }
+        return
+    case *image.Gray:
+        for x, v := range m.Pix[m.PixOffset(b.Min.X, y):][:b.Dx()] {
+            row[x*3], row[x*3+1], row[x*3+2] = v, v, v
+        }
+        return
+    }
+    for x := 0; x < b.Dx(); x++ {
+        r, g, bl, _ := img.At(b.Min.X+x, y).RGBA()
+        row[x*3], row[x*3+1], row[x*3+2] = uint8(r>>8), uint8(g>>8), uint8(bl>>8)
+    }
+}
@@ -0,0 +1,223 @@
+package metrics
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "math"
+    "runtime"
+    "sync"
+    "sync/atomic"
+)
+
+// SSIM as in Wang et al. (2004): an 11x11 Gaussian window with sigma 1.5
+// and the constants (0.01*255)^2 and (0.03*255)^2 for 8-bit samples
+const (
+    ssimWindow = 11
+    ssimSigma  = 1.5
+    ssimC1     = (0.01 * 255) * (0.01 * 255)
+    ssimC2     = (0.03 * 255) * (0.03 * 255)
+    ssimBand   = 64 // Rows per parallel band
+)
+
+// msssimWeights are the exponents of the MS-SSIM scales, finest first,
+// from Wang, Simoncelli and Bovik (2003)
+var msssimWeights = [5]float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
+// ErrTooSmall is returned for images narrower or shorter than the SSIM window
+var ErrTooSmall = errors.New("images are smaller than the 11x11 SSIM window")
+
+var gaussian = gaussianKernel()
+
+// gaussianKernel is the normalized 1-D window; the 2-D one is separable
+func gaussianKernel() [ssimWindow]float64 {
+    var k [ssimWindow]float64
+    sum := 0.0
+    for i := range k {
+        d := float64(i - ssimWindow/2)
+        k[i] = math.Exp(-d * d / (2 * ssimSigma * ssimSigma))
+        sum += k[i]
+    }
+    for i := range k {
+        k[i] /= sum
+    }
+    return k
+}
+
+// lumaPlane is the BT.601 luma of an image, on the 0..255 scale
+type lumaPlane struct {
+    w, h int
+    pix  []float32
+}
+
+func luma(img image.Image) lumaPlane {
+    b := img.Bounds()
+    p := lumaPlane{b.Dx(), b.Dy(), make([]float32, b.Dx()*b.Dy())}
+    parallelBands(p.h, func(_, y0, y1 int) {
+        row := make([]uint8, p.w*3)
+        for y := y0; y < y1; y++ {
+            rgbRow(img, b.Min.Y+y, row)
+            out := p.pix[y*p.w:]
+            for x := 0; x < p.w; x++ {
+                out[x] = 0.299*float32(row[x*3]) + 0.587*float32(row[x*3+1]) + 0.114*float32(row[x*3+2])
+            }
+        }
+    })
+    return p
+}
+
+// halve averages each 2x2 block, dropping an odd last column and row
+func (p lumaPlane) halve() lumaPlane {
+    h := lumaPlane{p.w / 2, p.h / 2, make([]float32, (p.w/2)*(p.h/2))}
+    parallelBands(h.h, func(_, y0, y1 int) {
+        for y := y0; y < y1; y++ {
+            r0, r1 := p.pix[2*y*p.w:], p.pix[(2*y+1)*p.w:]
+            for x := 0; x < h.w; x++ {
+                h.pix[y*h.w+x] = (r0[2*x] + r0[2*x+1] + r1[2*x] + r1[2*x+1]) / 4
+            }
+        }
+    })
+    return h
+}
+
+// lumaPair checks a and b can be compared by SSIM and returns their lumas
+func lumaPair(a, b image.Image) (lumaPlane, lumaPlane, error) {
+    ab, bb := a.Bounds(), b.Bounds()
+    if ab.Size() != bb.Size() {
+        return lumaPlane{}, lumaPlane{}, fmt.Errorf("images differ in size: %dx%d and %dx%d", ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy())
+    }
+    if ab.Dx() < ssimWindow || ab.Dy() < ssimWindow {
+        return lumaPlane{}, lumaPlane{}, ErrTooSmall
+    }
+    return luma(a), luma(b), nil
+}
+
+// SSIM is the mean structural similarity of the lumas of a and b over
+// every window position inside the images: 1 for identical images,
+// lower as structure is lost. Images of different size, or smaller than
+// the window (ErrTooSmall), are an error.
+func SSIM(a, b image.Image) (float64, error) {
+    la, lb, err := lumaPair(a, b)
+    if err != nil {
+        return 0, err
+    }
+    s, _ := ssimScale(la, lb)
+    return s, nil
+}
+
+// MSSSIM is the multi-scale SSIM of the lumas of a and b: the contrast
+// and structure terms at five scales, halving the images each time, and
+// the luminance term at the coarsest. Images too small for five scales
+// use as many as fit, with the weights of those renormalized, so one
+// scale is plain SSIM. Negative terms count as 0.
+func MSSSIM(a, b image.Image) (float64, error) {
+    la, lb, err := lumaPair(a, b)
+    if err != nil {
+        return 0, err
+    }
+    scales := 1
+    for w, h := la.w/2, la.h/2; scales < len(msssimWeights) && w >= ssimWindow && h >= ssimWindow; w, h = w/2, h/2 {
+        scales++
+    }
+    total := 0.0
+    for _, w := range msssimWeights[:scales] {
+        total += w
+    }
+
+    result := 1.0
+    for j := 0; j < scales; j++ {
+        s, cs := ssimScale(la, lb)
+        if j == scales-1 {
+            cs = s
+        } else {
+            la, lb = la.halve(), lb.halve()
+        }
+        result *= math.Pow(math.Max(cs, 0), msssimWeights[j]/total)
+    }
+    return result, nil
+}
+
+// ssimScale returns the mean SSIM and the mean of its contrast-structure
+// term over the valid window positions of a and b. Output rows are split
+// into bands, each filtering the input rows it covers horizontally and
+// then vertically.
+func ssimScale(a, b lumaPlane) (float64, float64) {
+    ow, oh := a.w-ssimWindow+1, a.h-ssimWindow+1
+    bands := (oh + ssimBand - 1) / ssimBand
+    ssims, css := make([]float64, bands), make([]float64, bands)
+    parallelBands(oh, func(band, y0, y1 int) {
+        // Weighted row sums of a, b, a², b² and ab
+        rows := y1 - y0 + ssimWindow - 1
+        var sums [5][]float64
+        for i := range sums {
+            sums[i] = make([]float64, rows*ow)
+        }
+        for r := 0; r < rows; r++ {
+            pa, pb := a.pix[(y0+r)*a.w:], b.pix[(y0+r)*b.w:]
+            for x := 0; x < ow; x++ {
+                var s [5]float64
+                for k, g := range gaussian {
+                    va, vb := float64(pa[x+k]), float64(pb[x+k])
+                    s[0] += g * va
+                    s[1] += g * vb
+                    s[2] += g * va * va
+                    s[3] += g * vb * vb
+                    s[4] += g * va * vb
+                }
+                for i := range sums {
+                    sums[i][r*ow+x] = s[i]
+                }
+            }
+        }
+
+        var sumSSIM, sumCS float64
+        for y := 0; y < y1-y0; y++ {
+            for x := 0; x < ow; x++ {
+                var m [5]float64
+                for k, g := range gaussian {
+                    o := (y+k)*ow + x
+                    for i := range m {
+                        m[i] += g * sums[i][o]
+                    }
+                }
+                ma, mb := m[0], m[1]
+                va, vb, cov := m[2]-ma*ma, m[3]-mb*mb, m[4]-ma*mb
+                cs := (2*cov + ssimC2) / (va + vb + ssimC2)
+                sumCS += cs
+                sumSSIM += (2*ma*mb + ssimC1) / (ma*ma + mb*mb + ssimC1) * cs
+            }
+        }
+        ssims[band], css[band] = sumSSIM, sumCS
+    })
+
+    // Summed in band order, so the result does not depend on the CPU count
+    var s, cs float64
+    for i := range ssims {
+        s += ssims[i]
+        cs += css[i]
+    }
+    n := float64(ow * oh)
+    return s / n, cs / n
+}
+
+// parallelBands calls fn for each band of ssimBand rows out of n, spread
+// over one goroutine per CPU
+func parallelBands(n int, fn func(band, y0, y1 int)) {
+    bands := (n + ssimBand - 1) / ssimBand
+    var next atomic.Int64
+    var wg sync.WaitGroup
+    for range min(runtime.GOMAXPROCS(0), bands) {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                band := int(next.Add(1)) - 1
+                if band >= bands {
+                    return
+                }
+                fn(band, band*ssimBand, min((band+1)*ssimBand, n))
+            }
+        }()
+    }
+    wg.Wait()
+}
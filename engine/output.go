@@ -0,0 +1,220 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "io"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "golang.org/x/image/bmp"
+    "golang.org/x/image/tiff"
+)
+
+// OutputFormat selects the image format decode writes
+type OutputFormat int
+
+const (
+    FormatAuto OutputFormat = iota // From the output file's extension, PNG when it names none
+    FormatPNG
+    FormatJPEG // Lossy; see DecodeOptions.JPEGQuality
+    FormatBMP
+    FormatTIFF // Keeps 16-bit samples
+    FormatPPM  // Binary netpbm (P6): a header and the raw samples, the fastest to write
+    FormatPGM  // Binary netpbm gray (P5); color images are written as their luma
+    FormatY4M  // The coded YCbCr planes as one YUV4MPEG2 frame, before upsampling; see DecodePlanes
+)
+
+// DefaultJPEGQuality is the quality of JPEG output when none is given
+const DefaultJPEGQuality = 90
+
+func (f OutputFormat) String() string {
+    switch f {
+    case FormatAuto:
+        return "auto"
+    case FormatPNG:
+        return "png"
+    case FormatJPEG:
+        return "jpeg"
+    case FormatBMP:
+        return "bmp"
+    case FormatTIFF:
+        return "tiff"
+    case FormatPPM:
+        return "ppm"
+    case FormatPGM:
+        return "pgm"
+    case FormatY4M:
+        return "y4m"
+    }
+    return fmt.Sprintf("unknown(%d)", int(f))
+}
+
+// ParseOutputFormat accepts the -format names and their usual extensions
+func ParseOutputFormat(name string) (OutputFormat, error) {
+    switch strings.ToLower(name) {
+    case "", "auto":
+        return FormatAuto, nil
+    case "png":
+        return FormatPNG, nil
+    case "jpeg", "jpg":
+        return FormatJPEG, nil
+    case "bmp":
+        return FormatBMP, nil
+    case "tiff", "tif":
+        return FormatTIFF, nil
+    case "ppm":
+        return FormatPPM, nil
+    case "pgm":
+        return FormatPGM, nil
+    case "y4m":
+        return FormatY4M, nil
+    }
+    return 0, fmt.Errorf("unknown output format %q (want png, jpeg, bmp, tiff, ppm, pgm or y4m)", name)
+}
+
+// forPath resolves FormatAuto from the extension of path; other formats,
+// and paths with no known image extension, are left as they are
+func (f OutputFormat) forPath(path string) OutputFormat {
+    if f != FormatAuto { return f }
+    if g, err := ParseOutputFormat(strings.TrimPrefix(filepath.Ext(path), ".")); err == nil { return g }
+    return FormatAuto
+}
+
+// Ext is the file extension batch decodes give outputs in this format
+func (f OutputFormat) Ext() string {
+    switch f {
+    case FormatJPEG:
+        return ".jpg"
+    case FormatBMP, FormatTIFF, FormatPPM, FormatPGM, FormatY4M:
+        return "." + f.String()
+    }
+    return ".png"
+}
+
+// writeDecoded writes a decoded image to outputPath in opts.Format, or
+// the format its extension names (see encodeDecoded)
+func writeDecoded(outputPath string, finalImg image.Image, chunks []GapChunk, opts DecodeOptions) error {
+    opts.Format = opts.Format.forPath(outputPath)
+    return writeFileAtomic(outputPath, func(w io.Writer) error {
+        return encodeDecoded(w, finalImg, chunks, opts)
+    })
+}
+
+// encodeDecoded writes an upright decoded image (see orientUpright) in
+// opts.Format (PNG for FormatAuto). Only PNG output carries the ICC
+// profile and EXIF chunks.
+func encodeDecoded(w io.Writer, finalImg image.Image, chunks []GapChunk, opts DecodeOptions) error {
+    if opts.Format == FormatAuto || opts.Format == FormatPNG {
+        return encodeDecodedPNG(w, finalImg, chunks, opts)
+    }
+
+    start := time.Now()
+    bufWriter := bufio.NewWriterSize(w, 1024*1024)
+    var err error
+    switch opts.Format {
+    case FormatJPEG:
+        quality := opts.JPEGQuality
+        if quality == 0 { quality = DefaultJPEGQuality }
+        err = jpeg.Encode(bufWriter, finalImg, &jpeg.Options{Quality: quality})
+    case FormatBMP:
+        err = bmp.Encode(bufWriter, finalImg)
+    case FormatTIFF:
+        err = tiff.Encode(bufWriter, finalImg, &tiff.Options{Compression: tiff.Deflate})
+    case FormatPPM, FormatPGM:
+        err = encodeNetpbm(bufWriter, finalImg, opts.Format == FormatPGM)
+    case FormatY4M:
+        return fmt.Errorf("y4m output is written from the planes, not a decoded image")
+    default:
+        return fmt.Errorf("cannot write output format %v", opts.Format)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to encode %v: %v", opts.Format, err)
+    }
+    if err := bufWriter.Flush(); err != nil {
+        return fmt.Errorf("failed to flush output: %v", err)
+    }
+    if opts.Stats != nil {
+        opts.Stats.add(&opts.Stats.PNGEncode, start)
+    }
+    return nil
+}
+
+// encodeNetpbm writes img as a binary PPM (P6), or PGM (P5) when gray,
+// with 16-bit big-endian samples for 16-bit images. *image.RGBA and
+// *image.Gray rows are copied straight from their pixels.
+func encodeNetpbm(w io.Writer, img image.Image, gray bool) error {
+    b := img.Bounds()
+    deep := false
+    switch img.(type) {
+    case *image.RGBA64, *image.Gray16:
+        deep = true
+    }
+    magic, maxVal, channels := "P6", 255, 3
+    if gray { magic, channels = "P5", 1 }
+    if deep { maxVal = 65535 }
+    if _, err := fmt.Fprintf(w, "%s\n%d %d\n%d\n", magic, b.Dx(), b.Dy(), maxVal); err != nil {
+        return err
+    }
+
+    bytesPer := 1
+    if deep { bytesPer = 2 }
+    row := make([]byte, b.Dx()*channels*bytesPer)
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+        switch m := img.(type) {
+        case *image.Gray:
+            if gray {
+                copy(row, m.Pix[m.PixOffset(b.Min.X, y):][:b.Dx()])
+                break
+            }
+            for x, v := range m.Pix[m.PixOffset(b.Min.X, y):][:b.Dx()] {
+                row[x*3], row[x*3+1], row[x*3+2] = v, v, v
+            }
+        case *image.RGBA:
+            if gray {
+                netpbmRowGeneric(row, img, y, gray, deep)
+                break
+            }
+            src := m.Pix[m.PixOffset(b.Min.X, y):]
+            for x := 0; x < b.Dx(); x++ {
+                row[x*3], row[x*3+1], row[x*3+2] = src[x*4], src[x*4+1], src[x*4+2]
+            }
+        default:
+            netpbmRowGeneric(row, img, y, gray, deep)
+        }
+        if _, err := w.Write(row); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// netpbmRowGeneric fills one netpbm row of img through its color model
+func netpbmRowGeneric(row []byte, img image.Image, y int, gray, deep bool) {
+    b := img.Bounds()
+    i := 0
+    put := func(v uint32) {
+        if deep {
+            row[i], row[i+1] = byte(v>>8), byte(v)
+            i += 2
+            return
+        }
+        row[i] = byte(v >> 8)
+        i++
+    }
+    for x := b.Min.X; x < b.Max.X; x++ {
+        c := img.At(x, y)
+        if gray {
+            put(uint32(color.Gray16Model.Convert(c).(color.Gray16).Y))
+            continue
+        }
+        r, g, bl, _ := c.RGBA()
+        put(r)
+        put(g)
+        put(bl)
+    }
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// readNetpbm parses the binary 8-bit PPM (P6) or PGM (P5) that decode
+// writes, into an RGBA or Gray image
+func readNetpbm(data []byte) (image.Image, error) {
+	var magic string
+	var w, h, maxVal int
+	r := bytes.NewReader(data)
+	if _, err := fmt.Fscan(r, &magic, &w, &h, &maxVal); err != nil {
+		return nil, fmt.Errorf("netpbm header: %v", err)
+	}
+	if b, err := r.ReadByte(); err != nil || b != '\n' || maxVal != 255 {
+		return nil, fmt.Errorf("netpbm header: maxval %d", maxVal)
+	}
+	pix := data[len(data)-r.Len():]
+	switch magic {
+	case "P5":
+		if len(pix) != w*h {
+			return nil, fmt.Errorf("pgm has %d sample bytes for %dx%d", len(pix), w, h)
+		}
+		return &image.Gray{Pix: pix, Stride: w, Rect: image.Rect(0, 0, w, h)}, nil
+	case "P6":
+		if len(pix) != w*h*3 {
+			return nil, fmt.Errorf("ppm has %d sample bytes for %dx%d", len(pix), w, h)
+		}
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for i := 0; i < w*h; i++ {
+			img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = pix[i*3], pix[i*3+1], pix[i*3+2], 255
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("netpbm magic %q", magic)
+}
+
+// TestOutputFormats decodes one file to every output format, by
+// extension and by -format, and reads each back with its decoder:
+// lossless formats must give the PNG's pixels, JPEG something close
+func TestOutputFormats(t *testing.T) {
+	data, err := encodeGap(colorWheel(72, 56), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := DecodeImageTo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "gap-formats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in.gap")
+	if err := os.WriteFile(input, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	readers := map[OutputFormat]func([]byte) (image.Image, error){
+		FormatPNG:  func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) },
+		FormatJPEG: func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) },
+		FormatBMP:  func(b []byte) (image.Image, error) { return bmp.Decode(bytes.NewReader(b)) },
+		FormatTIFF: func(b []byte) (image.Image, error) { return tiff.Decode(bytes.NewReader(b)) },
+		FormatPPM:  readNetpbm,
+		FormatPGM:  readNetpbm,
+	}
+	for _, ext := range []string{".png", ".jpg", ".jpeg", ".bmp", ".tif", ".tiff", ".ppm", ".pgm", ".out"} {
+		format := FormatAuto.forPath("x" + ext)
+		output := filepath.Join(dir, "out"+ext)
+		if err := DecodeImage(input, output, DecodeOptions{}); err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+		fromFile, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+		// The stream API takes the format explicitly
+		var buf bytes.Buffer
+		if err := Decode(bytes.NewReader(data), &buf, DecodeOptions{Format: format}); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if !bytes.Equal(buf.Bytes(), fromFile) {
+			t.Fatalf("%s file differs from -format %v", ext, format)
+		}
+		read := readers[format]
+		if format == FormatAuto {
+			read = readers[FormatPNG]
+		}
+		got, err := read(fromFile)
+		if err != nil {
+			t.Fatalf("%s output is unreadable: %v", ext, err)
+		}
+		if got.Bounds() != want.Bounds() {
+			t.Fatalf("%s output is %v, want %v", ext, got.Bounds(), want.Bounds())
+		}
+		switch format {
+		case FormatJPEG:
+			if psnr := PSNR(got, want); psnr < 30 {
+				t.Fatalf("jpeg output at %.1f dB", psnr)
+			}
+		case FormatPGM:
+			for y := 0; y < want.Bounds().Dy(); y++ {
+				for x := 0; x < want.Bounds().Dx(); x++ {
+					if g := color.GrayModel.Convert(want.At(x, y)).(color.Gray); g != got.At(x, y) {
+						t.Fatalf("pgm pixel (%d, %d) is %v, want %v", x, y, got.At(x, y), g)
+					}
+				}
+			}
+		default:
+			if !math.IsInf(PSNR(got, want), 1) {
+				t.Fatalf("%s output differs from the decoded pixels", ext)
+			}
+		}
+	}
+
+	// Lower JPEG quality, smaller file
+	var hi, lo bytes.Buffer
+	if err := Decode(bytes.NewReader(data), &hi, DecodeOptions{Format: FormatJPEG, JPEGQuality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Decode(bytes.NewReader(data), &lo, DecodeOptions{Format: FormatJPEG, JPEGQuality: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if lo.Len() >= hi.Len() {
+		t.Fatalf("quality 20 JPEG is %d bytes, quality 95 %d", lo.Len(), hi.Len())
+	}
+	if _, err := ParseOutputFormat("webp"); err == nil {
+		t.Fatalf("accepted webp output")
+	}
+}
+
+// TestPlaneOutput decodes an odd-sized image to Y4M and to PGM
+// planes: the header must name 4:2:0, the frame hold a full luma plane and
+// two rounded-up chroma planes, and the luma match DecodeGray's unfiltered
+// plane. Identity-matrix files have no YCbCr planes to write as Y4M.
+func TestPlaneOutput(t *testing.T) {
+	const w, h = 71, 45
+	data, err := encodeGap(colorWheel(w, h), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var y4m bytes.Buffer
+	if err := Decode(bytes.NewReader(data), &y4m, DecodeOptions{Format: FormatY4M}); err != nil {
+		t.Fatal(err)
+	}
+	header, frame, ok := strings.Cut(y4m.String(), "\nFRAME\n")
+	if !ok || header != fmt.Sprintf("YUV4MPEG2 W%d H%d F1:1 Ip A1:1 C420jpeg XCOLORRANGE=FULL", w, h) {
+		t.Fatalf("y4m header %q", header)
+	}
+	cw, ch := (w+1)/2, (h+1)/2
+	if len(frame) != w*h+2*cw*ch {
+		t.Fatalf("y4m frame is %d bytes, want %d", len(frame), w*h+2*cw*ch)
+	}
+	luma, err := DecodeGray(bytes.NewReader(data), DecodeOptions{SkipAntialias: true, SkipLineContinuity: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte(frame[:w*h]), luma.Pix) {
+		t.Fatalf("y4m luma differs from the deblocked gray decode")
+	}
+
+	dir, err := os.MkdirTemp("", "gap-planes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in.gap")
+	if err := os.WriteFile(input, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := decodePlaneFiles(input, filepath.Join(dir, "planes"), DecodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]image.Point{"y.pgm": {w, h}, "cb.pgm": {cw, ch}, "cr.pgm": {cw, ch}} {
+		pgm, err := os.ReadFile(filepath.Join(dir, "planes", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := readNetpbm(pgm)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if img.Bounds().Size() != size {
+			t.Fatalf("%s is %v, want %v", name, img.Bounds().Size(), size)
+		}
+		if name == "y.pgm" && !bytes.Equal(img.(*image.Gray).Pix, luma.Pix) {
+			t.Fatalf("y.pgm differs from the y4m luma")
+		}
+	}
+	// -o out.y4m picks the format from the extension
+	output := filepath.Join(dir, "out.y4m")
+	if err := DecodeImage(input, output, DecodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if fromFile, err := os.ReadFile(output); err != nil || !bytes.Equal(fromFile, y4m.Bytes()) {
+		t.Fatalf("out.y4m differs from the stream output (%v)", err)
+	}
+
+	rgb, err := encodeGap(colorWheel(w, h), nil, EncodeOptions{S: 0.1, Threshold: 0.5, Matrix: MatrixIdentity}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Decode(bytes.NewReader(rgb), io.Discard, DecodeOptions{Format: FormatY4M}); err == nil {
+		t.Fatalf("wrote y4m for RGB planes")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+)
+
+// byteStream yields the next n bytes of one logical stream. The returned
+// slice is only valid until the next call.
+type byteStream interface {
+    read(n int) ([]byte, error)
+}
+
+// sliceStream reads from an already-decompressed split stream
+type sliceStream struct {
+    buf []byte
+    pos int
+}
+
+func (s *sliceStream) read(n int) ([]byte, error) {
+    if s.pos+n > len(s.buf) {
+        return nil, io.ErrUnexpectedEOF
+    }
+    b := s.buf[s.pos : s.pos+n]
+    s.pos += n
+    return b, nil
+}
+
+// readerStream reads from a sequential reader (legacy interleaved layout)
+type readerStream struct {
+    r   io.Reader
+    buf []byte
+}
+
+func (s *readerStream) read(n int) ([]byte, error) {
+    if cap(s.buf) < n { s.buf = make([]byte, n) }
+    b := s.buf[:n]
+    _, err := io.ReadFull(s.r, b)
+    return b, err
+}
+
+// patchParser turns the per-patch fields (angle, count, maxVal, then
+// index + re/im per coefficient) into dequantized coefficients. Split
+// files give each field its own stream; the legacy interleaved layout is
+// the same field order read from a single stream.
+type patchParser struct {
+    angles, counts, maxVals, indices, values byteStream
+
+    quantized  bool
+    dcPred     bool
+    runIndex   bool
+    skipFlat   bool
+    angleDelta bool
+    sparse     bool      // Patches with count 0 carry no angle (FlagSparseAngles)
+    prevAngle  uint8     // Last angle byte in the current block row (the delta reference)
+    qMax       float32   // Largest quantized magnitude at the file's coefficient depth
+    wide       bool      // Coefficients stored as int16 rather than int8
+    halfMaxVal bool      // maxVal stored as float16 rather than float32
+    compand    bool      // AC codes are on the square-root curve
+    qtable     *QTable   // Per-bin quantization weights, nil for flat
+    dcRow      []float32 // Reconstructed DC per block column (current row up to bx, previous row after)
+}
+
+func newPatchParser(angles, counts, maxVals, indices, values byteStream, blocksW int, flags uint32, qtable *QTable) *patchParser {
+    p := &patchParser{
+        angles: angles, counts: counts, maxVals: maxVals, indices: indices, values: values,
+        qtable:     qtable,
+        quantized:  flags&FlagQuantized != 0,
+        dcPred:     flags&FlagDCPred != 0,
+        runIndex:   flags&FlagRunIndices != 0,
+        skipFlat:   flags&FlagSkipFlat != 0,
+        angleDelta: flags&FlagAngleDelta != 0,
+        sparse:     flags&FlagSparseAngles != 0,
+        qMax:       coeffQMax(coeffDepth(flags)),
+        wide:       coeffDepth(flags) > 8,
+        halfMaxVal: flags&FlagHalfMaxVal != 0,
+        compand:    flags&FlagCompand != 0,
+    }
+    if p.dcPred {
+        p.dcRow = make([]float32, blocksW)
+    }
+    return p
+}
+
+// newInterleavedParser reads every field from one sequential reader
+func newInterleavedParser(r io.Reader, blocksW int, flags uint32, qtable *QTable) *patchParser {
+    s := &readerStream{r: r}
+    return newPatchParser(s, s, s, s, s, blocksW, flags, qtable)
+}
+
+// flatPatchCount is the count value marking a flat (skipped) patch when
+// FlagSkipFlat is set; real counts never exceed 64.
+const flatPatchCount = 0xFF
+
+// parsePatch reads the patch at block (bx, by) into coeffs (128 floats,
+// zeroed by the caller) and returns its angle. Patches must be parsed in
+// raster order. fill is -1 for a coded patch, or the level (0..255) of a
+// flat patch that the caller should write directly; coeffs is then
+// untouched.
+func (p *patchParser) parsePatch(bx, by int, coeffs []float32) (angle float32, fill int, err error) {
+    // Angle deltas restart at each block row
+    if bx == 0 { p.prevAngle = 0 }
+
+    // Skip-flat and sparse-angle files put the count first so a flat or
+    // empty patch needs no angle
+    var count int
+    countFirst := p.skipFlat || p.sparse
+    if countFirst {
+        c, err := p.counts.read(1)
+        if err != nil { return 0, -1, err }
+        count = int(c[0])
+        if p.skipFlat && count == flatPatchCount {
+            v, err := p.values.read(1)
+            if err != nil { return 0, -1, err }
+            return 0, int(v[0]), nil
+        }
+    }
+
+    if count > 0 || !p.sparse {
+        a, err := p.angles.read(1)
+        if err != nil { return 0, -1, err }
+        angleByte := a[0]
+        if p.angleDelta {
+            angleByte += p.prevAngle // mod 256
+        }
+        p.prevAngle = angleByte
+        angle = dequantizeAngle(angleByte)
+    }
+
+    if !countFirst {
+        c, err := p.counts.read(1)
+        if err != nil { return 0, -1, err }
+        count = int(c[0])
+    }
+
+    if count > 64 {
+        return 0, -1, fmt.Errorf("coefficient count %d exceeds 64", count)
+    }
+
+    var maxVal float32 = 1.0
+    if p.quantized && p.halfMaxVal {
+        m, err := p.maxVals.read(2)
+        if err != nil { return 0, -1, err }
+        maxVal = halfToFloat32(binary.LittleEndian.Uint16(m))
+    } else if p.quantized {
+        m, err := p.maxVals.read(4)
+        if err != nil { return 0, -1, err }
+        maxVal = math.Float32frombits(binary.LittleEndian.Uint32(m))
+    }
+
+    scanPos := -1
+    for k := 0; k < count; k++ {
+        ib, err := p.indices.read(1)
+        if err != nil { return 0, -1, err }
+        idx := int(ib[0])
+        if p.runIndex {
+            // Index is the run of skipped positions in frequency scan order
+            scanPos += idx + 1
+            if scanPos >= 64 {
+                return 0, -1, fmt.Errorf("coefficient run reaches scan position %d", scanPos)
+            }
+            idx = int(coeffScanOrder[scanPos])
+        } else if idx >= 64 {
+            return 0, -1, fmt.Errorf("coefficient index %d out of range", idx)
+        }
+        var qRe, qIm int
+        if p.wide {
+            v, err := p.values.read(4)
+            if err != nil { return 0, -1, err }
+            qRe = int(int16(binary.LittleEndian.Uint16(v)))
+            qIm = int(int16(binary.LittleEndian.Uint16(v[2:])))
+        } else {
+            v, err := p.values.read(2)
+            if err != nil { return 0, -1, err }
+            qRe, qIm = int(int8(v[0])), int(int8(v[1]))
+        }
+
+        step := quantStep(maxVal, p.qtable, idx)
+        if p.compand && idx != 0 {
+            coeffs[2*idx] = dequantCompanded(qRe, p.qMax, step)
+            coeffs[2*idx+1] = dequantCompanded(qIm, p.qMax, step)
+        } else {
+            coeffs[2*idx] = dequantCoeff(qRe, p.qMax, step)
+            coeffs[2*idx+1] = dequantCoeff(qIm, p.qMax, step)
+        }
+    }
+
+    if p.dcPred {
+        dc := predictDC(p.dcRow, bx, by) + coeffs[0]
+        coeffs[0] = dc
+        p.dcRow[bx] = dc
+    }
+    return angle, -1, nil
+}
+
+// coeffScanOrder visits the 64 DFT bins from low to high frequency. For
+// the real-valued patch input bin k and bin 64-k share a frequency, so the
+// order is 0, 1, 63, 2, 62, ... 32 (the 1-D analogue of a JPEG zigzag).
+var coeffScanOrder = func() [64]uint8 {
+    var order [64]uint8
+    order[0] = 0
+    pos := 1
+    for f := 1; f <= 32; f++ {
+        order[pos] = uint8(f)
+        pos++
+        if f != 32 {
+            order[pos] = uint8(64 - f)
+            pos++
+        }
+    }
+    return order
+}()
+
+// dequantCoeff maps a quantized code back to a coefficient value. The
+// explicit conversion keeps the result rounded to float32 so the encoder's
+// DC predictor tracks the decoder exactly.
+func dequantCoeff(q int, qMax, maxVal float32) float32 {
+    return float32(float32(q) / qMax * maxVal)
+}
+
+// halfToFloat32 widens an IEEE 754 half-precision value
+func halfToFloat32(h uint16) float32 {
+    sign := uint32(h&0x8000) << 16
+    exp := uint32(h>>10) & 0x1F
+    mant := uint32(h & 0x3FF)
+    switch {
+    case exp == 0:
+        // Zero or subnormal: mant * 2^-24
+        v := float32(mant) / (1 << 24)
+        if sign != 0 { v = -v }
+        return v
+    case exp == 0x1F:
+        return math.Float32frombits(sign | 0x7F800000 | mant<<13) // Inf or NaN
+    }
+    return math.Float32frombits(sign | (exp-15+127)<<23 | mant<<13)
+}
+
+// halfFromFloat32Ceil converts a positive float32 to the nearest half
+// that is not smaller (+Inf above the half range).
+func halfFromFloat32Ceil(v float32) uint16 {
+    bits := math.Float32bits(v)
+    exp := int(bits>>23&0xFF) - 127 + 15
+    mant := bits & 0x7FFFFF
+
+    var h uint16
+    switch {
+    case exp >= 0x1F:
+        return 0x7C00
+    case exp <= 0:
+        // Subnormal half; anything below the smallest one truncates to 0
+        if exp >= -10 {
+            h = uint16((mant | 0x800000) >> uint(14-exp))
+        }
+    default:
+        h = uint16(exp)<<10 | uint16(mant>>13)
+    }
+    if halfToFloat32(h) < v {
+        h++ // Carries into the exponent correctly, up to +Inf
+    }
+    return h
+}
+
+// coeffDepth returns the coefficient bit depth recorded in the header
+// flags; files without the field use 8 bits.
+func coeffDepth(flags uint32) int {
+    d := int((flags & FlagDepthMask) >> flagDepthShift)
+    if d == 0 { return 8 }
+    return d
+}
+
+// coeffQMax is the largest quantized magnitude at a bit depth (127 at 8)
+func coeffQMax(depth int) float32 {
+    return float32(int(1)<<(depth-1) - 1)
+}
+
+// predictDC predicts a patch's DC from the reconstructed DC of its left
+// and top neighbors. row holds the current block row up to bx-1 and the
+// previous block row from bx onward.
+func predictDC(row []float32, bx, by int) float32 {
+    switch {
+    case bx > 0 && by > 0:
+        return float32((row[bx-1] + row[bx]) / 2)
+    case bx > 0:
+        return row[bx-1]
+    case by > 0:
+        return row[bx]
+    }
+    return 0
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "image"
+    "io"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// DecodedPlanes are a file's reconstructed planes before chroma
+// upsampling and color conversion
+type DecodedPlanes struct {
+    Planes     []*image.Gray // Y, Cb, Cr (R, G, B for MatrixIdentity), or luma alone; chroma at its coded size
+    Matrix     ColorMatrix
+    Subsampled bool       // Planes 1 and 2 are reduced as Chroma says (4:2:0 rounded as the file's FlagChromaCeil says)
+    Chroma     ChromaMode // Reduction of subsampled chroma
+}
+
+// DecodePlanes decodes a .gap stream as far as its planes: they are
+// reconstructed and deblocked each on its own grid, unless opts.SkipDeblock,
+// and returned without upsampling, color conversion, the RGB-domain
+// filters, grain, the lossless residual or the EXIF orientation. 16-bit
+// files come back at 8 bits. Crop and Scale are not supported.
+func DecodePlanes(r io.Reader, opts DecodeOptions) (*DecodedPlanes, error) {
+    stats := opts.Stats
+    if stats == nil { stats = &DecodeStats{} }
+    if opts.Crop != (image.Rectangle{}) || opts.Scale > 1 {
+        return nil, fmt.Errorf("plane output cannot be cropped or scaled")
+    }
+    br := bufio.NewReaderSize(r, 1024*1024)
+    start := time.Now()
+    header, err := readHeader(br)
+    if err != nil {
+        return nil, err
+    }
+    stats.add(&stats.HeaderRead, start)
+    if header.Flags&FlagFrames != 0 {
+        return nil, fmt.Errorf("file holds %d frames; use decode-seq", len(header.Frames))
+    }
+    logInfof("Image: %dx%d, %d ch, %s, planes only", header.Width, header.Height, len(header.Planes), matrixFromFlags(header.Flags))
+
+    opts.lossyOnly, opts.planesOnly = true, true
+    opts.interiorEdges = header.Flags&FlagLossless != 0
+    planes, _, _, err := decodePlanes(br, header, opts, stats)
+    if err != nil {
+        return nil, err
+    }
+    if !opts.SkipDeblock {
+        start := time.Now()
+        deblock := fileDeblock(header)
+        if opts.Deblock != nil { deblock = opts.Deblock }
+        if deblock == nil { deblock = &DeblockNormal }
+        parallelFor(len(planes), opts.Workers, func(i int) {
+            deblockGray(planes[i], *deblock, !opts.interiorEdges, 8, opts.Workers)
+        })
+        stats.add(&stats.Deblock, start)
+    }
+    return &DecodedPlanes{Planes: planes, Matrix: matrixFromFlags(header.Flags), Subsampled: header.Flags&FlagSubsampled != 0, Chroma: header.Chroma}, nil
+}
+
+// y4mChroma is the Y4M colorspace tag for the planes. 4:2:0 chroma
+// averages 2x2 luma pixels, so its samples sit between them as in JPEG.
+// Y4M has no tag for mono chroma.
+func (p *DecodedPlanes) y4mChroma() (string, error) {
+    switch {
+    case len(p.Planes) == 1:
+        return "mono", nil
+    case len(p.Planes) != 3:
+        return "", fmt.Errorf("y4m output needs 1 or 3 planes, the file has %d", len(p.Planes))
+    case p.Matrix == MatrixIdentity:
+        return "", fmt.Errorf("y4m output needs YCbCr planes; this file's planes are %s", p.Matrix)
+    case p.Subsampled && p.Chroma == Chroma411:
+        return "411", nil
+    case p.Subsampled && p.Chroma != Chroma420:
+        return "", fmt.Errorf("y4m has no tag for %s chroma; use -planes", p.Chroma)
+    case p.Subsampled:
+        return "420jpeg", nil
+    }
+    return "444", nil
+}
+
+// WriteY4M writes the planes as a single-frame YUV4MPEG2 stream, full
+// range. Chroma of files without FlagChromaCeil is a column or row short
+// of the rounded-up size Y4M expects, and is padded with its last one.
+func (p *DecodedPlanes) WriteY4M(w io.Writer) error {
+    tag, err := p.y4mChroma()
+    if err != nil {
+        return err
+    }
+    width, height := p.Planes[0].Rect.Dx(), p.Planes[0].Rect.Dy()
+    bw := bufio.NewWriterSize(w, 1024*1024)
+    fmt.Fprintf(bw, "YUV4MPEG2 W%d H%d F1:1 Ip A1:1 C%s XCOLORRANGE=FULL\nFRAME\n", width, height, tag)
+    for i, plane := range p.Planes {
+        if i > 0 && p.Subsampled && p.Chroma == Chroma420 {
+            plane = extendPlane(plane, (width+1)/2, (height+1)/2)
+        }
+        b := plane.Rect
+        for y := 0; y < b.Dy(); y++ {
+            if _, err := bw.Write(plane.Pix[y*plane.Stride:][:b.Dx()]); err != nil {
+                return fmt.Errorf("failed to write y4m: %v", err)
+            }
+        }
+    }
+    if err := bw.Flush(); err != nil {
+        return fmt.Errorf("failed to write y4m: %v", err)
+    }
+    return nil
+}
+
+// planeNames are the file names WritePGM gives the planes
+func (p *DecodedPlanes) planeNames() []string {
+    if len(p.Planes) == 1 { return []string{"y.pgm"} }
+    if p.Matrix == MatrixIdentity { return []string{"r.pgm", "g.pgm", "b.pgm", "a.pgm"}[:len(p.Planes)] }
+    return []string{"y.pgm", "cb.pgm", "cr.pgm", "a.pgm"}[:len(p.Planes)]
+}
+
+// WritePGM writes each plane at its coded size as a binary PGM in dir,
+// creating it if needed: y.pgm, cb.pgm and cr.pgm (r, g and b.pgm for
+// MatrixIdentity files). It returns the paths written.
+func (p *DecodedPlanes) WritePGM(dir string) ([]string, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create output directory: %v", err)
+    }
+    var paths []string
+    for i, name := range p.planeNames() {
+        path := filepath.Join(dir, name)
+        err := writeFileAtomic(path, func(w io.Writer) error {
+            bw := bufio.NewWriterSize(w, 1024*1024)
+            if err := encodeNetpbm(bw, p.Planes[i], true); err != nil {
+                return fmt.Errorf("failed to write %s: %v", name, err)
+            }
+            return bw.Flush()
+        })
+        if err != nil {
+            return paths, err
+        }
+        paths = append(paths, path)
+    }
+    return paths, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "runtime"
+    "runtime/pprof"
+    "strings"
+)
+
+// startProfile begins the profile named by a --profile value: "cpu" or
+// "mem", optionally followed by "=path" (default cpu.prof / mem.prof).
+// The returned function stops it and writes the file. A heap profile is
+// taken when it is called, i.e. at the end of the command.
+func startProfile(spec string) (func() error, error) {
+    kind, path, _ := strings.Cut(spec, "=")
+    if path == "" { path = kind + ".prof" }
+    switch kind {
+    case "cpu":
+        f, err := os.Create(path)
+        if err != nil {
+            return nil, fmt.Errorf("failed to create profile: %v", err)
+        }
+        if err := pprof.StartCPUProfile(f); err != nil {
+            f.Close()
+            return nil, fmt.Errorf("failed to start CPU profile: %v", err)
+        }
+        return func() error {
+            pprof.StopCPUProfile()
+            fmt.Fprintf(os.Stderr, "CPU profile written to %s\n", path)
+            return f.Close()
+        }, nil
+    case "mem":
+        return func() error {
+            f, err := os.Create(path)
+            if err != nil {
+                return fmt.Errorf("failed to create profile: %v", err)
+            }
+            runtime.GC() // Up-to-date allocation statistics
+            if err := pprof.WriteHeapProfile(f); err != nil {
+                f.Close()
+                return fmt.Errorf("failed to write heap profile: %v", err)
+            }
+            fmt.Fprintf(os.Stderr, "Heap profile written to %s\n", path)
+            return f.Close()
+        }, nil
+    }
+    return nil, fmt.Errorf("unknown profile %q (want cpu or mem, optionally =path)", kind)
+}
+
+// parseProfileArg takes a leading --profile flag ("--profile cpu" or
+// "--profile=cpu", one or two dashes) off args, returning its value and
+// the remaining arguments
+func parseProfileArg(args []string) (string, []string, error) {
+    if len(args) == 0 { return "", args, nil }
+    name, value, hasValue := strings.Cut(strings.TrimLeft(args[0], "-"), "=")
+    if !strings.HasPrefix(args[0], "-") || name != "profile" {
+        return "", args, nil
+    }
+    if hasValue { return value, args[1:], nil }
+    if len(args) < 2 {
+        return "", nil, fmt.Errorf("--profile needs a value: cpu or mem, optionally =path")
+    }
+    return args[1], args[2:], nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "math"
+    "os"
+)
+
+// ChunkQTable holds one 64-entry float32 weight table per plane when
+// FlagQTable is set.
+var ChunkQTable = [4]byte{'Q', 'T', 'A', 'B'}
+
+// QTable scales the quantization step per DFT bin: coefficient k is coded
+// as round(coef / (maxVal * weight[k]) * qMax), qMax being 127 at the
+// default 8-bit depth. Weights >= 1 coarsen a bin.
+type QTable [64]float32
+
+// binFrequency folds DFT bin k onto its frequency 0..32 (bins k and 64-k
+// describe the same frequency for real input).
+func binFrequency(k int) int {
+    if k > 32 { return 64 - k }
+    return k
+}
+
+// FlatQTable quantizes every bin against maxVal alone
+func FlatQTable() QTable {
+    var t QTable
+    for k := range t { t[k] = 1 }
+    return t
+}
+
+// PerceptualQTable coarsens high frequencies, roughly following the shape
+// of the JPEG luma table (about 6x between DC and the highest frequency).
+func PerceptualQTable() QTable {
+    var t QTable
+    for k := range t {
+        f := float64(binFrequency(k)) / 32
+        t[k] = float32(1 + 5*math.Pow(f, 1.5))
+    }
+    return t
+}
+
+// LoadQTables resolves the -qtable flag: "flat", "perceptual", or a JSON
+// file holding either a 64-number array (all planes) or an object with
+// "luma" and "chroma" arrays. Returns one table per plane.
+func LoadQTables(spec string) ([]QTable, error) {
+    switch spec {
+    case "flat":
+        t := FlatQTable()
+        return []QTable{t, t, t}, nil
+    case "perceptual":
+        t := PerceptualQTable()
+        return []QTable{t, t, t}, nil
+    }
+
+    data, err := os.ReadFile(spec)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read qtable: %v", err)
+    }
+
+    var single []float32
+    if err := json.Unmarshal(data, &single); err == nil {
+        t, err := qtableFromSlice(single)
+        if err != nil { return nil, err }
+        return []QTable{t, t, t}, nil
+    }
+
+    var split struct {
+        Luma   []float32 `json:"luma"`
+        Chroma []float32 `json:"chroma"`
+    }
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&split); err != nil {
+        return nil, fmt.Errorf("invalid qtable %s: want a 64-entry array or {\"luma\": [...], \"chroma\": [...]}", spec)
+    }
+    luma, err := qtableFromSlice(split.Luma)
+    if err != nil { return nil, fmt.Errorf("luma: %v", err) }
+    chroma, err := qtableFromSlice(split.Chroma)
+    if err != nil { return nil, fmt.Errorf("chroma: %v", err) }
+    return []QTable{luma, chroma, chroma}, nil
+}
+
+func qtableFromSlice(v []float32) (QTable, error) {
+    var t QTable
+    if len(v) != 64 {
+        return t, fmt.Errorf("qtable needs 64 entries, got %d", len(v))
+    }
+    for k, w := range v {
+        if !(w > 0) || math.IsInf(float64(w), 0) {
+            return t, fmt.Errorf("qtable entry %d must be positive, got %g", k, w)
+        }
+        t[k] = w
+    }
+    return t, nil
+}
+
+// encodeQTables serializes the per-plane tables for ChunkQTable
+func encodeQTables(tables []QTable) []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.LittleEndian, tables)
+    return buf.Bytes()
+}
+
+// decodeQTables parses ChunkQTable for the given number of planes
+func decodeQTables(data []byte, planes int) ([]QTable, error) {
+    if len(data) != planes*64*4 {
+        return nil, fmt.Errorf("qtable chunk is %d bytes, want %d", len(data), planes*64*4)
+    }
+    tables := make([]QTable, planes)
+    if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, tables); err != nil {
+        return nil, err
+    }
+    for i := range tables {
+        if _, err := qtableFromSlice(tables[i][:]); err != nil {
+            return nil, fmt.Errorf("plane %d: %v", i, err)
+        }
+    }
+    return tables, nil
+}
+
+// quantStep is the dequantization scale for bin k. A nil table means
+// plain maxVal quantization.
+func quantStep(maxVal float32, table *QTable, k int) float32 {
+    if table == nil { return maxVal }
+    return float32(maxVal * table[k])
+}
+
+// quantizeCompanded quantizes v on a square-root curve: the code is
+// qMax*sqrt(|v|/step), rounded. Small coefficients get fine steps (the
+// smallest code is step/qMax^2 rather than step/qMax) at the cost of
+// coarser steps near maxVal, where the relative error is small anyway.
+// DC stays linear so DC prediction and flat levels are unchanged.
+func quantizeCompanded(v, step, qMax float32) int {
+    q := math.Round(math.Sqrt(math.Abs(float64(v/step))) * float64(qMax))
+    if q > float64(qMax) { q = float64(qMax) }
+    if v < 0 { q = -q }
+    return int(q)
+}
+
+// dequantCompanded is the inverse of quantizeCompanded
+func dequantCompanded(q int, qMax, step float32) float32 {
+    r := float32(q) / qMax
+    if q < 0 { return -r * r * step }
+    return r * r * step
+}
+
+// quantizeWeighted rounds v/step*qMax into the +-qMax range
+func quantizeWeighted(v, step, qMax float32) int {
+    q := math.Round(float64(v / step * qMax))
+    if q > float64(qMax) { q = float64(qMax) }
+    if q < -float64(qMax) { q = -float64(qMax) }
+    return int(q)
+}
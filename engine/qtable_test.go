@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// TestQTable codes textured images with the flat and the perceptual
+// table. Coarsening the high frequencies must buy more PSNR per byte
+// than it costs, and the tables must come back from the file.
+func TestQTable(t *testing.T) {
+	flat, err := LoadQTables("flat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	perceptual, err := LoadQTables("perceptual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		src  *image.RGBA
+	}{
+		{"texture", benchRGBA(256, 192)},
+		{"wheel", colorWheel(192, 128)},
+	} {
+		src := tc.src
+		var perByte [2]float64
+		for i, tables := range [][]QTable{flat, perceptual} {
+			data, img := roundTrip(t, src, EncodeOptions{S: 0.1, Threshold: 0.5, QTables: tables})
+			header, err := readHeader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeQTables(findChunk(header.Chunks, ChunkQTable), len(header.Planes))
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if got[0] != tables[0] {
+				t.Fatalf("%s: file holds table %v, want %v", tc.name, got[0], tables[0])
+			}
+			perByte[i] = PSNR(img, src) / float64(len(data))
+		}
+		if perByte[1] <= perByte[0] {
+			t.Fatalf("%s: perceptual table gives %.4f dB/KB, flat %.4f", tc.name, perByte[1]*1000, perByte[0]*1000)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "io"
+
+    "gap-engine/metrics"
+)
+
+// Quality is the result of decoding an encoded image and comparing it
+// with the source.
+type Quality struct {
+    PSNR    [3]float64 `json:"psnr_rgb"` // Per channel, dB
+    Overall float64    `json:"psnr"`     // Over all three channels, dB
+    Ratio   float64    `json:"ratio"`    // 24-bit RGB size / encoded size
+    SSIM    float64    `json:"ssim,omitempty"`    // Luma, see metrics.SSIM (0 for images under 11x11)
+    MSSSIM  float64    `json:"ms_ssim,omitempty"` // Luma, see metrics.MSSSIM
+}
+
+// WriteTable prints the PSNR figures and compression ratio, and SSIM
+// when it was measured
+func (q *Quality) WriteTable(w io.Writer) {
+    fmt.Fprintf(w, "PSNR: %.2f dB (R %.2f, G %.2f, B %.2f), ratio %.1f:1\n", q.Overall, q.PSNR[0], q.PSNR[1], q.PSNR[2], q.Ratio)
+    if q.SSIM != 0 {
+        fmt.Fprintf(w, "SSIM: %.4f, MS-SSIM %.4f\n", q.SSIM, q.MSSSIM)
+    }
+}
+
+// PSNR returns the peak signal-to-noise ratio in dB over the RGB channels
+// of a and b (see metrics.PSNR). Images are compared relative to their
+// own Min corners, so bounds need not share an origin; images of
+// different size return 0. Identical images return +Inf.
+func PSNR(a, b image.Image) float64 {
+    return metrics.PSNR(a, b)
+}
+
+// psnrChannels returns PSNR per RGB channel and over all of them
+func psnrChannels(a, b image.Image) ([3]float64, float64) {
+    r, err := metrics.Compare(a, b)
+    if err != nil {
+        return [3]float64{}, 0
+    }
+    return r.PSNR, r.Overall
+}
+
+// structural returns the luma SSIM and MS-SSIM of a and b, or zeros for
+// images too small for the SSIM window
+func structural(a, b image.Image) (float64, float64) {
+    ssim, err := metrics.SSIM(a, b)
+    if err != nil {
+        return 0, 0
+    }
+    msssim, _ := metrics.MSSSIM(a, b)
+    return ssim, msssim
+}
+
+// ssimPlane returns the mean SSIM of two equally sized gray planes over
+// non-overlapping 8x8 windows (the patch size), with the usual constants
+// for 8-bit data.
+func ssimPlane(a, b *image.Gray) float64 {
+    const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+    ab, bb := a.Bounds(), b.Bounds()
+    var sum float64
+    windows := 0
+    for y := 0; y+8 <= ab.Dy(); y += 8 {
+        for x := 0; x+8 <= ab.Dx(); x += 8 {
+            var sa, sb, saa, sbb, sab float64
+            for j := 0; j < 8; j++ {
+                for i := 0; i < 8; i++ {
+                    va := float64(a.Pix[a.PixOffset(ab.Min.X+x+i, ab.Min.Y+y+j)])
+                    vb := float64(b.Pix[b.PixOffset(bb.Min.X+x+i, bb.Min.Y+y+j)])
+                    sa, sb = sa+va, sb+vb
+                    saa, sbb, sab = saa+va*va, sbb+vb*vb, sab+va*vb
+                }
+            }
+            ma, mb := sa/64, sb/64
+            va, vb, cov := saa/64-ma*ma, sbb/64-mb*mb, sab/64-ma*mb
+            sum += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+            windows++
+        }
+    }
+    if windows == 0 { return 1 }
+    return sum / float64(windows)
+}
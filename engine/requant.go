@@ -0,0 +1,220 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+)
+
+// RequantizeOptions selects how Requantize shrinks a file
+type RequantizeOptions struct {
+    CoeffBits int     // New coefficient depth, 2 up to the file's (0 = keep)
+    Threshold float32 // Drop luma coefficients with a smaller magnitude (0 = keep all)
+    ChromaT   float32 // Chroma threshold (0 = Threshold scaled like the file's chroma)
+}
+
+// RequantizeReport describes one requantization
+type RequantizeReport struct {
+    OldBytes  int
+    NewBytes  int
+    OldCoeffs int // Coded coefficients before
+    NewCoeffs int // and after
+}
+
+// Requantize rewrites a .gap file at a lower coefficient depth and/or a
+// higher threshold entirely in the coefficient domain: each patch's
+// stored coefficients are dequantized, thresholded and quantized again,
+// without the transform or any pixel reconstruction. Angles, flat
+// patches, CfL alphas and metadata carry over unchanged; a lossless
+// residual no longer matches and is dropped.
+func Requantize(data []byte, opts RequantizeOptions) ([]byte, *RequantizeReport, error) {
+    r := bytes.NewReader(data)
+    header, err := readHeader(r)
+    if err != nil {
+        return nil, nil, err
+    }
+    flags := header.Flags
+    switch {
+    case flags&FlagFrames != 0:
+        return nil, nil, fmt.Errorf("cannot requantize a sequence")
+    case flags&FlagEncrypted != 0:
+        return nil, nil, fmt.Errorf("cannot requantize an encrypted file")
+    case flags&FlagRangeCoded == 0:
+        return nil, nil, fmt.Errorf("requantize needs split streams, not %s; transcode the file first", compressionFromFlags(flags))
+    case flags&FlagQuantized == 0:
+        return nil, nil, fmt.Errorf("cannot requantize unquantized coefficients")
+    }
+    depth := coeffDepth(flags)
+    newDepth := depth
+    if opts.CoeffBits != 0 {
+        if opts.CoeffBits < 2 || opts.CoeffBits > depth {
+            return nil, nil, fmt.Errorf("coefficient depth must be 2..%d (the file's), got %d", depth, opts.CoeffBits)
+        }
+        newDepth = opts.CoeffBits
+    }
+    if opts.Threshold < 0 || opts.ChromaT < 0 {
+        return nil, nil, fmt.Errorf("thresholds must not be negative")
+    }
+    if flags&FlagLossless != 0 {
+        logWarnf("dropping the lossless residual")
+    }
+
+    var qtables []QTable
+    if flags&FlagQTable != 0 {
+        if qtables, err = decodeQTables(findChunk(header.Chunks, ChunkQTable), len(header.Planes)); err != nil {
+            return nil, nil, fmt.Errorf("invalid quantization table: %v", err)
+        }
+    }
+
+    var payload io.Reader = r
+    if flags&FlagChecksum != 0 {
+        if payload, err = readPayload(r, header, true); err != nil {
+            return nil, nil, err
+        }
+    }
+    readBlock := func(name string, maxLen int) ([]byte, error) {
+        block, err := readStreamBlock(payload, flags, maxLen)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read %s: %v", name, err)
+        }
+        data := block.unpack()
+        if !block.verify(data) {
+            return nil, fmt.Errorf("%s is corrupt", name)
+        }
+        return data, nil
+    }
+    streams := make([][5][]byte, len(header.Planes))
+    for i := range streams {
+        for s, name := range splitStreamNames {
+            if streams[i][s], err = readBlock(fmt.Sprintf("plane %d %s", i, name), planePatches(header, i)*splitStreamMax[s]); err != nil {
+                return nil, nil, err
+            }
+        }
+    }
+    var alphas [][]byte
+    if flags&FlagCfL != 0 {
+        for i := 1; i < len(header.Planes); i++ {
+            a, err := readBlock(fmt.Sprintf("plane %d alphas", i), planePatches(header, i))
+            if err != nil {
+                return nil, nil, err
+            }
+            alphas = append(alphas, a)
+        }
+    }
+
+    newFlags := flags&^(FlagDepthMask|FlagLossless|FlagStoredBlocks) | FlagChecksum
+    if newDepth != 8 {
+        newFlags |= uint32(newDepth) << flagDepthShift
+    }
+    newHeader := header.GapHeader
+    newHeader.Magic[3] = FormatVersion // v1 files gain the plane table
+    newHeader.Flags = newFlags
+    planes := append([]PlaneParams(nil), header.Planes...)
+    chromaT := opts.ChromaT
+    if chromaT == 0 && planes[0].Threshold > 0 {
+        chromaT = opts.Threshold * planes[min(1, len(planes)-1)].Threshold / planes[0].Threshold
+    }
+
+    report := &RequantizeReport{OldBytes: len(data)}
+    results := make([][5][]byte, len(planes))
+    for i := range planes {
+        pWidth, pHeight := header.planeSize(i)
+        t := opts.Threshold
+        if i > 0 { t = chromaT }
+        planes[i].Threshold = max(planes[i].Threshold, t)
+        for _, c := range streams[i][1] {
+            if c != flatPatchCount { report.OldCoeffs += int(c) }
+        }
+        var kept keptStats
+        results[i], err = requantizePlane(streams[i], pWidth, pHeight, flags, newFlags, t, planeQTable(qtables, i), &kept)
+        if err != nil {
+            return nil, nil, fmt.Errorf("failed to requantize plane %d: %v", i, err)
+        }
+        report.NewCoeffs += kept.Kept
+    }
+    newHeader.Threshold = planes[0].Threshold
+
+    var out bytes.Buffer
+    binary.Write(&out, binary.LittleEndian, &newHeader)
+    binary.Write(&out, binary.LittleEndian, planes)
+    if newFlags&FlagChunks != 0 {
+        if err := writeChunks(&out, header.Chunks); err != nil {
+            return nil, nil, fmt.Errorf("failed to write metadata: %v", err)
+        }
+    }
+    payloadStart := out.Len()
+    withCRC := newFlags&FlagStreamCRC != 0
+    writeBlock := func(data []byte) error {
+        if newFlags&FlagRawStreams != 0 {
+            return writeStoredBlock(&out, data, withCRC)
+        }
+        stored, err := writeStreamBlock(&out, data, withCRC)
+        if stored && newHeader.Flags&FlagStoredBlocks == 0 {
+            newHeader.Flags |= FlagStoredBlocks
+            binary.LittleEndian.PutUint32(out.Bytes()[headerFlagsOffset:], newHeader.Flags)
+        }
+        return err
+    }
+    for i := range results {
+        for s, stream := range results[i] {
+            if err := writeBlock(stream); err != nil {
+                return nil, nil, fmt.Errorf("failed to write %s for plane %d: %v", splitStreamNames[s], i, err)
+            }
+        }
+    }
+    for _, a := range alphas {
+        if err := writeBlock(a); err != nil {
+            return nil, nil, fmt.Errorf("failed to write CfL alphas: %v", err)
+        }
+    }
+
+    file := appendChecksum(out.Bytes(), payloadStart)
+    report.NewBytes = len(file)
+    return file, report, nil
+}
+
+// requantizePlane parses a plane's streams under flags and codes the same
+// patches again under newFlags, zeroing coefficients whose magnitude is
+// below threshold. Codes are rounded, so an unchanged depth and threshold
+// reproduce the coefficients.
+func requantizePlane(streams [5][]byte, width, height int, flags, newFlags uint32, threshold float32, qtable *QTable, kept *keptStats) ([5][]byte, error) {
+    blocksW, blocksH := (width+7)/8, (height+7)/8
+    in := [5]*sliceStream{}
+    for s := range in {
+        in[s] = &sliceStream{buf: streams[s]}
+    }
+    parser := newPatchParser(in[0], in[1], in[2], in[3], in[4], blocksW, flags, qtable)
+    enc := newPlaneEncoder(width, height, planeOptions{Flags: newFlags, QTable: qtable, RoundCodes: true}, kept)
+    coeffs := make([]float32, 128)
+    t2 := threshold * threshold
+    for by := 0; by < blocksH; by++ {
+        for bx := 0; bx < blocksW; bx++ {
+            clear(coeffs)
+            _, fill, err := parser.parsePatch(bx, by, coeffs)
+            if err != nil {
+                return [5][]byte{}, fmt.Errorf("failed to read patch at (%d, %d): %v", bx*8, by*8, err)
+            }
+            if fill >= 0 {
+                enc.codeFlat(bx, uint8(fill))
+                continue
+            }
+            // The angle byte carries over exactly rather than via the float angle
+            for k := 0; k < 64; k++ {
+                re, im := coeffs[2*k], coeffs[2*k+1]
+                if re*re+im*im < t2 {
+                    coeffs[2*k], coeffs[2*k+1] = 0, 0
+                }
+            }
+            if err := enc.codePatch(bx, by, parser.prevAngle, coeffs); err != nil {
+                return [5][]byte{}, err
+            }
+        }
+    }
+    for s, st := range in {
+        if st.pos != len(st.buf) {
+            return [5][]byte{}, fmt.Errorf("%d unread bytes in the %s stream", len(st.buf)-st.pos, splitStreamNames[s])
+        }
+    }
+    return [5][]byte{enc.angles, enc.counts, enc.maxVals, enc.indices, enc.values}, nil
+}
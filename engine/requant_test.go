@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// TestRequantize re-codes files with a range of features at coarser
+// coefficients and expects them to stay decodable and close to their
+// source, and legacy gzip files to be refused
+func TestRequantize(t *testing.T) {
+	src := benchRGBA(64, 48)
+	perceptual, _ := LoadQTables("perceptual")
+	configs := []EncodeOptions{
+		{S: 0.1, Threshold: 0.2},
+		{S: 0.1, Threshold: 0.2, DCPred: true, RunIndices: true, AngleDelta: true, SkipFlat: true},
+		{S: 0.1, Threshold: 0.2, HalfMaxVal: true, CoeffBits: 12, StreamChecksums: true},
+		{S: 0.1, Threshold: 0.2, QTables: perceptual, Compand: true},
+		{S: 0.1, Threshold: 0.2, CfL: true, Lossless: true},
+	}
+	for i, opts := range configs {
+		data, err := encodeGap(src, nil, opts, nil)
+		if err != nil {
+			t.Fatalf("set %d: %v", i, err)
+		}
+		want, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{lossyOnly: true})
+		if err != nil {
+			t.Fatalf("set %d: %v", i, err)
+		}
+		decode := func(ro RequantizeOptions) (*image.RGBA, *gapFileHeader, *RequantizeReport, error) {
+			out, rep, err := Requantize(data, ro)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			img, header, err := decodeGap(bytes.NewReader(out), DecodeOptions{})
+			return img, header, rep, err
+		}
+
+		// Unchanged settings give back the coefficients (float16 maxVals
+		// may round differently)
+		got, header, rep, err := decode(RequantizeOptions{})
+		if err != nil {
+			t.Fatalf("set %d: unchanged settings: %v", i, err)
+		}
+		if psnr := PSNR(want, got); psnr < 60 || rep.NewCoeffs != rep.OldCoeffs {
+			t.Fatalf("set %d: unchanged settings: %.2f dB, %d -> %d coefficients", i, psnr, rep.OldCoeffs, rep.NewCoeffs)
+		}
+		if header.Flags&FlagLossless != 0 {
+			t.Fatalf("set %d: kept the lossless residual", i)
+		}
+
+		got, header, _, err = decode(RequantizeOptions{CoeffBits: 4})
+		if err != nil {
+			t.Fatalf("set %d: 4 bits: %v", i, err)
+		}
+		if psnr := PSNR(want, got); coeffDepth(header.Flags) != 4 || psnr < 30 {
+			t.Fatalf("set %d: 4 bits: depth %d, %.2f dB", i, coeffDepth(header.Flags), psnr)
+		}
+
+		_, _, rep, err = decode(RequantizeOptions{Threshold: 3 * opts.Threshold})
+		if err != nil {
+			t.Fatalf("set %d: threshold: %v", i, err)
+		}
+		if rep.NewCoeffs >= rep.OldCoeffs || rep.NewBytes >= rep.OldBytes {
+			t.Fatalf("set %d: 3x threshold kept %d of %d coefficients, %d -> %d bytes", i, rep.NewCoeffs, rep.OldCoeffs, rep.OldBytes, rep.NewBytes)
+		}
+		if _, _, err := Requantize(data, RequantizeOptions{CoeffBits: max(opts.CoeffBits, 8) + 1}); err == nil {
+			t.Fatalf("set %d: raising the depth succeeded", i)
+		}
+	}
+
+	legacy, err := legacyGzipGap(src, 0.1, 0.5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Requantize(legacy, RequantizeOptions{CoeffBits: 6}); err == nil {
+		t.Fatalf("legacy gzip file accepted")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "image/color/palette"
+    "image/draw"
+    "image/gif"
+    "io"
+    "os"
+    "strings"
+)
+
+// A sequence file is a container: a header with FlagFrames (dimensions,
+// matrix and plane parameters copied from the first frame), the frame
+// index (u32 count, then one u64 absolute offset per frame), and then the
+// frames themselves, each a complete single-image .gap stream. Frames are
+// coded independently, so any frame can be decoded by seeking to it.
+
+// maxFrames bounds the frame index read from untrusted input
+const maxFrames = 1 << 16
+
+// readFrameIndex reads the frame count and offsets that follow the header
+func readFrameIndex(r io.Reader) ([]uint64, error) {
+    var count uint32
+    if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+        return nil, fmt.Errorf("failed to read frame count: %v", err)
+    }
+    if count == 0 || count > maxFrames {
+        return nil, fmt.Errorf("invalid frame count %d", count)
+    }
+    offsets := make([]uint64, count)
+    if err := binary.Read(r, binary.LittleEndian, offsets); err != nil {
+        return nil, fmt.Errorf("failed to read frame index: %v", err)
+    }
+    for i := 1; i < len(offsets); i++ {
+        if offsets[i] <= offsets[i-1] {
+            return nil, fmt.Errorf("frame index is not increasing at frame %d", i)
+        }
+    }
+    return offsets, nil
+}
+
+// writeSequence writes the container header, frame index and frames.
+func writeSequence(w io.Writer, frames [][]byte) error {
+    first, err := readHeader(bytes.NewReader(frames[0]))
+    if err != nil {
+        return fmt.Errorf("failed to read frame 0 header: %v", err)
+    }
+
+    header := first.GapHeader
+    header.Flags = FlagFrames | first.Flags&FlagMatrixMask
+
+    // Header, plane table, u32 count, u64 per frame
+    headerSize := binary.Size(header) + binary.Size(first.Planes) + 4 + 8*len(frames)
+    offsets := make([]uint64, len(frames))
+    pos := uint64(headerSize)
+    for i, f := range frames {
+        offsets[i] = pos
+        pos += uint64(len(f))
+    }
+
+    if err := binary.Write(w, binary.LittleEndian, &header); err != nil { return err }
+    if err := binary.Write(w, binary.LittleEndian, first.Planes); err != nil { return err }
+    if err := binary.Write(w, binary.LittleEndian, uint32(len(frames))); err != nil { return err }
+    if err := binary.Write(w, binary.LittleEndian, offsets); err != nil { return err }
+    for _, f := range frames {
+        if _, err := w.Write(f); err != nil { return err }
+    }
+    return nil
+}
+
+// expandFramePattern lists the files matched by a printf-style pattern
+// such as "frame%03d.png", counting up from 0 (or 1) until a number is
+// missing.
+func expandFramePattern(pattern string) ([]string, error) {
+    if !strings.Contains(pattern, "%") {
+        return nil, fmt.Errorf("frame pattern %q needs a %%d verb", pattern)
+    }
+    start := 0
+    if _, err := os.Stat(fmt.Sprintf(pattern, 0)); err != nil {
+        start = 1
+    }
+    var paths []string
+    for n := start; ; n++ {
+        path := fmt.Sprintf(pattern, n)
+        if _, err := os.Stat(path); err != nil { break }
+        paths = append(paths, path)
+    }
+    if len(paths) == 0 {
+        return nil, fmt.Errorf("no frames match %q", pattern)
+    }
+    if len(paths) > maxFrames {
+        return nil, fmt.Errorf("too many frames: %d (max %d)", len(paths), maxFrames)
+    }
+    return paths, nil
+}
+
+// EncodeSequence encodes every frame matched by pattern into one
+// sequence file. All frames must share the same dimensions.
+func EncodeSequence(pattern, outputPath string, opts EncodeOptions) error {
+    paths, err := expandFramePattern(pattern)
+    if err != nil {
+        return err
+    }
+    logInfof("Encoding %d frames -> %s (%s)", len(paths), outputPath, opts.Matrix)
+
+    frames := make([][]byte, len(paths))
+    var size image.Point
+    for i, path := range paths {
+        srcData, err := os.ReadFile(path)
+        if err != nil {
+            return fmt.Errorf("failed to open frame %d: %v", i, err)
+        }
+        srcImg, err := decodeSource(srcData)
+        if err != nil {
+            return fmt.Errorf("failed to decode frame %d (%s): %v", i, path, err)
+        }
+        if i == 0 {
+            size = srcImg.Bounds().Size()
+        } else if srcImg.Bounds().Size() != size {
+            return fmt.Errorf("frame %d (%s) is %v, want %v", i, path, srcImg.Bounds().Size(), size)
+        }
+
+        logInfof("Frame %d: %s", i, path)
+        frames[i], err = encodeGap(srcImg, sourceMetadata(srcData), opts, nil)
+        if err != nil {
+            return fmt.Errorf("failed to encode frame %d: %v", i, err)
+        }
+    }
+
+    var out bytes.Buffer
+    if err := writeSequence(&out, frames); err != nil {
+        return fmt.Errorf("failed to write sequence: %v", err)
+    }
+    return writeBytesAtomic(outputPath, out.Bytes())
+}
+
+// decodeFrame decodes frame i of an open sequence file
+func decodeFrame(file *os.File, header *gapFileHeader, i int, opts DecodeOptions) (*image.RGBA, *gapFileHeader, error) {
+    if i < 0 || i >= len(header.Frames) {
+        return nil, nil, fmt.Errorf("frame %d out of range (file has %d)", i, len(header.Frames))
+    }
+    stat, err := file.Stat()
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to stat input: %v", err)
+    }
+    end := uint64(stat.Size())
+    if i+1 < len(header.Frames) {
+        end = header.Frames[i+1]
+    }
+    start := header.Frames[i]
+    if start >= end || end > uint64(stat.Size()) {
+        return nil, nil, fmt.Errorf("frame %d lies outside the file", i)
+    }
+
+    section := io.NewSectionReader(file, int64(start), int64(end-start))
+    img, frameHeader, err := decodeGap(bufio.NewReaderSize(section, 1024*1024), opts)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to decode frame %d: %v", i, err)
+    }
+    return img, frameHeader, nil
+}
+
+// DecodeSequence decodes a sequence file. An output ending in .gif is
+// written as one animated GIF with the given per-frame delay (1/100 s);
+// otherwise output is a printf-style pattern and each frame becomes a
+// numbered PNG. frame >= 0 decodes only that frame.
+func DecodeSequence(inputPath, output string, opts DecodeOptions, frame, gifDelay int) error {
+    file, err := os.Open(inputPath)
+    if err != nil {
+        return fmt.Errorf("failed to open input: %v", err)
+    }
+    defer file.Close()
+
+    header, err := readHeader(bufio.NewReader(file))
+    if err != nil {
+        return err
+    }
+    if header.Flags&FlagFrames == 0 {
+        return fmt.Errorf("%s is a single image; use decode", inputPath)
+    }
+
+    first, last := 0, len(header.Frames)-1
+    if frame >= 0 {
+        first, last = frame, frame
+    }
+    logInfof("Decoding %s (%d frames) -> %s", inputPath, len(header.Frames), output)
+
+    if strings.HasSuffix(strings.ToLower(output), ".gif") {
+        anim := &gif.GIF{}
+        for i := first; i <= last; i++ {
+            img, _, err := decodeFrame(file, header, i, opts)
+            if err != nil {
+                return err
+            }
+            paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+            draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, image.Point{})
+            anim.Image = append(anim.Image, paletted)
+            anim.Delay = append(anim.Delay, gifDelay)
+        }
+        err := writeFileAtomic(output, func(w io.Writer) error {
+            if err := gif.EncodeAll(w, anim); err != nil {
+                return fmt.Errorf("failed to encode gif: %v", err)
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+    } else {
+        if !strings.Contains(output, "%") {
+            return fmt.Errorf("output pattern %q needs a %%d verb (or a .gif extension)", output)
+        }
+        for i := first; i <= last; i++ {
+            img, frameHeader, err := decodeFrame(file, header, i, opts)
+            if err != nil {
+                return err
+            }
+            upright, chunks := orientUpright(img, frameHeader.Chunks, opts)
+            if err := writeDecoded(fmt.Sprintf(output, i), upright, chunks, opts); err != nil {
+                return fmt.Errorf("frame %d: %v", i, err)
+            }
+        }
+    }
+
+    logInfof("Success.")
+    return nil
+}
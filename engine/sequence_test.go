@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sequenceFrame draws frame k of a test sequence: a gradient with a
+// square that moves with k, so every frame differs
+func sequenceFrame(w, h, k int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{uint8(3*x + 20*k), uint8(4 * y), uint8(128 + x - y), 255}
+			if x >= 8*k && x < 8*k+16 && y >= 8 && y < 24 {
+				c = color.RGBA{240, 40, 40, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// TestSequence encodes a multi-frame sequence and decodes it frame by
+// frame: every frame must come back closest to its own source, and
+// decoding frame k alone must give the same file as the full decode
+func TestSequence(t *testing.T) {
+	const w, h, n = 64, 32, 4
+	dir := t.TempDir()
+	var sources []*image.RGBA
+	for k := 0; k < n; k++ {
+		src := sequenceFrame(w, h, k)
+		sources = append(sources, src)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, src); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("in%d.png", k)), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := filepath.Join(dir, "seq.gap")
+	if err := EncodeSequence(filepath.Join(dir, "in%d.png"), seq, EncodeOptions{S: 0.1, Threshold: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeSequence(seq, filepath.Join(dir, "all%d.png"), DecodeOptions{}, -1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	readPNG := func(name string) ([]byte, image.Image) {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data, img
+	}
+	for k := 0; k < n; k++ {
+		_, img := readPNG(fmt.Sprintf("all%d.png", k))
+		if img.Bounds().Size() != (image.Point{w, h}) {
+			t.Fatalf("frame %d decoded at %v", k, img.Bounds().Size())
+		}
+		own := PSNR(img, sources[k])
+		for j, src := range sources {
+			if j != k && PSNR(img, src) >= own {
+				t.Fatalf("frame %d is as close to source %d as to its own (%.2f dB)", k, j, own)
+			}
+		}
+
+		// Random access, in reverse so no frame follows the one before it
+		i := n - 1 - k
+		if err := DecodeSequence(seq, filepath.Join(dir, "one%d.png"), DecodeOptions{}, i, 0); err != nil {
+			t.Fatal(err)
+		}
+		one, _ := readPNG(fmt.Sprintf("one%d.png", i))
+		if want, _ := readPNG(fmt.Sprintf("all%d.png", i)); !bytes.Equal(one, want) {
+			t.Fatalf("frame %d decoded alone differs from the sequential decode", i)
+		}
+	}
+	if err := DecodeSequence(seq, filepath.Join(dir, "out%d.png"), DecodeOptions{}, n, 0); err == nil {
+		t.Fatalf("frame %d of %d decoded", n, n)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "math"
+    "time"
+)
+
+// Stats describes where an encode spent its bytes and time. JSON field
+// names are part of the -stats -json output.
+type Stats struct {
+    Width        int          `json:"width"`
+    Height       int          `json:"height"`
+    Planes       []PlaneStats `json:"planes"`
+    TotalBytes   int          `json:"total_bytes"`
+    BitsPerPixel float64      `json:"bpp"`
+    Stages       []StageTime  `json:"stages"`
+    Quality      *Quality     `json:"quality,omitempty"` // Set when EncodeOptions.Verify is
+    Chroma       *ChromaStats `json:"chroma,omitempty"`  // Set for 4:1:1 and mono chroma
+}
+
+// ChromaStats compares the chroma of a 4:1:1 or mono file with what
+// 4:2:0 would have coded. The byte count covers both chroma planes.
+type ChromaStats struct {
+    Mode       string `json:"mode"`
+    Samples    int    `json:"samples"`     // Per chroma plane
+    Samples420 int    `json:"samples_420"` // Per chroma plane at 4:2:0
+    Bytes      int    `json:"bytes"`
+}
+
+func newChromaStats(m ChromaMode, width, height, bytes int) *ChromaStats {
+    cw, ch := m.planeSize(width, height, FlagChromaCeil)
+    w420, h420 := chromaPlaneSize(width, height, FlagChromaCeil)
+    return &ChromaStats{Mode: m.String(), Samples: cw * ch, Samples420: w420 * h420, Bytes: bytes}
+}
+
+// Saved is the share of 4:2:0 chroma samples the mode leaves out, in percent
+func (c *ChromaStats) Saved() float64 {
+    return (1 - float64(c.Samples)/float64(c.Samples420)) * 100
+}
+
+// PlaneStats covers one coded plane. BitsPerPixel is relative to the
+// full image size, so the planes add up to the file total.
+type PlaneStats struct {
+    Width          int           `json:"width"`
+    Height         int           `json:"height"`
+    Patches        int           `json:"patches"`
+    CoeffsPerPatch float64       `json:"coeffs_per_patch"`
+    Streams        []StreamStats `json:"streams"`
+    Bytes          int           `json:"bytes"`
+    BitsPerPixel   float64       `json:"bpp"`
+}
+
+// StreamStats is the size of one stream before and after range coding
+type StreamStats struct {
+    Name       string `json:"name"`
+    Raw        int    `json:"raw"`
+    Compressed int    `json:"compressed"`
+}
+
+// StageTime is the wall-clock time of one encoder stage
+type StageTime struct {
+    Name         string  `json:"name"`
+    Milliseconds float64 `json:"ms"`
+}
+
+// stage records the time since start under name; a nil Stats ignores it
+func (s *Stats) stage(name string, start time.Time) {
+    if s == nil { return }
+    s.Stages = append(s.Stages, StageTime{Name: name, Milliseconds: float64(time.Since(start).Microseconds()) / 1000})
+}
+
+// bpp converts a byte count to bits per pixel of the image
+func (s *Stats) bpp(bytes int) float64 {
+    return float64(bytes) * 8 / float64(s.Width*s.Height)
+}
+
+// WriteTable prints the stats as a human-readable table
+func (s *Stats) WriteTable(w io.Writer) {
+    fmt.Fprintf(w, "Image: %dx%d\n", s.Width, s.Height)
+    for i, p := range s.Planes {
+        fmt.Fprintf(w, "Plane %d (%dx%d): %d patches, %.2f coeffs/patch, %d bytes, %.3f bpp\n",
+            i, p.Width, p.Height, p.Patches, p.CoeffsPerPatch, p.Bytes, p.BitsPerPixel)
+        for _, st := range p.Streams {
+            ratio := 0.0
+            if st.Raw > 0 { ratio = float64(st.Compressed) / float64(st.Raw) * 100 }
+            fmt.Fprintf(w, "  %-8s %10d -> %10d bytes (%5.1f%%)\n", st.Name, st.Raw, st.Compressed, ratio)
+        }
+    }
+    if s.Chroma != nil {
+        fmt.Fprintf(w, "Chroma %s: %d samples per plane, %.1f%% fewer than 4:2:0, %d bytes\n", s.Chroma.Mode, s.Chroma.Samples, s.Chroma.Saved(), s.Chroma.Bytes)
+    }
+    fmt.Fprintf(w, "Total: %d bytes, %.3f bpp\n", s.TotalBytes, s.BitsPerPixel)
+    if s.Quality != nil {
+        s.Quality.WriteTable(w)
+    }
+    for _, st := range s.Stages {
+        fmt.Fprintf(w, "  %-16s %9.1f ms\n", st.Name, st.Milliseconds)
+    }
+}
+
+// DecodeStats accumulates decoder stage timings in milliseconds; decoding
+// several frames adds up. Set DecodeOptions.Stats to collect them. JSON
+// field names are part of -stats json.
+type DecodeStats struct {
+    HeaderRead       float64 `json:"header_read_ms"`
+    StreamRead       float64 `json:"stream_read_ms"`       // Reading the split streams' blocks from the input
+    StreamDecompress float64 `json:"stream_decompress_ms"` // Range-coded files; legacy streams count as reconstruction
+    Reconstruction   float64 `json:"reconstruction_ms"`    // Patch reconstruction and CfL, and reducing or cropping the planes
+    Upsample         float64 `json:"upsample_ms"`          // Subsampled chroma to the luma size
+    ColorMerge       float64 `json:"color_merge_ms"`       // Planes to RGB
+    Deblock          float64 `json:"deblock_ms"`
+    Antialias        float64 `json:"aa_ms"`
+    LineContinuity   float64 `json:"line_continuity_ms"`
+    Grain            float64 `json:"grain_ms"`
+    Residual         float64 `json:"residual_ms"`
+    PNGEncode        float64 `json:"png_encode_ms"`        // Writing the output image, whatever its format
+    Total            float64 `json:"total_ms"`
+}
+
+// add adds the time since start to one of s's fields
+func (s *DecodeStats) add(field *float64, start time.Time) {
+    *field += float64(time.Since(start).Microseconds()) / 1000
+}
+
+// total records the whole decode; a nil DecodeStats ignores it
+func (s *DecodeStats) total(start time.Time) {
+    if s == nil { return }
+    s.add(&s.Total, start)
+}
+
+// decodeStage is one line of the decode timing tables
+type decodeStage struct {
+    name string
+    ms   float64
+}
+
+// stages lists the timings in pipeline order, the total last
+func (s *DecodeStats) stages() []decodeStage {
+    return []decodeStage{
+        {"header read", s.HeaderRead},
+        {"stream read", s.StreamRead},
+        {"stream decompress", s.StreamDecompress},
+        {"reconstruction", s.Reconstruction},
+        {"upsample", s.Upsample},
+        {"color merge", s.ColorMerge},
+        {"deblock", s.Deblock},
+        {"antialias", s.Antialias},
+        {"line continuity", s.LineContinuity},
+        {"grain", s.Grain},
+        {"residual", s.Residual},
+        {"output encode", s.PNGEncode},
+        {"total", s.Total},
+    }
+}
+
+// WriteTable prints the decode timings, one stage per line
+func (s *DecodeStats) WriteTable(w io.Writer) {
+    for _, r := range s.stages() {
+        fmt.Fprintf(w, "  %-18s %9.1f ms\n", r.name, r.ms)
+    }
+}
+
+// DecodeBenchmark holds the timings of repeated decodes of one file
+type DecodeBenchmark struct {
+    Width  int           `json:"width"` // Stored image size
+    Height int           `json:"height"`
+    Runs   []DecodeStats `json:"runs"`
+}
+
+// BenchmarkDecode decodes data runs times with opts and collects each
+// run's stage timings. Every run encodes its output as Decode does; the
+// first run's goes to out when it is non-nil, the rest are discarded.
+func BenchmarkDecode(data []byte, runs int, out io.Writer, opts DecodeOptions) (*DecodeBenchmark, error) {
+    if runs < 1 {
+        return nil, fmt.Errorf("benchmark needs at least 1 run, got %d", runs)
+    }
+    header, err := readHeader(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    b := &DecodeBenchmark{Width: int(header.Width), Height: int(header.Height), Runs: make([]DecodeStats, runs)}
+    for i := range b.Runs {
+        opts.Stats = &b.Runs[i]
+        w := io.Discard
+        if i == 0 && out != nil { w = out }
+        if err := Decode(bytes.NewReader(data), w, opts); err != nil {
+            return nil, err
+        }
+    }
+    return b, nil
+}
+
+// Throughput is the stored image's megapixels decoded per second, in the
+// fastest run and on average
+func (b *DecodeBenchmark) Throughput() (best, mean float64) {
+    minMS, sumMS := math.Inf(1), 0.0
+    for i := range b.Runs {
+        minMS = min(minMS, b.Runs[i].Total)
+        sumMS += b.Runs[i].Total
+    }
+    mp := float64(b.Width*b.Height) / 1e6
+    return mp / minMS * 1000, mp / (sumMS / float64(len(b.Runs))) * 1000
+}
+
+// WriteTable prints the fastest, mean and slowest time of each stage
+// that ran, then the throughput
+func (b *DecodeBenchmark) WriteTable(w io.Writer) {
+    fmt.Fprintf(w, "Decoded %dx%d (%.2f MP) %d times\n", b.Width, b.Height, float64(b.Width*b.Height)/1e6, len(b.Runs))
+    fmt.Fprintf(w, "  %-18s %9s %9s %9s\n", "stage (ms)", "min", "mean", "max")
+    for i, stage := range b.Runs[0].stages() {
+        lo, hi, sum := math.Inf(1), 0.0, 0.0
+        for r := range b.Runs {
+            ms := b.Runs[r].stages()[i].ms
+            lo, hi, sum = min(lo, ms), max(hi, ms), sum+ms
+        }
+        if hi == 0 { continue }
+        fmt.Fprintf(w, "  %-18s %9.1f %9.1f %9.1f\n", stage.name, lo, sum/float64(len(b.Runs)), hi)
+    }
+    best, mean := b.Throughput()
+    fmt.Fprintf(w, "Throughput: %.1f MP/s fastest, %.1f MP/s mean\n", best, mean)
+}
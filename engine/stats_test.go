@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestDecodeBench benchmarks a few decodes of a 4:2:0 file: every run
+// is timed, the stages add up to no more than the total, the pipeline
+// stages all register, and the kept output is what Decode writes
+func TestDecodeBench(t *testing.T) {
+	data, err := encodeGap(benchRGBA(256, 192), nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetLogger(SetLogger(nil))
+	var first bytes.Buffer
+	b, err := BenchmarkDecode(data, 3, &first, DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Runs) != 3 || b.Width != 256 || b.Height != 192 {
+		t.Fatalf("%d runs of %dx%d", len(b.Runs), b.Width, b.Height)
+	}
+	for i, run := range b.Runs {
+		sum := 0.0
+		for _, st := range run.stages() {
+			if st.name != "total" {
+				sum += st.ms
+			}
+		}
+		// Each stage is rounded down to the microsecond
+		if run.Total <= 0 || sum > run.Total+0.02 {
+			t.Fatalf("run %d stages add up to %.3f ms of %.3f", i, sum, run.Total)
+		}
+		if run.StreamDecompress <= 0 || run.Reconstruction <= 0 || run.Upsample <= 0 || run.ColorMerge <= 0 || run.PNGEncode <= 0 {
+			t.Fatalf("run %d missed a stage: %+v", i, run)
+		}
+	}
+	if best, mean := b.Throughput(); best < mean || mean <= 0 {
+		t.Fatalf("throughput %.2f fastest, %.2f mean", best, mean)
+	}
+	var want bytes.Buffer
+	if err := Decode(bytes.NewReader(data), &want, DecodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), want.Bytes()) {
+		t.Fatalf("the kept output differs from a plain decode")
+	}
+	if _, err := BenchmarkDecode(data, 0, nil, DecodeOptions{}); err == nil {
+		t.Fatalf("ran 0 times")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "image"
+    "io"
+    "os"
+)
+
+// gapDecodePlaneDC reconstructs one pixel per 8x8 patch from its DC term
+// alone. The DC is the patch sum (the inverse transform divides by 64 and
+// the polylog filter leaves bin 0 alone), so the result is the patch mean,
+// an 8x downscale, without running a single inverse FFT. The AC terms are
+// still parsed, since the streams have to be walked to reach the next DC.
+func gapDecodePlaneDC(parser *patchParser, width, height int) (*image.Gray, error) {
+    bw, bh := (width+7)/8, (height+7)/8
+    img := image.NewGray(image.Rect(0, 0, bw, bh))
+    coeffs := make([]float32, 128)
+    for by := 0; by < bh; by++ {
+        for bx := 0; bx < bw; bx++ {
+            for i := range coeffs { coeffs[i] = 0 }
+            _, fill, err := parser.parsePatch(bx, by, coeffs)
+            if err != nil {
+                return nil, fmt.Errorf("failed to read patch at (%d, %d): %v", bx*8, by*8, err)
+            }
+            if fill >= 0 {
+                img.Pix[by*img.Stride+bx] = uint8(fill)
+                continue
+            }
+            v := coeffs[0] / 64
+            if v < 0 { v = 0 }
+            if v > 1 { v = 1 }
+            img.Pix[by*img.Stride+bx] = uint8(v * 255.0)
+        }
+    }
+    return img, nil
+}
+
+// blockMeans averages each n x n block of a fully decoded plane; for n
+// 8 it gives the plane gapDecodePlaneDC would have produced
+func blockMeans(src *image.Gray, n int) *image.Gray {
+    w, h := src.Bounds().Dx(), src.Bounds().Dy()
+    dst := image.NewGray(image.Rect(0, 0, (w+n-1)/n, (h+n-1)/n))
+    for by := 0; by < dst.Rect.Dy(); by++ {
+        for bx := 0; bx < dst.Rect.Dx(); bx++ {
+            sum, count := 0, 0
+            for y := by * n; y < by*n+n && y < h; y++ {
+                for x := bx * n; x < bx*n+n && x < w; x++ {
+                    sum += int(src.Pix[y*src.Stride+x])
+                    count++
+                }
+            }
+            dst.Pix[by*dst.Stride+bx] = uint8(sum / count)
+        }
+    }
+    return dst
+}
+
+// thumbnailSize scales w x h so the longer side is maxSize, keeping the
+// aspect ratio; maxSize 0 keeps the size
+func thumbnailSize(w, h, maxSize int) (int, int) {
+    if maxSize <= 0 { return w, h }
+    if w >= h {
+        return maxSize, max(1, (h*maxSize+w/2)/w)
+    }
+    return max(1, (w*maxSize+h/2)/h), maxSize
+}
+
+// Thumbnail decodes a preview of a .gap file: one pixel per 8x8 block
+// from the patch DC terms, resized so its longer side is maxSize (0 keeps
+// the block resolution). Post-filters, grain and the lossless residual
+// are skipped. Chroma-from-luma files need their full luma plane, so
+// they fall back to an inverse transform of every patch.
+func Thumbnail(r io.Reader, maxSize int) (*image.RGBA, error) {
+    br := bufio.NewReaderSize(r, 1024*1024)
+    header, err := readHeader(br)
+    if err != nil {
+        return nil, err
+    }
+    if header.Flags&FlagFrames != 0 {
+        return nil, fmt.Errorf("file holds %d frames; thumbnails take a single image", len(header.Frames))
+    }
+    width, height := int(header.Width), int(header.Height)
+
+    opts := DecodeOptions{lossyOnly: true, dcOnly: header.Flags&FlagCfL == 0}
+    planes, _, _, err := decodePlanes(br, header, opts, &DecodeStats{})
+    if err != nil {
+        return nil, err
+    }
+
+    // Luma's block grid sets the preview's native size
+    tw, th := thumbnailSize((width+7)/8, (height+7)/8, maxSize)
+    for i, p := range planes {
+        if !opts.dcOnly { p = blockMeans(p, 8) }
+        if p.Bounds().Dx() != tw || p.Bounds().Dy() != th {
+            p = resizePlane(p, tw, th, 0)
+        }
+        planes[i] = p
+    }
+
+    img := image.NewRGBA(image.Rect(0, 0, tw, th))
+    matrix := matrixFromFlags(header.Flags)
+    for y := 0; y < th; y++ {
+        row := planeRow(planes[0], y)
+        if len(planes) == 3 {
+            planesToRGBARow(matrix, row, planeRow(planes[1], y), planeRow(planes[2], y), img.Pix[img.PixOffset(0, y):])
+            continue
+        }
+        planesToRGBARow(MatrixIdentity, row, row, row, img.Pix[img.PixOffset(0, y):])
+    }
+
+    // Upright, like a full decode
+    if orientation, _ := exifOrientation(findChunk(header.Chunks, ChunkExif)); orientation != 1 {
+        img = applyOrientation(img, orientation)
+    }
+    return img, nil
+}
+
+// runThumbnail writes a PNG preview of a .gap file
+func runThumbnail(args []string) {
+    fs := flag.NewFlagSet("thumbnail", flag.ExitOnError)
+    inputPtr := fs.String("i", "", "Input .gap file (- for stdin)")
+    outputPtr := fs.String("o", "", "Output PNG path (- for stdout)")
+    maxPtr := fs.Int("max", 256, "Longer side of the preview in pixels (0 = one pixel per 8x8 block)")
+    fs.Parse(args)
+    if *inputPtr == "" || *outputPtr == "" {
+        fmt.Fprintln(os.Stderr, "Error: -i and -o are required")
+        fs.PrintDefaults()
+        os.Exit(1)
+    }
+    if *maxPtr < 0 {
+        fmt.Fprintln(os.Stderr, "Error: -max must not be negative")
+        os.Exit(1)
+    }
+
+    err := func() error {
+        in, err := openInput(*inputPtr)
+        if err != nil {
+            return err
+        }
+        defer in.Close()
+        img, err := Thumbnail(in, *maxPtr)
+        if err != nil {
+            return err
+        }
+        // Previews carry no metadata; the orientation is already applied
+        if *outputPtr == "-" {
+            return encodeDecodedPNG(os.Stdout, img, nil, DecodeOptions{})
+        }
+        return writeFileAtomic(*outputPtr, func(w io.Writer) error {
+            return encodeDecodedPNG(w, img, nil, DecodeOptions{})
+        })
+    }()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Thumbnail failed: %v\n", err)
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// TestThumbnail compares DC-only thumbnails against the unfiltered
+// full decode averaged over 8x8 blocks, for a plain, a legacy gzip and a
+// chroma-from-luma file, and checks -max sizing
+func TestThumbnail(t *testing.T) {
+	const w, h = 96, 64
+	src := benchRGBA(w, h)
+	for _, opts := range []EncodeOptions{{}, {Compress: CompressGzip, SkipFlat: true}, {CfL: true}} {
+		opts.S, opts.Threshold = 0.1, 0.5
+		data, err := encodeGap(src, nil, opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{SkipDeblock: true, SkipAntialias: true, SkipLineContinuity: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumb, err := Thumbnail(bytes.NewReader(data), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thumb.Bounds() != image.Rect(0, 0, w/8, h/8) {
+			t.Fatalf("native size %v", thumb.Bounds())
+		}
+		boxed := image.NewRGBA(thumb.Bounds())
+		for by := 0; by < h/8; by++ {
+			for bx := 0; bx < w/8; bx++ {
+				for c := 0; c < 4; c++ {
+					sum := 0
+					for y := 0; y < 8; y++ {
+						for x := 0; x < 8; x++ {
+							sum += int(full.Pix[full.PixOffset(bx*8+x, by*8+y)+c])
+						}
+					}
+					boxed.Pix[boxed.PixOffset(bx, by)+c] = uint8(sum / 64)
+				}
+			}
+		}
+		if p := PSNR(thumb, boxed); p < 30 {
+			t.Fatalf("%.2f dB against the block-averaged decode (compress %s, cfl %v)", p, opts.Compress, opts.CfL)
+		}
+	}
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := Thumbnail(bytes.NewReader(data), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Bounds() != image.Rect(0, 0, 30, 20) {
+		t.Fatalf("-max 30 gave %v", thumb.Bounds())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+)
+
+// TranscodeReport describes one transcode
+type TranscodeReport struct {
+    OldBytes int
+    NewBytes int
+    PSNR     float64 // New decode against the old one (post-filters, no grain): the generational loss
+}
+
+// Transcode re-encodes a .gap file with new options straight from its
+// decoded planes, skipping the post-filters and the RGB round trip that
+// decoding to PNG and encoding again would add. The color matrix is the
+// source's; the output uses opts.Compress, by default range-coded split
+// streams, so this also upgrades legacy gzip and raw files. Metadata chunks are carried over;
+// a lossless residual and grain parameters are not (pass -grain again).
+func Transcode(data []byte, opts EncodeOptions) ([]byte, *TranscodeReport, error) {
+    r := bytes.NewReader(data)
+    header, err := readHeader(r)
+    if err != nil {
+        return nil, nil, err
+    }
+    if header.Flags&FlagFrames != 0 {
+        return nil, nil, fmt.Errorf("cannot transcode a sequence")
+    }
+    if len(header.Planes) != 3 {
+        return nil, nil, fmt.Errorf("cannot transcode a %d-plane file", len(header.Planes))
+    }
+    width, height := int(header.Width), int(header.Height)
+    if header.Flags&FlagLossless != 0 {
+        logWarnf("dropping the lossless residual")
+    }
+    if header.Flags&FlagHighDepth != 0 {
+        logWarnf("coding the 16-bit planes at 8 bits")
+    }
+
+    planes, _, _, err := decodePlanes(r, header, DecodeOptions{lossyOnly: true, Workers: opts.Workers}, &DecodeStats{})
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // Bring chroma to the size the encoder codes it at for this matrix and
+    // opts.Chroma, going through full size when the mode changes
+    opts.Matrix = matrixFromFlags(header.Flags)
+    subsampled := header.Flags&FlagSubsampled != 0
+    want := chromaSubsampled(opts.Matrix, width, height)
+    if subsampled && want && header.Chroma != opts.Chroma {
+        logInfof("converting %s chroma to %s", header.Chroma, opts.Chroma)
+    }
+    for i := 1; i < 3; i++ {
+        full := !subsampled
+        if subsampled && (!want || header.Chroma != opts.Chroma) {
+            planes[i] = header.Chroma.upsample(planes[i], width, height, UpsampleBilinear, opts.Workers)
+            full = true
+        }
+        if full && want {
+            planes[i] = opts.Chroma.downsample(planes[i], opts.Workers)
+        } else if want && opts.Chroma == Chroma420 {
+            // Pre-FlagChromaCeil chroma lacks the last odd column and row
+            cw, ch := chromaPlaneSize(width, height, FlagChromaCeil)
+            planes[i] = extendPlane(planes[i], cw, ch)
+        }
+    }
+    opts.sourcePlanes = planes
+
+    // The encoder writes its own quantization table, grain and chroma chunks
+    var metadata []GapChunk
+    for _, c := range header.Chunks {
+        if c.Tag != ChunkQTable && c.Tag != ChunkGrain && c.Tag != ChunkChroma {
+            metadata = append(metadata, c)
+        }
+    }
+
+    out, err := encodeGap(nil, metadata, opts, nil)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    before, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{NoGrain: true})
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to decode source for comparison: %v", err)
+    }
+    after, _, err := decodeGap(bytes.NewReader(out), DecodeOptions{NoGrain: true})
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to decode result: %v", err)
+    }
+    report := &TranscodeReport{OldBytes: len(data), NewBytes: len(out), PSNR: PSNR(before, after)}
+    return out, report, nil
+}
+
+// extendPlane grows src to w x h by repeating its last column and row
+func extendPlane(src *image.Gray, w, h int) *image.Gray {
+    sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+    if sw == w && sh == h {
+        return src
+    }
+    dst := image.NewGray(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        row := src.Pix[min(y, sh-1)*src.Stride:]
+        for x := 0; x < w; x++ {
+            dst.Pix[y*dst.Stride+x] = row[min(x, sw-1)]
+        }
+    }
+    return dst
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// legacyGzipGap builds a v1 gzip file (interleaved per-patch fields,
+// 4:2:0 YCbCr, or the luma plane alone when gray) the way encoders before
+// range coding wrote them
+func legacyGzipGap(src image.Image, s, t float32, gray bool) ([]byte, error) {
+	b := src.Bounds()
+	flags := uint32(FlagGzip | FlagQuantized | FlagSubsampled)
+	channels := uint32(3)
+	if gray {
+		flags, channels = FlagGzip|FlagQuantized, 1
+	}
+	var out bytes.Buffer
+	header := GapHeader{Magic: [4]byte{'G', 'A', 'P', 0x01}, Width: uint32(b.Dx()), Height: uint32(b.Dy()), S: s, Threshold: t, Flags: flags, Channels: channels}
+	if err := binary.Write(&out, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(&out)
+	y, cb, cr := splitImagePlanes(src, MatrixBT601, 0)
+	planes := []*image.Gray{y, downsamplePlane(cb, 0), downsamplePlane(cr, 0)}
+	for _, p := range planes[:channels] {
+		pb := p.Bounds()
+		// v1 decodes chroma with the header s as well
+		angles, counts, maxVals, indices, values, err := gapEncodePlane(p, pb.Dx(), pb.Dy(), planeOptions{S: s, Threshold: t, Flags: flags}, &keptStats{})
+		if err != nil {
+			return nil, err
+		}
+		for i, n := range counts {
+			zw.Write(angles[i : i+1])
+			zw.Write(counts[i : i+1])
+			zw.Write(maxVals[4*i : 4*i+4])
+			for k := 0; k < int(n); k++ {
+				zw.Write(indices[:1])
+				zw.Write(values[:2])
+				indices, values = indices[1:], values[2:]
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// TestTranscode transcodes a file to a higher threshold and a legacy
+// gzip file to the current layout, checking sizes, flags and that each
+// result stays close to its source's decode
+func TestTranscode(t *testing.T) {
+	src := benchRGBA(64, 48)
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, rep, err := Transcode(data, EncodeOptions{S: 0.1, Threshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.NewBytes >= rep.OldBytes || rep.NewBytes != len(out) {
+		t.Fatalf("%d -> %d bytes at a higher threshold", rep.OldBytes, rep.NewBytes)
+	}
+	if rep.PSNR < 25 {
+		t.Fatalf("%.2f dB against the source decode", rep.PSNR)
+	}
+
+	legacy, err := legacyGzipGap(src, 0.1, 0.5, false)
+	if err != nil {
+		t.Fatalf("building legacy file: %v", err)
+	}
+	out, rep, err = Transcode(legacy, EncodeOptions{S: 0.1, Threshold: 0.5})
+	if err != nil {
+		t.Fatalf("legacy file: %v", err)
+	}
+	h, err := readHeader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("legacy file: %v", err)
+	}
+	if h.Flags&FlagGzip != 0 || h.Flags&FlagRangeCoded == 0 || h.Magic[3] != FormatVersion {
+		t.Fatalf("legacy file: output flags 0x%x, version %d", h.Flags, h.Magic[3])
+	}
+	if rep.PSNR < 25 {
+		t.Fatalf("legacy file: %.2f dB against the source decode", rep.PSNR)
+	}
+}
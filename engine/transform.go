@@ -0,0 +1,84 @@
+package main
+
+import "fmt"
+
+// PatchTransform is the basis patches are coded in. Forward takes an 8x8
+// patch, row major on the 0..1 scale, to 64 complex coefficients (128
+// floats, re and im interleaved) with those below threshold zeroed, and
+// an angle in radians that the file stores to 1/255 of a turn. Inverse
+// takes the dequantized coefficients and the stored angle back to 64
+// samples; it may overwrite coeffs. s is the plane's decay parameter.
+//
+// The streams are laid out the same whatever the transform, so nothing
+// in a file says which one coded it: it only decodes correctly with the
+// same transform. DC prediction, thumbnails and sparse angles take
+// coeffs[0] to be the sum of the samples, and a patch holding only it to
+// invert to their mean at any angle.
+type PatchTransform interface {
+    Forward(patch []float32, s, threshold float32) (angle float32, coeffs []float32, err error)
+    Inverse(coeffs []float32, angle, s float32) ([]float32, error)
+}
+
+// DefaultTransform is the polylogarithmic transform of the Zig core,
+// which a nil PatchTransform also selects
+var DefaultTransform PatchTransform = pltmTransform{}
+
+type pltmTransform struct{}
+
+func (pltmTransform) Forward(patch []float32, s, threshold float32) (float32, []float32, error) {
+    angle, coeffs, _, err := GapCompressPatch(patch, s, threshold)
+    return angle, coeffs, err
+}
+
+func (pltmTransform) Inverse(coeffs []float32, angle, s float32) ([]float32, error) {
+    return GapDecompressPatch(coeffs, angle, s)
+}
+
+// isPLTM reports whether t is the core's transform, which the codec
+// calls directly to batch patches (see bulkDecompress)
+func isPLTM(t PatchTransform) bool {
+    _, ok := t.(pltmTransform)
+    return t == nil || ok
+}
+
+// forwardPatch is t.Forward, the core's when t is nil, with the
+// coefficient count checked
+func forwardPatch(t PatchTransform, patch []float32, s, threshold float32) (float32, []float32, error) {
+    if isPLTM(t) {
+        angle, coeffs, _, err := GapCompressPatch(patch, s, threshold)
+        return angle, coeffs, err
+    }
+    angle, coeffs, err := t.Forward(patch, s, threshold)
+    if err == nil && len(coeffs) != 128 {
+        err = fmt.Errorf("transform returned %d coefficient floats, want 128", len(coeffs))
+    }
+    return angle, coeffs, err
+}
+
+// inversePatches reconstructs len(angles) patches from coeffs (128 floats
+// each) into output (64 each) with t, in one batched core call when t is
+// the core's
+func inversePatches(t PatchTransform, coeffs, angles, output []float32, s float32) error {
+    if isPLTM(t) {
+        return bulkDecompress(coeffs, angles, output, s)
+    }
+    for i, angle := range angles {
+        patch, err := t.Inverse(coeffs[i*128:(i+1)*128], angle, s)
+        if err != nil {
+            return err
+        }
+        if len(patch) != 64 {
+            return fmt.Errorf("transform returned %d samples, want 64", len(patch))
+        }
+        copy(output[i*64:(i+1)*64], patch)
+    }
+    return nil
+}
+
+// inversePatch is inversePatches for a single patch
+func inversePatch(t PatchTransform, coeffs []float32, angle, s float32, output []float32) error {
+    if isPLTM(t) {
+        return GapDecompressPatchTo(coeffs, angle, s, output)
+    }
+    return inversePatches(t, coeffs, []float32{angle}, output, s)
+}
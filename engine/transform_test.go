@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"testing"
+)
+
+// dctTransform is an 8x8 DCT-II in pure Go for TestPatchTransform.
+// Bin v*8+u holds the real coefficient, unnormalized so bin 0 is the sum.
+type dctTransform struct{}
+
+func dctCos(i, k int) float64 { return math.Cos(float64((2*i+1)*k) * math.Pi / 16) }
+
+func (dctTransform) Forward(patch []float32, s, threshold float32) (float32, []float32, error) {
+	coeffs := make([]float32, 128)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					sum += float64(patch[y*8+x]) * dctCos(x, u) * dctCos(y, v)
+				}
+			}
+			if math.Abs(sum) >= float64(threshold) {
+				coeffs[2*(v*8+u)] = float32(sum)
+			}
+		}
+	}
+	return 0, coeffs, nil
+}
+
+func (dctTransform) Inverse(coeffs []float32, angle, s float32) ([]float32, error) {
+	patch := make([]float32, 64)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			var sum float64
+			for v := 0; v < 8; v++ {
+				for u := 0; u < 8; u++ {
+					w := dctCos(x, u) * dctCos(y, v)
+					if u > 0 {
+						w *= 2
+					}
+					if v > 0 {
+						w *= 2
+					}
+					sum += float64(coeffs[2*(v*8+u)]) * w
+				}
+			}
+			patch[y*8+x] = float32(sum / 64)
+		}
+	}
+	return patch, nil
+}
+
+// TestPatchTransform codes a plane with DefaultTransform, which must
+// give the same streams as no transform, and with a DCT: that plane must
+// decode well with the DCT and not with the core's transform. A whole
+// file coded with the DCT, DC prediction and sparse angles must round
+// trip through EncodeOptions and DecodeOptions.
+func TestPatchTransform(t *testing.T) {
+	const w, h = 64, 48
+	plane := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			plane.Pix[y*plane.Stride+x] = uint8(128 + 100*math.Sin(float64(x)/2)*math.Cos(float64(y)/3))
+		}
+	}
+	flags := uint32(FlagQuantized | FlagDCPred)
+	var streams [2][5][]byte
+	for i, tr := range []PatchTransform{nil, DefaultTransform} {
+		a, c, m, idx, v, err := gapEncodePlane(plane, w, h, planeOptions{S: 0.1, Threshold: 0.5, Flags: flags, Transform: tr}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = [5][]byte{a, c, m, idx, v}
+	}
+	for k := range streams[0] {
+		if !bytes.Equal(streams[0][k], streams[1][k]) {
+			t.Fatalf("DefaultTransform codes stream %d differently from the default", k)
+		}
+	}
+
+	a, c, m, idx, v, err := gapEncodePlane(plane, w, h, planeOptions{S: 0.1, Threshold: 0.5, Flags: flags, Transform: dctTransform{}}, nil)
+	if err != nil {
+		t.Fatalf("dct: %v", err)
+	}
+	dct, err := gapDecodePlaneSplit(a, c, m, idx, v, w, h, flags, 0, 0.1, nil, dctTransform{}, 0)
+	if err != nil {
+		t.Fatalf("dct: %v", err)
+	}
+	pltm, err := gapDecodePlaneSplit(a, c, m, idx, v, w, h, flags, 0, 0.1, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("dct: %v", err)
+	}
+	good, wrong := PSNR(plane, dct), PSNR(plane, pltm)
+	t.Logf("dct plane: %.2f dB, %.2f dB decoded as pltm", good, wrong)
+	if good < 30 || wrong > good-10 {
+		t.Fatalf("dct plane decodes at %.2f dB, %.2f dB with the wrong transform", good, wrong)
+	}
+
+	src := image.NewRGBA(plane.Rect)
+	for i, v := range plane.Pix {
+		src.Pix[4*i], src.Pix[4*i+1], src.Pix[4*i+2], src.Pix[4*i+3] = v, 255-v, v/2+64, 255
+	}
+	data, err := encodeGap(src, nil, EncodeOptions{S: 0.1, Threshold: 0.5, DCPred: true, SparseAngles: true, Transform: dctTransform{}}, nil)
+	if err != nil {
+		t.Fatalf("dct file: %v", err)
+	}
+	var quality [2]float64
+	for i, tr := range []PatchTransform{dctTransform{}, nil} {
+		img, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{Transform: tr, SkipDeblock: true, SkipAntialias: true, SkipLineContinuity: true})
+		if err != nil {
+			t.Fatalf("dct file: %v", err)
+		}
+		quality[i] = PSNR(src, img)
+	}
+	if quality[0] < 25 || quality[1] > quality[0]-10 {
+		t.Fatalf("dct file decodes at %.2f dB, %.2f dB with the wrong transform", quality[0], quality[1])
+	}
+}
+
+// TestAnglePrecision measures what an angle stored finer than one
+// byte would buy on diagonal edges. The core picks one of 256 scan orders
+// by truncating the angle the way quantizeAngle does, so reconstructing
+// at the encoder's exact angle and at the stored byte's must give the
+// same error; the next byte must do worse, or the angle would not matter.
+func TestAnglePrecision(t *testing.T) {
+	var sse [3]float64 // Exact angle, stored byte, next byte
+	n := 0
+	for deg := 0.0; deg < 360; deg += 7.3 {
+		th := deg * math.Pi / 180
+		patch := make([]float32, 64)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				d := (float64(x)-3.5)*math.Cos(th) + (float64(y)-3.5)*math.Sin(th)
+				patch[y*8+x] = float32(0.2 + 0.6/(1+math.Exp(-4*d)))
+			}
+		}
+		angle, coeffs, err := forwardPatch(nil, patch, 0.1, 0)
+		if err != nil {
+			t.Fatalf("%.1f degrees: %v", deg, err)
+		}
+		q := quantizeAngle(angle)
+		for i, a := range []float32{angle, dequantizeAngle(q), dequantizeAngle(q + 1)} {
+			out := make([]float32, 64)
+			if err := inversePatch(nil, coeffs, a, 0.1, out); err != nil {
+				t.Fatalf("%.1f degrees: %v", deg, err)
+			}
+			for k, v := range out {
+				d := float64(v - patch[k])
+				sse[i] += d * d
+			}
+		}
+		n += 64
+	}
+	psnr := func(sse float64) float64 { return 10 * math.Log10(float64(n)/max(sse, 1e-12)) }
+	if sse[1] > sse[0]+1e-9 {
+		t.Fatalf("byte angles give %.2f dB, exact ones %.2f dB", psnr(sse[1]), psnr(sse[0]))
+	}
+	if sse[2] <= sse[1] {
+		t.Fatalf("the next byte gives %.2f dB, no worse than the stored %.2f dB", psnr(sse[2]), psnr(sse[1]))
+	}
+}
+
+// TestAnalyzePatch feeds GapAnalyzePatch patches with a known
+// dominant orientation and expects the angle of their gradient, the one
+// GapCompressPatch then codes with
+func TestAnalyzePatch(t *testing.T) {
+	patch := func(f func(x, y int) float32) []float32 {
+		p := make([]float32, 64)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				p[y*8+x] = f(x, y)
+			}
+		}
+		return p
+	}
+	step := func(on bool) float32 {
+		if on {
+			return 0.8
+		}
+		return 0.2
+	}
+	cases := []struct {
+		name  string
+		patch []float32
+		want  float64
+	}{
+		{"ramp right", patch(func(x, y int) float32 { return float32(x) / 7 }), 0},
+		{"ramp down", patch(func(x, y int) float32 { return float32(y) / 7 }), math.Pi / 2},
+		{"ramp left", patch(func(x, y int) float32 { return float32(7-x) / 7 }), math.Pi},
+		{"vertical stripes", patch(func(x, y int) float32 { return step(x%2 == 1) }), 0},
+		{"vertical edge", patch(func(x, y int) float32 { return step(x >= 4) }), 0},
+		{"horizontal edge", patch(func(x, y int) float32 { return step(y >= 4) }), math.Pi / 2},
+		{"45 degree line", patch(func(x, y int) float32 { return step(x+y >= 8) }), math.Pi / 4},
+		{"135 degree line", patch(func(x, y int) float32 { return step(x > y) }), -math.Pi / 4},
+		{"30 degree ramp", patch(func(x, y int) float32 {
+			return 0.5 + 0.05*(float32(math.Cos(math.Pi/6))*float32(x)+float32(math.Sin(math.Pi/6))*float32(y))
+		}), math.Pi / 6},
+	}
+	for _, c := range cases {
+		got, err := GapAnalyzePatch(c.patch)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		// Angles compare on the circle, so pi and -pi agree
+		if d := math.Remainder(float64(got)-c.want, 2*math.Pi); math.Abs(d) > 0.02 {
+			t.Fatalf("%s: angle %.3f, want %.3f", c.name, got, c.want)
+		}
+		if angle, _, _, err := GapCompressPatch(c.patch, 0.1, 0); err != nil || angle != got {
+			t.Fatalf("%s: GapCompressPatch used angle %.3f (%v), GapAnalyzePatch %.3f", c.name, angle, err, got)
+		}
+	}
+	if _, err := GapAnalyzePatch(make([]float32, 63)); err == nil {
+		t.Fatalf("accepted a 63-sample patch")
+	}
+}
+
+// TestPatchRoundTrip pushes synthetic 8x8 patches through compress and
+// decompress, using the same angle quantization as the file format, and
+// checks the reconstruction RMSE against a per-case tolerance.
+func TestPatchRoundTrip(t *testing.T) {
+	cases := []struct {
+		name      string
+		tolerance float64
+		pixel     func(x, y int) float32
+	}{
+		// Flat patches only carry DC energy, so they must be near-exact
+		{"flat", 1e-3, func(x, y int) float32 { return 0.5 }},
+		{"gradient", 0.02, func(x, y int) float32 { return float32(x+y) / 14.0 }},
+		// High-contrast cases are bounded by the decoder's impulse suppression
+		{"impulse", 0.1, func(x, y int) float32 {
+			if x == 3 && y == 4 {
+				return 1.0
+			}
+			return 0.0
+		}},
+		{"checkerboard", 0.25, func(x, y int) float32 { return float32((x + y) % 2) }},
+	}
+
+	const s = 0.1
+	for _, tc := range cases {
+		patch := make([]float32, 64)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				patch[y*8+x] = tc.pixel(x, y)
+			}
+		}
+
+		angle, coeffs, _, err := GapCompressPatch(patch, s, 0)
+		if err != nil {
+			t.Fatalf("%s: compress: %v", tc.name, err)
+		}
+		decoded, err := GapDecompressPatch(coeffs, dequantizeAngle(quantizeAngle(angle)), s)
+		if err != nil {
+			t.Fatalf("%s: decompress: %v", tc.name, err)
+		}
+
+		var sumSq float64
+		for i := range patch {
+			d := float64(decoded[i] - patch[i])
+			sumSq += d * d
+		}
+		rmse := math.Sqrt(sumSq / 64)
+		if math.IsNaN(rmse) || rmse > tc.tolerance {
+			t.Fatalf("%s patch round trip RMSE %.5f exceeds tolerance %.5f (angle %.3f)", tc.name, rmse, tc.tolerance, angle)
+		}
+	}
+}
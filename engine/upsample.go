@@ -0,0 +1,87 @@
+package main
+
+import (
+    "fmt"
+)
+
+// ChromaUpsample selects the interpolation that brings subsampled chroma
+// back to the luma size
+type ChromaUpsample int
+
+const (
+    UpsampleBilinear ChromaUpsample = iota // 2x2 taps, the default
+    UpsampleNearest                        // Each chroma sample repeated, fastest; keeps pixel art crisp
+    UpsampleBicubic                        // 4x4 Catmull-Rom taps, sharper chroma edges on photos
+)
+
+func (m ChromaUpsample) String() string {
+    switch m {
+    case UpsampleBilinear:
+        return "bilinear"
+    case UpsampleNearest:
+        return "nearest"
+    case UpsampleBicubic:
+        return "bicubic"
+    }
+    return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+// ParseChromaUpsample accepts the -chroma-upsample names
+func ParseChromaUpsample(name string) (ChromaUpsample, error) {
+    switch name {
+    case "bilinear":
+        return UpsampleBilinear, nil
+    case "nearest":
+        return UpsampleNearest, nil
+    case "bicubic":
+        return UpsampleBicubic, nil
+    }
+    return 0, fmt.Errorf("unknown chroma upsampling %q (want nearest, bilinear or bicubic)", name)
+}
+
+// upsampleTaps are the source samples one destination coordinate reads
+// and their weights
+type upsampleTaps struct {
+    idx [4]int
+    wt  [4]float32
+    n   int
+}
+
+// taps samples destination coordinate d at source position
+// (d+0.5)*scale-0.5, clamped to the n source samples; taps beyond the
+// edges repeat the edge sample
+func (m ChromaUpsample) taps(d int, scale float32, n int) upsampleTaps {
+    f := (float32(d)+0.5)*scale - 0.5
+    if f < 0 { f = 0 }
+    if f > float32(n-1) { f = float32(n - 1) }
+    lo := int(f)
+    t := f - float32(lo)
+    switch m {
+    case UpsampleNearest:
+        if t >= 0.5 { lo = min(lo+1, n-1) }
+        return upsampleTaps{idx: [4]int{lo}, wt: [4]float32{1}, n: 1}
+    case UpsampleBicubic:
+        // Catmull-Rom: interpolates the samples and reproduces linear ramps
+        t2, t3 := t*t, t*t*t
+        return upsampleTaps{
+            idx: [4]int{max(lo-1, 0), lo, min(lo+1, n-1), min(lo+2, n-1)},
+            wt: [4]float32{
+                (-t3 + 2*t2 - t) / 2,
+                (3*t3 - 5*t2 + 2) / 2,
+                (-3*t3 + 4*t2 + t) / 2,
+                (t3 - t2) / 2,
+            },
+            n: 4,
+        }
+    }
+    return upsampleTaps{idx: [4]int{lo, min(lo+1, n-1)}, wt: [4]float32{1 - t, t}, n: 2}
+}
+
+// columnTaps precomputes the taps of every destination column
+func (m ChromaUpsample) columnTaps(dstW int, scale float32, srcW int) []upsampleTaps {
+    cols := make([]upsampleTaps, dstW)
+    for x := range cols {
+        cols[x] = m.taps(x, scale, srcW)
+    }
+    return cols
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "bytes"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+
+    "gap-engine/metrics"
+)
+
+// RoundTripReport is how far a source comes back from an in-memory
+// encode and decode
+type RoundTripReport struct {
+    Bytes int     // Encoded size
+    Ratio float64 // 24-bit RGB size / encoded size
+    *metrics.Result
+}
+
+// VerifyRoundTrip encodes the source image in srcData with opts, decodes
+// the result in memory and compares it with the source, as -verify does.
+// Nothing is written.
+func VerifyRoundTrip(srcData []byte, opts EncodeOptions) (*RoundTripReport, error) {
+    src, err := decodeSource(srcData)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode image: %v", err)
+    }
+    out, err := encodeGap(src, sourceMetadata(srcData), opts, nil)
+    if err != nil {
+        return nil, err
+    }
+    decoded, _, err := decodeGap(bytes.NewReader(out), DecodeOptions{Passphrase: opts.Passphrase, Transform: opts.Transform, Workers: opts.Workers})
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode the encoded image: %v", err)
+    }
+    r, err := metrics.Compare(src, decoded)
+    if err != nil {
+        return nil, err
+    }
+    b := src.Bounds()
+    return &RoundTripReport{Bytes: len(out), Ratio: float64(b.Dx()*b.Dy()*3) / float64(len(out)), Result: r}, nil
+}
+
+// WriteTable prints the round trip the way verify reports it
+func (r *RoundTripReport) WriteTable(w io.Writer) {
+    c := metrics.Channels
+    fmt.Fprintf(w, "Encoded:     %d bytes (ratio %.1f:1)\n", r.Bytes, r.Ratio)
+    fmt.Fprintf(w, "Max error:   %d (%s %d, %s %d, %s %d)\n", r.MaxDiff, c[0], r.MaxDiffs[0], c[1], r.MaxDiffs[1], c[2], r.MaxDiffs[2])
+    fmt.Fprintf(w, "Mean error:  %.4f (%s %.4f, %s %.4f, %s %.4f)\n", r.MAEOverall, c[0], r.MAE[0], c[1], r.MAE[1], c[2], r.MAE[2])
+    if r.MaxDiff > 0 {
+        fmt.Fprintf(w, "Worst pixel: (%d, %d) in %s\n", r.MaxDiffAt.X, r.MaxDiffAt.Y, c[r.MaxChannel])
+    }
+    fmt.Fprintf(w, "PSNR:        %.2f dB\n", r.Overall)
+}
+
+// runVerify round-trips an image through the encoder and decoder with
+// the encode flags and reports the error, failing above -tolerance
+func runVerify(args []string) {
+    fs := flag.NewFlagSet("verify", flag.ExitOnError)
+    inputPtr := fs.String("i", "", "Source image (png, jpeg, bmp, tiff or webp)")
+    tolerancePtr := fs.Int("tolerance", -1, "Exit 1 if any sample is off by more than this (negative = report only)")
+    encodeOpts := addEncodeFlags(fs)
+    applyConfigFile := addConfigFlag(fs)
+    fs.Parse(args)
+    if err := applyConfigFile(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    if *inputPtr == "" {
+        fmt.Fprintln(os.Stderr, "Error: -i is required")
+        fs.PrintDefaults()
+        os.Exit(1)
+    }
+
+    err := func() error {
+        opts, err := encodeOpts()
+        if err != nil {
+            return err
+        }
+        data, err := os.ReadFile(*inputPtr)
+        if err != nil {
+            return fmt.Errorf("failed to read input: %v", err)
+        }
+        r, err := VerifyRoundTrip(data, opts)
+        if err != nil {
+            return err
+        }
+        r.WriteTable(os.Stdout)
+        if *tolerancePtr >= 0 && r.MaxDiff > *tolerancePtr {
+            return fmt.Errorf("max error %d at (%d, %d) is over -tolerance %d", r.MaxDiff, r.MaxDiffAt.X, r.MaxDiffAt.Y, *tolerancePtr)
+        }
+        return nil
+    }()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Verify failed: %v\n", err)
+        os.Exit(1)
+    }
+}
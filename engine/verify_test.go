@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"math"
+	"testing"
+
+	"gap-engine/metrics"
+)
+
+// TestVerify round-trips a PNG in memory: lossless mode comes back
+// exact, and a lossy encode's report agrees with the decode itself, the
+// worst pixel being off by the reported amount in its channel
+func TestVerify(t *testing.T) {
+	const w, h = 64, 48
+	src := benchRGBA(w, h)
+	var source bytes.Buffer
+	if err := png.Encode(&source, src); err != nil {
+		t.Fatal(err)
+	}
+	exact, err := VerifyRoundTrip(source.Bytes(), EncodeOptions{S: 0.1, Threshold: 0.5, Lossless: true})
+	if err != nil {
+		t.Fatalf("lossless: %v", err)
+	}
+	if exact.MaxDiff != 0 || exact.MAEOverall != 0 {
+		t.Fatalf("lossless: max error %d, mean %.4f", exact.MaxDiff, exact.MAEOverall)
+	}
+
+	opts := EncodeOptions{S: 0.1, Threshold: 0.5}
+	r, err := VerifyRoundTrip(source.Bytes(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := encodeGap(src, nil, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Bytes != len(data) {
+		t.Fatalf("reported %d bytes, the encode is %d", r.Bytes, len(data))
+	}
+	decoded, _, err := decodeGap(bytes.NewReader(data), DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sumAbs float64
+	for i := range src.Pix {
+		if i%4 == 3 {
+			continue
+		}
+		sumAbs += math.Abs(float64(src.Pix[i]) - float64(decoded.Pix[i]))
+	}
+	if math.Abs(r.MAEOverall-sumAbs/float64(w*h*3)) > 1e-9 {
+		t.Fatalf("mean error %.6f, the decode gives %.6f", r.MAEOverall, sumAbs/float64(w*h*3))
+	}
+	i := src.PixOffset(r.MaxDiffAt.X, r.MaxDiffAt.Y) + r.MaxChannel
+	if r.MaxDiff == 0 || int(math.Abs(float64(src.Pix[i])-float64(decoded.Pix[i]))) != r.MaxDiff || r.MaxDiffs[r.MaxChannel] != r.MaxDiff {
+		t.Fatalf("worst pixel %v in %s is not off by the reported %d", r.MaxDiffAt, metrics.Channels[r.MaxChannel], r.MaxDiff)
+	}
+	for c, d := range r.MaxDiffs {
+		if d > r.MaxDiff {
+			t.Fatalf("%s max error %d is over the overall %d", metrics.Channels[c], d, r.MaxDiff)
+		}
+	}
+}